@@ -56,20 +56,20 @@ func main() {
 
 	logger.WithField("config", cfg).Debug("Configuration loaded")
 
-	// Initialize MongoDB authenticator
-	authenticator, err := auth.NewMongoAuthenticator(&cfg.MongoDB)
+	// Initialize the user store selected by auth.backend
+	authenticator, err := auth.New(cfg, logger)
 	if err != nil {
-		logger.WithError(err).Fatal("Failed to initialize MongoDB authenticator")
+		logger.WithError(err).WithField("backend", cfg.Auth.Backend).Fatal("Failed to initialize authenticator")
 	}
 	defer func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		if err := authenticator.Close(ctx); err != nil {
-			logger.WithError(err).Error("Failed to close MongoDB connection")
+			logger.WithError(err).Error("Failed to close authenticator")
 		}
 	}()
 
-	logger.Info("MongoDB authenticator initialized")
+	logger.WithField("backend", cfg.Auth.Backend).Info("Authenticator initialized")
 
 	// Initialize STUN server
 	stunServer := server.NewSTUNServer(&cfg.Server.STUN, logger)
@@ -82,8 +82,33 @@ func main() {
 		}
 	}()
 
+	// Initialize TURN REST API credentials
+	var restCredentials *auth.RESTCredentials
+	if cfg.Security.RESTCredentials {
+		restCredentials = auth.NewRESTCredentials(cfg.Security.SecretKey, cfg.Security.SecretKeys)
+		logger.WithField("secrets", len(cfg.Security.SecretKeys)+1).Info("TURN REST API credentials enabled")
+	}
+
 	// Initialize TURN server
-	turnServer := server.NewTURNServer(&cfg.Server.TURN, authenticator, logger)
+	turnServer := server.NewTURNServer(&cfg.Server.TURN, authenticator, restCredentials, logger)
+
+	// Each further realm gets its own view of the user store
+	for i := range cfg.Server.TURN.Realms {
+		realmCfg := cfg.ForRealm(&cfg.Server.TURN.Realms[i])
+		realmAuth, err := auth.New(realmCfg, logger)
+		if err != nil {
+			logger.WithError(err).WithField("realm", realmCfg.Server.TURN.Realm).Fatal("Failed to initialize realm authenticator")
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := realmAuth.Close(ctx); err != nil {
+				logger.WithError(err).Error("Failed to close realm authenticator")
+			}
+		}()
+		turnServer.AddRealm(&realmCfg.Server.TURN, realmAuth)
+	}
+
 	if err := turnServer.Start(); err != nil {
 		logger.WithError(err).Fatal("Failed to start TURN server")
 	}
@@ -94,7 +119,7 @@ func main() {
 	}()
 
 	// Initialize health check handler
-	healthHandler := health.NewHealthHandler(cfg, authenticator, stunServer, turnServer, logger)
+	healthHandler := health.NewHealthHandler(cfg, authenticator, restCredentials, stunServer, turnServer, logger)
 	if err := healthHandler.Start(); err != nil {
 		logger.WithError(err).Fatal("Failed to start health check server")
 	}
@@ -129,15 +154,29 @@ func printServerInfo(cfg *config.Config, logger *logrus.Logger) {
 		"type":    "TURN",
 	}).Info("Server listening")
 
+	for _, realm := range cfg.Server.TURN.Realms {
+		address := "shared"
+		if realm.Port != 0 {
+			address = fmt.Sprintf("%s:%d", cfg.ForRealm(&realm).Server.TURN.Address, realm.Port)
+		}
+		logger.WithFields(logrus.Fields{
+			"address": address,
+			"realm":   realm.Name,
+			"type":    "TURN",
+		}).Info("Realm served")
+	}
+
 	logger.WithFields(logrus.Fields{
 		"address": fmt.Sprintf("%s:%d", cfg.Server.Health.Address, cfg.Server.Health.Port),
 		"type":    "Health Check",
 	}).Info("Server listening")
 
-	logger.WithFields(logrus.Fields{
-		"database":   cfg.MongoDB.Database,
-		"collection": cfg.MongoDB.Collection,
-	}).Info("MongoDB configuration")
+	if cfg.Auth.Backend == auth.BackendMongoDB {
+		logger.WithFields(logrus.Fields{
+			"database":   cfg.MongoDB.Database,
+			"collection": cfg.MongoDB.Collection,
+		}).Info("MongoDB configuration")
+	}
 
 	logger.Info("=== Ready to serve ===")
 }
@@ -2,28 +2,28 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"github.com/sirupsen/logrus"
 
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
 	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
 )
 
 func main() {
 	var (
 		configPath = flag.String("config", "configs/config.yaml", "Path to configuration file")
-		action     = flag.String("action", "", "Action to perform: add, delete, list, update")
+		action     = flag.String("action", "", "Action to perform: add, delete, list, update, migrate")
 		username   = flag.String("username", "", "Username")
 		password   = flag.String("password", "", "Password")
 		enabled    = flag.Bool("enabled", true, "Enable user")
+		realm      = flag.String("realm", "", "Realm from server.turn.realms whose users to manage")
 	)
 	flag.Parse()
 
@@ -35,13 +35,16 @@ func main() {
 		fmt.Println("  List users:  go run cmd/usermgr/main.go -action list")
 		fmt.Println("  Delete user: go run cmd/usermgr/main.go -action delete -username testuser1")
 		fmt.Println("  Update user: go run cmd/usermgr/main.go -action update -username testuser1 -password newpass")
+		fmt.Println("  Migrate:     go run cmd/usermgr/main.go -action migrate")
+		fmt.Println("  Realm user:  go run cmd/usermgr/main.go -action add -realm customer-a.example.com -username testuser1 -password password123")
 		fmt.Println()
 		fmt.Println("Options:")
 		fmt.Println("  -config      Path to configuration file (default: configs/config.yaml)")
-		fmt.Println("  -action      Action to perform: add, delete, list, update")
+		fmt.Println("  -action      Action to perform: add, delete, list, update, migrate")
 		fmt.Println("  -username    Username")
 		fmt.Println("  -password    Password")
 		fmt.Println("  -enabled     Enable user (default: true)")
+		fmt.Println("  -realm       Realm from server.turn.realms (default: server.turn.realm)")
 		os.Exit(1)
 	}
 
@@ -50,43 +53,46 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	if *realm != "" && *realm != cfg.Server.TURN.Realm {
+		cfg = realmConfig(cfg, *realm)
+	}
 
-	// Connect to MongoDB
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	// Users are written through the auth package, which owns the stored
+	// credential format of every backend. The migration is run explicitly
+	// below rather than on connect.
+	cfg.MongoDB.MigrateCredentials = false
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.MongoDB.URI))
+	authenticator, err := auth.New(cfg, logger)
 	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
+		log.Fatalf("Failed to open user store: %v", err)
 	}
-	defer client.Disconnect(context.Background())
+	defer authenticator.Close(context.Background())
 
-	// Ping to verify connection
-	if err := client.Ping(ctx, nil); err != nil {
-		log.Fatalf("Failed to ping MongoDB: %v", err)
-	}
-
-	db := client.Database(cfg.MongoDB.Database)
-	collection := db.Collection(cfg.MongoDB.Collection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
 
 	switch *action {
 	case "add":
 		if *username == "" || *password == "" {
 			log.Fatal("Username and password are required for add action")
 		}
-		err = addUser(ctx, collection, cfg, *username, *password, *enabled)
+		err = addUser(ctx, authenticator, *username, *password, *enabled)
 	case "delete":
 		if *username == "" {
 			log.Fatal("Username is required for delete action")
 		}
-		err = deleteUser(ctx, collection, cfg, *username)
+		err = deleteUser(ctx, authenticator, *username)
 	case "list":
-		err = listUsers(ctx, collection, cfg)
+		err = listUsers(ctx, authenticator)
+	case "migrate":
+		err = migrateUsers(ctx, authenticator)
 	case "update":
 		if *username == "" {
 			log.Fatal("Username is required for update action")
 		}
-		err = updateUser(ctx, collection, cfg, *username, *password, *enabled)
+		err = updateUser(ctx, authenticator, *username, *password, *enabled)
 	default:
 		log.Fatalf("Unknown action: %s", *action)
 	}
@@ -96,78 +102,61 @@ func main() {
 	}
 }
 
-func addUser(ctx context.Context, collection *mongo.Collection, cfg *config.Config, username, password string, enabled bool) error {
+func addUser(ctx context.Context, authenticator auth.Authenticator, username, password string, enabled bool) error {
 	// Check if user already exists
-	filter := bson.M{cfg.MongoDB.Fields.Username: username}
-	count, err := collection.CountDocuments(ctx, filter)
-	if err != nil {
-		return fmt.Errorf("failed to check existing user: %w", err)
-	}
-	if count > 0 {
+	if _, err := authenticator.GetUserByUsername(ctx, username); err == nil {
 		return fmt.Errorf("user '%s' already exists", username)
+	} else if !errors.Is(err, auth.ErrUserNotFound) {
+		return fmt.Errorf("failed to check existing user: %w", err)
 	}
 
-	// For TURN's long-term authentication, the 'password' is the MD5 hash of "username:realm:password"
-	key := md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", username, cfg.Server.TURN.Realm, password)))
-	hashedPassword := hex.EncodeToString(key[:])
-
-	// Create user document
-	now := time.Now()
-	user := bson.M{
-		cfg.MongoDB.Fields.Username: username,
-		cfg.MongoDB.Fields.Password: hashedPassword,
-		cfg.MongoDB.Fields.Enabled:  enabled,
-		"created_at":                now,
-		"updated_at":                now,
+	// The store derives the login hash and the TURN keys from the password
+	user := &models.User{
+		Username: username,
+		Enabled:  enabled,
 	}
-
-	// Insert user
-	result, err := collection.InsertOne(ctx, user)
-	if err != nil {
-		return fmt.Errorf("failed to insert user: %w", err)
+	if err := authenticator.CreateUser(ctx, user, password); err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
 	}
 
-	fmt.Printf("User '%s' added successfully with ID: %s\n", username, result.InsertedID)
+	fmt.Printf("User '%s' added successfully with ID: %s\n", username, user.IDString())
 	return nil
 }
 
-func deleteUser(ctx context.Context, collection *mongo.Collection, cfg *config.Config, username string) error {
-	filter := bson.M{cfg.MongoDB.Fields.Username: username}
-	result, err := collection.DeleteOne(ctx, filter)
+func deleteUser(ctx context.Context, authenticator auth.Authenticator, username string) error {
+	user, err := findUser(ctx, authenticator, username)
 	if err != nil {
-		return fmt.Errorf("failed to delete user: %w", err)
+		return err
 	}
 
-	if result.DeletedCount == 0 {
-		return fmt.Errorf("user '%s' not found", username)
+	if err := authenticator.DeleteUser(ctx, user.IDString()); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
 	}
 
 	fmt.Printf("User '%s' deleted successfully\n", username)
 	return nil
 }
 
-func listUsers(ctx context.Context, collection *mongo.Collection, cfg *config.Config) error {
-	cursor, err := collection.Find(ctx, bson.M{})
-	if err != nil {
-		return fmt.Errorf("failed to query users: %w", err)
-	}
-	defer cursor.Close(ctx)
+func listUsers(ctx context.Context, authenticator auth.Authenticator) error {
+	const pageSize = 100
 
 	fmt.Println("Users:")
 	fmt.Println("------")
 	count := 0
-	for cursor.Next(ctx) {
-		var result bson.M
-		if err := cursor.Decode(&result); err != nil {
-			return fmt.Errorf("failed to decode user: %w", err)
+	for {
+		users, err := authenticator.ListUsers(ctx, count, pageSize)
+		if err != nil {
+			return fmt.Errorf("failed to query users: %w", err)
 		}
 
-		username := result[cfg.MongoDB.Fields.Username]
-		enabled := result[cfg.MongoDB.Fields.Enabled]
-		createdAt := result["created_at"]
+		for _, user := range users {
+			fmt.Printf("Username: %s, Enabled: %v, Created: %v\n", user.Username, user.Enabled, user.CreatedAt)
+		}
+		count += len(users)
 
-		fmt.Printf("Username: %s, Enabled: %v, Created: %v\n", username, enabled, createdAt)
-		count++
+		if len(users) < pageSize {
+			break
+		}
 	}
 
 	if count == 0 {
@@ -176,35 +165,69 @@ func listUsers(ctx context.Context, collection *mongo.Collection, cfg *config.Co
 		fmt.Printf("\nTotal users: %d\n", count)
 	}
 
-	return cursor.Err()
+	return nil
 }
 
-func updateUser(ctx context.Context, collection *mongo.Collection, cfg *config.Config, username, password string, enabled bool) error {
-	filter := bson.M{cfg.MongoDB.Fields.Username: username}
+func updateUser(ctx context.Context, authenticator auth.Authenticator, username, password string, enabled bool) error {
+	user, err := findUser(ctx, authenticator, username)
+	if err != nil {
+		return err
+	}
 
-	update := bson.M{
-		"$set": bson.M{
-			cfg.MongoDB.Fields.Enabled: enabled,
-			"updated_at":               time.Now(),
-		},
+	user.Enabled = enabled
+	if err := authenticator.UpdateUser(ctx, user); err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
 	}
 
 	// Update password if provided
 	if password != "" {
-		key := md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", username, cfg.Server.TURN.Realm, password)))
-		hashedPassword := hex.EncodeToString(key[:])
-		update["$set"].(bson.M)[cfg.MongoDB.Fields.Password] = hashedPassword
+		if err := authenticator.UpdatePassword(ctx, user.IDString(), password); err != nil {
+			return fmt.Errorf("failed to update password: %w", err)
+		}
+	}
+
+	fmt.Printf("User '%s' updated successfully\n", username)
+	return nil
+}
+
+func migrateUsers(ctx context.Context, authenticator auth.Authenticator) error {
+	migrator, ok := auth.Unwrap(authenticator).(auth.CredentialMigrator)
+	if !ok {
+		fmt.Println("Nothing to migrate, this backend has no legacy credentials")
+		return nil
 	}
 
-	result, err := collection.UpdateOne(ctx, filter, update)
+	result, err := migrator.MigrateCredentials(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to update user: %w", err)
+		return err
 	}
 
-	if result.MatchedCount == 0 {
-		return fmt.Errorf("user '%s' not found", username)
+	fmt.Printf("Converted %d users to versioned credentials\n", result.Converted)
+	if result.Skipped > 0 {
+		fmt.Printf("Skipped %d users whose password field was not recognized; set their password again\n", result.Skipped)
 	}
+	return nil
+}
 
-	fmt.Printf("User '%s' updated successfully\n", username)
+// findUser looks a user up by username
+func findUser(ctx context.Context, authenticator auth.Authenticator, username string) (*models.User, error) {
+	user, err := authenticator.GetUserByUsername(ctx, username)
+	if errors.Is(err, auth.ErrUserNotFound) {
+		return nil, fmt.Errorf("user '%s' not found", username)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find user: %w", err)
+	}
+	return user, nil
+}
+
+// realmConfig returns the configuration a realm's users are stored with
+func realmConfig(cfg *config.Config, realm string) *config.Config {
+	for i := range cfg.Server.TURN.Realms {
+		if cfg.Server.TURN.Realms[i].Name == realm {
+			return cfg.ForRealm(&cfg.Server.TURN.Realms[i])
+		}
+	}
+	log.Fatalf("Realm %s is not configured", realm)
 	return nil
 }
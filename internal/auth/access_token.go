@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Encryption algorithms of self-contained access tokens, as named in RFC
+// 7518 section 5.1
+const (
+	TokenAlgorithmA128GCM = "A128GCM"
+	TokenAlgorithmA256GCM = "A256GCM"
+)
+
+// tokenClockSkew is how far in the future a token may have been issued,
+// as the authorization server's clock may run ahead of ours
+const tokenClockSkew = 5 * time.Second
+
+// ErrUnknownKeyID is returned for tokens whose key ID is not configured
+var ErrUnknownKeyID = errors.New("unknown access token key ID")
+
+// AccessTokenKey is a key shared with the authorization server. Tokens name
+// the key they are encrypted with by its ID in USERNAME.
+type AccessTokenKey struct {
+	KID       string
+	Algorithm string // TokenAlgorithmA128GCM or TokenAlgorithmA256GCM
+	Key       []byte
+}
+
+// AccessToken is the content of a self-contained access token: the key the
+// client signs its requests with in place of a long-term credential key,
+// and how long that key may be used
+type AccessToken struct {
+	KID       string
+	MACKey    []byte
+	Timestamp time.Time
+	Lifetime  time.Duration
+}
+
+// ExpiresAt returns when the MAC key stops being accepted
+func (a *AccessToken) ExpiresAt() time.Time {
+	return a.Timestamp.Add(a.Lifetime)
+}
+
+// AccessTokens validates the self-contained access tokens of RFC 7635
+// section 6.2. A token is
+//
+//	uint16 nonce_length, nonce, AEAD(key, nonce, encrypted_block, server name)
+//
+// where the encrypted block holds the MAC key (uint16 length, key), a
+// 64-bit timestamp of 48 bits of Unix seconds and 16 bits of 1/64000
+// seconds, and a 32-bit lifetime in seconds.
+type AccessTokens struct {
+	serverName string
+	keys       map[string]cipher.AEAD
+}
+
+// NewAccessTokens creates a validator for tokens issued for serverName,
+// encrypted with one of keys
+func NewAccessTokens(serverName string, keys []AccessTokenKey) (*AccessTokens, error) {
+	tokens := &AccessTokens{serverName: serverName, keys: make(map[string]cipher.AEAD, len(keys))}
+	for _, key := range keys {
+		size := 16
+		if key.Algorithm == TokenAlgorithmA256GCM {
+			size = 32
+		} else if key.Algorithm != TokenAlgorithmA128GCM {
+			return nil, fmt.Errorf("unknown access token algorithm %q for key %s", key.Algorithm, key.KID)
+		}
+		if len(key.Key) != size {
+			return nil, fmt.Errorf("access token key %s must be %d bytes for %s", key.KID, size, key.Algorithm)
+		}
+
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access token key %s: %w", key.KID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access token key %s: %w", key.KID, err)
+		}
+		tokens.keys[key.KID] = aead
+	}
+	return tokens, nil
+}
+
+// HasKey reports whether tokens encrypted with the key kid are accepted
+func (a *AccessTokens) HasKey(kid string) bool {
+	_, ok := a.keys[kid]
+	return ok
+}
+
+// Validate decrypts a token encrypted with the key kid and checks that its
+// MAC key has not expired
+func (a *AccessTokens) Validate(kid string, token []byte) (*AccessToken, error) {
+	aead, ok := a.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+
+	if len(token) < 2 {
+		return nil, fmt.Errorf("access token too short")
+	}
+	nonceLength := int(binary.BigEndian.Uint16(token[0:2]))
+	if nonceLength != aead.NonceSize() || len(token) < 2+nonceLength {
+		return nil, fmt.Errorf("access token nonce has the wrong length")
+	}
+	nonce := token[2 : 2+nonceLength]
+
+	block, err := aead.Open(nil, nonce, token[2+nonceLength:], []byte(a.serverName))
+	if err != nil {
+		return nil, fmt.Errorf("access token does not decrypt: %w", err)
+	}
+
+	if len(block) < 2 {
+		return nil, fmt.Errorf("access token block too short")
+	}
+	keyLength := int(binary.BigEndian.Uint16(block[0:2]))
+	if keyLength == 0 || len(block) != 2+keyLength+8+4 {
+		return nil, fmt.Errorf("access token block has the wrong length")
+	}
+
+	timestamp := binary.BigEndian.Uint64(block[2+keyLength:])
+	parsed := &AccessToken{
+		KID:       kid,
+		MACKey:    block[2 : 2+keyLength],
+		Timestamp: decodeTokenTimestamp(timestamp),
+		Lifetime:  time.Duration(binary.BigEndian.Uint32(block[2+keyLength+8:])) * time.Second,
+	}
+
+	now := time.Now()
+	if parsed.Timestamp.After(now.Add(tokenClockSkew)) {
+		return nil, fmt.Errorf("access token issued in the future at %s", parsed.Timestamp.Format(time.RFC3339))
+	}
+	if now.After(parsed.ExpiresAt()) {
+		return nil, fmt.Errorf("access token expired at %s", parsed.ExpiresAt().Format(time.RFC3339))
+	}
+	return parsed, nil
+}
+
+// Issue creates a token with the key kid, as the authorization server does
+func (a *AccessTokens) Issue(kid string, macKey []byte, lifetime time.Duration) ([]byte, error) {
+	aead, ok := a.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+
+	block := binary.BigEndian.AppendUint16(nil, uint16(len(macKey)))
+	block = append(block, macKey...)
+	block = binary.BigEndian.AppendUint64(block, encodeTokenTimestamp(time.Now()))
+	block = binary.BigEndian.AppendUint32(block, uint32(lifetime/time.Second))
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate access token nonce: %w", err)
+	}
+
+	token := binary.BigEndian.AppendUint16(nil, uint16(len(nonce)))
+	token = append(token, nonce...)
+	return aead.Seal(token, nonce, block, []byte(a.serverName)), nil
+}
+
+// encodeTokenTimestamp packs a time as 48 bits of Unix seconds and 16 bits
+// of 1/64000 seconds
+func encodeTokenTimestamp(t time.Time) uint64 {
+	fraction := uint64(t.Nanosecond()) * 64000 / uint64(time.Second)
+	return uint64(t.Unix())<<16 | fraction
+}
+
+// decodeTokenTimestamp is the inverse of encodeTokenTimestamp
+func decodeTokenTimestamp(timestamp uint64) time.Time {
+	fraction := timestamp & 0xffff
+	return time.Unix(int64(timestamp>>16), int64(fraction*uint64(time.Second)/64000))
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// Errors returned by every authenticator for unknown and disabled users
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserDisabled = errors.New("user is disabled")
+)
+
+// ErrUnsupported is returned by authenticators that can't perform an
+// operation, such as user management on a read-only backend
+var ErrUnsupported = errors.New("operation not supported by this auth backend")
+
+// Authenticator is a user store the TURN server and the health endpoints
+// authenticate against
+type Authenticator interface {
+	// GetTURNAuthKey returns the hex-encoded long-term credential key,
+	// MD5(username:realm:password), of an enabled user. The user carries
+	// the SHA-256 key in KeySHA256 if the store has one.
+	GetTURNAuthKey(ctx context.Context, username string) (string, *models.User, error)
+
+	// Authenticate verifies a user's password
+	Authenticate(ctx context.Context, username, password string) (*models.User, error)
+
+	CreateUser(ctx context.Context, user *models.User, plainPassword string) error
+	UpdateUser(ctx context.Context, user *models.User) error
+
+	// UpdatePassword, DeleteUser and GetUser take the user's ID as
+	// returned by models.User.IDString
+	UpdatePassword(ctx context.Context, userID string, newPassword string) error
+	DeleteUser(ctx context.Context, userID string) error
+	GetUser(ctx context.Context, userID string) (*models.User, error)
+	GetUserByUsername(ctx context.Context, username string) (*models.User, error)
+	ListUsers(ctx context.Context, offset, limit int) ([]*models.User, error)
+
+	// Ping checks that the store is reachable
+	Ping(ctx context.Context) error
+
+	// Close releases the store's resources
+	Close(ctx context.Context) error
+}
+
+// QuotaStore is implemented by authenticators that can persist the live
+// quota counters kept by the TURN server. Several server instances may
+// share a store: each counts the sessions it holds under its instance ID
+// next to the user's total, so it can take back its own counts without
+// touching those of the others.
+type QuotaStore interface {
+	// AcquireSession counts a new session of a user held by instance,
+	// checking and incrementing the total in one step. It reports false,
+	// counting nothing, when the user already has max sessions; max <= 0
+	// means no limit. Users without a quota are never counted.
+	AcquireSession(ctx context.Context, username, instance string, max int) (bool, error)
+
+	// ReleaseSession takes back a session counted by AcquireSession
+	ReleaseSession(ctx context.Context, username, instance string) error
+
+	// ReleaseInstanceSessions takes back every session counted for
+	// instance, left behind by a run that did not shut down cleanly. It
+	// returns the number of users whose count changed.
+	ReleaseInstanceSessions(ctx context.Context, instance string) (int64, error)
+
+	// AddUsedBandwidth adds relayed bytes to a user's usage
+	AddUsedBandwidth(ctx context.Context, username string, bytes int64) error
+
+	// ResetUsage starts a new usage period for users whose reset time passed
+	ResetUsage(ctx context.Context, now, next time.Time) (int64, error)
+}
+
+// SessionStore is implemented by authenticators that keep a history of
+// ended TURN sessions
+type SessionStore interface {
+	// RecordSession stores a session that just ended, with its final
+	// traffic counters
+	RecordSession(ctx context.Context, session *models.SessionInfo) error
+}
+
+// Backend names accepted in auth.backend
+const (
+	BackendMongoDB = "mongodb"
+	BackendFile    = "file"
+	BackendSQL     = "sql"
+	BackendWebhook = "webhook"
+)
+
+// New creates the authenticator selected by auth.backend. The database
+// backends get the auth cache in front of them if it is enabled; the file
+// backend is in memory already and the webhook backend has its own cache.
+func New(cfg *config.Config, logger *logrus.Logger) (Authenticator, error) {
+	var (
+		backend Authenticator
+		err     error
+	)
+
+	switch cfg.Auth.Backend {
+	case BackendMongoDB, "":
+		backend, err = NewMongoAuthenticator(&cfg.MongoDB, cfg.Server.TURN.Realm, cfg.Security.PasswordHashCost)
+	case BackendSQL:
+		backend, err = NewSQLAuthenticator(&cfg.SQL, cfg.Server.TURN.Realm)
+	case BackendFile:
+		return NewFileAuthenticator(&cfg.Auth.File, cfg.Server.TURN.Realm, logger)
+	case BackendWebhook:
+		return NewWebhookAuthenticator(&cfg.Auth.Webhook, cfg.Server.TURN.Realm)
+	default:
+		return nil, fmt.Errorf("unknown auth backend %q", cfg.Auth.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Auth.Cache.Enabled {
+		return NewCachedAuthenticator(backend, &cfg.Auth.Cache, logger), nil
+	}
+	return backend, nil
+}
@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// watchRetryMax caps the delay between attempts to reopen a user change
+// stream
+const watchRetryMax = 5 * time.Minute
+
+// UserChange identifies a user that was created, changed or deleted.
+// Username is empty when the store only knows the ID, e.g. for deletes.
+type UserChange struct {
+	ID       primitive.ObjectID
+	Username string
+}
+
+// UserWatcher is implemented by authenticators that can report changes to
+// users as they happen
+type UserWatcher interface {
+	// WatchUsers calls onChange for each changed user until ctx is done or
+	// the stream fails. A nil change means any user may have changed.
+	WatchUsers(ctx context.Context, onChange func(change *UserChange)) error
+}
+
+// wrapper is implemented by authenticators that decorate another one
+type wrapper interface {
+	Unwrap() Authenticator
+}
+
+// Unwrap returns the authenticator behind decorators such as the cache, so
+// callers can check it for optional interfaces like QuotaStore
+func Unwrap(a Authenticator) Authenticator {
+	for {
+		w, ok := a.(wrapper)
+		if !ok {
+			return a
+		}
+		a = w.Unwrap()
+	}
+}
+
+// cacheEntry is a cached GetTURNAuthKey answer. Unknown users are cached
+// with err set.
+type cacheEntry struct {
+	username string
+	key      string
+	user     *models.User
+	err      error
+	expires  time.Time
+}
+
+// CachedAuthenticator keeps recent GetTURNAuthKey answers in a bounded LRU
+// cache in front of another authenticator, including "user not found"
+// answers for a shorter time. Writes made through it invalidate the user's
+// entry; if the backend is a UserWatcher, changes made elsewhere do too.
+// Otherwise they take effect once the entry expires.
+type CachedAuthenticator struct {
+	Authenticator
+	config *config.AuthCacheConfig
+	logger *logrus.Logger
+
+	mutex      sync.Mutex
+	entries    map[string]*list.Element // by username
+	lru        *list.List               // most recently used first
+	generation uint64                   // bumped by every invalidation
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewCachedAuthenticator puts a cache in front of backend and, if the
+// backend supports it, starts watching it for changes
+func NewCachedAuthenticator(backend Authenticator, cfg *config.AuthCacheConfig, logger *logrus.Logger) *CachedAuthenticator {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &CachedAuthenticator{
+		Authenticator: backend,
+		config:        cfg,
+		logger:        logger,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
+
+	if watcher, ok := backend.(UserWatcher); ok {
+		go c.watch(ctx, watcher)
+	} else {
+		close(c.done)
+	}
+
+	return c
+}
+
+// Unwrap returns the cached authenticator
+func (c *CachedAuthenticator) Unwrap() Authenticator {
+	return c.Authenticator
+}
+
+// GetTURNAuthKey returns the cached answer for a username, asking the
+// backend on a miss
+func (c *CachedAuthenticator) GetTURNAuthKey(ctx context.Context, username string) (string, *models.User, error) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	generation := c.generation
+	if element, ok := c.entries[username]; ok {
+		entry := element.Value.(*cacheEntry)
+		if now.Before(entry.expires) {
+			c.lru.MoveToFront(element)
+			c.mutex.Unlock()
+			if entry.err != nil {
+				return "", nil, entry.err
+			}
+			return entry.key, copyUser(entry.user), nil
+		}
+		c.removeElement(element)
+	}
+	c.mutex.Unlock()
+
+	key, user, err := c.Authenticator.GetTURNAuthKey(ctx, username)
+	switch {
+	case err == nil:
+		c.store(generation, &cacheEntry{username: username, key: key, user: copyUser(user),
+			expires: now.Add(time.Duration(c.config.TTL) * time.Second)})
+	case errors.Is(err, ErrUserNotFound) && c.config.NegativeTTL > 0:
+		c.store(generation, &cacheEntry{username: username, err: err,
+			expires: now.Add(time.Duration(c.config.NegativeTTL) * time.Second)})
+	}
+
+	return key, user, err
+}
+
+// CreateUser creates a user and drops a cached "user not found" answer
+func (c *CachedAuthenticator) CreateUser(ctx context.Context, user *models.User, plainPassword string) error {
+	err := c.Authenticator.CreateUser(ctx, user, plainPassword)
+	c.invalidate(&UserChange{ID: user.ID, Username: user.Username})
+	return err
+}
+
+// UpdateUser updates a user and drops its cached entry. A user known by an
+// ExternalID can't be matched with cached users, so every entry is
+// dropped.
+func (c *CachedAuthenticator) UpdateUser(ctx context.Context, user *models.User) error {
+	err := c.Authenticator.UpdateUser(ctx, user)
+	if user.ExternalID != "" {
+		c.invalidate(nil)
+	} else {
+		c.invalidate(&UserChange{ID: user.ID, Username: user.Username})
+	}
+	return err
+}
+
+// UpdatePassword changes a user's password and drops its cached entry
+func (c *CachedAuthenticator) UpdatePassword(ctx context.Context, userID string, newPassword string) error {
+	err := c.Authenticator.UpdatePassword(ctx, userID, newPassword)
+	c.invalidate(changeOf(userID))
+	return err
+}
+
+// DeleteUser deletes a user and drops its cached entry
+func (c *CachedAuthenticator) DeleteUser(ctx context.Context, userID string) error {
+	err := c.Authenticator.DeleteUser(ctx, userID)
+	c.invalidate(changeOf(userID))
+	return err
+}
+
+// changeOf identifies the user behind an ID passed to the Authenticator
+// methods. An ID that isn't the hex of an ObjectID can't be matched with
+// cached users, so it yields nil, dropping every entry.
+func changeOf(userID string) *UserChange {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil
+	}
+	return &UserChange{ID: id}
+}
+
+// Close stops watching for changes and closes the backend
+func (c *CachedAuthenticator) Close(ctx context.Context) error {
+	c.cancel()
+	<-c.done
+	return c.Authenticator.Close(ctx)
+}
+
+// store adds an entry, evicting the least recently used ones beyond
+// max_entries. Answers fetched before an invalidation that happened since
+// may be stale and are not stored.
+func (c *CachedAuthenticator) store(generation uint64, entry *cacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if element, ok := c.entries[entry.username]; ok {
+		c.removeElement(element)
+	}
+	c.entries[entry.username] = c.lru.PushFront(entry)
+
+	for c.config.MaxEntries > 0 && c.lru.Len() > c.config.MaxEntries {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// removeElement drops an entry. Callers hold the mutex.
+func (c *CachedAuthenticator) removeElement(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).username)
+}
+
+// invalidate drops the entries a change affects; a nil change flushes the
+// whole cache
+func (c *CachedAuthenticator) invalidate(change *UserChange) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	if change == nil {
+		c.entries = make(map[string]*list.Element)
+		c.lru.Init()
+		return
+	}
+
+	if element, ok := c.entries[change.Username]; ok {
+		c.removeElement(element)
+	}
+	if change.ID.IsZero() {
+		return
+	}
+	for _, element := range c.entries {
+		if entry := element.Value.(*cacheEntry); entry.user != nil && entry.user.ID == change.ID {
+			c.removeElement(element)
+		}
+	}
+}
+
+// Len returns the number of cached entries
+func (c *CachedAuthenticator) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
+
+// watch keeps a change stream open, reopening it with backoff when it
+// fails. Changes missed while the stream was down are unknown, so the
+// cache is flushed each time it is reopened.
+func (c *CachedAuthenticator) watch(ctx context.Context, watcher UserWatcher) {
+	defer close(c.done)
+
+	delay := time.Second
+	warned := false
+	for {
+		started := time.Now()
+		err := watcher.WatchUsers(ctx, c.invalidate)
+		if ctx.Err() != nil {
+			return
+		}
+		c.invalidate(nil)
+
+		if time.Since(started) > watchRetryMax {
+			delay = time.Second // the stream was healthy for a while
+		}
+		entry := c.logger.WithError(err).WithField("retry_in", delay.String())
+		if !warned {
+			entry.Warn("User change stream unavailable, cached entries expire after auth.cache.ttl")
+			warned = true
+		} else {
+			entry.Debug("User change stream unavailable")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > watchRetryMax {
+			delay = watchRetryMax
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CredentialsVersion is the layout of the credentials document written by
+// this package. Documents without one predate it: they keep a single
+// password field holding either a bcrypt hash or a hex MD5 TURN key.
+const CredentialsVersion = 1
+
+// ErrNoTURNKey is returned for users whose credentials hold no TURN key for
+// the realm yet, such as users converted from a bcrypt hash. The keys are
+// derived the next time the user logs in or changes password.
+var ErrNoTURNKey = errors.New("no TURN key stored for the realm")
+
+// Credentials is the versioned credential document of a user. The login
+// hash and the TURN keys are derived from the same password but kept
+// apart, as neither can be computed from the other.
+type Credentials struct {
+	Version      int         `bson:"version"`
+	PasswordHash string      `bson:"password_hash,omitempty"` // bcrypt, checked by Authenticate
+	TURNKeys     []RealmKeys `bson:"turn_keys,omitempty"`
+	UpdatedAt    time.Time   `bson:"updated_at"`
+}
+
+// RealmKeys are the hex-encoded long-term credential keys of one realm
+type RealmKeys struct {
+	Realm  string `bson:"realm"`
+	MD5    string `bson:"md5"`
+	SHA256 string `bson:"sha256,omitempty"`
+}
+
+// MigrationResult counts the documents a credential migration looked at
+type MigrationResult struct {
+	Converted int // legacy documents rewritten as versioned credentials
+	Skipped   int // legacy documents whose password field was not recognized
+}
+
+// CredentialMigrator is implemented by authenticators whose stored
+// credentials can predate the versioned credentials document
+type CredentialMigrator interface {
+	// MigrateCredentials converts every legacy document it recognizes
+	MigrateCredentials(ctx context.Context) (*MigrationResult, error)
+}
+
+// NewCredentials derives the login hash and the TURN keys of every realm
+// from a password
+func NewCredentials(username, password string, realms []string, hashCost int) (*Credentials, error) {
+	creds := &Credentials{Version: CredentialsVersion}
+	if _, err := creds.Complete(username, password, realms, hashCost); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// ConvertLegacyCredentials detects what the password field of a document
+// written before CredentialsVersion holds and converts it. A bcrypt hash
+// becomes the login hash; a hex MD5 key becomes the TURN key of realm,
+// together with the SHA-256 key if the document has a valid one.
+func ConvertLegacyCredentials(password, keySHA256, realm string) (*Credentials, error) {
+	creds := &Credentials{Version: CredentialsVersion, UpdatedAt: time.Now()}
+
+	switch {
+	case isBcryptHash(password):
+		creds.PasswordHash = password
+	case isHexKey(password, md5.Size):
+		keys := RealmKeys{Realm: realm, MD5: strings.ToLower(password)}
+		if isHexKey(keySHA256, sha256.Size) {
+			keys.SHA256 = strings.ToLower(keySHA256)
+		}
+		creds.TURNKeys = []RealmKeys{keys}
+	default:
+		return nil, errors.New("password field holds neither a bcrypt hash nor a hex MD5 TURN key")
+	}
+
+	return creds, nil
+}
+
+// Keys returns the TURN keys of a realm, ErrNoTURNKey if there are none
+func (c *Credentials) Keys(realm string) (*RealmKeys, error) {
+	for i := range c.TURNKeys {
+		if c.TURNKeys[i].Realm == realm {
+			return &c.TURNKeys[i], nil
+		}
+	}
+	return nil, ErrNoTURNKey
+}
+
+// Verify checks a password against the login hash or, for credentials
+// converted from a TURN key alone, against the MD5 key of realm
+func (c *Credentials) Verify(username, realm, password string) bool {
+	if c.PasswordHash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(c.PasswordHash), []byte(password)) == nil
+	}
+
+	keys, err := c.Keys(realm)
+	if err != nil {
+		return false
+	}
+	expected := TURNKey(username, realm, password)
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(keys.MD5)), []byte(expected)) == 1
+}
+
+// Complete adds what a verified password lets it derive but the
+// credentials lack: the login hash and the TURN keys of the given realms.
+// It reports whether anything was added.
+func (c *Credentials) Complete(username, password string, realms []string, hashCost int) (bool, error) {
+	changed := false
+
+	if c.PasswordHash == "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), hashCost)
+		if err != nil {
+			return false, fmt.Errorf("failed to hash password: %w", err)
+		}
+		c.PasswordHash = string(hash)
+		changed = true
+	}
+
+	for _, realm := range realms {
+		keys, err := c.Keys(realm)
+		switch {
+		case err != nil:
+			c.TURNKeys = append(c.TURNKeys, RealmKeys{
+				Realm:  realm,
+				MD5:    TURNKey(username, realm, password),
+				SHA256: TURNKeySHA256(username, realm, password),
+			})
+			changed = true
+		case keys.SHA256 == "":
+			keys.SHA256 = TURNKeySHA256(username, realm, password)
+			changed = true
+		}
+	}
+
+	if changed {
+		c.Version = CredentialsVersion
+		c.UpdatedAt = time.Now()
+	}
+	return changed, nil
+}
+
+// isBcryptHash reports whether a stored password looks like a bcrypt hash
+func isBcryptHash(password string) bool {
+	_, err := bcrypt.Cost([]byte(password))
+	return err == nil
+}
+
+// isHexKey reports whether a stored key is size hex-encoded bytes
+func isHexKey(key string, size int) bool {
+	decoded, err := hex.DecodeString(key)
+	return err == nil && len(decoded) == size
+}
@@ -0,0 +1,605 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// Users file formats
+const (
+	FileFormatYAML     = "yaml"
+	FileFormatJSON     = "json"
+	FileFormatHTDigest = "htdigest"
+)
+
+// usersReloadDelay lets editors and config management finish replacing the
+// users file before it is loaded again
+const usersReloadDelay = time.Second
+
+// usersFile is the layout of YAML and JSON users files
+type usersFile struct {
+	Users []fileUser `yaml:"users" json:"users"`
+}
+
+// fileUser is one entry of a YAML or JSON users file. Key is the hex-encoded
+// long-term credential key MD5(username:realm:password); KeySHA256, if set,
+// is SHA-256(username:realm:password) for RFC 8489 clients.
+type fileUser struct {
+	Username  string     `yaml:"username" json:"username"`
+	Key       string     `yaml:"key" json:"key"`
+	KeySHA256 string     `yaml:"key_sha256,omitempty" json:"key_sha256,omitempty"`
+	Enabled   *bool      `yaml:"enabled,omitempty" json:"enabled,omitempty"` // defaults to true
+	Quota     *fileQuota `yaml:"quota,omitempty" json:"quota,omitempty"`
+}
+
+// fileQuota holds the quota limits a users file can set. Usage counters are
+// kept in memory by the TURN server only.
+type fileQuota struct {
+	MaxSessions  int   `yaml:"max_sessions,omitempty" json:"max_sessions,omitempty"`
+	MaxBandwidth int64 `yaml:"max_bandwidth,omitempty" json:"max_bandwidth,omitempty"`
+	MaxDuration  int   `yaml:"max_duration,omitempty" json:"max_duration,omitempty"`
+}
+
+// FileAuthenticator serves users from a static YAML, JSON or htdigest-style
+// file and reloads it when it changes. htdigest files hold one
+// "username:realm:key" line per user, the format written by htdigest(1) and
+// accepted by coturn; their users are always enabled and have no quota.
+type FileAuthenticator struct {
+	path    string
+	format  string
+	realm   string
+	logger  *logrus.Logger
+	watcher *fsnotify.Watcher
+
+	mutex sync.RWMutex
+	users map[string]*models.User // by username
+	keys  map[string]string       // hex-encoded, by username
+
+	timerMutex sync.Mutex
+	timer      *time.Timer // pending reload, if any
+	closed     bool
+}
+
+var _ Authenticator = (*FileAuthenticator)(nil)
+
+// NewFileAuthenticator loads the users file and starts watching it for
+// changes. realm is the TURN realm keys are computed for.
+func NewFileAuthenticator(cfg *config.FileAuthConfig, realm string, logger *logrus.Logger) (*FileAuthenticator, error) {
+	format := cfg.Format
+	if format == "" {
+		format = fileFormatFromPath(cfg.Path)
+	}
+
+	f := &FileAuthenticator{
+		path:   cfg.Path,
+		format: format,
+		realm:  realm,
+		logger: logger,
+		users:  make(map[string]*models.User),
+		keys:   make(map[string]string),
+	}
+
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create users file watcher: %w", err)
+	}
+
+	// Watch the directory: editors and config management usually replace
+	// the file rather than write it in place
+	if err := watcher.Add(filepath.Dir(cfg.Path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", filepath.Dir(cfg.Path), err)
+	}
+
+	f.watcher = watcher
+	go f.watch()
+
+	return f, nil
+}
+
+// fileFormatFromPath picks the users file format from its extension
+func fileFormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FileFormatYAML
+	case ".json":
+		return FileFormatJSON
+	default:
+		return FileFormatHTDigest
+	}
+}
+
+// reload loads the users file, keeping the IDs of users that were already
+// known so they stay stable across reloads
+func (f *FileAuthenticator) reload() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read users file: %w", err)
+	}
+
+	entries, err := f.parse(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse users file %s: %w", f.path, err)
+	}
+
+	users := make(map[string]*models.User, len(entries))
+	keys := make(map[string]string, len(entries))
+	for i, entry := range entries {
+		if entry.Username == "" {
+			return fmt.Errorf("users file %s: entry %d has no username", f.path, i+1)
+		}
+		if _, dup := users[entry.Username]; dup {
+			return fmt.Errorf("users file %s: duplicate user %q", f.path, entry.Username)
+		}
+		if key, err := hex.DecodeString(entry.Key); err != nil || len(key) != 16 {
+			return fmt.Errorf("users file %s: user %q has an invalid key, expected hex MD5(username:realm:password)", f.path, entry.Username)
+		}
+		if entry.KeySHA256 != "" {
+			if _, err := DecodeKey(PasswordAlgorithmSHA256, entry.KeySHA256); err != nil {
+				return fmt.Errorf("users file %s: user %q has an invalid key_sha256, expected hex SHA-256(username:realm:password)", f.path, entry.Username)
+			}
+		}
+
+		user := &models.User{
+			Username:  entry.Username,
+			KeySHA256: strings.ToLower(entry.KeySHA256),
+			Enabled:   entry.Enabled == nil || *entry.Enabled,
+		}
+		if entry.Quota != nil {
+			user.Quota = &models.UserQuota{
+				MaxSessions:  entry.Quota.MaxSessions,
+				MaxBandwidth: entry.Quota.MaxBandwidth,
+				MaxDuration:  entry.Quota.MaxDuration,
+			}
+		}
+		users[entry.Username] = user
+		keys[entry.Username] = strings.ToLower(entry.Key)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for username, user := range users {
+		if previous, ok := f.users[username]; ok {
+			user.ID = previous.ID
+			user.CreatedAt = previous.CreatedAt
+			user.UpdatedAt = previous.UpdatedAt
+		} else {
+			user.ID = primitive.NewObjectID()
+		}
+	}
+	f.users = users
+	f.keys = keys
+
+	return nil
+}
+
+// parse decodes the users file in its configured format
+func (f *FileAuthenticator) parse(data []byte) ([]fileUser, error) {
+	switch f.format {
+	case FileFormatYAML:
+		var file usersFile
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, err
+		}
+		return file.Users, nil
+	case FileFormatJSON:
+		var file usersFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, err
+		}
+		return file.Users, nil
+	case FileFormatHTDigest:
+		return f.parseHTDigest(data)
+	default:
+		return nil, fmt.Errorf("unknown users file format %q", f.format)
+	}
+}
+
+// parseHTDigest reads "username:realm:key" lines, skipping blank lines and
+// # comments
+func (f *FileAuthenticator) parseHTDigest(data []byte) ([]fileUser, error) {
+	var users []fileUser
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected username:realm:key", line)
+		}
+		if fields[1] != f.realm {
+			return nil, fmt.Errorf("line %d: realm %q does not match the TURN realm %q", line, fields[1], f.realm)
+		}
+		users = append(users, fileUser{Username: fields[0], Key: fields[2]})
+	}
+
+	return users, scanner.Err()
+}
+
+// watch reloads the users file after file system events in its directory,
+// keeping the previous users if the new file can't be loaded
+func (f *FileAuthenticator) watch() {
+	for {
+		select {
+		case _, ok := <-f.watcher.Events:
+			if !ok {
+				return
+			}
+			f.scheduleReload()
+		case err, ok := <-f.watcher.Errors:
+			if !ok {
+				return
+			}
+			f.logger.WithError(err).Warn("Users file watcher error")
+		}
+	}
+}
+
+// scheduleReload reloads the users file once its directory has been quiet
+// for usersReloadDelay, unless the authenticator is closed first
+func (f *FileAuthenticator) scheduleReload() {
+	f.timerMutex.Lock()
+	defer f.timerMutex.Unlock()
+
+	if f.closed {
+		return
+	}
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	f.timer = time.AfterFunc(usersReloadDelay, func() {
+		if f.isClosed() {
+			return
+		}
+		if err := f.reload(); err != nil {
+			f.logger.WithError(err).Error("Failed to reload users file, keeping the previous users")
+			return
+		}
+		f.logger.WithField("path", f.path).Debug("Reloaded users file")
+	})
+}
+
+// isClosed reports whether Close has been called
+func (f *FileAuthenticator) isClosed() bool {
+	f.timerMutex.Lock()
+	defer f.timerMutex.Unlock()
+	return f.closed
+}
+
+// save writes the users back to the file, replacing it atomically. Callers
+// hold the write lock.
+func (f *FileAuthenticator) save() error {
+	usernames := make([]string, 0, len(f.users))
+	for username := range f.users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var data []byte
+	switch f.format {
+	case FileFormatHTDigest:
+		var buf bytes.Buffer
+		for _, username := range usernames {
+			fmt.Fprintf(&buf, "%s:%s:%s\n", username, f.realm, f.keys[username])
+		}
+		data = buf.Bytes()
+	default:
+		file := usersFile{Users: make([]fileUser, 0, len(usernames))}
+		for _, username := range usernames {
+			user := f.users[username]
+			entry := fileUser{Username: username, Key: f.keys[username], KeySHA256: user.KeySHA256}
+			if !user.Enabled {
+				enabled := false
+				entry.Enabled = &enabled
+			}
+			if user.Quota != nil {
+				entry.Quota = &fileQuota{
+					MaxSessions:  user.Quota.MaxSessions,
+					MaxBandwidth: user.Quota.MaxBandwidth,
+					MaxDuration:  user.Quota.MaxDuration,
+				}
+			}
+			file.Users = append(file.Users, entry)
+		}
+
+		var err error
+		if f.format == FileFormatJSON {
+			data, err = json.MarshalIndent(file, "", "  ")
+		} else {
+			data, err = yaml.Marshal(file)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to encode users file: %w", err)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".users-*")
+	if err != nil {
+		return fmt.Errorf("failed to write users file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write users file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write users file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to replace users file: %w", err)
+	}
+
+	return nil
+}
+
+// key computes the hex-encoded long-term credential key of a user
+func (f *FileAuthenticator) key(username, password string) string {
+	return TURNKey(username, f.realm, password)
+}
+
+// usernameOf returns the username of the user with the given ID. Callers
+// hold the lock.
+func (f *FileAuthenticator) usernameOf(userID string) (string, bool) {
+	for username, user := range f.users {
+		if user.ID.Hex() == userID {
+			return username, true
+		}
+	}
+	return "", false
+}
+
+// copyUser returns a copy of a stored user callers may modify
+func copyUser(user *models.User) *models.User {
+	copied := *user
+	if user.Quota != nil {
+		quota := *user.Quota
+		copied.Quota = &quota
+	}
+	return &copied
+}
+
+// Authenticate verifies user credentials against the stored key
+func (f *FileAuthenticator) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	storedKey, user, err := f.GetTURNAuthKey(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(storedKey), []byte(f.key(username, password))) != 1 {
+		return nil, fmt.Errorf("invalid password")
+	}
+
+	return user, nil
+}
+
+// CreateUser adds a user to the file
+func (f *FileAuthenticator) CreateUser(ctx context.Context, user *models.User, plainPassword string) error {
+	if f.format == FileFormatHTDigest && (!user.Enabled || user.Quota != nil) {
+		return fmt.Errorf("htdigest users files can't store disabled users or quotas")
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, ok := f.users[user.Username]; ok {
+		return fmt.Errorf("user already exists")
+	}
+
+	now := time.Now()
+	user.ID = primitive.NewObjectID()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	stored := copyUser(user)
+	if f.format != FileFormatHTDigest {
+		stored.KeySHA256 = TURNKeySHA256(user.Username, f.realm, plainPassword)
+	}
+	f.users[user.Username] = stored
+	f.keys[user.Username] = f.key(user.Username, plainPassword)
+
+	if err := f.save(); err != nil {
+		delete(f.users, user.Username)
+		delete(f.keys, user.Username)
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateUser updates the enabled flag and quota of an existing user. The
+// key is bound to the username, so users can't be renamed.
+func (f *FileAuthenticator) UpdateUser(ctx context.Context, user *models.User) error {
+	if f.format == FileFormatHTDigest && (!user.Enabled || user.Quota != nil) {
+		return fmt.Errorf("htdigest users files can't store disabled users or quotas")
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	username, ok := f.usernameOf(user.ID.Hex())
+	if !ok {
+		return ErrUserNotFound
+	}
+	if user.Username != "" && user.Username != username {
+		return fmt.Errorf("users can't be renamed, their key depends on the username")
+	}
+
+	previous := f.users[username]
+	updated := copyUser(previous)
+	updated.Enabled = user.Enabled
+	if user.Quota != nil {
+		quota := *user.Quota
+		updated.Quota = &quota
+	}
+	updated.UpdatedAt = time.Now()
+	f.users[username] = updated
+
+	if err := f.save(); err != nil {
+		f.users[username] = previous
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+
+	return nil
+}
+
+// UpdatePassword replaces a user's keys
+func (f *FileAuthenticator) UpdatePassword(ctx context.Context, userID string, newPassword string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	username, ok := f.usernameOf(userID)
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	previous, previousUser := f.keys[username], f.users[username]
+	f.keys[username] = f.key(username, newPassword)
+	if f.format != FileFormatHTDigest {
+		updated := copyUser(previousUser)
+		updated.KeySHA256 = TURNKeySHA256(username, f.realm, newPassword)
+		f.users[username] = updated
+	}
+
+	if err := f.save(); err != nil {
+		f.keys[username] = previous
+		f.users[username] = previousUser
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteUser removes a user from the file
+func (f *FileAuthenticator) DeleteUser(ctx context.Context, userID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	username, ok := f.usernameOf(userID)
+	if !ok {
+		return nil
+	}
+
+	user, key := f.users[username], f.keys[username]
+	delete(f.users, username)
+	delete(f.keys, username)
+
+	if err := f.save(); err != nil {
+		f.users[username] = user
+		f.keys[username] = key
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	return nil
+}
+
+// GetUser retrieves a user by ID
+func (f *FileAuthenticator) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	username, ok := f.usernameOf(userID)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return copyUser(f.users[username]), nil
+}
+
+// GetUserByUsername retrieves a user by username
+func (f *FileAuthenticator) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	user, ok := f.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+// GetTURNAuthKey returns the stored TURN key of an enabled user
+func (f *FileAuthenticator) GetTURNAuthKey(ctx context.Context, username string) (string, *models.User, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	user, ok := f.users[username]
+	if !ok {
+		return "", nil, ErrUserNotFound
+	}
+	if !user.Enabled {
+		return "", nil, ErrUserDisabled
+	}
+
+	return f.keys[username], copyUser(user), nil
+}
+
+// ListUsers returns the users sorted by username
+func (f *FileAuthenticator) ListUsers(ctx context.Context, offset, limit int) ([]*models.User, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	usernames := make([]string, 0, len(f.users))
+	for username := range f.users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	if offset >= len(usernames) {
+		return nil, nil
+	}
+	usernames = usernames[offset:]
+	if limit > 0 && limit < len(usernames) {
+		usernames = usernames[:limit]
+	}
+
+	users := make([]*models.User, 0, len(usernames))
+	for _, username := range usernames {
+		users = append(users, copyUser(f.users[username]))
+	}
+	return users, nil
+}
+
+// Ping checks that the users file is still readable
+func (f *FileAuthenticator) Ping(ctx context.Context) error {
+	_, err := os.Stat(f.path)
+	return err
+}
+
+// Close stops watching the users file and cancels a pending reload
+func (f *FileAuthenticator) Close(ctx context.Context) error {
+	f.timerMutex.Lock()
+	f.closed = true
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	f.timerMutex.Unlock()
+
+	return f.watcher.Close()
+}
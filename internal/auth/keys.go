@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/pion/turn/v2"
+)
+
+// Password algorithms a long-term credential key can be derived with, as
+// named in RFC 8489 section 18.5
+const (
+	PasswordAlgorithmMD5    = "MD5"
+	PasswordAlgorithmSHA256 = "SHA-256"
+)
+
+// TURNKey computes the hex-encoded long-term credential key
+// MD5(username:realm:password) understood by every TURN client
+func TURNKey(username, realm, password string) string {
+	return hex.EncodeToString(turn.GenerateAuthKey(username, realm, password))
+}
+
+// TURNKeySHA256 computes the hex-encoded key SHA-256(username:realm:password)
+// used by RFC 8489 clients that negotiate the SHA-256 password algorithm.
+// Realms and passwords are used as is, without OpaqueString preparation.
+func TURNKeySHA256(username, realm, password string) string {
+	return hex.EncodeToString(generateSHA256Key(username, realm, password))
+}
+
+// generateSHA256Key is the binary form of TURNKeySHA256
+func generateSHA256Key(username, realm, password string) []byte {
+	sum := sha256.Sum256([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+// DecodeKey decodes a stored hex key, checking it has the length the
+// password algorithm produces
+func DecodeKey(algorithm, key string) ([]byte, error) {
+	size := 16
+	if algorithm == PasswordAlgorithmSHA256 {
+		size = sha256.Size
+	}
+
+	decoded, err := hex.DecodeString(key)
+	if err != nil || len(decoded) != size {
+		return nil, fmt.Errorf("invalid %s key, expected %d hex-encoded bytes", algorithm, size)
+	}
+	return decoded, nil
+}
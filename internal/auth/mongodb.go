@@ -3,6 +3,7 @@ package auth
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -15,16 +16,32 @@ import (
 	"github.com/ga666666-new/pion-stun-server/pkg/models"
 )
 
+var (
+	_ Authenticator = (*MongoAuthenticator)(nil)
+	_ QuotaStore    = (*MongoAuthenticator)(nil)
+	_ UserWatcher   = (*MongoAuthenticator)(nil)
+
+	_ CredentialMigrator = (*MongoAuthenticator)(nil)
+)
+
 // MongoAuthenticator implements authentication using MongoDB
 type MongoAuthenticator struct {
 	client     *mongo.Client
 	database   *mongo.Database
 	collection *mongo.Collection
 	config     *config.MongoDBConfig
+	realm      string
+	hashCost   int
 }
 
-// NewMongoAuthenticator creates a new MongoDB authenticator
-func NewMongoAuthenticator(cfg *config.MongoDBConfig) (*MongoAuthenticator, error) {
+// NewMongoAuthenticator creates a new MongoDB authenticator. TURN keys are
+// derived for realm and login hashes use bcrypt with hashCost. If enabled,
+// legacy credential documents are migrated before it returns.
+func NewMongoAuthenticator(cfg *config.MongoDBConfig, realm string, hashCost int) (*MongoAuthenticator, error) {
+	if hashCost < bcrypt.MinCost || hashCost > bcrypt.MaxCost {
+		hashCost = bcrypt.DefaultCost
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Options.ConnectTimeout)*time.Second)
 	defer cancel()
 
@@ -64,6 +81,8 @@ func NewMongoAuthenticator(cfg *config.MongoDBConfig) (*MongoAuthenticator, erro
 		database:   database,
 		collection: collection,
 		config:     cfg,
+		realm:      realm,
+		hashCost:   hashCost,
 	}
 
 	// Create indexes
@@ -71,6 +90,14 @@ func NewMongoAuthenticator(cfg *config.MongoDBConfig) (*MongoAuthenticator, erro
 		return nil, fmt.Errorf("failed to create indexes: %w", err)
 	}
 
+	// Convert documents written before versioned credentials. This scans
+	// the whole collection, so it doesn't share the connect timeout.
+	if cfg.MigrateCredentials {
+		if _, err := auth.MigrateCredentials(context.Background()); err != nil {
+			return nil, fmt.Errorf("failed to migrate credentials: %w", err)
+		}
+	}
+
 	return auth, nil
 }
 
@@ -87,22 +114,21 @@ func (m *MongoAuthenticator) Authenticate(ctx context.Context, username, passwor
 	}
 
 	var result bson.M
-	err := m.collection.FindOne(ctx, filter).Decode(&result)
+	err := m.collection.FindOne(ctx, m.scope(filter)).Decode(&result)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, fmt.Errorf("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("database query failed: %w", err)
 	}
 
-	// Extract password from result
-	storedPassword, ok := result[m.config.Fields.Password].(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid password field type")
+	creds, legacy, err := m.credentialsOf(result)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials: %w", err)
 	}
 
 	// Verify password
-	if err := bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(password)); err != nil {
+	if !creds.Verify(username, m.realm, password) {
 		return nil, fmt.Errorf("invalid password")
 	}
 
@@ -115,23 +141,25 @@ func (m *MongoAuthenticator) Authenticate(ctx context.Context, username, passwor
 	// Update last login time
 	go m.updateLastLogin(context.Background(), user.ID)
 
+	// The password is known now, store what the credentials lack
+	go m.completeCredentials(context.Background(), user.ID, creds, legacy, username, password)
+
 	return user, nil
 }
 
 // CreateUser creates a new user
 func (m *MongoAuthenticator) CreateUser(ctx context.Context, user *models.User, plainPassword string) error {
-	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(plainPassword), bcrypt.DefaultCost)
+	creds, err := NewCredentials(user.Username, plainPassword, []string{m.realm}, m.hashCost)
 	if err != nil {
-		return fmt.Errorf("failed to hash password: %w", err)
+		return err
 	}
 
 	// Build document using configured field names
 	doc := bson.M{
-		m.config.Fields.Username: user.Username,
-		m.config.Fields.Password: string(hashedPassword),
-		"created_at":             time.Now(),
-		"updated_at":             time.Now(),
+		m.config.Fields.Username:    user.Username,
+		m.config.Fields.Credentials: creds,
+		"created_at":                time.Now(),
+		"updated_at":                time.Now(),
 	}
 
 	// Add enabled field if configured
@@ -139,6 +167,11 @@ func (m *MongoAuthenticator) CreateUser(ctx context.Context, user *models.User,
 		doc[m.config.Fields.Enabled] = user.Enabled
 	}
 
+	// Tag the user with the tenant it belongs to
+	if m.config.TenantField != "" {
+		doc[m.config.TenantField] = m.config.Tenant
+	}
+
 	// Add salt field if configured and provided
 	if m.config.Fields.Salt != "" && user.Salt != "" {
 		doc[m.config.Fields.Salt] = user.Salt
@@ -161,7 +194,9 @@ func (m *MongoAuthenticator) CreateUser(ctx context.Context, user *models.User,
 	return nil
 }
 
-// UpdateUser updates an existing user
+// UpdateUser updates an existing user. TURN keys are derived from the
+// username, so renaming a user drops them until the next login or
+// password change.
 func (m *MongoAuthenticator) UpdateUser(ctx context.Context, user *models.User) error {
 	filter := bson.M{"_id": user.ID}
 	
@@ -173,19 +208,29 @@ func (m *MongoAuthenticator) UpdateUser(ctx context.Context, user *models.User)
 
 	// Update configurable fields
 	if user.Username != "" {
+		renamed, err := m.renamedCredentials(ctx, user)
+		if err != nil {
+			return err
+		}
+		if renamed != nil {
+			update = m.credentialsUpdate(renamed)
+		}
 		update["$set"].(bson.M)[m.config.Fields.Username] = user.Username
 	}
 	if m.config.Fields.Enabled != "" {
 		update["$set"].(bson.M)[m.config.Fields.Enabled] = user.Enabled
 	}
 	if user.Quota != nil {
-		update["$set"].(bson.M)["quota"] = user.Quota
+		// Only the limits: the live counters belong to the TURN servers
+		update["$set"].(bson.M)["quota.max_sessions"] = user.Quota.MaxSessions
+		update["$set"].(bson.M)["quota.max_bandwidth"] = user.Quota.MaxBandwidth
+		update["$set"].(bson.M)["quota.max_duration"] = user.Quota.MaxDuration
 	}
 	if user.Metadata != nil {
 		update["$set"].(bson.M)["metadata"] = user.Metadata
 	}
 
-	_, err := m.collection.UpdateOne(ctx, filter, update)
+	_, err := m.collection.UpdateOne(ctx, m.scope(filter), update)
 	if err != nil {
 		return fmt.Errorf("failed to update user: %w", err)
 	}
@@ -193,33 +238,36 @@ func (m *MongoAuthenticator) UpdateUser(ctx context.Context, user *models.User)
 	return nil
 }
 
-// UpdatePassword updates user password
-func (m *MongoAuthenticator) UpdatePassword(ctx context.Context, userID primitive.ObjectID, newPassword string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+// UpdatePassword replaces a user's credentials with ones derived from a
+// new password
+func (m *MongoAuthenticator) UpdatePassword(ctx context.Context, userID string, newPassword string) error {
+	user, err := m.GetUser(ctx, userID)
 	if err != nil {
-		return fmt.Errorf("failed to hash password: %w", err)
+		return err
 	}
 
-	filter := bson.M{"_id": userID}
-	update := bson.M{
-		"$set": bson.M{
-			m.config.Fields.Password: string(hashedPassword),
-			"updated_at":             time.Now(),
-		},
+	creds, err := NewCredentials(user.Username, newPassword, []string{m.realm}, m.hashCost)
+	if err != nil {
+		return err
 	}
 
-	_, err = m.collection.UpdateOne(ctx, filter, update)
+	// The keys are only valid for the username they were derived from
+	filter := bson.M{"_id": user.ID, m.config.Fields.Username: user.Username}
+	result, err := m.collection.UpdateOne(ctx, m.scope(filter), m.credentialsUpdate(creds))
 	if err != nil {
 		return fmt.Errorf("failed to update password: %w", err)
 	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("failed to update password: user was renamed or deleted meanwhile")
+	}
 
 	return nil
 }
 
 // DeleteUser deletes a user
-func (m *MongoAuthenticator) DeleteUser(ctx context.Context, userID primitive.ObjectID) error {
-	filter := bson.M{"_id": userID}
-	_, err := m.collection.DeleteOne(ctx, filter)
+func (m *MongoAuthenticator) DeleteUser(ctx context.Context, userID string) error {
+	filter := idFilter(userID)
+	_, err := m.collection.DeleteOne(ctx, m.scope(filter))
 	if err != nil {
 		return fmt.Errorf("failed to delete user: %w", err)
 	}
@@ -227,14 +275,14 @@ func (m *MongoAuthenticator) DeleteUser(ctx context.Context, userID primitive.Ob
 }
 
 // GetUser retrieves a user by ID
-func (m *MongoAuthenticator) GetUser(ctx context.Context, userID primitive.ObjectID) (*models.User, error) {
-	filter := bson.M{"_id": userID}
+func (m *MongoAuthenticator) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	filter := idFilter(userID)
 	
 	var result bson.M
-	err := m.collection.FindOne(ctx, filter).Decode(&result)
+	err := m.collection.FindOne(ctx, m.scope(filter)).Decode(&result)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, fmt.Errorf("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("database query failed: %w", err)
 	}
@@ -242,38 +290,68 @@ func (m *MongoAuthenticator) GetUser(ctx context.Context, userID primitive.Objec
 	return m.resultToUser(result)
 }
 
-// GetTURNAuthKey retrieves the pre-computed TURN auth key for a user.
-// The key stored in the database is expected to be MD5(username:realm:password).
+// idFilter matches the document of a user ID passed to the Authenticator
+// methods. An ID that isn't the hex of an ObjectID is matched as is, so it
+// finds no user rather than failing.
+func idFilter(userID string) bson.M {
+	if id, err := primitive.ObjectIDFromHex(userID); err == nil {
+		return bson.M{"_id": id}
+	}
+	return bson.M{"_id": userID}
+}
+
+// GetUserByUsername retrieves a user by username
+func (m *MongoAuthenticator) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	filter := bson.M{m.config.Fields.Username: username}
+
+	var result bson.M
+	err := m.collection.FindOne(ctx, m.scope(filter)).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("database query failed: %w", err)
+	}
+
+	return m.resultToUser(result)
+}
+
+// GetTURNAuthKey retrieves the TURN keys of the realm from a user's
+// credentials. Legacy documents are read as they are until migrated.
 func (m *MongoAuthenticator) GetTURNAuthKey(ctx context.Context, username string) (string, *models.User, error) {
 	filter := bson.M{
 		m.config.Fields.Username: username,
 	}
 
 	var result bson.M
-	err := m.collection.FindOne(ctx, filter).Decode(&result)
+	err := m.collection.FindOne(ctx, m.scope(filter)).Decode(&result)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return "", nil, fmt.Errorf("user not found")
+			return "", nil, ErrUserNotFound
 		}
 		return "", nil, fmt.Errorf("database query failed: %w", err)
 	}
 
-	// Extract password (which is the TURN key) from result
-	storedKey, ok := result[m.config.Fields.Password].(string)
-	if !ok {
-		return "", nil, fmt.Errorf("invalid key field type in db")
-	}
-
 	user, err := m.resultToUser(result)
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to convert user data: %w", err)
 	}
 
 	if !user.Enabled {
-		return "", nil, fmt.Errorf("user is disabled")
+		return "", nil, ErrUserDisabled
 	}
 
-	return storedKey, user, nil
+	creds, _, err := m.credentialsOf(result)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid credentials: %w", err)
+	}
+	keys, err := creds.Keys(m.realm)
+	if err != nil {
+		return "", nil, err
+	}
+	user.KeySHA256 = keys.SHA256
+
+	return keys.MD5, user, nil
 }
 
 // ListUsers retrieves all users with pagination
@@ -283,7 +361,7 @@ func (m *MongoAuthenticator) ListUsers(ctx context.Context, offset, limit int) (
 	opts.SetLimit(int64(limit))
 	opts.SetSort(bson.D{{Key: "created_at", Value: -1}})
 
-	cursor, err := m.collection.Find(ctx, bson.M{}, opts)
+	cursor, err := m.collection.Find(ctx, m.scope(bson.M{}), opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query users: %w", err)
 	}
@@ -306,6 +384,11 @@ func (m *MongoAuthenticator) ListUsers(ctx context.Context, offset, limit int) (
 	return users, nil
 }
 
+// Ping checks the MongoDB connection
+func (m *MongoAuthenticator) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
+
 // Close closes the MongoDB connection
 func (m *MongoAuthenticator) Close(ctx context.Context) error {
 	return m.client.Disconnect(ctx)
@@ -313,9 +396,14 @@ func (m *MongoAuthenticator) Close(ctx context.Context) error {
 
 // createIndexes creates necessary database indexes
 func (m *MongoAuthenticator) createIndexes(ctx context.Context) error {
-	// Create unique index on username field
+	// Create unique index on username field, or on tenant and username
+	// when realms share the collection
+	keys := bson.D{{Key: m.config.Fields.Username, Value: 1}}
+	if m.config.TenantField != "" {
+		keys = bson.D{{Key: m.config.TenantField, Value: 1}, {Key: m.config.Fields.Username, Value: 1}}
+	}
 	indexModel := mongo.IndexModel{
-		Keys:    bson.D{{Key: m.config.Fields.Username, Value: 1}},
+		Keys:    keys,
 		Options: options.Index().SetUnique(true),
 	}
 
@@ -348,6 +436,148 @@ func (m *MongoAuthenticator) createIndexes(ctx context.Context) error {
 	return nil
 }
 
+// MigrateCredentials converts the legacy password field of every document
+// without versioned credentials. Documents whose password field is not
+// recognized are left alone and counted as skipped; those users can't
+// authenticate until their password is set again.
+func (m *MongoAuthenticator) MigrateCredentials(ctx context.Context) (*MigrationResult, error) {
+	filter := bson.M{m.config.Fields.Credentials: bson.M{"$exists": false}}
+	cursor, err := m.collection.Find(ctx, m.scope(filter))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query legacy users: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	migration := &MigrationResult{}
+	for cursor.Next(ctx) {
+		var result bson.M
+		if err := cursor.Decode(&result); err != nil {
+			return migration, fmt.Errorf("failed to decode user: %w", err)
+		}
+
+		creds, _, err := m.credentialsOf(result)
+		if err != nil {
+			migration.Skipped++
+			continue
+		}
+
+		// Skip documents converted by a concurrent login meanwhile
+		update, err := m.collection.UpdateOne(ctx,
+			m.scope(bson.M{"_id": result["_id"], m.config.Fields.Credentials: bson.M{"$exists": false}}),
+			m.credentialsUpdate(creds))
+		if err != nil {
+			return migration, fmt.Errorf("failed to convert credentials: %w", err)
+		}
+		migration.Converted += int(update.ModifiedCount)
+	}
+
+	if err := cursor.Err(); err != nil {
+		return migration, fmt.Errorf("failed to read legacy users: %w", err)
+	}
+	return migration, nil
+}
+
+// scope restricts a filter to the authenticator's tenant, if it has one
+func (m *MongoAuthenticator) scope(filter bson.M) bson.M {
+	if m.config.TenantField != "" {
+		filter[m.config.TenantField] = m.config.Tenant
+	}
+	return filter
+}
+
+// credentialsOf returns the versioned credentials of a user document,
+// converting the legacy password field of older documents in memory. It
+// reports whether the document still holds legacy credentials.
+func (m *MongoAuthenticator) credentialsOf(result bson.M) (*Credentials, bool, error) {
+	if stored, ok := result[m.config.Fields.Credentials]; ok {
+		data, err := bson.Marshal(stored)
+		if err != nil {
+			return nil, false, err
+		}
+		creds := &Credentials{}
+		if err := bson.Unmarshal(data, creds); err != nil {
+			return nil, false, err
+		}
+		if creds.Version > CredentialsVersion {
+			return nil, false, fmt.Errorf("credentials version %d is newer than this server supports", creds.Version)
+		}
+		return creds, false, nil
+	}
+
+	password, _ := result[m.config.Fields.Password].(string)
+	var keySHA256 string
+	if m.config.Fields.KeySHA256 != "" {
+		keySHA256, _ = result[m.config.Fields.KeySHA256].(string)
+	}
+
+	creds, err := ConvertLegacyCredentials(password, keySHA256, m.realm)
+	if err != nil {
+		return nil, false, err
+	}
+	return creds, true, nil
+}
+
+// credentialsUpdate stores versioned credentials and drops the legacy
+// password fields they replace
+func (m *MongoAuthenticator) credentialsUpdate(creds *Credentials) bson.M {
+	unset := bson.M{m.config.Fields.Password: ""}
+	if m.config.Fields.KeySHA256 != "" {
+		unset[m.config.Fields.KeySHA256] = ""
+	}
+
+	return bson.M{
+		"$set": bson.M{
+			m.config.Fields.Credentials: creds,
+			"updated_at":                time.Now(),
+		},
+		"$unset": unset,
+	}
+}
+
+// completeCredentials stores what a verified password lets derive but the
+// user's credentials lack, converting a legacy document on the way. The
+// write is skipped if the credentials changed since they were read.
+func (m *MongoAuthenticator) completeCredentials(ctx context.Context, userID primitive.ObjectID, creds *Credentials, legacy bool, username, password string) {
+	filter := bson.M{"_id": userID, m.config.Fields.Username: username}
+	if legacy {
+		filter[m.config.Fields.Credentials] = bson.M{"$exists": false}
+	} else {
+		filter[m.config.Fields.Credentials+".updated_at"] = creds.UpdatedAt
+	}
+
+	changed, err := creds.Complete(username, password, []string{m.realm}, m.hashCost)
+	if err != nil || (!changed && !legacy) {
+		return
+	}
+	m.collection.UpdateOne(ctx, m.scope(filter), m.credentialsUpdate(creds))
+}
+
+// renamedCredentials returns the credentials of a user that UpdateUser is
+// about to rename, without the TURN keys of the old username, or nil if the
+// username doesn't change
+func (m *MongoAuthenticator) renamedCredentials(ctx context.Context, user *models.User) (*Credentials, error) {
+	var result bson.M
+	err := m.collection.FindOne(ctx, m.scope(bson.M{"_id": user.ID})).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("database query failed: %w", err)
+	}
+	if result[m.config.Fields.Username] == user.Username {
+		return nil, nil
+	}
+
+	creds, _, err := m.credentialsOf(result)
+	if err != nil {
+		// Nothing usable to keep, the user needs a new password either way
+		creds = &Credentials{Version: CredentialsVersion}
+	}
+	creds.TURNKeys = nil
+	creds.UpdatedAt = time.Now()
+	return creds, nil
+}
+
 // updateLastLogin updates the user's last login time
 func (m *MongoAuthenticator) updateLastLogin(ctx context.Context, userID primitive.ObjectID) {
 	filter := bson.M{"_id": userID}
@@ -356,7 +586,250 @@ func (m *MongoAuthenticator) updateLastLogin(ctx context.Context, userID primiti
 			"last_login": time.Now(),
 		},
 	}
-	m.collection.UpdateOne(ctx, filter, update)
+	m.collection.UpdateOne(ctx, m.scope(filter), update)
+}
+
+// instanceSessionsField is the field under quota counting the sessions
+// of each TURN server instance
+const instanceSessionsField = "quota.instance_sessions"
+
+// instanceSessionsPath is the field counting the sessions of one instance.
+// Dots and dollars would be read as paths and operators, so they are
+// replaced.
+func instanceSessionsPath(instance string) string {
+	return instanceSessionsField + "." + strings.NewReplacer(".", "_", "$", "_").Replace(instance)
+}
+
+// AcquireSession counts a new session in quota.current_sessions and the
+// instance's count under quota.instance_sessions, in one update that only
+// matches while the user is below max
+func (m *MongoAuthenticator) AcquireSession(ctx context.Context, username, instance string, max int) (bool, error) {
+	filter := bson.M{
+		m.config.Fields.Username: username,
+		"quota":                  bson.M{"$type": "object"},
+	}
+	if max > 0 {
+		filter["$expr"] = bson.M{"$lt": bson.A{
+			bson.M{"$ifNull": bson.A{"$quota.current_sessions", int32(0)}},
+			int32(max),
+		}}
+	}
+	update := bson.M{"$inc": bson.M{
+		"quota.current_sessions":       int32(1),
+		instanceSessionsPath(instance): int32(1),
+	}}
+
+	result, err := m.collection.UpdateOne(ctx, m.scope(filter), update)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire session: %w", err)
+	}
+	// Without a limit, a user that didn't match has no quota to count in
+	return result.MatchedCount > 0 || max <= 0, nil
+}
+
+// ReleaseSession takes back a session the instance counted. Users the
+// instance holds no sessions of are left alone, so the total never drops
+// below what the other instances counted.
+func (m *MongoAuthenticator) ReleaseSession(ctx context.Context, username, instance string) error {
+	path := instanceSessionsPath(instance)
+	filter := bson.M{
+		m.config.Fields.Username: username,
+		path:                     bson.M{"$gt": 0},
+	}
+	update := bson.M{"$inc": bson.M{
+		"quota.current_sessions": int32(-1),
+		path:                     int32(-1),
+	}}
+
+	if _, err := m.collection.UpdateOne(ctx, m.scope(filter), update); err != nil {
+		return fmt.Errorf("failed to release session: %w", err)
+	}
+	return nil
+}
+
+// ReleaseInstanceSessions subtracts the sessions an instance counted from
+// each user's quota.current_sessions and forgets the instance's counts
+func (m *MongoAuthenticator) ReleaseInstanceSessions(ctx context.Context, instance string) (int64, error) {
+	path := instanceSessionsPath(instance)
+	cursor, err := m.collection.Find(ctx, m.scope(bson.M{path: bson.M{"$exists": true}}),
+		options.Find().SetProjection(bson.M{"quota": 1}))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find instance sessions: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var released int64
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID    primitive.ObjectID `bson:"_id"`
+			Quota struct {
+				InstanceSessions map[string]int64 `bson:"instance_sessions"`
+			} `bson:"quota"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return released, fmt.Errorf("failed to decode instance sessions: %w", err)
+		}
+		count := doc.Quota.InstanceSessions[strings.TrimPrefix(path, instanceSessionsField+".")]
+
+		// Match the count read so sessions acquired meanwhile stay counted
+		filter := bson.M{"_id": doc.ID, path: count}
+		update := mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"quota.current_sessions": bson.M{"$max": bson.A{
+					int32(0),
+					bson.M{"$subtract": bson.A{bson.M{"$ifNull": bson.A{"$quota.current_sessions", int32(0)}}, count}},
+				}},
+			}}},
+			{{Key: "$unset", Value: path}},
+		}
+		result, err := m.collection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return released, fmt.Errorf("failed to release instance sessions: %w", err)
+		}
+		if count > 0 {
+			released += result.ModifiedCount
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return released, fmt.Errorf("failed to find instance sessions: %w", err)
+	}
+	return released, nil
+}
+
+// AddUsedBandwidth adds relayed bytes to a user's quota.used_bandwidth
+func (m *MongoAuthenticator) AddUsedBandwidth(ctx context.Context, username string, bytes int64) error {
+	filter := bson.M{
+		m.config.Fields.Username: username,
+		"quota":                  bson.M{"$exists": true},
+	}
+	update := bson.M{"$inc": bson.M{"quota.used_bandwidth": bytes}}
+
+	if _, err := m.collection.UpdateOne(ctx, m.scope(filter), update); err != nil {
+		return fmt.Errorf("failed to update used bandwidth: %w", err)
+	}
+	return nil
+}
+
+// ResetUsage starts a new usage period for every user whose
+// quota.reset_at has passed: used_bandwidth is zeroed and reset_at moves
+// to next. Users with a quota but no reset_at get one without a reset.
+// It returns the number of users whose usage was reset.
+func (m *MongoAuthenticator) ResetUsage(ctx context.Context, now, next time.Time) (int64, error) {
+	result, err := m.collection.UpdateMany(ctx,
+		m.scope(bson.M{"quota.reset_at": bson.M{"$lte": now}}),
+		bson.M{"$set": bson.M{
+			"quota.used_bandwidth": int64(0),
+			"quota.reset_at":       next,
+		}},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reset usage: %w", err)
+	}
+
+	_, err = m.collection.UpdateMany(ctx,
+		m.scope(bson.M{"quota": bson.M{"$type": "object"}, "quota.reset_at": bson.M{"$exists": false}}),
+		bson.M{"$set": bson.M{"quota.reset_at": next}},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to schedule usage reset: %w", err)
+	}
+
+	return result.ModifiedCount, nil
+}
+
+// WatchUsers follows a change stream on the users collection, reporting
+// inserted, replaced and deleted users and updates of the fields a TURN key
+// lookup depends on. Updates of quota counters or login times are left
+// out, they would drop the entries of active users all the time; changed
+// quota limits apply once the cache entry expires. Change streams need a
+// replica set or sharded cluster; on a standalone server it fails at once.
+func (m *MongoAuthenticator) WatchUsers(ctx context.Context, onChange func(change *UserChange)) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"operationType": bson.M{"$in": bson.A{"insert", "update", "replace", "delete", "drop", "invalidate"}}}}},
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"operationType": bson.M{"$ne": "update"}},
+			bson.M{"$expr": m.updatesWatchedFields()},
+		}}}},
+	}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+
+	stream, err := m.collection.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return fmt.Errorf("failed to open change stream: %w", err)
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var event struct {
+			OperationType string `bson:"operationType"`
+			DocumentKey   struct {
+				ID primitive.ObjectID `bson:"_id"`
+			} `bson:"documentKey"`
+			FullDocument bson.M `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			onChange(nil)
+			continue
+		}
+
+		if event.OperationType == "drop" || event.OperationType == "invalidate" {
+			onChange(nil)
+			continue
+		}
+
+		change := &UserChange{ID: event.DocumentKey.ID}
+		if username, ok := event.FullDocument[m.config.Fields.Username].(string); ok {
+			change.Username = username
+		}
+		onChange(change)
+	}
+
+	if err := stream.Err(); err != nil {
+		return fmt.Errorf("change stream failed: %w", err)
+	}
+	return fmt.Errorf("change stream closed")
+}
+
+// watchedFields returns the fields of a user document a TURN key lookup
+// depends on: the username, enabled and credential fields
+func (m *MongoAuthenticator) watchedFields() []string {
+	fields := []string{m.config.Fields.Username, m.config.Fields.Password, m.config.Fields.Credentials}
+	for _, field := range []string{m.config.Fields.Enabled, m.config.Fields.Salt, m.config.Fields.KeySHA256} {
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// updatesWatchedFields is an aggregation expression matching change events
+// whose updateDescription sets or removes one of watchedFields, a field
+// within one, or a document holding one
+func (m *MongoAuthenticator) updatesWatchedFields() bson.M {
+	paths := bson.M{"$concatArrays": bson.A{
+		bson.M{"$map": bson.M{
+			"input": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$updateDescription.updatedFields", bson.M{}}}},
+			"in":    "$$this.k",
+		}},
+		bson.M{"$ifNull": bson.A{"$updateDescription.removedFields", bson.A{}}},
+	}}
+
+	// Paths and fields are compared with a trailing dot so "credentials"
+	// matches "credentials.turn_keys" but not "credentials_backup"
+	path := bson.M{"$concat": bson.A{"$$path", "."}}
+	var conditions bson.A
+	for _, field := range m.watchedFields() {
+		conditions = append(conditions,
+			bson.M{"$eq": bson.A{bson.M{"$indexOfCP": bson.A{path, field + "."}}, 0}},
+			bson.M{"$eq": bson.A{bson.M{"$indexOfCP": bson.A{field + ".", path}}, 0}},
+		)
+	}
+
+	return bson.M{"$anyElementTrue": bson.A{bson.M{"$map": bson.M{
+		"input": paths,
+		"as":    "path",
+		"in":    bson.M{"$or": conditions},
+	}}}}
 }
 
 // resultToUser converts MongoDB result to User model
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/turn/v2"
+)
+
+// RESTCredentials implements the "TURN REST API" ephemeral credential
+// scheme. The username is "expiry:userid", where expiry is a Unix
+// timestamp, and the password is base64(HMAC-SHA1(secret, username)).
+// Credentials are minted with the first secret; every configured secret is
+// accepted so secrets can be rotated without invalidating live credentials.
+type RESTCredentials struct {
+	secrets []string
+}
+
+// NewRESTCredentials creates a REST credential validator. secret is used to
+// mint new credentials, additional secrets are only accepted.
+func NewRESTCredentials(secret string, additional []string) *RESTCredentials {
+	secrets := []string{secret}
+	for _, s := range additional {
+		if s != "" && s != secret {
+			secrets = append(secrets, s)
+		}
+	}
+	return &RESTCredentials{secrets: secrets}
+}
+
+// ParseRESTUsername splits a REST API username into its expiry and user ID.
+// ok is false for usernames that don't follow the "expiry:userid" format.
+func ParseRESTUsername(username string) (expiresAt time.Time, userID string, ok bool) {
+	timestamp, userID, found := strings.Cut(username, ":")
+	if !found || timestamp == "" {
+		return time.Time{}, "", false
+	}
+
+	expiry, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || expiry <= 0 {
+		return time.Time{}, "", false
+	}
+
+	return time.Unix(expiry, 0), userID, true
+}
+
+// Generate mints a credential for userID that is valid for ttl
+func (r *RESTCredentials) Generate(userID string, ttl time.Duration) (username, password string, expiresAt time.Time) {
+	expiresAt = time.Now().Add(ttl).Truncate(time.Second)
+	username = fmt.Sprintf("%d:%s", expiresAt.Unix(), userID)
+	return username, restPassword(r.secrets[0], username), expiresAt
+}
+
+// Keys returns the candidate long-term credential keys, one per secret, for
+// a REST API username. It fails if the username is malformed or expired.
+func (r *RESTCredentials) Keys(username, realm string) ([][]byte, error) {
+	expiresAt, _, ok := ParseRESTUsername(username)
+	if !ok {
+		return nil, fmt.Errorf("not a REST API username")
+	}
+	if time.Now().After(expiresAt) {
+		return nil, fmt.Errorf("credential expired at %s", expiresAt.Format(time.RFC3339))
+	}
+
+	keys := make([][]byte, 0, len(r.secrets))
+	for _, secret := range r.secrets {
+		keys = append(keys, turn.GenerateAuthKey(username, realm, restPassword(secret, username)))
+	}
+	return keys, nil
+}
+
+// KeysSHA256 returns the candidate SHA-256 password algorithm keys, one per
+// secret, for a REST API username
+func (r *RESTCredentials) KeysSHA256(username, realm string) ([][]byte, error) {
+	if _, err := r.Keys(username, realm); err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, 0, len(r.secrets))
+	for _, secret := range r.secrets {
+		keys = append(keys, generateSHA256Key(username, realm, restPassword(secret, username)))
+	}
+	return keys, nil
+}
+
+// restPassword computes base64(HMAC-SHA1(secret, username))
+func restPassword(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
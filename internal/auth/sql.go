@@ -0,0 +1,686 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	_ "modernc.org/sqlite"
+
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// SQL drivers accepted in sql.driver
+const (
+	SQLDriverPostgres = "postgres"
+	SQLDriverSQLite   = "sqlite"
+)
+
+// SQLAuthenticator implements authentication using a PostgreSQL or SQLite
+// users table. Every column can be mapped onto an existing schema, and the
+// enabled, salt, key_sha256, metadata and timestamp columns may be absent.
+// The password column holds the hex-encoded TURN key
+// MD5(username:realm:password) and the optional key_sha256 column
+// SHA-256(username:realm:password). A user has a quota when any of the
+// max_sessions, max_bandwidth and max_duration columns is set. IDs that
+// aren't the hex of an ObjectID, such as integers or UUIDs, are kept in
+// the user's ExternalID.
+type SQLAuthenticator struct {
+	config *config.SQLConfig
+	realm  string
+	db     *sql.DB
+
+	users    string // quoted table names
+	sessions string
+	columns  sqlColumns
+}
+
+var (
+	_ Authenticator = (*SQLAuthenticator)(nil)
+	_ QuotaStore    = (*SQLAuthenticator)(nil)
+	_ SessionStore  = (*SQLAuthenticator)(nil)
+)
+
+// sqlColumns holds the quoted names of the mapped columns. enabled, salt,
+// keySHA256, metadata and the timestamps are empty when not configured.
+type sqlColumns struct {
+	id        string
+	username  string
+	password  string
+	enabled   string
+	salt      string
+	keySHA256 string
+	metadata  string
+	createdAt string
+	updatedAt string
+	lastLogin string
+
+	maxSessions     string
+	maxBandwidth    string
+	maxDuration     string
+	currentSessions string
+	usedBandwidth   string
+	resetAt         string
+}
+
+// NewSQLAuthenticator opens the database and, if enabled, migrates its
+// schema. realm is the TURN realm keys are computed for.
+func NewSQLAuthenticator(cfg *config.SQLConfig, realm string) (*SQLAuthenticator, error) {
+	db, err := sql.Open(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database: %w", cfg.Driver, err)
+	}
+
+	db.SetMaxOpenConns(cfg.Options.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.Options.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.Options.ConnMaxLifetime) * time.Second)
+
+	s := &SQLAuthenticator{
+		config:   cfg,
+		realm:    realm,
+		db:       db,
+		users:    quoteIdentifier(cfg.Table),
+		sessions: quoteIdentifier(cfg.SessionsTable),
+		columns: sqlColumns{
+			id:        quoteIdentifier(columnOrDefault(cfg.Columns.ID, "id")),
+			username:  quoteIdentifier(cfg.Columns.Username),
+			password:  quoteIdentifier(cfg.Columns.Password),
+			enabled:   quoteIdentifier(cfg.Columns.Enabled),
+			salt:      quoteIdentifier(cfg.Columns.Salt),
+			keySHA256: quoteIdentifier(cfg.Columns.KeySHA256),
+			metadata:  quoteIdentifier(cfg.Columns.Metadata),
+			createdAt: quoteIdentifier(cfg.Columns.CreatedAt),
+			updatedAt: quoteIdentifier(cfg.Columns.UpdatedAt),
+			lastLogin: quoteIdentifier(cfg.Columns.LastLogin),
+
+			maxSessions:     quoteIdentifier(columnOrDefault(cfg.Columns.MaxSessions, "max_sessions")),
+			maxBandwidth:    quoteIdentifier(columnOrDefault(cfg.Columns.MaxBandwidth, "max_bandwidth")),
+			maxDuration:     quoteIdentifier(columnOrDefault(cfg.Columns.MaxDuration, "max_duration")),
+			currentSessions: quoteIdentifier(columnOrDefault(cfg.Columns.CurrentSessions, "current_sessions")),
+			usedBandwidth:   quoteIdentifier(columnOrDefault(cfg.Columns.UsedBandwidth, "used_bandwidth")),
+			resetAt:         quoteIdentifier(columnOrDefault(cfg.Columns.ResetAt, "reset_at")),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to %s database: %w", cfg.Driver, err)
+	}
+
+	if cfg.Migrate {
+		if err := s.Migrate(ctx); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// columnOrDefault returns the configured name of a column every users table
+// has, or its default name when it isn't mapped
+func columnOrDefault(name, defaultName string) string {
+	if name == "" {
+		return defaultName
+	}
+	return name
+}
+
+// quoteIdentifier quotes a possibly schema-qualified identifier. Empty
+// names stay empty.
+func quoteIdentifier(name string) string {
+	if name == "" {
+		return ""
+	}
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = `"` + strings.ReplaceAll(part, `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+// rebind turns ? placeholders into the driver's placeholder syntax
+func (s *SQLAuthenticator) rebind(query string) string {
+	if s.config.Driver != SQLDriverPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *SQLAuthenticator) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.db.ExecContext(ctx, s.rebind(query), args...)
+}
+
+func (s *SQLAuthenticator) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRowContext(ctx, s.rebind(query), args...)
+}
+
+// selectColumns is the column list scanUser expects. Absent columns are
+// selected as constants.
+func (s *SQLAuthenticator) selectColumns() string {
+	enabled := "TRUE"
+	if s.columns.enabled != "" {
+		enabled = s.columns.enabled
+	}
+	return strings.Join([]string{
+		s.columns.id, s.columns.username, s.columns.password, orNull(s.columns.keySHA256), enabled,
+		s.columns.maxSessions, s.columns.maxBandwidth, s.columns.maxDuration,
+		s.columns.currentSessions, s.columns.usedBandwidth, s.columns.resetAt,
+		orNull(s.columns.metadata), orNull(s.columns.createdAt), orNull(s.columns.updatedAt), orNull(s.columns.lastLogin),
+	}, ", ")
+}
+
+// orNull selects NULL in place of an absent column
+func orNull(column string) string {
+	if column == "" {
+		return "NULL"
+	}
+	return column
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser converts a row selected with selectColumns to a user and its key
+func scanUser(row rowScanner) (*models.User, string, error) {
+	var (
+		id, username, key                       string
+		enabled                                 bool
+		maxSessions, maxBandwidth, maxDuration  sql.NullInt64
+		currentSessions, usedBandwidth          int64
+		resetAt, lastLogin, createdAt, updateAt sql.NullTime
+		metadata, keySHA256                     sql.NullString
+	)
+
+	err := row.Scan(&id, &username, &key, &keySHA256, &enabled,
+		&maxSessions, &maxBandwidth, &maxDuration,
+		&currentSessions, &usedBandwidth, &resetAt,
+		&metadata, &createdAt, &updateAt, &lastLogin)
+	if err != nil {
+		return nil, "", err
+	}
+
+	user := &models.User{
+		Username:  username,
+		KeySHA256: strings.ToLower(keySHA256.String),
+		Enabled:   enabled,
+		CreatedAt: createdAt.Time,
+		UpdatedAt: updateAt.Time,
+	}
+	if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+		user.ID = objectID
+	} else {
+		user.ExternalID = id
+	}
+	if lastLogin.Valid {
+		t := lastLogin.Time
+		user.LastLogin = &t
+	}
+	if maxSessions.Valid || maxBandwidth.Valid || maxDuration.Valid {
+		user.Quota = &models.UserQuota{
+			MaxSessions:     int(maxSessions.Int64),
+			MaxBandwidth:    maxBandwidth.Int64,
+			MaxDuration:     int(maxDuration.Int64),
+			CurrentSessions: int(currentSessions),
+			UsedBandwidth:   usedBandwidth,
+			ResetAt:         resetAt.Time,
+		}
+	}
+	if metadata.Valid && metadata.String != "" {
+		if err := json.Unmarshal([]byte(metadata.String), &user.Metadata); err != nil {
+			return nil, "", fmt.Errorf("invalid metadata: %w", err)
+		}
+	}
+
+	return user, key, nil
+}
+
+// quotaArgs returns the quota limit column values of a user, NULL without a
+// quota
+func quotaArgs(quota *models.UserQuota) []interface{} {
+	if quota == nil {
+		return []interface{}{nil, nil, nil}
+	}
+	return []interface{}{quota.MaxSessions, quota.MaxBandwidth, quota.MaxDuration}
+}
+
+// metadataArg encodes a user's metadata as JSON, NULL if there is none
+func metadataArg(metadata map[string]interface{}) (interface{}, error) {
+	if metadata == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	return string(data), nil
+}
+
+// key computes the hex-encoded long-term credential key of a user
+func (s *SQLAuthenticator) key(username, password string) string {
+	return TURNKey(username, s.realm, password)
+}
+
+// Authenticate verifies user credentials against the stored key
+func (s *SQLAuthenticator) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	storedKey, user, err := s.GetTURNAuthKey(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(storedKey)), []byte(s.key(username, password))) != 1 {
+		return nil, fmt.Errorf("invalid password")
+	}
+
+	// Update last login time
+	if s.columns.lastLogin != "" {
+		go s.updateLastLogin(context.Background(), user.IDString())
+	}
+
+	return user, nil
+}
+
+// CreateUser creates a new user
+func (s *SQLAuthenticator) CreateUser(ctx context.Context, user *models.User, plainPassword string) error {
+	metadata, err := metadataArg(user.Metadata)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	id := primitive.NewObjectID()
+
+	columns := []string{s.columns.id, s.columns.username, s.columns.password,
+		s.columns.maxSessions, s.columns.maxBandwidth, s.columns.maxDuration}
+	args := []interface{}{id.Hex(), user.Username, s.key(user.Username, plainPassword)}
+	args = append(args, quotaArgs(user.Quota)...)
+
+	if s.columns.metadata != "" {
+		columns = append(columns, s.columns.metadata)
+		args = append(args, metadata)
+	}
+	if s.columns.createdAt != "" {
+		columns = append(columns, s.columns.createdAt)
+		args = append(args, now)
+	}
+	if s.columns.updatedAt != "" {
+		columns = append(columns, s.columns.updatedAt)
+		args = append(args, now)
+	}
+	if s.columns.enabled != "" {
+		columns = append(columns, s.columns.enabled)
+		args = append(args, user.Enabled)
+	}
+	if s.columns.salt != "" && user.Salt != "" {
+		columns = append(columns, s.columns.salt)
+		args = append(args, user.Salt)
+	}
+	if s.columns.keySHA256 != "" {
+		columns = append(columns, s.columns.keySHA256)
+		args = append(args, TURNKeySHA256(user.Username, s.realm, plainPassword))
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", s.users, strings.Join(columns, ", "), placeholders)
+	if _, err := s.exec(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+
+	user.ID = id
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	return nil
+}
+
+// UpdateUser updates an existing user. As with MongoDB, the quota and
+// metadata are only replaced when set.
+func (s *SQLAuthenticator) UpdateUser(ctx context.Context, user *models.User) error {
+	var sets []string
+	var args []interface{}
+	if s.columns.updatedAt != "" {
+		sets = append(sets, s.columns.updatedAt+" = ?")
+		args = append(args, time.Now().UTC())
+	}
+
+	if user.Username != "" {
+		sets = append(sets, s.columns.username+" = ?")
+		args = append(args, user.Username)
+	}
+	if s.columns.enabled != "" {
+		sets = append(sets, s.columns.enabled+" = ?")
+		args = append(args, user.Enabled)
+	}
+	if user.Quota != nil {
+		sets = append(sets, s.columns.maxSessions+" = ?", s.columns.maxBandwidth+" = ?", s.columns.maxDuration+" = ?")
+		args = append(args, quotaArgs(user.Quota)...)
+	}
+	if user.Metadata != nil && s.columns.metadata != "" {
+		metadata, err := metadataArg(user.Metadata)
+		if err != nil {
+			return err
+		}
+		sets = append(sets, s.columns.metadata+" = ?")
+		args = append(args, metadata)
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s = ?", s.users, strings.Join(sets, ", "), s.columns.id)
+	if _, err := s.exec(ctx, query, append(args, user.IDString())...); err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+
+	return nil
+}
+
+// UpdatePassword replaces a user's keys
+func (s *SQLAuthenticator) UpdatePassword(ctx context.Context, userID string, newPassword string) error {
+	var username string
+	err := s.queryRow(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", s.columns.username, s.users, s.columns.id), userID).Scan(&username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("database query failed: %w", err)
+	}
+
+	sets := []string{s.columns.password + " = ?"}
+	args := []interface{}{s.key(username, newPassword)}
+	if s.columns.updatedAt != "" {
+		sets = append(sets, s.columns.updatedAt+" = ?")
+		args = append(args, time.Now().UTC())
+	}
+	if s.columns.keySHA256 != "" {
+		sets = append(sets, s.columns.keySHA256+" = ?")
+		args = append(args, TURNKeySHA256(username, s.realm, newPassword))
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s = ?", s.users, strings.Join(sets, ", "), s.columns.id)
+	if _, err := s.exec(ctx, query, append(args, userID)...); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteUser deletes a user
+func (s *SQLAuthenticator) DeleteUser(ctx context.Context, userID string) error {
+	if _, err := s.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s = ?", s.users, s.columns.id), userID); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	return nil
+}
+
+// GetUser retrieves a user by ID
+func (s *SQLAuthenticator) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", s.selectColumns(), s.users, s.columns.id)
+	user, _, err := scanUser(s.queryRow(ctx, query, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("database query failed: %w", err)
+	}
+	return user, nil
+}
+
+// GetUserByUsername retrieves a user by username
+func (s *SQLAuthenticator) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", s.selectColumns(), s.users, s.columns.username)
+	user, _, err := scanUser(s.queryRow(ctx, query, username))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("database query failed: %w", err)
+	}
+	return user, nil
+}
+
+// GetTURNAuthKey retrieves the pre-computed TURN auth key for a user
+func (s *SQLAuthenticator) GetTURNAuthKey(ctx context.Context, username string) (string, *models.User, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", s.selectColumns(), s.users, s.columns.username)
+	user, storedKey, err := scanUser(s.queryRow(ctx, query, username))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil, ErrUserNotFound
+		}
+		return "", nil, fmt.Errorf("database query failed: %w", err)
+	}
+
+	if !user.Enabled {
+		return "", nil, ErrUserDisabled
+	}
+
+	return storedKey, user, nil
+}
+
+// ListUsers retrieves all users with pagination, newest first, or by ID
+// without a created_at column
+func (s *SQLAuthenticator) ListUsers(ctx context.Context, offset, limit int) ([]*models.User, error) {
+	order := s.columns.id
+	if s.columns.createdAt != "" {
+		order = s.columns.createdAt + " DESC"
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s ORDER BY %s LIMIT ? OFFSET ?", s.selectColumns(), s.users, order)
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []*models.User
+	for rows.Next() {
+		user, _, err := scanUser(rows)
+		if err != nil {
+			continue // Skip invalid users
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// Ping checks the database connection
+func (s *SQLAuthenticator) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Close closes the database
+func (s *SQLAuthenticator) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+// updateLastLogin updates the user's last login time
+func (s *SQLAuthenticator) updateLastLogin(ctx context.Context, userID string) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	s.exec(ctx, fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", s.users, s.columns.lastLogin, s.columns.id), time.Now().UTC(), userID)
+}
+
+// hasQuota is the condition matching users with a quota
+func (s *SQLAuthenticator) hasQuota() string {
+	return fmt.Sprintf("(%s IS NOT NULL OR %s IS NOT NULL OR %s IS NOT NULL)",
+		s.columns.maxSessions, s.columns.maxBandwidth, s.columns.maxDuration)
+}
+
+// AcquireSession counts a new session in current_sessions, with a
+// conditional update that only matches while the user is below max, and
+// in the instance's row of the instance sessions table
+func (s *SQLAuthenticator) AcquireSession(ctx context.Context, username, instance string, max int) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire session: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("UPDATE %[1]s SET %[2]s = %[2]s + 1 WHERE %[3]s = ? AND %[4]s AND (? <= 0 OR %[2]s < ?)",
+		s.users, s.columns.currentSessions, s.columns.username, s.hasQuota())
+	result, err := tx.ExecContext(ctx, s.rebind(query), username, max, max)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire session: %w", err)
+	}
+	acquired, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire session: %w", err)
+	}
+	if acquired == 0 {
+		// Without a limit, a user that didn't match has no quota to count in
+		return max <= 0, nil
+	}
+
+	query = fmt.Sprintf(`INSERT INTO %[1]s (users_table, username, instance, sessions) VALUES (?, ?, ?, 1)
+		ON CONFLICT (users_table, username, instance) DO UPDATE SET sessions = %[1]s.sessions + 1`, sqlInstanceSessionsTable)
+	if _, err := tx.ExecContext(ctx, s.rebind(query), s.config.Table, username, instance); err != nil {
+		return false, fmt.Errorf("failed to acquire session: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to acquire session: %w", err)
+	}
+	return true, nil
+}
+
+// ReleaseSession takes back a session the instance counted. Users the
+// instance holds no sessions of are left alone, so the total never drops
+// below what the other instances counted.
+func (s *SQLAuthenticator) ReleaseSession(ctx context.Context, username, instance string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to release session: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("UPDATE %s SET sessions = sessions - 1 WHERE users_table = ? AND username = ? AND instance = ? AND sessions > 0",
+		sqlInstanceSessionsTable)
+	result, err := tx.ExecContext(ctx, s.rebind(query), s.config.Table, username, instance)
+	if err != nil {
+		return fmt.Errorf("failed to release session: %w", err)
+	}
+	released, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to release session: %w", err)
+	}
+	if released == 0 {
+		return nil
+	}
+
+	query = fmt.Sprintf("UPDATE %[1]s SET %[2]s = %[2]s - 1 WHERE %[3]s = ? AND %[2]s > 0",
+		s.users, s.columns.currentSessions, s.columns.username)
+	if _, err := tx.ExecContext(ctx, s.rebind(query), username); err != nil {
+		return fmt.Errorf("failed to release session: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to release session: %w", err)
+	}
+	return nil
+}
+
+// ReleaseInstanceSessions subtracts the sessions an instance counted from
+// each user's current_sessions and forgets the instance's counts
+func (s *SQLAuthenticator) ReleaseInstanceSessions(ctx context.Context, instance string) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release instance sessions: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`UPDATE %[1]s SET %[4]s = CASE WHEN %[4]s > c.sessions THEN %[4]s - c.sessions ELSE 0 END
+		FROM (SELECT username, sessions FROM %[2]s WHERE users_table = ? AND instance = ? AND sessions > 0) AS c
+		WHERE %[1]s.%[3]s = c.username`, s.users, sqlInstanceSessionsTable, s.columns.username, s.columns.currentSessions)
+	result, err := tx.ExecContext(ctx, s.rebind(query), s.config.Table, instance)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release instance sessions: %w", err)
+	}
+	released, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to release instance sessions: %w", err)
+	}
+
+	query = fmt.Sprintf("DELETE FROM %s WHERE users_table = ? AND instance = ?", sqlInstanceSessionsTable)
+	if _, err := tx.ExecContext(ctx, s.rebind(query), s.config.Table, instance); err != nil {
+		return 0, fmt.Errorf("failed to release instance sessions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to release instance sessions: %w", err)
+	}
+	return released, nil
+}
+
+// AddUsedBandwidth adds relayed bytes to a user's used_bandwidth
+func (s *SQLAuthenticator) AddUsedBandwidth(ctx context.Context, username string, bytes int64) error {
+	query := fmt.Sprintf("UPDATE %[1]s SET %[2]s = %[2]s + ? WHERE %[3]s = ? AND %[4]s",
+		s.users, s.columns.usedBandwidth, s.columns.username, s.hasQuota())
+	if _, err := s.exec(ctx, query, bytes, username); err != nil {
+		return fmt.Errorf("failed to update used bandwidth: %w", err)
+	}
+	return nil
+}
+
+// ResetUsage starts a new usage period for every user whose reset_at has
+// passed. Users with a quota but no reset_at get one without a reset. It
+// returns the number of users whose usage was reset.
+func (s *SQLAuthenticator) ResetUsage(ctx context.Context, now, next time.Time) (int64, error) {
+	result, err := s.exec(ctx,
+		fmt.Sprintf("UPDATE %[1]s SET %[2]s = 0, %[3]s = ? WHERE %[3]s <= ?", s.users, s.columns.usedBandwidth, s.columns.resetAt),
+		next.UTC(), now.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to reset usage: %w", err)
+	}
+	reset, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to reset usage: %w", err)
+	}
+
+	_, err = s.exec(ctx,
+		fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s IS NULL AND %s", s.users, s.columns.resetAt, s.columns.resetAt, s.hasQuota()),
+		next.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to schedule usage reset: %w", err)
+	}
+
+	return reset, nil
+}
+
+// RecordSession stores an ended session in the sessions table
+func (s *SQLAuthenticator) RecordSession(ctx context.Context, session *models.SessionInfo) error {
+	query := fmt.Sprintf(`INSERT INTO %s (id, username, client_addr, relay_addr, start_time, end_time,
+		bytes_sent, bytes_recv, packets_sent, packets_recv) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, s.sessions)
+	_, err := s.exec(ctx, query,
+		session.ID, session.Username, session.ClientAddr, session.RelayAddr,
+		session.StartTime.UTC(), time.Now().UTC(),
+		session.BytesSent, session.BytesRecv, session.PacketsSent, session.PacketsRecv)
+	if err != nil {
+		return fmt.Errorf("failed to record session: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqlMigrationsTable records the schema versions applied to each pair of
+// users and sessions tables, so realms keeping their users in different
+// tables of one database are each migrated. It is named so it doesn't clash
+// with the schema_migrations table of other tools sharing the database.
+const sqlMigrationsTable = "turn_schema_migrations"
+
+// sqlInstanceSessionsTable counts the sessions each TURN server instance
+// holds of each user, so an instance can take back the counts it left
+// behind without touching those of the others
+const sqlInstanceSessionsTable = "turn_instance_sessions"
+
+// sqlMigration is one schema change, applied once and in version order
+type sqlMigration struct {
+	version     int
+	description string
+	statements  func(ctx context.Context, s *SQLAuthenticator) []string
+}
+
+// sqlMigrations lists the schema changes. Append new ones; never edit or
+// reorder migrations that have shipped.
+var sqlMigrations = []sqlMigration{
+	{
+		version:     1,
+		description: "create users and sessions tables",
+		statements: func(ctx context.Context, s *SQLAuthenticator) []string {
+			timestamp := s.timestampType()
+
+			columns := []string{
+				s.columns.id + " VARCHAR(24) PRIMARY KEY",
+				s.columns.username + " TEXT NOT NULL UNIQUE",
+				s.columns.password + " TEXT NOT NULL",
+			}
+			if s.columns.enabled != "" {
+				columns = append(columns, s.columns.enabled+" BOOLEAN NOT NULL DEFAULT TRUE")
+			}
+			if s.columns.salt != "" {
+				columns = append(columns, s.columns.salt+" TEXT")
+			}
+			columns = append(columns,
+				s.columns.maxSessions+" INTEGER",
+				s.columns.maxBandwidth+" BIGINT",
+				s.columns.maxDuration+" INTEGER",
+				s.columns.currentSessions+" INTEGER NOT NULL DEFAULT 0",
+				s.columns.usedBandwidth+" BIGINT NOT NULL DEFAULT 0",
+				s.columns.resetAt+" "+timestamp,
+			)
+			if s.columns.metadata != "" {
+				columns = append(columns, s.columns.metadata+" TEXT")
+			}
+			for _, column := range []string{s.columns.createdAt, s.columns.updatedAt, s.columns.lastLogin} {
+				if column != "" {
+					columns = append(columns, column+" "+timestamp)
+				}
+			}
+
+			index := quoteIdentifier(strings.ReplaceAll(s.config.SessionsTable, ".", "_") + "_username_idx")
+
+			return []string{
+				fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n)", s.users, strings.Join(columns, ",\n\t")),
+				fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id TEXT NOT NULL,
+	username TEXT NOT NULL,
+	client_addr TEXT NOT NULL,
+	relay_addr TEXT NOT NULL,
+	start_time %s NOT NULL,
+	end_time %s NOT NULL,
+	bytes_sent BIGINT NOT NULL DEFAULT 0,
+	bytes_recv BIGINT NOT NULL DEFAULT 0,
+	packets_sent BIGINT NOT NULL DEFAULT 0,
+	packets_recv BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (id, start_time)
+)`, s.sessions, timestamp, timestamp),
+				fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (username, start_time)", index, s.sessions),
+			}
+		},
+	},
+	{
+		version:     2,
+		description: "add SHA-256 key column",
+		statements: func(ctx context.Context, s *SQLAuthenticator) []string {
+			// A mapped table may already have the column
+			if s.columns.keySHA256 == "" || s.hasColumn(ctx, s.users, s.columns.keySHA256) {
+				return nil
+			}
+			return []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s TEXT", s.users, s.columns.keySHA256)}
+		},
+	},
+	{
+		version:     3,
+		description: "create instance sessions table",
+		statements: func(ctx context.Context, s *SQLAuthenticator) []string {
+			return []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	users_table TEXT NOT NULL,
+	username TEXT NOT NULL,
+	instance TEXT NOT NULL,
+	sessions INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (users_table, username, instance)
+)`, sqlInstanceSessionsTable)}
+		},
+	},
+}
+
+// timestampType is the column type used for times
+func (s *SQLAuthenticator) timestampType() string {
+	if s.config.Driver == SQLDriverPostgres {
+		return "TIMESTAMPTZ"
+	}
+	return "TIMESTAMP"
+}
+
+// hasColumn reports whether a table has a column. It probes with a query
+// outside of any transaction, since a failed statement aborts a PostgreSQL
+// transaction. The column is qualified, or SQLite would take a quoted
+// unknown column for a string.
+func (s *SQLAuthenticator) hasColumn(ctx context.Context, table, column string) bool {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT t.%s FROM %s t WHERE 1 = 0", column, table))
+	if err != nil {
+		return false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+	}
+	return rows.Err() == nil
+}
+
+// Migrate brings the schema of the users and sessions tables up to date,
+// applying each pending migration in its own transaction
+func (s *SQLAuthenticator) Migrate(ctx context.Context) error {
+	_, err := s.exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	users_table TEXT NOT NULL,
+	sessions_table TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	description TEXT NOT NULL,
+	applied_at %s NOT NULL,
+	PRIMARY KEY (users_table, sessions_table, version)
+)`, sqlMigrationsTable, s.timestampType()))
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var current int
+	err = s.queryRow(ctx,
+		fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s WHERE users_table = ? AND sessions_table = ?", sqlMigrationsTable),
+		s.config.Table, s.config.SessionsTable).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for _, migration := range sqlMigrations {
+		if migration.version <= current {
+			continue
+		}
+		if err := s.applyMigration(ctx, migration); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", migration.version, migration.description, err)
+		}
+	}
+
+	return nil
+}
+
+// applyMigration runs one migration and records it
+func (s *SQLAuthenticator) applyMigration(ctx context.Context, migration sqlMigration) error {
+	statements := migration.statements(ctx, s)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		s.rebind(fmt.Sprintf("INSERT INTO %s (users_table, sessions_table, version, description, applied_at) VALUES (?, ?, ?, ?, ?)", sqlMigrationsTable)),
+		s.config.Table, s.config.SessionsTable, migration.version, migration.description, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,381 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// webhookRetryDelay is the delay before the first retry; it doubles with
+// each further attempt
+const webhookRetryDelay = 100 * time.Millisecond
+
+// webhookRequest is the body POSTed to the webhook for each username
+type webhookRequest struct {
+	Username string `json:"username"`
+	Realm    string `json:"realm"`
+}
+
+// webhookResponse is the webhook's answer for a known user. It returns
+// either the hex-encoded key MD5(username:realm:password), optionally with
+// key_sha256 SHA-256(username:realm:password), or the password itself.
+// Enabled defaults to true.
+type webhookResponse struct {
+	Key       string                 `json:"key"`
+	KeySHA256 string                 `json:"key_sha256"`
+	Password  string                 `json:"password"`
+	Enabled   *bool                  `json:"enabled"`
+	Quota     *models.UserQuota      `json:"quota"`
+	Metadata  map[string]interface{} `json:"metadata"`
+}
+
+// webhookEntry is a cached webhook answer, either a user and key or the
+// ErrUserNotFound or ErrUserDisabled the webhook answered with
+type webhookEntry struct {
+	key     string
+	user    *models.User
+	err     error
+	expires time.Time
+}
+
+// WebhookAuthenticator delegates TURN auth decisions to an HTTP endpoint of
+// an existing account service. Each username is POSTed as JSON; the
+// endpoint answers 200 with the user's key or password and quota, 404 for
+// unknown users and 403 for disabled ones. Transport errors, 429 and 5xx
+// answers are retried while the auth context's deadline leaves time for
+// them. Answers for known users are cached for cache_ttl, 404 and 403
+// answers for negative_ttl.
+// Users are managed by the account service, so the user CRUD methods
+// return ErrUnsupported.
+type WebhookAuthenticator struct {
+	config *config.WebhookAuthConfig
+	realm  string
+	client *http.Client
+
+	mutex sync.Mutex
+	cache map[string]*webhookEntry
+}
+
+var _ Authenticator = (*WebhookAuthenticator)(nil)
+
+// NewWebhookAuthenticator creates a webhook authenticator. realm is sent
+// with each request and used to compute keys from passwords.
+func NewWebhookAuthenticator(cfg *config.WebhookAuthConfig, realm string) (*WebhookAuthenticator, error) {
+	tlsConfig, err := webhookTLSConfig(&cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &WebhookAuthenticator{
+		config: cfg,
+		realm:  realm,
+		client: &http.Client{Transport: transport},
+		cache:  make(map[string]*webhookEntry),
+	}, nil
+}
+
+// webhookTLSConfig builds the client TLS configuration: a custom CA bundle
+// to verify the endpoint and a client certificate for mTLS, both optional
+func webhookTLSConfig(cfg *config.WebhookTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webhook CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in webhook CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load webhook client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// lookup returns a user's key and user, from the cache or the webhook
+func (w *WebhookAuthenticator) lookup(ctx context.Context, username string) (string, *models.User, error) {
+	now := time.Now()
+
+	w.mutex.Lock()
+	entry, ok := w.cache[username]
+	w.mutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		if entry.err != nil {
+			return "", nil, entry.err
+		}
+		return entry.key, copyUser(entry.user), nil
+	}
+
+	key, user, err := w.call(ctx, username)
+	switch {
+	case err == nil:
+		w.store(username, &webhookEntry{key: key, user: copyUser(user)}, time.Duration(w.config.CacheTTL)*time.Second, now)
+	case errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrUserDisabled):
+		w.store(username, &webhookEntry{err: err}, time.Duration(w.config.NegativeTTL)*time.Second, now)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return key, user, nil
+}
+
+// store caches an answer for ttl, if ttl is positive, and drops expired
+// answers
+func (w *WebhookAuthenticator) store(username string, entry *webhookEntry, ttl time.Duration, now time.Time) {
+	if ttl <= 0 {
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for name, cached := range w.cache {
+		if now.After(cached.expires) {
+			delete(w.cache, name)
+		}
+	}
+	entry.expires = now.Add(ttl)
+	w.cache[username] = entry
+}
+
+// call asks the webhook about a user, retrying transient failures. The
+// attempts and the delays between them share ctx's deadline, so an
+// endpoint that hangs can't use up the time left for the retries.
+func (w *WebhookAuthenticator) call(ctx context.Context, username string) (string, *models.User, error) {
+	body, err := json.Marshal(webhookRequest{Username: username, Realm: w.realm})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode webhook request: %w", err)
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		key, user, retry, err := w.post(ctx, w.attemptTimeout(ctx, attempt, delay), username, body)
+		if err == nil || !retry || attempt >= w.config.Retries {
+			return key, user, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			return "", nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", nil, fmt.Errorf("webhook request failed: %w", err)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post makes one webhook request. retry reports whether a failure is
+// transient.
+func (w *WebhookAuthenticator) post(ctx context.Context, timeout time.Duration, username string, body []byte) (key string, user *models.User, retry bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", nil, false, fmt.Errorf("failed to build webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", nil, true, fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusNotFound:
+		return "", nil, false, ErrUserNotFound
+	case resp.StatusCode == http.StatusForbidden:
+		return "", nil, false, ErrUserDisabled
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return "", nil, true, fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		return "", nil, false, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	var answer webhookResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&answer); err != nil {
+		return "", nil, false, fmt.Errorf("invalid webhook response: %w", err)
+	}
+
+	var keySHA256 string
+	switch {
+	case answer.Key != "":
+		if _, err := DecodeKey(PasswordAlgorithmMD5, answer.Key); err != nil {
+			return "", nil, false, fmt.Errorf("invalid key in webhook response")
+		}
+		if answer.KeySHA256 != "" {
+			if _, err := DecodeKey(PasswordAlgorithmSHA256, answer.KeySHA256); err != nil {
+				return "", nil, false, fmt.Errorf("invalid key_sha256 in webhook response")
+			}
+		}
+		key, keySHA256 = strings.ToLower(answer.Key), strings.ToLower(answer.KeySHA256)
+	case answer.Password != "":
+		key = TURNKey(username, w.realm, answer.Password)
+		keySHA256 = TURNKeySHA256(username, w.realm, answer.Password)
+	default:
+		return "", nil, false, fmt.Errorf("webhook response has neither key nor password")
+	}
+
+	user = &models.User{
+		Username:  username,
+		KeySHA256: keySHA256,
+		Enabled:   answer.Enabled == nil || *answer.Enabled,
+		Quota:     answer.Quota,
+		Metadata:  answer.Metadata,
+	}
+	if !user.Enabled {
+		return "", nil, false, ErrUserDisabled
+	}
+
+	return key, user, false, nil
+}
+
+// attemptTimeout returns the time one attempt may take: the configured
+// timeout, or less when ctx's deadline must also leave room for the
+// attempts still to come and the delays before them. delay is the delay
+// before the next retry.
+func (w *WebhookAuthenticator) attemptTimeout(ctx context.Context, attempt int, delay time.Duration) time.Duration {
+	timeout := time.Duration(w.config.Timeout) * time.Second
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+	remaining := time.Until(deadline)
+
+	attempts := w.config.Retries - attempt + 1
+	for i := 1; i < attempts; i++ {
+		remaining -= delay
+		delay *= 2
+	}
+	if share := remaining / time.Duration(attempts); share > 0 && share < timeout {
+		return share
+	}
+	return timeout
+}
+
+// GetTURNAuthKey returns the key of an enabled user
+func (w *WebhookAuthenticator) GetTURNAuthKey(ctx context.Context, username string) (string, *models.User, error) {
+	return w.lookup(ctx, username)
+}
+
+// Authenticate verifies user credentials against the key the webhook returns
+func (w *WebhookAuthenticator) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	storedKey, user, err := w.lookup(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	key := TURNKey(username, w.realm, password)
+	if subtle.ConstantTimeCompare([]byte(storedKey), []byte(key)) != 1 {
+		return nil, fmt.Errorf("invalid password")
+	}
+
+	return user, nil
+}
+
+// CreateUser is not supported, users live in the account service
+func (w *WebhookAuthenticator) CreateUser(ctx context.Context, user *models.User, plainPassword string) error {
+	return ErrUnsupported
+}
+
+// UpdateUser is not supported, users live in the account service
+func (w *WebhookAuthenticator) UpdateUser(ctx context.Context, user *models.User) error {
+	return ErrUnsupported
+}
+
+// UpdatePassword is not supported, users live in the account service
+func (w *WebhookAuthenticator) UpdatePassword(ctx context.Context, userID string, newPassword string) error {
+	return ErrUnsupported
+}
+
+// DeleteUser is not supported, users live in the account service
+func (w *WebhookAuthenticator) DeleteUser(ctx context.Context, userID string) error {
+	return ErrUnsupported
+}
+
+// GetUser is not supported, the webhook is only queried by username
+func (w *WebhookAuthenticator) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	return nil, ErrUnsupported
+}
+
+// GetUserByUsername is not supported, the webhook only answers for enabled
+// users with their keys
+func (w *WebhookAuthenticator) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	return nil, ErrUnsupported
+}
+
+// ListUsers is not supported, users live in the account service
+func (w *WebhookAuthenticator) ListUsers(ctx context.Context, offset, limit int) ([]*models.User, error) {
+	return nil, ErrUnsupported
+}
+
+// Ping checks the webhook's health_url, if one is configured
+func (w *WebhookAuthenticator) Ping(ctx context.Context) error {
+	if w.config.HealthURL == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(w.config.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.config.HealthURL, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range w.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Close releases idle connections to the webhook
+func (w *WebhookAuthenticator) Close(ctx context.Context) error {
+	w.client.CloseIdleConnections()
+	return nil
+}
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/spf13/viper"
@@ -10,7 +12,9 @@ import (
 // Config holds all configuration for the application
 type Config struct {
 	Server   ServerConfig   `mapstructure:"server"`
+	Auth     AuthConfig     `mapstructure:"auth"`
 	MongoDB  MongoDBConfig  `mapstructure:"mongodb"`
+	SQL      SQLConfig      `mapstructure:"sql"`
 	Logging  LoggingConfig  `mapstructure:"logging"`
 	Security SecurityConfig `mapstructure:"security"`
 }
@@ -24,43 +28,276 @@ type ServerConfig struct {
 
 // STUNConfig holds STUN server configuration
 type STUNConfig struct {
-	Port    int    `mapstructure:"port"`
+	Port      int                 `mapstructure:"port"`
+	Address   string              `mapstructure:"address"`
+	TCP       bool                `mapstructure:"tcp"`
+	TLS       TLSConfig           `mapstructure:"tls"`
+	Alternate STUNAlternateConfig `mapstructure:"alternate"`
+}
+
+// TLSConfig holds the settings for a TLS listener. The listener is
+// enabled when both a certificate and a key are configured. Certificate
+// files are reloaded when they change on disk.
+type TLSConfig struct {
+	Port         int    `mapstructure:"port"`
+	CertFile     string `mapstructure:"cert_file"`
+	KeyFile      string `mapstructure:"key_file"`
+	ClientCAFile string `mapstructure:"client_ca_file"` // optional, requires client certificates
+}
+
+// Enabled reports whether a certificate and key are configured
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// STUNAlternateConfig holds the secondary IP and port used for RFC 5780
+// NAT behavior discovery. Discovery is enabled when both are set.
+type STUNAlternateConfig struct {
 	Address string `mapstructure:"address"`
+	Port    int    `mapstructure:"port"`
+}
+
+// Enabled reports whether an alternate address is configured
+func (c STUNAlternateConfig) Enabled() bool {
+	return c.Address != "" && c.Port != 0
 }
 
 // TURNConfig holds TURN server configuration
 type TURNConfig struct {
-	Port         int      `mapstructure:"port"`
-	Address      string   `mapstructure:"address"`
-	Realm        string   `mapstructure:"realm"`
-	PublicIP     string   `mapstructure:"public_ip"`
-	RelayRanges  []string `mapstructure:"relay_ranges"`
-	MaxLifetime  int      `mapstructure:"max_lifetime"`
-	DefaultTTL   int      `mapstructure:"default_ttl"`
+	Port         int             `mapstructure:"port"`
+	Address      string          `mapstructure:"address"`
+	Realm        string          `mapstructure:"realm"`
+	PublicIP     string          `mapstructure:"public_ip"`
+	IPv6         bool            `mapstructure:"ipv6"`           // listen dual-stack and relay over IPv6 too (RFC 8656 section 7.2)
+	PublicIPv6   string          `mapstructure:"public_ipv6"`    // IPv6 relayed address, discovered when empty
+	RelayRanges  []string        `mapstructure:"relay_ranges"`   // peer CIDRs clients may relay to, empty allows all
+	DenyRanges   []string        `mapstructure:"deny_ranges"`    // peer CIDRs that are always refused
+	RelayAddress string          `mapstructure:"relay_address"`  // local IP relay sockets bind to
+	RelayMinPort int             `mapstructure:"relay_min_port"` // 0 with relay_max_port 0 uses ephemeral ports
+	RelayMaxPort int             `mapstructure:"relay_max_port"`
+	TCPRelays    bool            `mapstructure:"tcp_relays"` // RFC 6062 TCP allocations for clients on TCP or TLS
+	MaxLifetime  int             `mapstructure:"max_lifetime"`
+	DefaultTTL   int             `mapstructure:"default_ttl"`
+	TLS          TLSConfig       `mapstructure:"tls"`
+	DTLS         bool            `mapstructure:"dtls"` // also serve DTLS on tls.port over UDP
+	Quota        TURNQuotaConfig `mapstructure:"quota"`
+	InstanceID   string          `mapstructure:"instance_id"` // names this server in session counts shared with others, defaults to the hostname
+	Lockout      LockoutConfig   `mapstructure:"lockout"`
+	// PasswordAlgorithms are offered to RFC 8489 clients in order of
+	// preference; "MD5" alone turns the negotiation off. The algorithm only
+	// picks the key: messages are still signed with MESSAGE-INTEGRITY, as
+	// MESSAGE-INTEGRITY-SHA256 is not supported.
+	PasswordAlgorithms []string `mapstructure:"password_algorithms"`
+	// OAuth accepts RFC 7635 access tokens in place of passwords
+	OAuth OAuthConfig `mapstructure:"oauth"`
+	// Realms are served by the same process next to Realm
+	Realms []RealmConfig `mapstructure:"realms"`
+}
+
+// RealmConfig holds a realm served next to server.turn.realm. A realm is
+// reached on its own listeners, if it has a port, or by naming it in the
+// REALM of requests sent to the default realm's listeners. Relay, quota
+// and user settings left empty are inherited from server.turn and the
+// auth backend.
+type RealmConfig struct {
+	Name         string           `mapstructure:"name"`
+	Port         int              `mapstructure:"port"` // UDP and TCP listeners of the realm, 0 for none
+	Address      string           `mapstructure:"address"`
+	TLS          TLSConfig        `mapstructure:"tls"`
+	DTLS         bool             `mapstructure:"dtls"`
+	RelayAddress string           `mapstructure:"relay_address"`
+	RelayMinPort int              `mapstructure:"relay_min_port"`
+	RelayMaxPort int              `mapstructure:"relay_max_port"`
+	RelayRanges  []string         `mapstructure:"relay_ranges"`
+	DenyRanges   []string         `mapstructure:"deny_ranges"`
+	Quota        *TURNQuotaConfig `mapstructure:"quota"`
+	Users        RealmUsersConfig `mapstructure:"users"`
+}
+
+// RealmUsersConfig selects where the users of a realm live in the
+// configured auth backend
+type RealmUsersConfig struct {
+	Collection  string `mapstructure:"collection"`   // mongodb collection, defaults to mongodb.collection
+	TenantField string `mapstructure:"tenant_field"` // mongodb field the realm's users are filtered on
+	Tenant      string `mapstructure:"tenant"`       // value of tenant_field, defaults to the realm name
+	Table       string `mapstructure:"table"`        // sql users table, defaults to sql.table
+	File        string `mapstructure:"file"`         // users file, defaults to auth.file.path
+}
+
+// TURNQuotaConfig holds the transfer cap applied to users that have a
+// quota. Usage is accumulated in quota.used_bandwidth and reset when
+// quota.reset_at passes.
+type TURNQuotaConfig struct {
+	TransferCap  int64  `mapstructure:"transfer_cap"`  // bytes per period, 0 disables the cap
+	ResetPeriod  string `mapstructure:"reset_period"`  // "daily" or "monthly"
+	SyncInterval int    `mapstructure:"sync_interval"` // seconds between usage write-backs
+}
+
+// LockoutConfig holds the brute-force protection for TURN credentials.
+// Failed authentications are counted per username and client IP, and per
+// client IP; once either reaches its threshold within the window, further
+// requests are refused for duration seconds, doubling with each repeated
+// lockout up to max_duration. A username is only locked out for the client
+// IP that failed, so others can't lock a user out everywhere.
+type LockoutConfig struct {
+	Enabled       bool     `mapstructure:"enabled"`
+	UserThreshold int      `mapstructure:"user_threshold"` // failures per username and client IP, 0 disables username lockouts
+	IPThreshold   int      `mapstructure:"ip_threshold"`   // failures per client IP, 0 disables IP lockouts
+	Window        int      `mapstructure:"window"`         // seconds failures are counted over
+	Duration      int      `mapstructure:"duration"`       // seconds of the first lockout
+	MaxDuration   int      `mapstructure:"max_duration"`   // seconds, upper bound for repeated lockouts
+	Allowlist     []string `mapstructure:"allowlist"`      // client CIDRs that are never locked out
+}
+
+// OAuthConfig holds the RFC 7635 third-party authorization of TURN
+// clients. Clients present a self-contained access token from the
+// authorization server, encrypted with a key shared with it, and sign
+// their requests with the MAC key the token carries.
+type OAuthConfig struct {
+	Enabled             bool             `mapstructure:"enabled"`
+	AuthorizationServer string           `mapstructure:"authorization_server"` // sent in THIRD-PARTY-AUTHORIZATION
+	ServerName          string           `mapstructure:"server_name"`          // tokens are bound to, defaults to the realm
+	Keys                []OAuthKeyConfig `mapstructure:"keys"`
+}
+
+// OAuthKeyConfig is a key shared with the authorization server
+type OAuthKeyConfig struct {
+	KID       string `mapstructure:"kid"`       // key ID clients send in USERNAME
+	Key       string `mapstructure:"key"`       // base64
+	Algorithm string `mapstructure:"algorithm"` // A128GCM or A256GCM
 }
 
 // HealthConfig holds health check configuration
 type HealthConfig struct {
-	Port    int    `mapstructure:"port"`
-	Address string `mapstructure:"address"`
-	Path    string `mapstructure:"path"`
+	Port       int              `mapstructure:"port"`
+	Address    string           `mapstructure:"address"`
+	Path       string           `mapstructure:"path"`
+	AdminToken string           `mapstructure:"admin_token"` // bearer token for admin endpoints, empty disables them
+	ICEServers ICEServersConfig `mapstructure:"ice_servers"`
+}
+
+// ICEServersConfig holds configuration for the endpoint that issues WebRTC
+// iceServers with TURN REST API credentials
+type ICEServersConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Token   string `mapstructure:"token"` // bearer token callers must present
+	TTL     int    `mapstructure:"ttl"`   // credential lifetime in seconds
+	Host    string `mapstructure:"host"`  // host name in URLs, defaults to the TURN public IP
+}
+
+// AuthConfig selects the user store TURN credentials are checked against
+type AuthConfig struct {
+	Backend string            `mapstructure:"backend"` // "mongodb", "sql", "file" or "webhook"
+	File    FileAuthConfig    `mapstructure:"file"`
+	Webhook WebhookAuthConfig `mapstructure:"webhook"`
+	Cache   AuthCacheConfig   `mapstructure:"cache"`
+}
+
+// AuthCacheConfig holds the settings of the cache in front of the MongoDB
+// and SQL backends
+type AuthCacheConfig struct {
+	Enabled     bool `mapstructure:"enabled"`
+	TTL         int  `mapstructure:"ttl"`          // seconds known users are cached
+	NegativeTTL int  `mapstructure:"negative_ttl"` // seconds unknown users are cached, 0 disables
+	MaxEntries  int  `mapstructure:"max_entries"`
+}
+
+// FileAuthConfig holds the settings of the static users file backend
+type FileAuthConfig struct {
+	Path   string `mapstructure:"path"`
+	Format string `mapstructure:"format"` // "yaml", "json" or "htdigest"; defaults from the extension
+}
+
+// WebhookAuthConfig holds the settings of the HTTP webhook backend
+type WebhookAuthConfig struct {
+	URL         string            `mapstructure:"url"`
+	HealthURL   string            `mapstructure:"health_url"`   // optional, checked by /health and /ready
+	Headers     map[string]string `mapstructure:"headers"`      // sent with every request, e.g. Authorization
+	Timeout     int               `mapstructure:"timeout"`      // seconds per attempt
+	Retries     int               `mapstructure:"retries"`      // extra attempts after transient failures
+	CacheTTL    int               `mapstructure:"cache_ttl"`    // seconds, 0 disables the cache
+	NegativeTTL int               `mapstructure:"negative_ttl"` // seconds 404 and 403 answers are cached, 0 disables
+	TLS         WebhookTLSConfig  `mapstructure:"tls"`
+}
+
+// WebhookTLSConfig holds the webhook client's TLS settings
+type WebhookTLSConfig struct {
+	CAFile   string `mapstructure:"ca_file"`   // optional, verifies the endpoint
+	CertFile string `mapstructure:"cert_file"` // optional client certificate for mTLS
+	KeyFile  string `mapstructure:"key_file"`
 }
 
 // MongoDBConfig holds MongoDB connection and authentication configuration
 type MongoDBConfig struct {
-	URI        string            `mapstructure:"uri"`
-	Database   string            `mapstructure:"database"`
-	Collection string            `mapstructure:"collection"`
-	Fields     MongoDBFields     `mapstructure:"fields"`
-	Options    MongoDBOptions    `mapstructure:"options"`
+	URI        string         `mapstructure:"uri"`
+	Database   string         `mapstructure:"database"`
+	Collection string         `mapstructure:"collection"`
+	Fields     MongoDBFields  `mapstructure:"fields"`
+	Options    MongoDBOptions `mapstructure:"options"`
+
+	// MigrateCredentials converts documents that keep a bcrypt hash or a
+	// TURN key in the password field to versioned credentials at startup.
+	// Off by default, as it writes to every such document; usermgr -action
+	// migrate does the same on demand.
+	MigrateCredentials bool `mapstructure:"migrate_credentials"`
+
+	// TenantField restricts the authenticator to the documents whose field
+	// of that name holds Tenant, so several realms can share a collection
+	TenantField string `mapstructure:"tenant_field"`
+	Tenant      string `mapstructure:"tenant"`
 }
 
-// MongoDBFields defines customizable field names for user authentication
+// MongoDBFields defines customizable field names for user authentication.
+// Password and KeySHA256 name the fields of documents written before
+// versioned credentials, which are read until they are migrated.
 type MongoDBFields struct {
-	Username string `mapstructure:"username"`
-	Password string `mapstructure:"password"`
-	Enabled  string `mapstructure:"enabled"`
-	Salt     string `mapstructure:"salt"`
+	Username    string `mapstructure:"username"`
+	Password    string `mapstructure:"password"`
+	Credentials string `mapstructure:"credentials"` // versioned credentials subdocument
+	Enabled     string `mapstructure:"enabled"`
+	Salt        string `mapstructure:"salt"`
+	KeySHA256   string `mapstructure:"key_sha256"` // hex SHA-256 TURN key, empty if not stored
+}
+
+// SQLConfig holds PostgreSQL or SQLite connection and authentication
+// configuration
+type SQLConfig struct {
+	Driver        string     `mapstructure:"driver"` // "postgres" or "sqlite"
+	DSN           string     `mapstructure:"dsn"`
+	Table         string     `mapstructure:"table"`
+	SessionsTable string     `mapstructure:"sessions_table"`
+	Columns       SQLColumns `mapstructure:"columns"`
+	Migrate       bool       `mapstructure:"migrate"` // create and upgrade the tables at startup, off by default
+	Options       SQLOptions `mapstructure:"options"`
+}
+
+// SQLColumns defines customizable column names for user authentication
+type SQLColumns struct {
+	ID        string `mapstructure:"id"`
+	Username  string `mapstructure:"username"`
+	Password  string `mapstructure:"password"`
+	Enabled   string `mapstructure:"enabled"`
+	Salt      string `mapstructure:"salt"`
+	KeySHA256 string `mapstructure:"key_sha256"` // hex SHA-256 TURN key, empty if not stored
+	Metadata  string `mapstructure:"metadata"`   // JSON object, empty if not stored
+	CreatedAt string `mapstructure:"created_at"` // timestamps, each empty if not stored
+	UpdatedAt string `mapstructure:"updated_at"`
+	LastLogin string `mapstructure:"last_login"`
+
+	// Quota limits, NULL for users without a quota, and live counters
+	MaxSessions     string `mapstructure:"max_sessions"`
+	MaxBandwidth    string `mapstructure:"max_bandwidth"`
+	MaxDuration     string `mapstructure:"max_duration"`
+	CurrentSessions string `mapstructure:"current_sessions"`
+	UsedBandwidth   string `mapstructure:"used_bandwidth"`
+	ResetAt         string `mapstructure:"reset_at"`
+}
+
+// SQLOptions holds SQL connection pool options
+type SQLOptions struct {
+	MaxOpenConns    int `mapstructure:"max_open_conns"`
+	MaxIdleConns    int `mapstructure:"max_idle_conns"`
+	ConnMaxLifetime int `mapstructure:"conn_max_lifetime"` // seconds
 }
 
 // MongoDBOptions holds MongoDB connection options
@@ -80,10 +317,76 @@ type LoggingConfig struct {
 
 // SecurityConfig holds security-related configuration
 type SecurityConfig struct {
-	PasswordHashCost int    `mapstructure:"password_hash_cost"`
-	SecretKey        string `mapstructure:"secret_key"`
+	PasswordHashCost int      `mapstructure:"password_hash_cost"`
+	SecretKey        string   `mapstructure:"secret_key"`
+	SecretKeys       []string `mapstructure:"secret_keys"`      // older secrets still accepted during rotation
+	RESTCredentials  bool     `mapstructure:"rest_credentials"` // accept TURN REST API "expiry:userid" credentials
+}
+
+// ForRealm returns the configuration a realm's TURN server and user store
+// run with: server.turn and the auth backend settings with the realm's
+// overrides applied. The realm's listeners are never inherited.
+func (c *Config) ForRealm(realm *RealmConfig) *Config {
+	cfg := *c
+
+	turn := c.Server.TURN
+	turn.Realm = realm.Name
+	turn.Port = realm.Port
+	turn.TLS = realm.TLS
+	turn.DTLS = realm.DTLS
+	turn.Realms = nil
+	if realm.Address != "" {
+		turn.Address = realm.Address
+	}
+	if realm.RelayAddress != "" {
+		turn.RelayAddress = realm.RelayAddress
+	}
+	if realm.RelayMinPort != 0 || realm.RelayMaxPort != 0 {
+		turn.RelayMinPort = realm.RelayMinPort
+		turn.RelayMaxPort = realm.RelayMaxPort
+	}
+	if realm.RelayRanges != nil {
+		turn.RelayRanges = realm.RelayRanges
+	}
+	if realm.DenyRanges != nil {
+		turn.DenyRanges = realm.DenyRanges
+	}
+	if realm.Quota != nil {
+		// A quota block always sets the cap, 0 lifting it for the realm
+		turn.Quota.TransferCap = realm.Quota.TransferCap
+		if realm.Quota.ResetPeriod != "" {
+			turn.Quota.ResetPeriod = realm.Quota.ResetPeriod
+		}
+		if realm.Quota.SyncInterval != 0 {
+			turn.Quota.SyncInterval = realm.Quota.SyncInterval
+		}
+	}
+	cfg.Server.TURN = turn
+
+	users := realm.Users
+	if users.Collection != "" {
+		cfg.MongoDB.Collection = users.Collection
+	}
+	if users.TenantField != "" {
+		cfg.MongoDB.TenantField = users.TenantField
+		cfg.MongoDB.Tenant = users.Tenant
+		if cfg.MongoDB.Tenant == "" {
+			cfg.MongoDB.Tenant = realm.Name
+		}
+	}
+	if users.Table != "" {
+		cfg.SQL.Table = users.Table
+	}
+	if users.File != "" {
+		cfg.Auth.File.Path = users.File
+	}
+
+	return &cfg
 }
 
+// placeholderSecretKey is the secret_key shipped in the example configuration
+const placeholderSecretKey = "your-secret-key-here"
+
 // Load loads configuration from file and environment variables
 func Load(configPath string) (*Config, error) {
 	viper.SetConfigName("config")
@@ -150,20 +453,63 @@ func Load(configPath string) (*Config, error) {
 	return &config, nil
 }
 
+// DefaultDenyRanges are the peer addresses refused unless deny_ranges is
+// configured: this host, the operator's private networks and addresses
+// that are never valid peers. Relaying into them would let any user reach
+// internal services through the server.
+var DefaultDenyRanges = []string{
+	"0.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "224.0.0.0/4", "255.255.255.255/32",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", // RFC 1918
+	"100.64.0.0/10", // RFC 6598 carrier-grade NAT
+	"::/128", "::1/128", "fe80::/10", "ff00::/8",
+	"fc00::/7", // RFC 4193 unique local
+}
+
 // setDefaults sets default configuration values
 func setDefaults() {
 	// Server defaults
 	viper.SetDefault("server.stun.port", 3478)
 	viper.SetDefault("server.stun.address", "0.0.0.0")
+	viper.SetDefault("server.stun.tcp", true)
+	viper.SetDefault("server.stun.tls.port", 5349)
 	viper.SetDefault("server.turn.port", 3479)
 	viper.SetDefault("server.turn.address", "0.0.0.0")
 	viper.SetDefault("server.turn.realm", "pion-stun-turn")
-	viper.SetDefault("server.turn.relay_ranges", []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"})
-	viper.SetDefault("server.turn.max_lifetime", 3600)
+	viper.SetDefault("server.turn.relay_ranges", []string{})
+	viper.SetDefault("server.turn.deny_ranges", DefaultDenyRanges)
+	viper.SetDefault("server.turn.relay_address", "0.0.0.0")
+	viper.SetDefault("server.turn.relay_min_port", 49152)
+	viper.SetDefault("server.turn.relay_max_port", 65535)
+	viper.SetDefault("server.turn.tcp_relays", false)
+	viper.SetDefault("server.turn.max_lifetime", 3599)
 	viper.SetDefault("server.turn.default_ttl", 600)
+	viper.SetDefault("server.turn.tls.port", 5350)
+	viper.SetDefault("server.turn.quota.transfer_cap", 0)
+	viper.SetDefault("server.turn.quota.reset_period", "monthly")
+	viper.SetDefault("server.turn.quota.sync_interval", 60)
+	viper.SetDefault("server.turn.password_algorithms", []string{"SHA-256", "MD5"})
+	viper.SetDefault("server.turn.lockout.enabled", true)
+	viper.SetDefault("server.turn.lockout.user_threshold", 10)
+	viper.SetDefault("server.turn.lockout.ip_threshold", 50)
+	viper.SetDefault("server.turn.lockout.window", 300)
+	viper.SetDefault("server.turn.lockout.duration", 60)
+	viper.SetDefault("server.turn.lockout.max_duration", 3600)
+	viper.SetDefault("server.turn.lockout.allowlist", []string{})
 	viper.SetDefault("server.health.port", 8080)
 	viper.SetDefault("server.health.address", "0.0.0.0")
 	viper.SetDefault("server.health.path", "/health")
+	viper.SetDefault("server.health.ice_servers.ttl", 86400)
+
+	// Auth defaults
+	viper.SetDefault("auth.backend", "mongodb")
+	viper.SetDefault("auth.webhook.timeout", 2)
+	viper.SetDefault("auth.webhook.retries", 2)
+	viper.SetDefault("auth.webhook.cache_ttl", 60)
+	viper.SetDefault("auth.webhook.negative_ttl", 10)
+	viper.SetDefault("auth.cache.enabled", true)
+	viper.SetDefault("auth.cache.ttl", 60)
+	viper.SetDefault("auth.cache.negative_ttl", 10)
+	viper.SetDefault("auth.cache.max_entries", 10000)
 
 	// MongoDB defaults
 	viper.SetDefault("mongodb.uri", "mongodb://localhost:27017")
@@ -171,13 +517,40 @@ func setDefaults() {
 	viper.SetDefault("mongodb.collection", "users")
 	viper.SetDefault("mongodb.fields.username", "username")
 	viper.SetDefault("mongodb.fields.password", "password")
+	viper.SetDefault("mongodb.fields.credentials", "credentials")
 	viper.SetDefault("mongodb.fields.enabled", "enabled")
 	viper.SetDefault("mongodb.fields.salt", "salt")
+	viper.SetDefault("mongodb.fields.key_sha256", "key_sha256")
+	viper.SetDefault("mongodb.migrate_credentials", false)
 	viper.SetDefault("mongodb.options.max_pool_size", 10)
 	viper.SetDefault("mongodb.options.min_pool_size", 1)
 	viper.SetDefault("mongodb.options.connect_timeout", 10)
 	viper.SetDefault("mongodb.options.server_selection_timeout", 5)
 
+	// SQL defaults
+	viper.SetDefault("sql.driver", "postgres")
+	viper.SetDefault("sql.table", "users")
+	viper.SetDefault("sql.sessions_table", "sessions")
+	viper.SetDefault("sql.columns.id", "id")
+	viper.SetDefault("sql.columns.username", "username")
+	viper.SetDefault("sql.columns.password", "password")
+	viper.SetDefault("sql.columns.enabled", "enabled")
+	viper.SetDefault("sql.columns.key_sha256", "key_sha256")
+	viper.SetDefault("sql.columns.metadata", "metadata")
+	viper.SetDefault("sql.columns.created_at", "created_at")
+	viper.SetDefault("sql.columns.updated_at", "updated_at")
+	viper.SetDefault("sql.columns.last_login", "last_login")
+	viper.SetDefault("sql.columns.max_sessions", "max_sessions")
+	viper.SetDefault("sql.columns.max_bandwidth", "max_bandwidth")
+	viper.SetDefault("sql.columns.max_duration", "max_duration")
+	viper.SetDefault("sql.columns.current_sessions", "current_sessions")
+	viper.SetDefault("sql.columns.used_bandwidth", "used_bandwidth")
+	viper.SetDefault("sql.columns.reset_at", "reset_at")
+	viper.SetDefault("sql.migrate", false)
+	viper.SetDefault("sql.options.max_open_conns", 10)
+	viper.SetDefault("sql.options.max_idle_conns", 2)
+	viper.SetDefault("sql.options.conn_max_lifetime", 300)
+
 	// Logging defaults
 	viper.SetDefault("logging.level", "info")
 	viper.SetDefault("logging.format", "json")
@@ -189,29 +562,462 @@ func setDefaults() {
 
 // validate validates the configuration
 func validate(config *Config) error {
-	if config.MongoDB.URI == "" {
+	switch config.Auth.Backend {
+	case "mongodb":
+		if err := validateMongoDB(&config.MongoDB); err != nil {
+			return err
+		}
+	case "sql":
+		if err := validateSQL(&config.SQL); err != nil {
+			return err
+		}
+	case "file":
+		if err := validateFileAuth(&config.Auth.File); err != nil {
+			return err
+		}
+	case "webhook":
+		if err := validateWebhookAuth(&config.Auth.Webhook); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid auth.backend: %q", config.Auth.Backend)
+	}
+	if err := validateAuthCache(&config.Auth.Cache); err != nil {
+		return err
+	}
+	if config.Server.STUN.Port <= 0 || config.Server.STUN.Port > 65535 {
+		return fmt.Errorf("invalid STUN port: %d", config.Server.STUN.Port)
+	}
+	if err := validateTLS("server.stun.tls", &config.Server.STUN.TLS); err != nil {
+		return err
+	}
+	if err := validateSTUNAlternate(&config.Server.STUN); err != nil {
+		return err
+	}
+	if config.Server.TURN.Port <= 0 || config.Server.TURN.Port > 65535 {
+		return fmt.Errorf("invalid TURN port: %d", config.Server.TURN.Port)
+	}
+	if err := validateCIDRs("server.turn.relay_ranges", config.Server.TURN.RelayRanges); err != nil {
+		return err
+	}
+	if err := validateCIDRs("server.turn.deny_ranges", config.Server.TURN.DenyRanges); err != nil {
+		return err
+	}
+	if config.Server.TURN.MaxLifetime <= 0 || config.Server.TURN.DefaultTTL <= 0 {
+		return fmt.Errorf("server.turn.max_lifetime and default_ttl must be positive")
+	}
+	if config.Server.TURN.DefaultTTL > config.Server.TURN.MaxLifetime {
+		return fmt.Errorf("server.turn.default_ttl must not exceed max_lifetime")
+	}
+	if err := validateTURNQuota(&config.Server.TURN.Quota); err != nil {
+		return err
+	}
+	if err := validateRelayPorts(&config.Server.TURN); err != nil {
+		return err
+	}
+	if err := validateIPv6(&config.Server.TURN); err != nil {
+		return err
+	}
+	if err := validateLockout(&config.Server.TURN.Lockout); err != nil {
+		return err
+	}
+	if err := validatePasswordAlgorithms(config.Server.TURN.PasswordAlgorithms); err != nil {
+		return err
+	}
+	if err := validateOAuth(&config.Server.TURN.OAuth); err != nil {
+		return err
+	}
+	if err := validateTLS("server.turn.tls", &config.Server.TURN.TLS); err != nil {
+		return err
+	}
+	if config.Server.TURN.DTLS && !config.Server.TURN.TLS.Enabled() {
+		return fmt.Errorf("server.turn.dtls requires server.turn.tls.cert_file and key_file")
+	}
+	if err := validateRealms(config); err != nil {
+		return err
+	}
+	if config.Security.RESTCredentials {
+		if config.Security.SecretKey == "" || config.Security.SecretKey == placeholderSecretKey {
+			return fmt.Errorf("security.rest_credentials requires a non-default security.secret_key")
+		}
+	}
+	if config.Server.Health.Port <= 0 || config.Server.Health.Port > 65535 {
+		return fmt.Errorf("invalid health port: %d", config.Server.Health.Port)
+	}
+	if ice := config.Server.Health.ICEServers; ice.Enabled {
+		if ice.Token == "" {
+			return fmt.Errorf("server.health.ice_servers.token is required")
+		}
+		if !config.Security.RESTCredentials {
+			return fmt.Errorf("server.health.ice_servers requires security.rest_credentials")
+		}
+		if ice.TTL <= 0 {
+			return fmt.Errorf("invalid server.health.ice_servers.ttl: %d", ice.TTL)
+		}
+	}
+	return nil
+}
+
+// validateMongoDB checks the settings the MongoDB backend needs
+func validateMongoDB(mongo *MongoDBConfig) error {
+	if mongo.URI == "" {
 		return fmt.Errorf("mongodb.uri is required")
 	}
-	if config.MongoDB.Database == "" {
+	if mongo.Database == "" {
 		return fmt.Errorf("mongodb.database is required")
 	}
-	if config.MongoDB.Collection == "" {
+	if mongo.Collection == "" {
 		return fmt.Errorf("mongodb.collection is required")
 	}
-	if config.MongoDB.Fields.Username == "" {
+	if mongo.Fields.Username == "" {
 		return fmt.Errorf("mongodb.fields.username is required")
 	}
-	if config.MongoDB.Fields.Password == "" {
+	if mongo.Fields.Password == "" {
 		return fmt.Errorf("mongodb.fields.password is required")
 	}
-	if config.Server.STUN.Port <= 0 || config.Server.STUN.Port > 65535 {
-		return fmt.Errorf("invalid STUN port: %d", config.Server.STUN.Port)
+	if mongo.Fields.Credentials == "" {
+		return fmt.Errorf("mongodb.fields.credentials is required")
 	}
-	if config.Server.TURN.Port <= 0 || config.Server.TURN.Port > 65535 {
-		return fmt.Errorf("invalid TURN port: %d", config.Server.TURN.Port)
+	if mongo.TenantField != "" && mongo.Tenant == "" {
+		return fmt.Errorf("mongodb.tenant is required with mongodb.tenant_field")
 	}
-	if config.Server.Health.Port <= 0 || config.Server.Health.Port > 65535 {
-		return fmt.Errorf("invalid health port: %d", config.Server.Health.Port)
+	return nil
+}
+
+// validateSQL checks the settings the SQL backend needs
+func validateSQL(sql *SQLConfig) error {
+	if sql.Driver != "postgres" && sql.Driver != "sqlite" {
+		return fmt.Errorf("invalid sql.driver: %q", sql.Driver)
+	}
+	if sql.DSN == "" {
+		return fmt.Errorf("sql.dsn is required")
+	}
+	if sql.Table == "" {
+		return fmt.Errorf("sql.table is required")
+	}
+	if sql.SessionsTable == "" {
+		return fmt.Errorf("sql.sessions_table is required")
+	}
+	if sql.Columns.Username == "" {
+		return fmt.Errorf("sql.columns.username is required")
+	}
+	if sql.Columns.Password == "" {
+		return fmt.Errorf("sql.columns.password is required")
+	}
+	return nil
+}
+
+// validateFileAuth checks the settings of the users file backend
+func validateFileAuth(file *FileAuthConfig) error {
+	if file.Path == "" {
+		return fmt.Errorf("auth.file.path is required")
+	}
+	switch file.Format {
+	case "", "yaml", "json", "htdigest":
+		return nil
+	default:
+		return fmt.Errorf("invalid auth.file.format: %q", file.Format)
+	}
+}
+
+// validateAuthCache checks the auth cache settings
+func validateAuthCache(cache *AuthCacheConfig) error {
+	if !cache.Enabled {
+		return nil
+	}
+	if cache.TTL <= 0 {
+		return fmt.Errorf("auth.cache.ttl must be positive")
+	}
+	if cache.NegativeTTL < 0 {
+		return fmt.Errorf("auth.cache.negative_ttl must not be negative")
+	}
+	if cache.MaxEntries <= 0 {
+		return fmt.Errorf("auth.cache.max_entries must be positive")
+	}
+	return nil
+}
+
+// validateWebhookAuth checks the settings of the webhook backend
+func validateWebhookAuth(webhook *WebhookAuthConfig) error {
+	if !strings.HasPrefix(webhook.URL, "http://") && !strings.HasPrefix(webhook.URL, "https://") {
+		return fmt.Errorf("auth.webhook.url must be an http or https URL")
+	}
+	if webhook.Timeout <= 0 {
+		return fmt.Errorf("auth.webhook.timeout must be positive")
+	}
+	if webhook.Retries < 0 {
+		return fmt.Errorf("auth.webhook.retries must not be negative")
+	}
+	if webhook.CacheTTL < 0 {
+		return fmt.Errorf("auth.webhook.cache_ttl must not be negative")
+	}
+	if webhook.NegativeTTL < 0 {
+		return fmt.Errorf("auth.webhook.negative_ttl must not be negative")
+	}
+	if (webhook.TLS.CertFile == "") != (webhook.TLS.KeyFile == "") {
+		return fmt.Errorf("auth.webhook.tls.cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+// validateTURNQuota checks the transfer cap settings
+func validateTURNQuota(quota *TURNQuotaConfig) error {
+	if quota.TransferCap < 0 {
+		return fmt.Errorf("server.turn.quota.transfer_cap must not be negative")
+	}
+	if quota.ResetPeriod != "daily" && quota.ResetPeriod != "monthly" {
+		return fmt.Errorf("server.turn.quota.reset_period must be \"daily\" or \"monthly\"")
+	}
+	if quota.SyncInterval <= 0 {
+		return fmt.Errorf("server.turn.quota.sync_interval must be positive")
+	}
+	return nil
+}
+
+// validatePasswordAlgorithms checks that only known algorithms are offered
+// and that MD5 stays available to clients that predate RFC 8489
+func validatePasswordAlgorithms(algorithms []string) error {
+	md5 := len(algorithms) == 0
+	for _, algorithm := range algorithms {
+		switch algorithm {
+		case "MD5":
+			md5 = true
+		case "SHA-256":
+		default:
+			return fmt.Errorf("unknown password algorithm %q in server.turn.password_algorithms", algorithm)
+		}
+	}
+	if !md5 {
+		return fmt.Errorf("server.turn.password_algorithms must include MD5")
+	}
+	return nil
+}
+
+// validateOAuth checks the keys shared with the authorization server
+func validateOAuth(oauth *OAuthConfig) error {
+	if !oauth.Enabled {
+		return nil
+	}
+	if oauth.AuthorizationServer == "" {
+		return fmt.Errorf("server.turn.oauth.authorization_server is required")
+	}
+	if len(oauth.Keys) == 0 {
+		return fmt.Errorf("server.turn.oauth.keys is required")
+	}
+
+	kids := make(map[string]bool, len(oauth.Keys))
+	for i, key := range oauth.Keys {
+		section := fmt.Sprintf("server.turn.oauth.keys[%d]", i)
+		if key.KID == "" {
+			return fmt.Errorf("%s.kid is required", section)
+		}
+		if kids[key.KID] {
+			return fmt.Errorf("%s.kid %q is already used", section, key.KID)
+		}
+		kids[key.KID] = true
+
+		size := 0
+		switch key.Algorithm {
+		case "A128GCM":
+			size = 16
+		case "A256GCM":
+			size = 32
+		default:
+			return fmt.Errorf("unknown %s.algorithm %q", section, key.Algorithm)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil || len(decoded) != size {
+			return fmt.Errorf("%s.key must be %d base64-encoded bytes for %s", section, size, key.Algorithm)
+		}
+	}
+	return nil
+}
+
+// validateLockout checks the brute-force protection settings
+func validateLockout(lockout *LockoutConfig) error {
+	if !lockout.Enabled {
+		return nil
+	}
+	if lockout.UserThreshold < 0 || lockout.IPThreshold < 0 {
+		return fmt.Errorf("server.turn.lockout thresholds must not be negative")
+	}
+	if lockout.Window <= 0 || lockout.Duration <= 0 {
+		return fmt.Errorf("server.turn.lockout.window and duration must be positive")
+	}
+	if lockout.MaxDuration < lockout.Duration {
+		return fmt.Errorf("server.turn.lockout.max_duration must not be less than duration")
+	}
+	return validateCIDRs("server.turn.lockout.allowlist", lockout.Allowlist)
+}
+
+// validateRelayPorts checks the relay bind address and port range
+func validateRelayPorts(turn *TURNConfig) error {
+	if turn.RelayAddress != "" && net.ParseIP(turn.RelayAddress) == nil {
+		return fmt.Errorf("server.turn.relay_address must be an IP address")
+	}
+	if turn.RelayMinPort == 0 && turn.RelayMaxPort == 0 {
+		return nil
+	}
+	if turn.RelayMinPort < 1 || turn.RelayMaxPort > 65535 || turn.RelayMinPort > turn.RelayMaxPort {
+		return fmt.Errorf("invalid relay port range: %d-%d", turn.RelayMinPort, turn.RelayMaxPort)
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// validateIPv6 checks that IPv6 relays have an address family to listen
+// and relay on. Dual-stack sockets bind the unspecified address, so the
+// listener and relay addresses can only name a single IPv6 address.
+func validateIPv6(turn *TURNConfig) error {
+	if turn.PublicIPv6 != "" {
+		if ip := net.ParseIP(turn.PublicIPv6); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("server.turn.public_ipv6 must be an IPv6 address")
+		}
+		if !turn.IPv6 {
+			return fmt.Errorf("server.turn.public_ipv6 requires server.turn.ipv6")
+		}
+	}
+	if !turn.IPv6 {
+		return nil
+	}
+	if ip := net.ParseIP(turn.Address); ip != nil && !ip.IsUnspecified() && ip.To4() != nil {
+		return fmt.Errorf("server.turn.ipv6 requires server.turn.address to be unspecified or an IPv6 address")
+	}
+	if ip := net.ParseIP(turn.RelayAddress); ip != nil && !ip.IsUnspecified() {
+		return fmt.Errorf("server.turn.ipv6 requires server.turn.relay_address to be unspecified")
+	}
+	return nil
+}
+
+// validateRealms checks the additional realms. Each needs a unique name,
+// listener ports no other realm uses and user settings that match the
+// auth backend; its effective TURN settings are checked like the default
+// realm's.
+func validateRealms(config *Config) error {
+	turn := &config.Server.TURN
+	names := map[string]bool{turn.Realm: true}
+	ports := map[int]string{turn.Port: "server.turn.port"}
+	if turn.TLS.Enabled() {
+		ports[turn.TLS.Port] = "server.turn.tls.port"
+	}
+
+	for i := range turn.Realms {
+		realm := &turn.Realms[i]
+		section := fmt.Sprintf("server.turn.realms[%d]", i)
+
+		if realm.Name == "" {
+			return fmt.Errorf("%s.name is required", section)
+		}
+		if names[realm.Name] {
+			return fmt.Errorf("%s.name %q is already served", section, realm.Name)
+		}
+		names[realm.Name] = true
+
+		if realm.Port < 0 || realm.Port > 65535 {
+			return fmt.Errorf("invalid %s.port: %d", section, realm.Port)
+		}
+		if err := validateTLS(section+".tls", &realm.TLS); err != nil {
+			return err
+		}
+		if realm.DTLS && !realm.TLS.Enabled() {
+			return fmt.Errorf("%s.dtls requires tls.cert_file and key_file", section)
+		}
+		if realm.TLS.Enabled() && realm.Port == 0 {
+			return fmt.Errorf("%s.tls requires a port", section)
+		}
+		listeners := map[string]int{section + ".port": realm.Port}
+		if realm.TLS.Enabled() {
+			listeners[section+".tls.port"] = realm.TLS.Port
+		}
+		for name, port := range listeners {
+			if port == 0 {
+				continue
+			}
+			if other, ok := ports[port]; ok {
+				return fmt.Errorf("%s %d is already used by %s", name, port, other)
+			}
+			ports[port] = name
+		}
+
+		users := realm.Users
+		switch {
+		case (users.Collection != "" || users.TenantField != "") && config.Auth.Backend != "mongodb":
+			return fmt.Errorf("%s.users.collection and tenant_field require auth.backend mongodb", section)
+		case users.Table != "" && config.Auth.Backend != "sql":
+			return fmt.Errorf("%s.users.table requires auth.backend sql", section)
+		case users.File != "" && config.Auth.Backend != "file":
+			return fmt.Errorf("%s.users.file requires auth.backend file", section)
+		}
+
+		effective := config.ForRealm(realm).Server.TURN
+		if err := validateCIDRs(section+".relay_ranges", effective.RelayRanges); err != nil {
+			return err
+		}
+		if err := validateCIDRs(section+".deny_ranges", effective.DenyRanges); err != nil {
+			return err
+		}
+		if err := validateRelayPorts(&effective); err != nil {
+			return fmt.Errorf("%s: %w", section, err)
+		}
+		if err := validateIPv6(&effective); err != nil {
+			return fmt.Errorf("%s: %w", section, err)
+		}
+		if err := validateTURNQuota(&effective.Quota); err != nil {
+			return fmt.Errorf("%s: %w", section, err)
+		}
+	}
+	return nil
+}
+
+// validateCIDRs checks that every entry of a list is a valid CIDR
+func validateCIDRs(section string, cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR %q in %s", cidr, section)
+		}
+	}
+	return nil
+}
+
+// validateTLS checks a TLS listener section
+func validateTLS(section string, tls *TLSConfig) error {
+	if tls.CertFile == "" && tls.KeyFile == "" {
+		return nil
+	}
+	if !tls.Enabled() {
+		return fmt.Errorf("%s requires both cert_file and key_file", section)
+	}
+	if tls.Port <= 0 || tls.Port > 65535 {
+		return fmt.Errorf("invalid %s port: %d", section, tls.Port)
+	}
+	return nil
+}
+
+// validateSTUNAlternate checks the RFC 5780 alternate address settings
+func validateSTUNAlternate(stun *STUNConfig) error {
+	alt := stun.Alternate
+	if alt.Address == "" && alt.Port == 0 {
+		return nil
+	}
+	if alt.Address == "" || alt.Port == 0 {
+		return fmt.Errorf("server.stun.alternate requires both address and port")
+	}
+	if alt.Port < 0 || alt.Port > 65535 {
+		return fmt.Errorf("invalid STUN alternate port: %d", alt.Port)
+	}
+	if alt.Port == stun.Port {
+		return fmt.Errorf("server.stun.alternate.port must differ from server.stun.port")
+	}
+
+	primaryIP := net.ParseIP(stun.Address)
+	alternateIP := net.ParseIP(alt.Address)
+	if primaryIP == nil || primaryIP.IsUnspecified() {
+		return fmt.Errorf("server.stun.address must be a specific IP when an alternate address is configured: %s", stun.Address)
+	}
+	if alternateIP == nil || alternateIP.IsUnspecified() {
+		return fmt.Errorf("invalid STUN alternate address: %s", alt.Address)
+	}
+	if primaryIP.Equal(alternateIP) {
+		return fmt.Errorf("server.stun.alternate.address must differ from server.stun.address")
+	}
+	return nil
+}
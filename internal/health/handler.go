@@ -19,7 +19,8 @@ import (
 // HealthHandler handles health check requests
 type HealthHandler struct {
 	config      *config.Config
-	auth        *auth.MongoAuthenticator
+	auth        auth.Authenticator
+	rest        *auth.RESTCredentials
 	stunServer  *server.STUNServer
 	turnServer  *server.TURNServer
 	logger      *logrus.Logger
@@ -30,7 +31,8 @@ type HealthHandler struct {
 // NewHealthHandler creates a new health handler
 func NewHealthHandler(
 	cfg *config.Config,
-	auth *auth.MongoAuthenticator,
+	auth auth.Authenticator,
+	rest *auth.RESTCredentials,
 	stunServer *server.STUNServer,
 	turnServer *server.TURNServer,
 	logger *logrus.Logger,
@@ -38,6 +40,7 @@ func NewHealthHandler(
 	return &HealthHandler{
 		config:     cfg,
 		auth:       auth,
+		rest:       rest,
 		stunServer: stunServer,
 		turnServer: turnServer,
 		logger:     logger,
@@ -45,21 +48,37 @@ func NewHealthHandler(
 	}
 }
 
-// Start starts the health check HTTP server
-func (h *HealthHandler) Start() error {
+// Handler returns the HTTP handler serving the health, credential and
+// admin endpoints
+func (h *HealthHandler) Handler() http.Handler {
 	mux := http.NewServeMux()
-	
+
 	// Health endpoints
 	mux.HandleFunc("/health", h.handleHealth)
 	mux.HandleFunc("/ready", h.handleReady)
 	mux.HandleFunc("/metrics", h.handleMetrics)
 	mux.HandleFunc("/sessions", h.handleSessions)
-	
+
+	// Credential endpoints
+	if h.config.Server.Health.ICEServers.Enabled {
+		mux.HandleFunc("/ice-servers", h.requireToken(h.config.Server.Health.ICEServers.Token, h.handleICEServers))
+	}
+
+	// Admin endpoints
+	if token := h.config.Server.Health.AdminToken; token != "" {
+		mux.HandleFunc("/lockouts", h.requireToken(token, h.handleLockouts))
+	}
+
+	return h.corsMiddleware(mux)
+}
+
+// Start starts the health check HTTP server
+func (h *HealthHandler) Start() error {
 	addr := fmt.Sprintf("%s:%d", h.config.Server.Health.Address, h.config.Server.Health.Port)
 	
 	h.httpServer = &http.Server{
 		Addr:         addr,
-		Handler:      h.corsMiddleware(mux),
+		Handler:      h.Handler(),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -101,15 +120,15 @@ func (h *HealthHandler) handleHealth(w http.ResponseWriter, r *http.Request) {
 		Services:  make(map[string]string),
 	}
 	
-	// Check MongoDB connection
+	// Check the user store
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 	
-	if err := h.checkMongoDB(ctx); err != nil {
+	if err := h.checkUserStore(ctx); err != nil {
 		status.Status = "unhealthy"
-		status.Services["mongodb"] = "unhealthy: " + err.Error()
+		status.Services[h.config.Auth.Backend] = "unhealthy: " + err.Error()
 	} else {
-		status.Services["mongodb"] = "healthy"
+		status.Services[h.config.Auth.Backend] = "healthy"
 	}
 	
 	// Check STUN server
@@ -147,12 +166,12 @@ func (h *HealthHandler) handleReady(w http.ResponseWriter, r *http.Request) {
 	ready := true
 	services := make(map[string]string)
 	
-	// Check MongoDB
-	if err := h.checkMongoDB(ctx); err != nil {
+	// Check the user store
+	if err := h.checkUserStore(ctx); err != nil {
 		ready = false
-		services["mongodb"] = "not ready: " + err.Error()
+		services[h.config.Auth.Backend] = "not ready: " + err.Error()
 	} else {
-		services["mongodb"] = "ready"
+		services[h.config.Auth.Backend] = "ready"
 	}
 	
 	// Check servers
@@ -207,12 +226,48 @@ func (h *HealthHandler) handleSessions(w http.ResponseWriter, r *http.Request) {
 	h.writeJSONResponse(w, http.StatusOK, response)
 }
 
-// checkMongoDB checks MongoDB connection health
-func (h *HealthHandler) checkMongoDB(ctx context.Context) error {
-	// Try to perform a simple operation to check connectivity
-	// This is a simplified check - you might want to implement a proper ping
-	_, err := h.auth.ListUsers(ctx, 0, 1)
-	return err
+// handleLockouts lists the usernames and client IPs with failed TURN
+// authentications on GET, and clears them on DELETE. DELETE takes optional
+// "kind" ("username" or "ip") and "key" query parameters; without them
+// every record is cleared.
+func (h *HealthHandler) handleLockouts(w http.ResponseWriter, r *http.Request) {
+	if h.turnServer == nil {
+		h.writeJSONResponse(w, http.StatusServiceUnavailable, map[string]string{"error": "TURN server not running"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		lockouts := h.turnServer.Lockouts()
+		h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+			"lockouts":  lockouts,
+			"count":     len(lockouts),
+			"timestamp": time.Now(),
+		})
+	case http.MethodDelete:
+		kind := r.URL.Query().Get("kind")
+		if kind != "" && kind != server.LockoutUsername && kind != server.LockoutIP {
+			h.writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "kind must be \"username\" or \"ip\""})
+			return
+		}
+		cleared := h.turnServer.ClearLockout(kind, r.URL.Query().Get("key"))
+		h.logger.WithFields(logrus.Fields{
+			"kind":    kind,
+			"key":     r.URL.Query().Get("key"),
+			"cleared": cleared,
+		}).Info("Cleared TURN lockouts")
+		h.writeJSONResponse(w, http.StatusOK, map[string]int{"cleared": cleared})
+	default:
+		h.writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// checkUserStore checks that the configured user store is reachable
+func (h *HealthHandler) checkUserStore(ctx context.Context) error {
+	if h.auth == nil {
+		return fmt.Errorf("no user store configured")
+	}
+	return h.auth.Ping(ctx)
 }
 
 // getMetrics returns server metrics
@@ -0,0 +1,140 @@
+package health
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ICEServer is one entry of a WebRTC RTCConfiguration.iceServers array
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEServersResponse is returned by the /ice-servers endpoint
+type ICEServersResponse struct {
+	ICEServers []ICEServer `json:"iceServers"`
+	TTL        int         `json:"ttl"`
+	ExpiresAt  time.Time   `json:"expires_at"`
+}
+
+// requireToken rejects requests that don't carry the given bearer token
+func (h *HealthHandler) requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + token)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		provided := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(provided, expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			h.writeJSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleICEServers issues short-lived TURN REST API credentials together
+// with the STUN and TURN URLs this server is actually listening on. The
+// optional "user" query parameter is embedded in the TURN username.
+func (h *HealthHandler) handleICEServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeJSONResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	host := h.advertisedHost()
+	if host == "" {
+		h.writeJSONResponse(w, http.StatusServiceUnavailable, map[string]string{"error": "public address not known yet"})
+		return
+	}
+
+	userID := r.URL.Query().Get("user")
+	if userID == "" {
+		var err error
+		if userID, err = randomUserID(); err != nil {
+			h.logger.WithError(err).Error("Failed to generate ICE server user ID")
+			h.writeJSONResponse(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+			return
+		}
+	}
+	if strings.Contains(userID, ":") {
+		h.writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "user must not contain ':'"})
+		return
+	}
+
+	ttl := h.config.Server.Health.ICEServers.TTL
+	username, password, expiresAt := h.rest.Generate(userID, time.Duration(ttl)*time.Second)
+
+	h.logger.WithField("user", userID).Debug("Issued ICE server credentials")
+
+	h.writeJSONResponse(w, http.StatusOK, &ICEServersResponse{
+		ICEServers: []ICEServer{
+			{URLs: h.stunURLs(host)},
+			{URLs: h.turnURLs(host), Username: username, Credential: password},
+		},
+		TTL:       ttl,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// advertisedHost returns the host placed in the URLs: the configured host
+// name, or the TURN server's public IP
+func (h *HealthHandler) advertisedHost() string {
+	if host := h.config.Server.Health.ICEServers.Host; host != "" {
+		return host
+	}
+	if h.turnServer != nil {
+		if ip := h.turnServer.PublicIP(); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// stunURLs lists the stun: URLs for the STUN server
+func (h *HealthHandler) stunURLs(host string) []string {
+	return []string{fmt.Sprintf("stun:%s", hostPort(host, h.config.Server.STUN.Port))}
+}
+
+// turnURLs lists the turn: and turns: URLs for every enabled TURN transport
+func (h *HealthHandler) turnURLs(host string) []string {
+	turnCfg := h.config.Server.TURN
+	plain := hostPort(host, turnCfg.Port)
+
+	urls := []string{
+		fmt.Sprintf("turn:%s?transport=udp", plain),
+		fmt.Sprintf("turn:%s?transport=tcp", plain),
+	}
+
+	if turnCfg.TLS.Enabled() {
+		secure := hostPort(host, turnCfg.TLS.Port)
+		urls = append(urls, fmt.Sprintf("turns:%s?transport=tcp", secure))
+		if turnCfg.DTLS {
+			urls = append(urls, fmt.Sprintf("turns:%s?transport=udp", secure))
+		}
+	}
+
+	return urls
+}
+
+// hostPort joins a host and port, bracketing IPv6 literals
+func hostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// randomUserID generates an opaque user ID for anonymous callers
+func randomUserID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate user ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
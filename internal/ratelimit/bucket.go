@@ -0,0 +1,115 @@
+// Package ratelimit limits the bandwidth users relay through the TURN server
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MinBurst lets a bucket pass at least one maximum-size datagram even when
+// the configured rate is lower than that per second
+const MinBurst = 65535
+
+// TokenBucket limits a user's relayed traffic, in both directions and
+// across all of the user's allocations, to MaxBandwidth bytes per second.
+// It allows bursts of up to one second's worth of traffic.
+type TokenBucket struct {
+	mu        sync.Mutex
+	now       func() time.Time
+	rate      float64 // bytes per second
+	burst     float64
+	tokens    float64
+	last      time.Time    // tokens were last refilled
+	used      time.Time    // tokens were last taken
+	throttled atomic.Int64 // packets dropped
+}
+
+// NewTokenBucket creates a full bucket for the given rate
+func NewTokenBucket(bytesPerSecond int64) *TokenBucket {
+	return NewTokenBucketWithClock(bytesPerSecond, time.Now)
+}
+
+// NewTokenBucketWithClock creates a full bucket that refills by the time
+// now returns instead of the wall clock
+func NewTokenBucketWithClock(bytesPerSecond int64, now func() time.Time) *TokenBucket {
+	b := &TokenBucket{now: now, last: now()}
+	b.used = b.last
+	b.SetRate(bytesPerSecond)
+	b.tokens = b.burst
+	return b
+}
+
+// SetRate changes the rate, e.g. when a user's quota was edited
+func (b *TokenBucket) SetRate(bytesPerSecond int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = float64(bytesPerSecond)
+	b.burst = b.rate
+	if b.burst < MinBurst {
+		b.burst = MinBurst
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Allow takes n bytes worth of tokens, or counts the packet as throttled
+// and returns false if there aren't enough
+func (b *TokenBucket) Allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.used = b.last
+	if b.tokens < float64(n) {
+		b.throttled.Add(1)
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Reserve takes n bytes worth of tokens, going into debt when there aren't
+// enough, and returns how long the caller has to wait for the debt to be
+// paid off. Streams are slowed down this way rather than losing data.
+func (b *TokenBucket) Reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.used = b.last
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Throttled returns the number of packets Allow refused
+func (b *TokenBucket) Throttled() int64 {
+	return b.throttled.Load()
+}
+
+// Idle reports whether nothing has been taken from the bucket for at least
+// d and it has refilled since, paying off any debt. Dropping an idle bucket
+// and creating a new one later doesn't hand the user any extra tokens.
+func (b *TokenBucket) Idle(d time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return b.tokens >= b.burst && b.last.Sub(b.used) >= d
+}
+
+// refill adds the tokens earned since the bucket was last used. Callers
+// hold mu.
+func (b *TokenBucket) refill() {
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
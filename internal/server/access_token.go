@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// RFC 7635 attributes pion/stun has no names for
+const (
+	attrAccessToken             stun.AttrType = 0x001B // ACCESS-TOKEN
+	attrThirdPartyAuthorization stun.AttrType = 0x802E // THIRD-PARTY-AUTHORIZATION
+)
+
+// newAccessTokens creates the validator of the access tokens accepted by a
+// realm
+func newAccessTokens(cfg *config.OAuthConfig, realm string) (*auth.AccessTokens, error) {
+	serverName := cfg.ServerName
+	if serverName == "" {
+		serverName = realm
+	}
+
+	keys := make([]auth.AccessTokenKey, 0, len(cfg.Keys))
+	for _, key := range cfg.Keys {
+		decoded, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid oauth key %s: %w", key.KID, err)
+		}
+		keys = append(keys, auth.AccessTokenKey{KID: key.KID, Algorithm: key.Algorithm, Key: decoded})
+	}
+	return auth.NewAccessTokens(serverName, keys)
+}
+
+// isKeyID reports whether a username is the key ID of access tokens.
+// Every client of the authorization server shares one, so it is never
+// locked out.
+func (t *TURNServer) isKeyID(username string) bool {
+	return t.tokens != nil && t.tokens.HasKey(username)
+}
+
+// tokenKey resolves the MAC key of a client authorized by an access token:
+// the one in the request's ACCESS-TOKEN or, for requests without one such
+// as CreatePermission, the one the client's last token granted. ok is false
+// for requests that use long-term credentials.
+func (t *TURNServer) tokenKey(kid string, srcAddr net.Addr) (key []byte, user *models.User, ok bool, err error) {
+	token, ok, err := t.accessToken(kid, srcAddr)
+	if !ok || err != nil {
+		return nil, nil, ok, err
+	}
+	return token.MACKey, &models.User{Username: kid, Enabled: true}, true, nil
+}
+
+// accessToken does the work of tokenKey
+func (t *TURNServer) accessToken(kid string, srcAddr net.Addr) (*auth.AccessToken, bool, error) {
+	if t.tokens == nil {
+		return nil, false, nil
+	}
+
+	if inflight := t.inflightMessageFrom(srcAddr); inflight != nil {
+		if value, err := inflight.msg.Get(attrAccessToken); err == nil {
+			token, err := t.tokens.Validate(kid, value)
+			return token, true, err
+		}
+	}
+
+	t.tokenGrantsMutex.Lock()
+	defer t.tokenGrantsMutex.Unlock()
+
+	grant, ok := t.tokenGrants[srcAddr.String()]
+	if !ok || grant.KID != kid {
+		return nil, false, nil
+	}
+	if time.Now().After(grant.ExpiresAt()) {
+		return nil, true, fmt.Errorf("access token expired at %s", grant.ExpiresAt().Format(time.RFC3339))
+	}
+	return grant, true, nil
+}
+
+// grantAccessToken keeps the MAC key of a request that authenticated with
+// an access token for the client's later requests
+func (t *TURNServer) grantAccessToken(kid string, srcAddr net.Addr) {
+	token, ok, err := t.accessToken(kid, srcAddr)
+	if !ok || err != nil {
+		return
+	}
+
+	t.tokenGrantsMutex.Lock()
+	t.tokenGrants[srcAddr.String()] = token
+	t.tokenGrantsMutex.Unlock()
+}
+
+// cleanupTokenGrants forgets MAC keys that have expired
+func (t *TURNServer) cleanupTokenGrants() {
+	t.tokenGrantsMutex.Lock()
+	defer t.tokenGrantsMutex.Unlock()
+
+	now := time.Now()
+	for addr, grant := range t.tokenGrants {
+		if now.After(grant.ExpiresAt()) {
+			delete(t.tokenGrants, addr)
+		}
+	}
+}
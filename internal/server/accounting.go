@@ -0,0 +1,172 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ga666666-new/pion-stun-server/internal/ratelimit"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// trafficStats counts relayed traffic. Sent is traffic from the client
+// relayed out to peers, received is traffic from peers relayed back.
+type trafficStats struct {
+	bytesSent   atomic.Int64
+	bytesRecv   atomic.Int64
+	packetsSent atomic.Int64
+	packetsRecv atomic.Int64
+	lastActive  atomic.Int64 // unix nanoseconds
+
+	packetsThrottled atomic.Int64
+}
+
+// addTo adds the counters to a session
+func (s *trafficStats) addTo(session *models.SessionInfo) {
+	session.BytesSent += s.bytesSent.Load()
+	session.BytesRecv += s.bytesRecv.Load()
+	session.PacketsSent += s.packetsSent.Load()
+	session.PacketsRecv += s.packetsRecv.Load()
+	if last := time.Unix(0, s.lastActive.Load()); last.After(session.LastActive) {
+		session.LastActive = last
+	}
+}
+
+// relayConn wraps the relay socket of one allocation and counts the traffic
+// through it, both for the allocation's session and for the server totals
+type relayConn struct {
+	net.PacketConn
+	server  *TURNServer
+	stats   trafficStats
+	session atomic.Pointer[models.SessionInfo]
+	limiter atomic.Pointer[ratelimit.TokenBucket] // set when the user has a MaxBandwidth
+	usage   atomic.Pointer[userUsage]             // set when the user's usage is written back
+	tcp     atomic.Pointer[tcpRelay]              // set when the allocation relays over TCP
+}
+
+// ReadFrom counts traffic received from peers, dropping datagrams over the
+// user's bandwidth limit. The socket of a TCP allocation relays no
+// datagrams at all.
+func (c *relayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if n > 0 && (c.tcp.Load() != nil || !c.allow(n)) {
+			continue
+		}
+		c.countRecv(n)
+		return n, addr, err
+	}
+}
+
+// countRecv counts a datagram received from a peer
+func (c *relayConn) countRecv(n int) {
+	if n > 0 {
+		c.stats.bytesRecv.Add(int64(n))
+		c.stats.packetsRecv.Add(1)
+		c.stats.lastActive.Store(time.Now().UnixNano())
+		c.server.traffic.bytesRecv.Add(int64(n))
+		c.server.traffic.packetsRecv.Add(1)
+		c.addUsage(n)
+	}
+}
+
+// WriteTo counts traffic relayed to peers. Datagrams over the user's
+// bandwidth limit are dropped as if sent, like a congested link would.
+func (c *relayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.allow(len(p)) {
+		return len(p), nil
+	}
+
+	n, err := c.PacketConn.WriteTo(p, addr)
+	c.countSent(n)
+	return n, err
+}
+
+// countSent counts a datagram relayed to a peer
+func (c *relayConn) countSent(n int) {
+	if n > 0 {
+		c.stats.bytesSent.Add(int64(n))
+		c.stats.packetsSent.Add(1)
+		c.stats.lastActive.Store(time.Now().UnixNano())
+		c.server.traffic.bytesSent.Add(int64(n))
+		c.server.traffic.packetsSent.Add(1)
+		c.addUsage(n)
+	}
+}
+
+// addUsage counts relayed bytes towards the user's transfer usage
+func (c *relayConn) addUsage(n int) {
+	if usage := c.usage.Load(); usage != nil {
+		usage.pending.Add(int64(n))
+	}
+}
+
+// allow checks a datagram against the user's bandwidth limit
+func (c *relayConn) allow(n int) bool {
+	limiter := c.limiter.Load()
+	if limiter == nil || limiter.Allow(n) {
+		return true
+	}
+	c.server.traffic.packetsThrottled.Add(1)
+	return false
+}
+
+// Close releases the relay and ends the allocation's session
+func (c *relayConn) Close() error {
+	c.server.releaseRelay(c)
+	return c.PacketConn.Close()
+}
+
+// trackRelay registers the relay socket of a new allocation. pion/turn
+// closes it when the allocation expires or is deleted.
+func (t *TURNServer) trackRelay(conn net.PacketConn) net.PacketConn {
+	relay := &relayConn{PacketConn: conn, server: t}
+
+	t.relaysMutex.Lock()
+	t.relays[relayPort(conn)] = relay
+	t.relaysMutex.Unlock()
+
+	return relay
+}
+
+// releaseRelay unregisters a relay socket
+func (t *TURNServer) releaseRelay(relay *relayConn) {
+	t.relaysMutex.Lock()
+	port := relayPort(relay)
+	if t.relays[port] != relay {
+		t.relaysMutex.Unlock()
+		return
+	}
+	delete(t.relays, port)
+	t.relaysMutex.Unlock()
+
+	if tcp := relay.tcp.Load(); tcp != nil {
+		tcp.close()
+	}
+
+	if session := relay.session.Load(); session != nil {
+		t.closeSession(session, relay)
+	}
+}
+
+// relayPort returns the local port of a relay socket
+func relayPort(conn net.PacketConn) int {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// sessionRelays returns the live relays grouped by session
+func (t *TURNServer) sessionRelays() map[*models.SessionInfo][]*relayConn {
+	t.relaysMutex.Lock()
+	defer t.relaysMutex.Unlock()
+
+	relays := make(map[*models.SessionInfo][]*relayConn)
+	for _, relay := range t.relays {
+		if session := relay.session.Load(); session != nil {
+			relays[session] = append(relays[session], relay)
+		}
+	}
+	return relays
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerACL decides which peer addresses clients may relay to. Denied ranges
+// win over allowed ranges; an empty allow list admits every address that
+// is not denied.
+type peerACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newPeerACL parses the allowed and denied CIDR lists
+func newPeerACL(allow, deny []string) (*peerACL, error) {
+	acl := &peerACL{}
+
+	var err error
+	if acl.allow, err = parseCIDRs(allow); err != nil {
+		return nil, fmt.Errorf("invalid relay_ranges: %w", err)
+	}
+	if acl.deny, err = parseCIDRs(deny); err != nil {
+		return nil, fmt.Errorf("invalid deny_ranges: %w", err)
+	}
+
+	return acl, nil
+}
+
+// Allowed reports whether clients may relay to ip
+func (a *peerACL) Allowed(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	for _, network := range a.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, network := range a.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionHandler adapts the ACL to pion/turn's permission callback
+func (a *peerACL) PermissionHandler(_ net.Addr, peerIP net.IP) bool {
+	return a.Allowed(peerIP)
+}
+
+// parseCIDRs parses a list of CIDR strings
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
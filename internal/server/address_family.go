@@ -0,0 +1,236 @@
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/pion/stun"
+)
+
+// RFC 8656 attributes pion/stun has no names for
+const (
+	attrAdditionalAddressFamily stun.AttrType = 0x8000 // ADDITIONAL-ADDRESS-FAMILY
+	attrAddressErrorCode        stun.AttrType = 0x8001 // ADDRESS-ERROR-CODE
+)
+
+// Address family values of REQUESTED-ADDRESS-FAMILY and friends
+const (
+	familyValueIPv4 = 0x01
+	familyValueIPv6 = 0x02
+)
+
+// addressFamilies is the set of address families an allocation relays
+type addressFamilies uint8
+
+const (
+	familyIPv4 addressFamilies = 1 << iota
+	familyIPv6
+)
+
+// errAddressFamily marks a malformed address family request
+var errAddressFamily = errors.New("invalid address family request")
+
+// allows reports whether a peer address is of a family the allocation has
+func (f addressFamilies) allows(ip net.IP) bool {
+	if ip.To4() != nil {
+		return f&familyIPv4 != 0
+	}
+	return f&familyIPv6 != 0
+}
+
+// resolvePublicIPv6 returns the IPv6 relayed address: the configured one,
+// the default realm's, or one discovered over IPv6. Without one the server
+// only relays over IPv4.
+func (t *TURNServer) resolvePublicIPv6() net.IP {
+	if !t.config.IPv6 {
+		return nil
+	}
+	if t.config.PublicIPv6 != "" {
+		return net.ParseIP(t.config.PublicIPv6)
+	}
+	if t.publicIPv6 != nil {
+		return t.publicIPv6
+	}
+
+	discovered, err := discoverPublicIP("udp6", t.logger)
+	if err != nil {
+		t.logger.WithError(err).Warn("Failed to discover public IPv6 address, relaying over IPv4 only")
+		return nil
+	}
+	t.logger.WithField("ip", discovered.String()).Info("Discovered public IPv6 address")
+	return discovered
+}
+
+// requestedFamilies reads the address families an Allocate request asks
+// for (RFC 8656 section 7.2). It returns the families the allocation gets,
+// those it asked for but can't have, and the error code to refuse it with
+// when it can't be served at all.
+func (t *TURNServer) requestedFamilies(msg *stun.Message) (granted, unavailable addressFamilies, code stun.ErrorCode) {
+	requested, requestedErr := msg.Get(stun.AttrRequestedAddressFamily)
+	additional, additionalErr := msg.Get(attrAdditionalAddressFamily)
+
+	switch {
+	case requestedErr == nil && additionalErr == nil:
+		return 0, 0, stun.CodeBadRequest
+	case requestedErr == nil:
+		family, err := decodeFamily(requested)
+		if err != nil {
+			return 0, 0, stun.CodeBadRequest
+		}
+		if family == familyIPv6 && t.publicIPv6 == nil {
+			return 0, 0, stun.CodeAddrFamilyNotSupported
+		}
+		return family, 0, 0
+	case additionalErr == nil:
+		family, err := decodeFamily(additional)
+		if err != nil || family != familyIPv6 {
+			return 0, 0, stun.CodeBadRequest
+		}
+		if t.publicIPv6 == nil {
+			return familyIPv4, familyIPv6, 0
+		}
+		return familyIPv4 | familyIPv6, 0, 0
+	}
+	return familyIPv4, 0, 0
+}
+
+// decodeFamily reads the family of a REQUESTED-ADDRESS-FAMILY or
+// ADDITIONAL-ADDRESS-FAMILY value
+func decodeFamily(value []byte) (addressFamilies, error) {
+	if len(value) != 4 {
+		return 0, errAddressFamily
+	}
+	switch value[0] {
+	case familyValueIPv4:
+		return familyIPv4, nil
+	case familyValueIPv6:
+		return familyIPv6, nil
+	}
+	return 0, errAddressFamily
+}
+
+// rewriteRelayedAddresses gives a successful Allocate response the relayed
+// addresses of the families the request was granted. pion/turn only knows
+// the IPv4 address; the dual-stack relay socket serves the IPv6 one on the
+// same port. A family that could not be granted is reported in
+// ADDRESS-ERROR-CODE. The response is signed again with the user's key.
+func (t *TURNServer) rewriteRelayedAddresses(msg *stun.Message, client net.Addr) (*stun.Message, error) {
+	inflight := t.inflightMessageFrom(client)
+	if inflight == nil || inflight.key == nil || inflight.families == 0 ||
+		(inflight.families == familyIPv4 && inflight.unavailable == 0) {
+		return msg, nil
+	}
+
+	var relayed stun.XORMappedAddress
+	if err := relayed.GetFromAs(msg, stun.AttrXORRelayedAddress); err != nil {
+		return msg, nil
+	}
+
+	rewritten := &stun.Message{Type: msg.Type, TransactionID: msg.TransactionID}
+	rewritten.WriteHeader()
+
+	// Copy the attributes covered by MESSAGE-INTEGRITY, minus the relayed address
+	for _, attr := range msg.Attributes {
+		if attr.Type == stun.AttrMessageIntegrity {
+			break
+		}
+		if attr.Type != stun.AttrXORRelayedAddress {
+			rewritten.Add(attr.Type, attr.Value)
+		}
+	}
+
+	var setters []stun.Setter
+	if inflight.families&familyIPv4 != 0 {
+		setters = append(setters, relayedAddress{IP: t.publicIP, Port: relayed.Port})
+	}
+	if inflight.families&familyIPv6 != 0 {
+		setters = append(setters, relayedAddress{IP: t.publicIPv6, Port: relayed.Port})
+	}
+	if inflight.unavailable&familyIPv6 != 0 {
+		setters = append(setters, addressErrorCode{family: familyValueIPv6, code: stun.CodeAddrFamilyNotSupported})
+	}
+	setters = append(setters, stun.MessageIntegrity(inflight.key))
+	if _, err := msg.Get(stun.AttrFingerprint); err == nil {
+		setters = append(setters, stun.Fingerprint)
+	}
+	for _, setter := range setters {
+		if err := setter.AddTo(rewritten); err != nil {
+			return nil, err
+		}
+	}
+
+	return rewritten, nil
+}
+
+// additionalRelayedAddress returns the second XOR-RELAYED-ADDRESS of an
+// Allocate response, the IPv6 one of a dual-stack allocation
+func additionalRelayedAddress(msg *stun.Message) (stun.XORMappedAddress, bool) {
+	var addrs []stun.XORMappedAddress
+	msg.ForEach(stun.AttrXORRelayedAddress, func(m *stun.Message) error {
+		var addr stun.XORMappedAddress
+		if err := addr.GetFromAs(m, stun.AttrXORRelayedAddress); err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+		return nil
+	})
+	if len(addrs) < 2 {
+		return stun.XORMappedAddress{}, false
+	}
+	return addrs[1], true
+}
+
+// relayedAddress is an XOR-RELAYED-ADDRESS attribute
+type relayedAddress stun.XORMappedAddress
+
+// AddTo adds the attribute to a message
+func (a relayedAddress) AddTo(m *stun.Message) error {
+	addr := stun.XORMappedAddress(a)
+	return addr.AddToAs(m, stun.AttrXORRelayedAddress)
+}
+
+// addressErrorCode is an ADDRESS-ERROR-CODE attribute: the error that kept
+// one of the requested families from being allocated
+type addressErrorCode struct {
+	family byte
+	code   stun.ErrorCode
+}
+
+// AddTo adds the attribute to a message
+func (a addressErrorCode) AddTo(m *stun.Message) error {
+	value := []byte{a.family, 0, byte(a.code / 100), byte(a.code % 100)}
+	value = append(value, "Address Family not Supported"...)
+	m.Add(attrAddressErrorCode, value)
+	return nil
+}
+
+// allocationFamilies returns the address families of a client's
+// allocation, zero if it holds none
+func (t *TURNServer) allocationFamilies(client net.Addr) addressFamilies {
+	t.sessionsMutex.RLock()
+	defer t.sessionsMutex.RUnlock()
+	return t.families[client.String()]
+}
+
+// mismatchedPeer returns the first XOR-PEER-ADDRESS of a family the
+// client's allocation has no relayed address for, or nil
+func (t *TURNServer) mismatchedPeer(msg *stun.Message, client net.Addr) net.IP {
+	families := t.allocationFamilies(client)
+	if families == 0 {
+		return nil
+	}
+
+	var mismatched net.IP
+	msg.ForEach(stun.AttrXORPeerAddress, func(m *stun.Message) error {
+		var peer stun.XORMappedAddress
+		if err := peer.GetFromAs(m, stun.AttrXORPeerAddress); err != nil {
+			return err
+		}
+		if !families.allows(peer.IP) {
+			mismatched = peer.IP
+			return errAddressFamily
+		}
+		return nil
+	})
+	return mismatched
+}
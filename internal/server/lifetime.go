@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// pionMaxLifetime is the longest lifetime pion/turn accepts in a request.
+// Anything at or above one hour silently falls back to its 10 minute default.
+const pionMaxLifetime = time.Hour - time.Second
+
+// allocationGrant tracks how long an allocation has existed and how long
+// it has been granted, so a user's total allocation time can be capped
+type allocationGrant struct {
+	start   time.Time
+	expires time.Time
+}
+
+// grantLifetime computes the lifetime granted to an Allocate or Refresh
+// request. Following RFC 8656 section 7.2 the requested lifetime is capped
+// at max_lifetime and raised to default_ttl, then cut to what remains of
+// the user's MaxDuration. A Refresh asking for zero deletes the allocation.
+func (t *TURNServer) grantLifetime(msg *stun.Message, srcAddr net.Addr, user *models.User) time.Duration {
+	maxLifetime := time.Duration(t.config.MaxLifetime) * time.Second
+	if maxLifetime <= 0 || maxLifetime > pionMaxLifetime {
+		maxLifetime = pionMaxLifetime
+	}
+	defaultTTL := time.Duration(t.config.DefaultTTL) * time.Second
+	if defaultTTL <= 0 || defaultTTL > maxLifetime {
+		defaultTTL = maxLifetime
+	}
+
+	lifetime := defaultTTL
+	if requested, ok := getLifetime(msg); ok {
+		if requested == 0 && msg.Type.Method == stun.MethodRefresh {
+			t.releaseGrant(srcAddr)
+			return 0
+		}
+		if requested > lifetime {
+			lifetime = requested
+		}
+		if lifetime > maxLifetime {
+			lifetime = maxLifetime
+		}
+	}
+
+	now := time.Now()
+	key := srcAddr.String()
+
+	t.grantsMutex.Lock()
+	defer t.grantsMutex.Unlock()
+
+	grant, ok := t.grants[key]
+	if !ok || (msg.Type.Method == stun.MethodAllocate && now.After(grant.expires)) {
+		grant = &allocationGrant{start: now}
+		t.grants[key] = grant
+	}
+
+	if user != nil && user.Quota != nil && user.Quota.MaxDuration > 0 {
+		remaining := grant.start.Add(time.Duration(user.Quota.MaxDuration) * time.Second).Sub(now)
+		if remaining < lifetime {
+			lifetime = remaining.Truncate(time.Second)
+		}
+		if lifetime <= 0 {
+			// The user's time is used up. A zero lifetime makes pion/turn
+			// delete the allocation on Refresh; a retransmitted Allocate
+			// gets a second rather than pion/turn's default.
+			if msg.Type.Method == stun.MethodRefresh {
+				delete(t.grants, key)
+				return 0
+			}
+			lifetime = time.Second
+		}
+	}
+
+	grant.expires = now.Add(lifetime)
+	return lifetime
+}
+
+// releaseGrant forgets the allocation time of a client
+func (t *TURNServer) releaseGrant(srcAddr net.Addr) {
+	t.grantsMutex.Lock()
+	delete(t.grants, srcAddr.String())
+	t.grantsMutex.Unlock()
+}
+
+// cleanupGrants forgets allocations whose lifetime has run out
+func (t *TURNServer) cleanupGrants() {
+	t.grantsMutex.Lock()
+	defer t.grantsMutex.Unlock()
+
+	now := time.Now()
+	for key, grant := range t.grants {
+		if now.After(grant.expires) {
+			delete(t.grants, key)
+		}
+	}
+}
+
+// rewriteLifetime rebuilds an authenticated request with the given
+// LIFETIME and signs it again with the user's key, so pion/turn applies the
+// server's lifetime policy instead of its own
+func rewriteLifetime(msg *stun.Message, key []byte, lifetime time.Duration) ([]byte, error) {
+	rewritten := &stun.Message{Type: msg.Type, TransactionID: msg.TransactionID}
+	rewritten.WriteHeader()
+
+	// Copy the attributes covered by MESSAGE-INTEGRITY, minus the old LIFETIME
+	for _, attr := range msg.Attributes {
+		if attr.Type == stun.AttrMessageIntegrity {
+			break
+		}
+		if attr.Type != stun.AttrLifetime {
+			rewritten.Add(attr.Type, attr.Value)
+		}
+	}
+
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(lifetime/time.Second))
+	rewritten.Add(stun.AttrLifetime, value)
+
+	setters := []stun.Setter{stun.MessageIntegrity(key)}
+	if _, err := msg.Get(stun.AttrFingerprint); err == nil {
+		setters = append(setters, stun.Fingerprint)
+	}
+	for _, setter := range setters {
+		if err := setter.AddTo(rewritten); err != nil {
+			return nil, err
+		}
+	}
+
+	return rewritten.Raw, nil
+}
+
+// getLifetime reads the LIFETIME attribute of a message
+func getLifetime(msg *stun.Message) (time.Duration, bool) {
+	value, err := msg.Get(stun.AttrLifetime)
+	if err != nil || len(value) != 4 {
+		return 0, false
+	}
+	return time.Duration(binary.BigEndian.Uint32(value)) * time.Second, true
+}
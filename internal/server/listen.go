@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+var (
+	ipv6Once      sync.Once
+	ipv6Supported bool
+)
+
+// hostSupportsIPv6 reports whether the host can open IPv6 sockets at all
+func hostSupportsIPv6() bool {
+	ipv6Once.Do(func() {
+		conn, err := net.ListenPacket("udp6", "[::1]:0")
+		if err == nil {
+			conn.Close()
+			ipv6Supported = true
+		}
+	})
+	return ipv6Supported
+}
+
+// listenAddress returns the network ("udp" or "tcp") suffixed for the
+// family a listener binds to, and its address. A specific IP is only
+// listened on in its own family. An unspecified one is listened on
+// dual-stack when dualStack is set, through an IPv6 wildcard socket that
+// Go opens with IPV6_V6ONLY cleared, and on IPv4 only otherwise or when
+// the host has no IPv6. Hostnames and an empty host are not IPs and are
+// handed to the net package as they are.
+func listenAddress(network, host string, port int, dualStack bool) (string, string) {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return network, net.JoinHostPort(host, strconv.Itoa(port))
+	case ip.IsUnspecified():
+		if dualStack && hostSupportsIPv6() {
+			return network, net.JoinHostPort("::", strconv.Itoa(port))
+		}
+		return network + "4", net.JoinHostPort("0.0.0.0", strconv.Itoa(port))
+	case ip.To4() != nil:
+		return network + "4", net.JoinHostPort(host, strconv.Itoa(port))
+	default:
+		return network + "6", net.JoinHostPort(host, strconv.Itoa(port))
+	}
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// Kinds of lockout
+const (
+	LockoutUsername = "username"
+	LockoutIP       = "ip"
+)
+
+var (
+	// errNoCredentials marks a request that carries no USERNAME or REALM,
+	// such as the first, unauthenticated Allocate
+	errNoCredentials = errors.New("request carries no credentials")
+	// errUserStore marks lookups that failed because the user store did,
+	// which says nothing about the credentials
+	errUserStore = errors.New("user store lookup failed")
+)
+
+// lockoutKey identifies the username or client IP failures are counted
+// for. Username failures are counted per client IP as well, so failures
+// from one address can't lock a user out everywhere.
+type lockoutKey struct {
+	kind string
+	key  string
+	ip   string // client IP of a username key
+}
+
+// failureRecord counts the failed authentications of one username or IP
+type failureRecord struct {
+	failures    int
+	windowStart time.Time
+	lastFailure time.Time
+	lockouts    int // lockouts so far, each one doubles the next
+	lockedUntil time.Time
+}
+
+// lockoutTracker counts failed authentications per username and client IP
+// and per client IP, and locks out those that reach their threshold within
+// the window
+type lockoutTracker struct {
+	config    *config.LockoutConfig
+	allowlist []*net.IPNet
+	mutex     sync.Mutex
+	records   map[lockoutKey]*failureRecord
+}
+
+// newLockoutTracker parses the allowlist and creates a tracker
+func newLockoutTracker(cfg *config.LockoutConfig) (*lockoutTracker, error) {
+	allowlist, err := parseCIDRs(cfg.Allowlist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lockout allowlist: %w", err)
+	}
+
+	return &lockoutTracker{
+		config:    cfg,
+		allowlist: allowlist,
+		records:   make(map[lockoutKey]*failureRecord),
+	}, nil
+}
+
+// allowed reports whether a client IP is exempt from lockouts
+func (l *lockoutTracker) allowed(ip net.IP) bool {
+	for _, network := range l.allowlist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// threshold returns the number of failures that locks out a kind of key,
+// 0 if that kind is never locked out
+func (l *lockoutTracker) threshold(kind string) int {
+	if kind == LockoutUsername {
+		return l.config.UserThreshold
+	}
+	return l.config.IPThreshold
+}
+
+// locked reports whether a key is locked out at now
+func (l *lockoutTracker) locked(key lockoutKey, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	record, ok := l.records[key]
+	return ok && now.Before(record.lockedUntil)
+}
+
+// failure counts a failed authentication. It returns the length of the
+// lockout it started, or 0 if the key is not locked out by it.
+func (l *lockoutTracker) failure(key lockoutKey, now time.Time) time.Duration {
+	threshold := l.threshold(key.kind)
+	if threshold <= 0 {
+		return 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	record, ok := l.records[key]
+	if !ok {
+		record = &failureRecord{}
+		l.records[key] = record
+	}
+	if now.Before(record.lockedUntil) {
+		return 0
+	}
+
+	window := time.Duration(l.config.Window) * time.Second
+	if now.Sub(record.windowStart) > window {
+		record.failures = 0
+		record.windowStart = now
+	}
+	record.failures++
+	record.lastFailure = now
+	if record.failures < threshold {
+		return 0
+	}
+
+	duration := time.Duration(l.config.Duration) * time.Second
+	maxDuration := time.Duration(l.config.MaxDuration) * time.Second
+	for i := 0; i < record.lockouts && duration < maxDuration; i++ {
+		duration *= 2
+	}
+	if duration > maxDuration {
+		duration = maxDuration
+	}
+
+	record.failures = 0
+	record.lockouts++
+	record.lockedUntil = now.Add(duration)
+	return duration
+}
+
+// success forgets the failures of a key
+func (l *lockoutTracker) success(key lockoutKey) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if record, ok := l.records[key]; ok && !record.lockedUntil.After(time.Now()) {
+		delete(l.records, key)
+	}
+}
+
+// cleanup forgets keys that are not locked out and have not failed for
+// max_duration, which also resets their backoff
+func (l *lockoutTracker) cleanup(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	quiet := time.Duration(l.config.MaxDuration) * time.Second
+	for key, record := range l.records {
+		if now.After(record.lockedUntil) && now.Sub(record.lastFailure) > quiet {
+			delete(l.records, key)
+		}
+	}
+}
+
+// list returns the keys with failures or lockouts on record, locked out
+// keys first
+func (l *lockoutTracker) list(now time.Time) []*models.Lockout {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	lockouts := make([]*models.Lockout, 0, len(l.records))
+	for key, record := range l.records {
+		lockout := &models.Lockout{
+			Kind:     key.kind,
+			Key:      key.key,
+			IP:       key.ip,
+			Failures: record.failures,
+			Lockouts: record.lockouts,
+		}
+		if now.Before(record.lockedUntil) {
+			lockout.LockedUntil = record.lockedUntil
+		}
+		lockouts = append(lockouts, lockout)
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		if !lockouts[i].LockedUntil.Equal(lockouts[j].LockedUntil) {
+			return lockouts[i].LockedUntil.After(lockouts[j].LockedUntil)
+		}
+		if lockouts[i].Kind != lockouts[j].Kind {
+			return lockouts[i].Kind < lockouts[j].Kind
+		}
+		if lockouts[i].Key != lockouts[j].Key {
+			return lockouts[i].Key < lockouts[j].Key
+		}
+		return lockouts[i].IP < lockouts[j].IP
+	})
+	return lockouts
+}
+
+// clear forgets the records matching kind and key, where empty matches
+// anything, and returns how many were forgotten. Clearing a username clears
+// it for every client IP.
+func (l *lockoutTracker) clear(kind, key string) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	cleared := 0
+	for k := range l.records {
+		if (kind == "" || k.kind == kind) && (key == "" || k.key == key) {
+			delete(l.records, k)
+			cleared++
+		}
+	}
+	return cleared
+}
+
+// clientIP returns the IP address of a client address
+func clientIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// lockedOut reports whether a request comes from a locked out client IP or
+// carries a username locked out for that IP. Clients that already hold an allocation
+// keep it, so a lockout can't be used to tear down someone's session.
+func (t *TURNServer) lockedOut(msg *stun.Message, srcAddr net.Addr) bool {
+	ip := clientIP(srcAddr)
+	if ip == nil || t.lockouts.allowed(ip) {
+		return false
+	}
+
+	now := time.Now()
+	locked := t.lockouts.locked(lockoutKey{kind: LockoutIP, key: ip.String()}, now)
+	if !locked {
+		var username stun.Username
+		if err := username.GetFrom(msg); err == nil && !t.isKeyID(username.String()) {
+			locked = t.lockouts.locked(lockoutKey{kind: LockoutUsername, key: username.String(), ip: ip.String()}, now)
+		}
+	}
+	return locked && !t.hasSession(srcAddr)
+}
+
+// hasSession reports whether a client address holds an allocation
+func (t *TURNServer) hasSession(client net.Addr) bool {
+	t.sessionsMutex.RLock()
+	defer t.sessionsMutex.RUnlock()
+
+	for _, session := range t.sessions {
+		if session.ClientAddr == client.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// recordAuthentication verifies a request's credentials and counts the
+// outcome against its username from that client IP and against the client
+// IP. Requests without
+// credentials and failures of the user store itself are not counted.
+func (t *TURNServer) recordAuthentication(inflight *inflightMessage, srcAddr net.Addr) {
+	username, err := t.authenticate(inflight, srcAddr)
+	if errors.Is(err, errNoCredentials) || errors.Is(err, errUserStore) {
+		return
+	}
+
+	ip := clientIP(srcAddr)
+	if ip == nil || t.lockouts.allowed(ip) {
+		return
+	}
+
+	// Access token failures only count against the client IP
+	usernameKey := lockoutKey{kind: LockoutUsername, key: username, ip: ip.String()}
+	keys := []lockoutKey{{kind: LockoutIP, key: ip.String()}}
+	if !t.isKeyID(username) {
+		keys = append([]lockoutKey{usernameKey}, keys...)
+	}
+	if err == nil {
+		t.lockouts.success(usernameKey)
+		return
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		if duration := t.lockouts.failure(key, now); duration > 0 {
+			t.logger.WithFields(logrus.Fields{
+				"kind":     key.kind,
+				"key":      key.key,
+				"client":   srcAddr.String(),
+				"duration": duration.String(),
+			}).WithError(err).Warn("Too many failed authentications, locking out")
+		}
+	}
+}
+
+// refuseRequest answers a request with an unsigned error response
+func (t *TURNServer) refuseRequest(msg *stun.Message, reply func([]byte) error, code stun.ErrorCode) {
+	response, err := stun.Build(
+		stun.NewTransactionIDSetter(msg.TransactionID),
+		stun.NewType(msg.Type.Method, stun.ClassErrorResponse),
+		code,
+		stun.Fingerprint,
+	)
+	if err != nil {
+		t.logger.WithError(err).Error("Failed to build error response")
+		return
+	}
+
+	if err := reply(response.Raw); err != nil {
+		t.logger.WithError(err).Debug("Failed to send error response")
+	}
+}
+
+// cleanupLockouts forgets failures that no longer matter
+func (t *TURNServer) cleanupLockouts() {
+	if t.lockouts != nil {
+		t.lockouts.cleanup(time.Now())
+	}
+}
+
+// Lockouts returns the usernames and client IPs with failed
+// authentications on record in every realm, locked out ones first within
+// each realm
+func (t *TURNServer) Lockouts() []*models.Lockout {
+	lockouts := []*models.Lockout{}
+	if t.lockouts != nil {
+		lockouts = t.lockouts.list(time.Now())
+		for _, lockout := range lockouts {
+			lockout.Realm = t.config.Realm
+		}
+	}
+	for _, realm := range t.realms {
+		lockouts = append(lockouts, realm.Lockouts()...)
+	}
+	return lockouts
+}
+
+// ClearLockout forgets the failures and lockout of a username or client IP
+// in every realm. Empty kind or key match any; it returns how many records
+// were cleared.
+func (t *TURNServer) ClearLockout(kind, key string) int {
+	cleared := 0
+	if t.lockouts != nil {
+		cleared = t.lockouts.clear(kind, key)
+	}
+	for _, realm := range t.realms {
+		cleared += realm.ClearLockout(kind, key)
+	}
+	return cleared
+}
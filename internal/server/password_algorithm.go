@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pion/stun"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// nonceCookie starts a nonce that carries the RFC 8489 security feature
+// set. It is followed by the base64-encoded 24-bit feature set; the one
+// used here only has the "Password algorithms" bit set.
+const (
+	nonceCookie            = "obMatJos2"
+	passwordAlgorithmsFlag = "gAAA"
+	securityNoncePrefix    = nonceCookie + passwordAlgorithmsFlag
+)
+
+// passwordAlgorithmNumbers are the registered numbers of the password
+// algorithms (RFC 8489 section 18.5)
+var passwordAlgorithmNumbers = map[string]uint16{
+	auth.PasswordAlgorithmMD5:    0x0001,
+	auth.PasswordAlgorithmSHA256: 0x0002,
+}
+
+// encodePasswordAlgorithms builds the PASSWORD-ALGORITHMS value offered to
+// clients. It returns nil when only MD5 is configured, as there is nothing
+// to negotiate then, which leaves challenges and their nonces untouched.
+func encodePasswordAlgorithms(algorithms []string) []byte {
+	onlyMD5 := true
+	for _, algorithm := range algorithms {
+		onlyMD5 = onlyMD5 && algorithm == auth.PasswordAlgorithmMD5
+	}
+	if onlyMD5 {
+		return nil
+	}
+
+	value := make([]byte, 0, 4*len(algorithms))
+	for _, algorithm := range algorithms {
+		// Neither algorithm takes parameters
+		value = binary.BigEndian.AppendUint16(value, passwordAlgorithmNumbers[algorithm])
+		value = binary.BigEndian.AppendUint16(value, 0)
+	}
+	return value
+}
+
+// decodePasswordAlgorithm reads the algorithm a PASSWORD-ALGORITHM value
+// names, if it is one of the offered ones
+func (t *TURNServer) decodePasswordAlgorithm(value []byte) (string, bool) {
+	if len(value) < 4 {
+		return "", false
+	}
+	number := binary.BigEndian.Uint16(value[0:2])
+	for offered := t.passwordAlgorithms; len(offered) >= 4; offered = offered[4:] {
+		if binary.BigEndian.Uint16(offered[0:2]) != number {
+			continue
+		}
+		for name, known := range passwordAlgorithmNumbers {
+			if known == number {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// extendChallenge adds what pion/turn doesn't know to offer to its unsigned
+// challenges. With password algorithms configured, the nonce gets the
+// security feature cookie and the algorithms are listed next to it, so RFC
+// 8489 clients know they may pick one; older clients echo the longer nonce
+// unchanged and keep using MD5. With access tokens accepted, the
+// authorization server is named in THIRD-PARTY-AUTHORIZATION.
+func (t *TURNServer) extendChallenge(msg *stun.Message, data []byte) []byte {
+	if (t.passwordAlgorithms == nil && t.tokens == nil) || msg.Type.Class != stun.ClassErrorResponse ||
+		!msg.Contains(stun.AttrNonce) || msg.Contains(stun.AttrMessageIntegrity) {
+		return data
+	}
+
+	rewritten := &stun.Message{Type: msg.Type, TransactionID: msg.TransactionID}
+	rewritten.WriteHeader()
+	for _, attr := range msg.Attributes {
+		switch {
+		case attr.Type == stun.AttrNonce && t.passwordAlgorithms != nil:
+			rewritten.Add(stun.AttrNonce, append([]byte(securityNoncePrefix), attr.Value...))
+		case attr.Type == stun.AttrFingerprint:
+		default:
+			rewritten.Add(attr.Type, attr.Value)
+		}
+	}
+	if t.passwordAlgorithms != nil {
+		rewritten.Add(stun.AttrPasswordAlgorithms, t.passwordAlgorithms)
+	}
+	if t.tokens != nil {
+		rewritten.Add(attrThirdPartyAuthorization, []byte(t.config.OAuth.AuthorizationServer))
+	}
+
+	if msg.Contains(stun.AttrFingerprint) {
+		if err := stun.Fingerprint.AddTo(rewritten); err != nil {
+			return data
+		}
+	}
+	return rewritten.Raw
+}
+
+// negotiatePasswordAlgorithm handles a request whose nonce carries the
+// security feature cookie. It verifies the request with the key of the
+// password algorithm the client picked, MD5 if it picked none, and hands
+// pion/turn, which knows nothing of RFC 8489, the request as an older
+// client would have sent it: with pion/turn's own nonce, without the
+// password algorithm attributes and signed with that same key. pion/turn
+// then signs its response with it too. It returns false, after answering
+// 400 Bad Request, when the negotiation attributes are inconsistent.
+func (t *TURNServer) negotiatePasswordAlgorithm(inflight *inflightMessage, srcAddr net.Addr, reply func([]byte) error, data []byte) ([]byte, bool) {
+	msg := inflight.msg
+
+	var nonce stun.Nonce
+	if err := nonce.GetFrom(msg); err != nil || !strings.HasPrefix(nonce.String(), securityNoncePrefix) {
+		return data, true
+	}
+
+	algorithm := auth.PasswordAlgorithmMD5
+	offered, offeredErr := msg.Get(stun.AttrPasswordAlgorithms)
+	chosen, chosenErr := msg.Get(stun.AttrPasswordAlgorithm)
+	switch {
+	case offeredErr != nil && chosenErr != nil:
+		// An RFC 5389 client echoing the nonce
+	case offeredErr != nil || chosenErr != nil || !bytes.Equal(offered, t.passwordAlgorithms):
+		t.refuseRequest(msg, reply, stun.CodeBadRequest)
+		return nil, false
+	default:
+		var ok bool
+		if algorithm, ok = t.decodePasswordAlgorithm(chosen); !ok {
+			t.refuseRequest(msg, reply, stun.CodeBadRequest)
+			return nil, false
+		}
+	}
+
+	var key []byte
+	var user *models.User
+	var username stun.Username
+	var realm stun.Realm
+	if username.GetFrom(msg) == nil && realm.GetFrom(msg) == nil {
+		var err error
+		key, user, err = t.lookupAlgorithmKey(algorithm, username.String(), realm.String(), srcAddr)
+		switch {
+		case err != nil:
+			t.logger.WithFields(logrus.Fields{
+				"username":  username.String(),
+				"algorithm": algorithm,
+				"client":    srcAddr.String(),
+			}).WithError(err).Debug("Password algorithm key lookup failed")
+		case stun.MessageIntegrity(key).Check(msg) != nil:
+			key, user = nil, nil
+		}
+	}
+
+	rewritten, err := stripPasswordAlgorithms(msg, strings.TrimPrefix(nonce.String(), securityNoncePrefix), key)
+	if err != nil {
+		t.logger.WithError(err).Error("Failed to rewrite request for pion/turn")
+		return data, true
+	}
+
+	t.inflightMutex.Lock()
+	inflight.msg = rewritten
+	if key != nil {
+		inflight.username = username.String()
+		inflight.key = key
+		inflight.user = user
+	}
+	t.inflightMutex.Unlock()
+	return rewritten.Raw, true
+}
+
+// lookupAlgorithmKey resolves a user's key for a password algorithm
+func (t *TURNServer) lookupAlgorithmKey(algorithm, username, realm string, srcAddr net.Addr) ([]byte, *models.User, error) {
+	if err := t.servesRealm(realm); err != nil {
+		return nil, nil, err
+	}
+	if algorithm == auth.PasswordAlgorithmMD5 {
+		return t.lookupKey(username, realm, srcAddr)
+	}
+
+	// An access token carries the key itself, whatever the algorithm
+	if key, user, isToken, err := t.tokenKey(username, srcAddr); isToken {
+		return key, user, err
+	}
+
+	if t.rest != nil {
+		if _, userID, isREST := auth.ParseRESTUsername(username); isREST {
+			keys, err := t.rest.KeysSHA256(username, realm)
+			if err != nil {
+				return nil, nil, err
+			}
+			key := keys[0]
+			if msg := t.inflightMessageFrom(srcAddr); msg != nil {
+				for _, candidate := range keys {
+					if stun.MessageIntegrity(candidate).Check(msg.msg) == nil {
+						key = candidate
+						break
+					}
+				}
+			}
+			return key, &models.User{Username: userID, Enabled: true}, nil
+		}
+	}
+
+	_, user, err := t.lookupKey(username, realm, srcAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.KeySHA256 == "" {
+		return nil, nil, fmt.Errorf("no %s key stored for the user", algorithm)
+	}
+	key, err := auth.DecodeKey(algorithm, user.KeySHA256)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errUserStore, err)
+	}
+	return key, user, nil
+}
+
+// stripPasswordAlgorithms rebuilds a request with the given nonce and
+// without the password algorithm attributes. With a key the request is
+// signed again; without one the original MESSAGE-INTEGRITY is kept so
+// pion/turn rejects it rather than challenging it again.
+func stripPasswordAlgorithms(msg *stun.Message, nonce string, key []byte) (*stun.Message, error) {
+	rewritten := &stun.Message{Type: msg.Type, TransactionID: msg.TransactionID}
+	rewritten.WriteHeader()
+
+	for _, attr := range msg.Attributes {
+		if attr.Type == stun.AttrMessageIntegrity {
+			if key == nil {
+				rewritten.Add(attr.Type, attr.Value)
+			}
+			break
+		}
+		switch attr.Type {
+		case stun.AttrNonce:
+			rewritten.Add(stun.AttrNonce, []byte(nonce))
+		case stun.AttrPasswordAlgorithm, stun.AttrPasswordAlgorithms:
+		default:
+			rewritten.Add(attr.Type, attr.Value)
+		}
+	}
+
+	var setters []stun.Setter
+	if key != nil {
+		setters = append(setters, stun.MessageIntegrity(key))
+	}
+	if msg.Contains(stun.AttrFingerprint) {
+		setters = append(setters, stun.Fingerprint)
+	}
+	for _, setter := range setters {
+		if err := setter.AddTo(rewritten); err != nil {
+			return nil, err
+		}
+	}
+
+	decoded := &stun.Message{Raw: rewritten.Raw}
+	if err := decoded.Decode(); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
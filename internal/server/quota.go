@@ -0,0 +1,349 @@
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/internal/ratelimit"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// defaultInstanceID names the server in shared session counts when neither
+// instance_id nor the hostname is available
+const defaultInstanceID = "turn"
+
+// limiterIdleTimeout is how long the bandwidth limiter of a user without
+// live allocations is kept once it has refilled
+const limiterIdleTimeout = 10 * time.Minute
+
+// reservationTimeout bounds how long an Allocate request may hold a
+// session slot without pion/turn answering it
+const reservationTimeout = 30 * time.Second
+
+// Session slots are acquired in the user store on the listener's read
+// loop, so a slow store is given little time. Once it has failed, the
+// server keeps to its own count for acquireBackoff before trying again.
+const (
+	acquireTimeout = 250 * time.Millisecond
+	acquireBackoff = 30 * time.Second
+)
+
+// instanceID returns the ID the server counts its sessions under in a
+// shared user store
+func instanceID(cfg *config.TURNConfig) string {
+	if cfg.InstanceID != "" {
+		return cfg.InstanceID
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return defaultInstanceID
+}
+
+// userSessions counts the live allocations of one user
+type userSessions struct {
+	count     int
+	persisted bool // the user has a quota document to keep in step
+}
+
+// sessionDelta is a session count change waiting to be written to the
+// user store
+type sessionDelta struct {
+	username string
+	delta    int
+}
+
+// sessionReservation holds a session slot for an Allocate request until
+// pion/turn has answered it
+type sessionReservation struct {
+	username   string
+	reservedAt time.Time
+	acquired   bool // the slot is counted in the user store already
+}
+
+// reserveSession claims a session slot for an authenticated Allocate
+// request. It returns false when the user already has MaxSessions
+// allocations live or reserved here, or counted in the user store by all
+// the servers sharing it. A MaxSessions of 0 means no limit, as it does for
+// the other quota fields.
+func (t *TURNServer) reserveSession(client net.Addr, user *models.User) bool {
+	if user == nil || user.Quota == nil || user.Quota.MaxSessions <= 0 {
+		return true
+	}
+
+	reservation, ok := t.reserveLocalSession(client, user)
+	if !ok || reservation == nil || t.quotas == nil {
+		return ok
+	}
+
+	key := client.String()
+	t.quotaMutex.Lock()
+	backingOff := time.Now().Before(t.acquireRetryAt)
+	t.quotaMutex.Unlock()
+	if backingOff {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), acquireTimeout)
+	acquired, err := t.quotas.AcquireSession(ctx, user.Username, t.instanceID, user.Quota.MaxSessions)
+	cancel()
+
+	t.quotaMutex.Lock()
+	defer t.quotaMutex.Unlock()
+	if err != nil {
+		// Keep to this server's own count until the store is back; the
+		// session is written back with the other counts once it opens
+		t.acquireRetryAt = time.Now().Add(acquireBackoff)
+		t.logger.WithField("username", user.Username).WithError(err).Warn("Failed to acquire session in user store, counting locally")
+		return true
+	}
+	current := t.reservations[key] == reservation
+	if !acquired {
+		if current {
+			delete(t.reservations, key)
+		}
+		return false
+	}
+	if current {
+		reservation.acquired = true
+	} else {
+		// The Allocate request was answered or timed out meanwhile
+		t.queueSessionDelta(user.Username, -1)
+	}
+	return true
+}
+
+// reserveLocalSession checks the user's sessions live or reserved on this
+// server and reserves a slot if MaxSessions allows it. The reservation is
+// nil for a retransmission of a request that holds one already.
+func (t *TURNServer) reserveLocalSession(client net.Addr, user *models.User) (*sessionReservation, bool) {
+	t.quotaMutex.Lock()
+	defer t.quotaMutex.Unlock()
+
+	key := client.String()
+	if _, ok := t.reservations[key]; ok {
+		return nil, true // retransmission
+	}
+
+	used := 0
+	if sessions, ok := t.userSessions[user.Username]; ok {
+		used = sessions.count
+	}
+	for _, reservation := range t.reservations {
+		if reservation.username == user.Username {
+			used++
+		}
+	}
+	if used >= user.Quota.MaxSessions {
+		return nil, false
+	}
+
+	reservation := &sessionReservation{username: user.Username, reservedAt: time.Now()}
+	t.reservations[key] = reservation
+	return reservation, true
+}
+
+// allocationQuotaExceeded checks a new allocation against the user's
+// transfer cap and session limit, reserving a session slot if both allow
+// it. It returns which quota was exceeded, or "" when the allocation may
+// go ahead.
+func (t *TURNServer) allocationQuotaExceeded(client net.Addr, user *models.User) string {
+	if t.overTransferCap(user) {
+		return "transfer cap"
+	}
+	if !t.reserveSession(client, user) {
+		return "session quota"
+	}
+	return ""
+}
+
+// releaseReservation gives back the slot of an Allocate request that failed
+func (t *TURNServer) releaseReservation(client net.Addr) {
+	t.quotaMutex.Lock()
+	reservation, ok := t.reservations[client.String()]
+	delete(t.reservations, client.String())
+	t.quotaMutex.Unlock()
+
+	if ok && reservation.acquired {
+		t.queueSessionDelta(reservation.username, -1)
+	}
+}
+
+// sessionOpened turns a client's reservation into a live session and
+// hands the relay the user's bandwidth limiter and usage accumulator
+func (t *TURNServer) sessionOpened(client net.Addr, user *models.User, relay *relayConn) {
+	t.quotaMutex.Lock()
+	reservation := t.reservations[client.String()]
+	delete(t.reservations, client.String())
+	sessions, ok := t.userSessions[user.Username]
+	if !ok {
+		sessions = &userSessions{}
+		t.userSessions[user.Username] = sessions
+	}
+	sessions.count++
+	sessions.persisted = user.Quota != nil && t.quotas != nil
+	// A session acquired with its reservation is counted already
+	persist := sessions.persisted && (reservation == nil || !reservation.acquired)
+	if limiter := t.userLimiter(user); limiter != nil {
+		relay.limiter.Store(limiter)
+	}
+	if usage := t.usageFor(user); usage != nil {
+		relay.usage.Store(usage)
+	}
+	t.quotaMutex.Unlock()
+
+	if persist {
+		t.queueSessionDelta(user.Username, 1)
+	}
+}
+
+// userLimiter returns the shared bandwidth limiter of a user, picking up
+// changes to MaxBandwidth. Limiters outlive the user's allocations until
+// cleanupLimiters finds them idle, so closing and reopening an allocation
+// doesn't refill the bucket or clear its debt. Callers hold quotaMutex.
+func (t *TURNServer) userLimiter(user *models.User) *ratelimit.TokenBucket {
+	if user.Quota == nil || user.Quota.MaxBandwidth <= 0 {
+		return nil
+	}
+
+	limiter, ok := t.limiters[user.Username]
+	if !ok {
+		limiter = ratelimit.NewTokenBucket(user.Quota.MaxBandwidth)
+		t.limiters[user.Username] = limiter
+	} else {
+		limiter.SetRate(user.Quota.MaxBandwidth)
+	}
+	return limiter
+}
+
+// cleanupLimiters drops the bandwidth limiters of users without live
+// allocations once they have been idle for limiterIdleTimeout
+func (t *TURNServer) cleanupLimiters() {
+	t.quotaMutex.Lock()
+	defer t.quotaMutex.Unlock()
+
+	for username, limiter := range t.limiters {
+		if _, live := t.userSessions[username]; !live && limiter.Idle(limiterIdleTimeout) {
+			delete(t.limiters, username)
+		}
+	}
+}
+
+// throttledByUser returns the packets dropped so far for each user with a
+// bandwidth limiter
+func (t *TURNServer) throttledByUser() map[string]int64 {
+	t.quotaMutex.Lock()
+	defer t.quotaMutex.Unlock()
+
+	throttled := make(map[string]int64, len(t.limiters))
+	for username, limiter := range t.limiters {
+		throttled[username] = limiter.Throttled()
+	}
+	return throttled
+}
+
+// sessionClosed releases the session slot of an ended allocation
+func (t *TURNServer) sessionClosed(username string) {
+	t.quotaMutex.Lock()
+	sessions, ok := t.userSessions[username]
+	if !ok {
+		t.quotaMutex.Unlock()
+		return
+	}
+	sessions.count--
+	persist := sessions.persisted
+	if sessions.count <= 0 {
+		delete(t.userSessions, username)
+	}
+	t.quotaMutex.Unlock()
+
+	if persist {
+		t.queueSessionDelta(username, -1)
+	}
+}
+
+// queueSessionDelta hands a session count change to persistSessionCounts
+// without blocking the TURN read loop. Callers may hold quotaMutex.
+func (t *TURNServer) queueSessionDelta(username string, delta int) {
+	select {
+	case t.sessionDeltas <- sessionDelta{username: username, delta: delta}:
+	default:
+		t.logger.WithField("username", username).Warn("Session count queue full, dropping update")
+	}
+}
+
+// persistSessionCounts writes session count changes to the user store one
+// at a time, so increments and decrements of a user land in order.
+// Increments are sessions that weren't acquired when reserved, such as
+// those of users without a session limit, so they are counted regardless
+// of MaxSessions.
+func (t *TURNServer) persistSessionCounts() {
+	for {
+		select {
+		case <-t.stopChan:
+			return
+		case change := <-t.sessionDeltas:
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			var err error
+			if change.delta > 0 {
+				_, err = t.quotas.AcquireSession(ctx, change.username, t.instanceID, 0)
+			} else {
+				err = t.quotas.ReleaseSession(ctx, change.username, t.instanceID)
+			}
+			if err != nil {
+				t.logger.WithFields(logrus.Fields{
+					"username": change.username,
+					"delta":    change.delta,
+				}).WithError(err).Warn("Failed to persist session count")
+			}
+			cancel()
+		}
+	}
+}
+
+// reconcileSessionCounts takes back the session counts this instance holds
+// in the user store. It runs while the server holds no allocations, so all
+// of them are stale: at startup, for those a previous run left behind if it
+// did not shut down cleanly, and once stopped. Counts of the other
+// instances sharing the store are left alone.
+func (t *TURNServer) reconcileSessionCounts() {
+	if t.quotas == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	released, err := t.quotas.ReleaseInstanceSessions(ctx, t.instanceID)
+	if err != nil {
+		t.logger.WithError(err).Warn("Failed to reconcile session counts")
+		return
+	}
+	if released > 0 {
+		t.logger.WithFields(logrus.Fields{
+			"users":    released,
+			"instance": t.instanceID,
+		}).Info("Released stale session counts")
+	}
+}
+
+// cleanupReservations drops reservations pion/turn never answered
+func (t *TURNServer) cleanupReservations() {
+	t.quotaMutex.Lock()
+	defer t.quotaMutex.Unlock()
+
+	now := time.Now()
+	for key, reservation := range t.reservations {
+		if now.Sub(reservation.reservedAt) > reservationTimeout {
+			delete(t.reservations, key)
+			if reservation.acquired {
+				t.queueSessionDelta(reservation.username, -1)
+			}
+		}
+	}
+}
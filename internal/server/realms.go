@@ -0,0 +1,301 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+)
+
+// routedPacketQueue is the number of datagrams a realm may have waiting
+// on the shared UDP socket before further ones are dropped
+const routedPacketQueue = 256
+
+// AddRealm adds a realm served by the same process. The realm gets its
+// own TURN server with its own user store, relay ports, peer ACL, quotas
+// and, if it has a port, listeners; it is also reachable through the
+// default realm's listeners by naming it in REALM. It must be called
+// before Start.
+func (t *TURNServer) AddRealm(cfg *config.TURNConfig, authenticator auth.Authenticator) {
+	realm := NewTURNServer(cfg, authenticator, t.rest, t.logger)
+	t.realms = append(t.realms, realm)
+}
+
+// startRealms shares the default realm's listeners with the other realms
+// and starts their servers
+func (t *TURNServer) startRealms(sharedUDP net.PacketConn, sharedStream net.Listener) error {
+	t.router = newRealmRouter(t)
+	for _, realm := range t.realms {
+		realm.routedPackets = newRoutedPacketConn(sharedUDP)
+		realm.routedStreams = newRoutedListener(sharedStream.Addr())
+		if realm.config.PublicIP == "" {
+			realm.publicIP = t.publicIP
+		}
+		if realm.config.PublicIPv6 == "" {
+			realm.publicIPv6 = t.publicIPv6
+		}
+	}
+
+	for _, realm := range t.realms {
+		if err := realm.Start(); err != nil {
+			t.stopRealms()
+			return fmt.Errorf("failed to start realm %s: %w", realm.config.Realm, err)
+		}
+	}
+	return nil
+}
+
+// stopRealms stops the servers of the other realms
+func (t *TURNServer) stopRealms() {
+	for _, realm := range t.realms {
+		if realm.server == nil {
+			continue
+		}
+		if err := realm.Stop(); err != nil {
+			t.logger.WithField("realm", realm.config.Realm).WithError(err).Warn("Failed to stop realm")
+		}
+	}
+}
+
+// cleanupRoutedClients forgets the clients of other realms that went quiet
+// on the shared listeners
+func (t *TURNServer) cleanupRoutedClients() {
+	if t.router != nil {
+		t.router.cleanup(time.Now())
+	}
+}
+
+// servesRealm checks that credentials are for the realm of this server
+func (t *TURNServer) servesRealm(realm string) error {
+	if realm != t.config.Realm {
+		return fmt.Errorf("realm %q is not served on this listener", realm)
+	}
+	return nil
+}
+
+// routePacket hands a datagram read from the default realm's UDP socket to
+// the realm its client belongs to. It returns false for the default
+// realm's own datagrams.
+func (t *TURNServer) routePacket(data []byte, client net.Addr) bool {
+	realm := t.router.route(data, client)
+	if realm == t {
+		return false
+	}
+	realm.routedPackets.deliver(data, client)
+	return true
+}
+
+// routeStream hands a connection accepted by the default realm's listeners
+// to the realm a frame names, together with that frame. It returns false
+// when the default realm keeps the connection.
+func (t *TURNServer) routeStream(frame []byte, conn *inspectingConn) bool {
+	realm := t.router.route(frame, conn.RemoteAddr())
+	if realm == t {
+		return false
+	}
+
+	conn.handedOff.Store(true)
+	realm.routedStreams.deliver(&inspectingConn{
+		Conn:      conn.Conn,
+		reader:    conn.reader,
+		inspect:   realm.inspectMessage,
+		observe:   realm.observeMessage,
+		claim:     realm.claimConnection,
+		transport: conn.transport,
+		replay:    frame,
+	})
+	return true
+}
+
+// routedClient is a client of another realm seen on the shared listeners
+type routedClient struct {
+	realm    *TURNServer
+	lastSeen time.Time
+}
+
+// realmRouter lets the default realm's listeners serve the other realms
+// too. A client is handed to the realm its requests name in REALM and
+// stays there until it names another one; clients that name none, or an
+// unknown realm, are served by the default realm. A client holding an
+// allocation is never moved.
+type realmRouter struct {
+	defaultRealm *TURNServer
+	realms       map[string]*TURNServer
+	mutex        sync.Mutex
+	clients      map[string]*routedClient // by client address, clients of other realms only
+}
+
+// newRealmRouter creates a router for the realms of a default realm server
+func newRealmRouter(defaultRealm *TURNServer) *realmRouter {
+	realms := map[string]*TURNServer{defaultRealm.config.Realm: defaultRealm}
+	for _, realm := range defaultRealm.realms {
+		realms[realm.config.Realm] = realm
+	}
+	return &realmRouter{
+		defaultRealm: defaultRealm,
+		realms:       realms,
+		clients:      make(map[string]*routedClient),
+	}
+}
+
+// route returns the realm server that handles a message from a client
+func (r *realmRouter) route(data []byte, client net.Addr) *TURNServer {
+	named := r.namedRealm(data)
+	now := time.Now()
+	key := client.String()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	current := r.defaultRealm
+	if routed, ok := r.clients[key]; ok {
+		current = routed.realm
+		routed.lastSeen = now
+	}
+	if named == nil || named == current || current.hasSession(client) {
+		return current
+	}
+
+	if named == r.defaultRealm {
+		delete(r.clients, key)
+	} else {
+		r.clients[key] = &routedClient{realm: named, lastSeen: now}
+	}
+	return named
+}
+
+// namedRealm returns the server of the realm a request names, nil if it
+// names none that is served here
+func (r *realmRouter) namedRealm(data []byte) *TURNServer {
+	if !stun.IsMessage(data) {
+		return nil
+	}
+
+	msg := &stun.Message{Raw: data}
+	if err := msg.Decode(); err != nil || msg.Type.Class != stun.ClassRequest {
+		return nil
+	}
+
+	var realm stun.Realm
+	if err := realm.GetFrom(msg); err != nil {
+		return nil
+	}
+	return r.realms[realm.String()]
+}
+
+// cleanup forgets clients that have been quiet for longer than any
+// allocation lives without a refresh
+func (r *realmRouter) cleanup(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for key, routed := range r.clients {
+		if now.Sub(routed.lastSeen) > pionMaxLifetime {
+			delete(r.clients, key)
+		}
+	}
+}
+
+// routedPacket is a datagram handed to a realm
+type routedPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// routedPacketConn is a realm's view of the default realm's UDP socket. It
+// reads the datagrams handed to the realm and writes to the shared socket,
+// which stays open when it is closed.
+type routedPacketConn struct {
+	net.PacketConn
+	packets   chan routedPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newRoutedPacketConn creates a realm's view of a shared socket
+func newRoutedPacketConn(shared net.PacketConn) *routedPacketConn {
+	return &routedPacketConn{
+		PacketConn: shared,
+		packets:    make(chan routedPacket, routedPacketQueue),
+		closed:     make(chan struct{}),
+	}
+}
+
+// deliver queues a datagram for the realm, dropping it when the realm
+// falls behind as a congested socket would
+func (c *routedPacketConn) deliver(data []byte, addr net.Addr) {
+	select {
+	case c.packets <- routedPacket{data: append([]byte{}, data...), addr: addr}:
+	default:
+	}
+}
+
+// ReadFrom returns the next datagram handed to the realm
+func (c *routedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		return copy(p, packet.data), packet.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// Close stops reading without closing the shared socket
+func (c *routedPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// routedListener is a realm's view of the default realm's stream
+// listeners. It accepts the connections handed to the realm.
+type routedListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newRoutedListener creates a realm's view of the shared listeners
+func newRoutedListener(addr net.Addr) *routedListener {
+	return &routedListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// deliver hands a connection to the realm, closing it if the realm has
+// stopped
+func (l *routedListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection handed to the realm
+func (l *routedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting without closing the shared listeners
+func (l *routedListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr returns the address of the default realm's TCP listener
+func (l *routedListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// errRelayPortsExhausted is returned when every port of the relay range is in use
+var errRelayPortsExhausted = errors.New("relay port range exhausted")
+
+// relayAddressGenerator allocates relay sockets on a fixed local address and
+// inside a fixed port range, so firewalls only need to open that range. The
+// relayed address handed to clients carries the advertised public IP rather
+// than the local one. A zero range lets the OS pick ephemeral ports.
+type relayAddressGenerator struct {
+	relayIP   net.IP // advertised in XOR-RELAYED-ADDRESS
+	address   string // local address the relay sockets bind to
+	minPort   int
+	maxPort   int
+	dualStack bool                                // relay sockets reach IPv4 and IPv6 peers alike
+	wrap      func(net.PacketConn) net.PacketConn // applied to every relay socket, may be nil
+}
+
+// newRelayAddressGenerator creates a generator for the configured range
+func newRelayAddressGenerator(relayIP net.IP, address string, minPort, maxPort int) *relayAddressGenerator {
+	if address == "" {
+		address = "0.0.0.0"
+	}
+	return &relayAddressGenerator{
+		relayIP: relayIP,
+		address: address,
+		minPort: minPort,
+		maxPort: maxPort,
+	}
+}
+
+// Validate is called by pion/turn when the server starts
+func (g *relayAddressGenerator) Validate() error {
+	switch {
+	case g.relayIP == nil:
+		return fmt.Errorf("relay address is not set")
+	case net.ParseIP(g.address) == nil:
+		return fmt.Errorf("invalid relay bind address %q", g.address)
+	case g.minPort < 0 || g.maxPort > 65535 || g.minPort > g.maxPort:
+		return fmt.Errorf("invalid relay port range %d-%d", g.minPort, g.maxPort)
+	case (g.minPort == 0) != (g.maxPort == 0):
+		return fmt.Errorf("relay port range needs both a minimum and a maximum port")
+	}
+	return nil
+}
+
+// AllocatePacketConn opens a UDP relay socket. A requested port must lie in
+// the range; otherwise the range is scanned from a random starting point so
+// that exhaustion is detected rather than guessed at.
+func (g *relayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	if requestedPort != 0 {
+		if g.minPort != 0 && (requestedPort < g.minPort || requestedPort > g.maxPort) {
+			return nil, nil, fmt.Errorf("requested relay port %d is outside %d-%d", requestedPort, g.minPort, g.maxPort)
+		}
+		return g.listenPacket(network, requestedPort)
+	}
+
+	if g.minPort == 0 {
+		return g.listenPacket(network, 0)
+	}
+
+	size := g.maxPort - g.minPort + 1
+	start := rand.Intn(size)
+	for i := 0; i < size; i++ {
+		port := g.minPort + (start+i)%size
+		conn, addr, err := g.listenPacket(network, port)
+		if err == nil {
+			return conn, addr, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("%w: all %d ports in %d-%d on %s are in use",
+		errRelayPortsExhausted, size, g.minPort, g.maxPort, g.address)
+}
+
+// AllocateConn is never called by pion/turn, which allocates a UDP relay
+// socket for TCP allocations too. The TCP side of an RFC 6062 allocation
+// is opened next to that socket, see listenStream.
+func (g *relayAddressGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	return nil, nil, fmt.Errorf("TCP relays are opened with listenStream")
+}
+
+// listenPacket binds one relay socket and rewrites its address to the
+// advertised relay IP. pion always asks for udp4; a dual-stack generator
+// binds a socket that relays to IPv6 peers too, so that one allocation can
+// carry both an IPv4 and an IPv6 relayed address on the same port.
+func (g *relayAddressGenerator) listenPacket(network string, port int) (net.PacketConn, net.Addr, error) {
+	addr := net.JoinHostPort(g.address, strconv.Itoa(port))
+	if g.dualStack {
+		network, addr = listenAddress("udp", g.address, port, true)
+	}
+
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unexpected relay address type %T", conn.LocalAddr())
+	}
+
+	relayAddr := &net.UDPAddr{IP: g.relayIP, Port: localAddr.Port}
+	if g.wrap != nil {
+		return g.wrap(conn), relayAddr, nil
+	}
+	return conn, relayAddr, nil
+}
+
+// streamAddress returns the network and local address of the TCP side of
+// the relay on a port
+func (g *relayAddressGenerator) streamAddress(port int) (string, string) {
+	if g.dualStack {
+		return listenAddress("tcp", g.address, port, true)
+	}
+	return "tcp4", net.JoinHostPort(g.address, strconv.Itoa(port))
+}
+
+// listenStream opens the listener peers connect to on a TCP allocation's
+// relayed transport address, the port of its UDP relay socket
+func (g *relayAddressGenerator) listenStream(port int) (net.Listener, error) {
+	network, addr := g.streamAddress(port)
+	config := net.ListenConfig{Control: reusePort}
+	return config.Listen(context.Background(), network, addr)
+}
+
+// dialStream connects to a peer from a TCP allocation's relayed transport
+// address
+func (g *relayAddressGenerator) dialStream(port int, peer net.Addr, timeout time.Duration) (net.Conn, error) {
+	network, addr := g.streamAddress(port)
+	local, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{LocalAddr: local, Timeout: timeout, Control: reusePort}
+	return dialer.Dial(network, peer.String())
+}
+
+// portRange describes the range for logs and stats
+func (g *relayAddressGenerator) portRange() string {
+	if g.minPort == 0 {
+		return "ephemeral"
+	}
+	return fmt.Sprintf("%d-%d", g.minPort, g.maxPort)
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package server
+
+import "syscall"
+
+// reusePort is not supported here: Connect requests fail with 447 as their
+// peer connections can't share the relay listener's port
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// observeMessage sees each message pion/turn sends to a client and follows
+// the allocation lifecycle from the responses: a successful Allocate opens
+// a session for the 5-tuple, a successful Refresh extends or ends it. The
+// session is also ended when pion/turn closes the relay on expiry.
+// Allocate responses get the relayed addresses of the families the client
+// asked for, and TCP allocations their TCP relay, whose permissions follow
+// successful CreatePermission requests. Challenges are sent on with the
+// password algorithms and the authorization server offered.
+func (t *TURNServer) observeMessage(data []byte, tuple fiveTuple) []byte {
+	if !stun.IsMessage(data) {
+		return data
+	}
+
+	msg := &stun.Message{Raw: append([]byte{}, data...)}
+	if err := msg.Decode(); err != nil {
+		return data
+	}
+
+	switch msg.Type {
+	case stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse):
+		rewritten, err := t.rewriteRelayedAddresses(msg, tuple.client)
+		if err != nil {
+			t.logger.WithError(err).Error("Failed to rewrite relayed addresses")
+		} else if rewritten != msg {
+			msg, data = rewritten, rewritten.Raw
+		}
+		if refused := t.openTCPRelay(msg, tuple.client); refused != nil {
+			t.releaseReservation(tuple.client)
+			return refused
+		}
+		t.openSession(msg, tuple)
+	case stun.NewType(stun.MethodCreatePermission, stun.ClassSuccessResponse):
+		t.recordTCPPermissions(tuple.client)
+	case stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse):
+		t.releaseReservation(tuple.client)
+	case stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse):
+		t.refreshSession(msg, tuple)
+	}
+
+	return t.extendChallenge(msg, data)
+}
+
+// openSession starts the session of a new allocation and ties it to the
+// relay socket pion/turn just created for it
+func (t *TURNServer) openSession(msg *stun.Message, tuple fiveTuple) {
+	var relayed stun.XORMappedAddress
+	if err := relayed.GetFromAs(msg, stun.AttrXORRelayedAddress); err != nil {
+		return
+	}
+
+	inflight := t.inflightMessageFrom(tuple.client)
+	if inflight == nil || inflight.user == nil {
+		t.releaseReservation(tuple.client)
+		return
+	}
+	user := inflight.user
+
+	t.relaysMutex.Lock()
+	relay, ok := t.relays[relayed.Port]
+	t.relaysMutex.Unlock()
+	if !ok {
+		t.releaseReservation(tuple.client)
+		return
+	}
+
+	now := time.Now()
+	lifetime, _ := getLifetime(msg)
+	session := &models.SessionInfo{
+		ID:         tuple.String(),
+		Username:   user.Username,
+		Realm:      t.config.Realm,
+		ClientAddr: tuple.client.String(),
+		RelayAddr:  relayed.String(),
+		StartTime:  now,
+		LastActive: now,
+		ExpiresAt:  now.Add(lifetime),
+	}
+	if additional, ok := additionalRelayedAddress(msg); ok {
+		session.RelayAddr6 = additional.String()
+	}
+	if !relay.session.CompareAndSwap(nil, session) {
+		// A retransmitted Allocate answered from pion/turn's cache
+		t.releaseReservation(tuple.client)
+		return
+	}
+
+	families := inflight.families
+	if families == 0 {
+		families = familyIPv4
+	}
+	t.sessionsMutex.Lock()
+	t.sessions[session.ID] = session
+	t.families[session.ClientAddr] = families
+	t.sessionsMutex.Unlock()
+	t.sessionOpened(tuple.client, user, relay)
+
+	t.logger.WithFields(logrus.Fields{
+		"session_id": session.ID,
+		"username":   user.Username,
+		"relay":      session.RelayAddr,
+	}).Debug("Allocation created")
+}
+
+// refreshSession extends a session's lifetime. A zero lifetime deleted the
+// allocation; the session ends when pion/turn closes the relay.
+func (t *TURNServer) refreshSession(msg *stun.Message, tuple fiveTuple) {
+	lifetime, ok := getLifetime(msg)
+	if !ok || lifetime == 0 {
+		return
+	}
+
+	t.sessionsMutex.Lock()
+	defer t.sessionsMutex.Unlock()
+
+	if session, ok := t.sessions[tuple.String()]; ok {
+		now := time.Now()
+		session.LastActive = now
+		session.ExpiresAt = now.Add(lifetime)
+	}
+}
+
+// closeSession ends the session of an allocation whose relay was closed
+func (t *TURNServer) closeSession(session *models.SessionInfo, relay *relayConn) {
+	t.sessionsMutex.Lock()
+	delete(t.sessions, session.ID)
+	delete(t.families, session.ClientAddr)
+	t.sessionsMutex.Unlock()
+	t.sessionClosed(session.Username)
+
+	if t.sessionStore != nil {
+		ended := *session
+		relay.stats.addTo(&ended)
+		select {
+		case t.endedSessions <- &ended:
+		default:
+			t.logger.WithField("session_id", session.ID).Warn("Session history queue full, dropping session")
+		}
+	}
+
+	t.logger.WithFields(logrus.Fields{
+		"session_id": session.ID,
+		"username":   session.Username,
+		"bytes_sent": relay.stats.bytesSent.Load(),
+		"bytes_recv": relay.stats.bytesRecv.Load(),
+	}).Debug("Allocation closed")
+}
+
+// recordSessions writes ended sessions to the session history as they come
+// in
+func (t *TURNServer) recordSessions() {
+	for {
+		select {
+		case <-t.stopChan:
+			return
+		case session := <-t.endedSessions:
+			t.recordSession(session)
+		}
+	}
+}
+
+// recordEndedSessions writes the sessions still queued, such as those ended
+// by shutting down
+func (t *TURNServer) recordEndedSessions() {
+	for {
+		select {
+		case session := <-t.endedSessions:
+			t.recordSession(session)
+		default:
+			return
+		}
+	}
+}
+
+// recordSession writes one ended session to the session history
+func (t *TURNServer) recordSession(session *models.SessionInfo) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := t.sessionStore.RecordSession(ctx, session); err != nil {
+		t.logger.WithField("session_id", session.ID).WithError(err).Warn("Failed to record session")
+	}
+}
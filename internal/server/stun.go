@@ -1,8 +1,10 @@
 package server
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/pion/stun"
 	"github.com/sirupsen/logrus"
@@ -10,155 +12,351 @@ import (
 	"github.com/ga666666-new/pion-stun-server/internal/config"
 )
 
+// CHANGE-REQUEST flags, see RFC 5780 section 7.2
+const (
+	changeIPFlag   = 0x04
+	changePortFlag = 0x02
+)
+
+// stunSocket is one of the UDP sockets the STUN server answers on. With NAT
+// behavior discovery enabled there are four: every combination of the
+// primary/alternate IP and the primary/alternate port.
+type stunSocket struct {
+	conn    net.PacketConn
+	altIP   bool
+	altPort bool
+}
+
 // STUNServer represents a STUN server
 type STUNServer struct {
-	config   *config.STUNConfig
-	conn     net.PacketConn
-	logger   *logrus.Logger
-	stopChan chan struct{}
+	config       *config.STUNConfig
+	sockets      [2][2]*stunSocket // indexed by [altIP][altPort]
+	listeners    []net.Listener
+	certReloader *certReloader
+	streamConns  map[net.Conn]struct{}
+	connsMutex   sync.Mutex
+	logger       *logrus.Logger
+	stopChan     chan struct{}
 }
 
 // NewSTUNServer creates a new STUN server
 func NewSTUNServer(cfg *config.STUNConfig, logger *logrus.Logger) *STUNServer {
 	return &STUNServer{
-		config:   cfg,
-		logger:   logger,
-		stopChan: make(chan struct{}),
+		config:      cfg,
+		logger:      logger,
+		streamConns: make(map[net.Conn]struct{}),
+		stopChan:    make(chan struct{}),
 	}
 }
 
 // Start starts the STUN server
 func (s *STUNServer) Start() error {
-	addr := fmt.Sprintf("%s:%d", s.config.Address, s.config.Port)
-	
-	conn, err := net.ListenPacket("udp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	combos := [][2]bool{{false, false}}
+	if s.config.Alternate.Enabled() {
+		combos = append(combos, [2]bool{false, true}, [2]bool{true, false}, [2]bool{true, true})
+	}
+
+	for _, combo := range combos {
+		network, addr := s.socketAddress(combo[0], combo[1])
+
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			s.closeSockets()
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+
+		s.sockets[index(combo[0])][index(combo[1])] = &stunSocket{
+			conn:    conn,
+			altIP:   combo[0],
+			altPort: combo[1],
+		}
+		s.logger.WithFields(logrus.Fields{
+			"address": addr,
+			"network": network,
+		}).Info("STUN server started")
+	}
+
+	if err := s.startStreamListeners(); err != nil {
+		s.closeSockets()
+		return err
+	}
+
+	for _, socket := range s.activeSockets() {
+		go s.handlePackets(socket)
 	}
-	
-	s.conn = conn
-	s.logger.WithField("address", addr).Info("STUN server started")
 
-	go s.handlePackets()
-	
 	return nil
 }
 
 // Stop stops the STUN server
 func (s *STUNServer) Stop() error {
 	close(s.stopChan)
-	
-	if s.conn != nil {
-		if err := s.conn.Close(); err != nil {
-			return fmt.Errorf("failed to close connection: %w", err)
-		}
+
+	s.closeStreams()
+	if err := s.closeSockets(); err != nil {
+		return fmt.Errorf("failed to close connection: %w", err)
 	}
-	
+
 	s.logger.Info("STUN server stopped")
 	return nil
 }
 
-// handlePackets handles incoming STUN packets
-func (s *STUNServer) handlePackets() {
+// closeSockets closes every open socket and returns the first error seen
+func (s *STUNServer) closeSockets() error {
+	var firstErr error
+	for _, socket := range s.activeSockets() {
+		if err := socket.conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// activeSockets returns the sockets that have been opened
+func (s *STUNServer) activeSockets() []*stunSocket {
+	var sockets []*stunSocket
+	for _, row := range s.sockets {
+		for _, socket := range row {
+			if socket != nil {
+				sockets = append(sockets, socket)
+			}
+		}
+	}
+	return sockets
+}
+
+// socketAddress returns the network and listen address for a
+// primary/alternate IP and port combination. An unspecified address is
+// listened on dual-stack.
+func (s *STUNServer) socketAddress(altIP, altPort bool) (string, string) {
+	host, port := s.config.Address, s.config.Port
+	if altIP {
+		host = s.config.Alternate.Address
+	}
+	if altPort {
+		port = s.config.Alternate.Port
+	}
+	return listenAddress("udp", host, port, true)
+}
+
+// handlePackets handles incoming STUN packets on a single socket
+func (s *STUNServer) handlePackets(socket *stunSocket) {
 	for {
 		select {
 		case <-s.stopChan:
 			return
 		default:
 			buffer := make([]byte, 1500) // Create new buffer for each packet
-			n, addr, err := s.conn.ReadFrom(buffer)
+			n, addr, err := socket.conn.ReadFrom(buffer)
 			if err != nil {
 				s.logger.WithError(err).Error("Failed to read packet")
 				continue
 			}
-			
+
 			// Make a copy of the data for the goroutine
 			data := make([]byte, n)
 			copy(data, buffer[:n])
-			go s.handlePacket(data, addr)
+			go s.handlePacket(data, addr, socket)
 		}
 	}
 }
 
-// handlePacket processes a single STUN packet
-func (s *STUNServer) handlePacket(data []byte, addr net.Addr) {
+// handlePacket processes a single STUN packet received over UDP
+func (s *STUNServer) handlePacket(data []byte, addr net.Addr, socket *stunSocket) {
+	response, origin := s.handleMessage(data, addr, socket)
+	if response == nil {
+		return
+	}
+
+	if _, err := origin.conn.WriteTo(response.Raw, addr); err != nil {
+		s.logger.WithField("client", addr.String()).WithError(err).Error("Failed to send response")
+	}
+}
+
+// handleMessage decodes a STUN message and returns the response to send, if
+// any, together with the UDP socket it has to leave from. socket is nil for
+// messages that arrived over TCP or TLS; those are answered on the same
+// connection.
+func (s *STUNServer) handleMessage(data []byte, addr net.Addr, socket *stunSocket) (*stun.Message, *stunSocket) {
 	logger := s.logger.WithField("client", addr.String())
-	
+
 	// Parse STUN message
 	msg := &stun.Message{
 		Raw: data,
 	}
 	if err := msg.Decode(); err != nil {
 		logger.WithError(err).Debug("Failed to parse STUN message")
-		return
+		return nil, nil
 	}
-	
+
 	logger.WithFields(logrus.Fields{
 		"type":   msg.Type.String(),
 		"length": msg.Length,
 	}).Debug("Received STUN message")
-	
+
 	// Handle different STUN message types
 	switch msg.Type.Method {
 	case stun.MethodBinding:
-		s.handleBindingRequest(msg, addr)
+		return s.handleBindingRequest(msg, addr, socket)
 	default:
 		logger.WithField("method", msg.Type.Method).Debug("Unsupported STUN method")
+		return nil, nil
 	}
 }
 
 // handleBindingRequest handles STUN binding requests
-func (s *STUNServer) handleBindingRequest(msg *stun.Message, addr net.Addr) {
+func (s *STUNServer) handleBindingRequest(msg *stun.Message, addr net.Addr, socket *stunSocket) (*stun.Message, *stunSocket) {
 	logger := s.logger.WithField("client", addr.String())
-	
+
+	// Work out which socket the response has to leave from. CHANGE-REQUEST
+	// only makes sense over UDP with an alternate address configured.
+	var change changeRequest
+	hasChange := msg.Contains(stun.AttrChangeRequest)
+	if hasChange {
+		if err := change.GetFrom(msg); err != nil {
+			logger.WithError(err).Debug("Invalid CHANGE-REQUEST attribute")
+			return s.errorResponse(msg, stun.CodeBadRequest, logger), socket
+		}
+	}
+	if hasChange && (socket == nil || !s.config.Alternate.Enabled()) {
+		// RFC 5780 section 6.1: a server without an alternate address
+		// treats CHANGE-REQUEST as an unknown attribute
+		return s.errorResponse(msg, stun.CodeUnknownAttribute, logger, stun.AttrChangeRequest), socket
+	}
+
+	origin := socket
+	if change.ChangeIP || change.ChangePort {
+		origin = s.sockets[index(socket.altIP != change.ChangeIP)][index(socket.altPort != change.ChangePort)]
+	}
+
 	// Create response message
 	response := &stun.Message{
 		Type:          stun.NewType(stun.MethodBinding, stun.ClassSuccessResponse),
 		TransactionID: msg.TransactionID,
 	}
-	
+
 	// Add XOR-MAPPED-ADDRESS attribute
 	xorAddr := &stun.XORMappedAddress{}
-	if udpAddr, ok := addr.(*net.UDPAddr); ok {
-		xorAddr.IP = udpAddr.IP
-		xorAddr.Port = udpAddr.Port
-	}
-	
+	xorAddr.IP, xorAddr.Port = addrIPPort(addr)
+
 	if err := xorAddr.AddTo(response); err != nil {
 		logger.WithError(err).Error("Failed to add XOR-MAPPED-ADDRESS")
-		return
+		return nil, nil
+	}
+
+	// Add RESPONSE-ORIGIN and OTHER-ADDRESS attributes for NAT behavior discovery
+	if socket != nil && s.config.Alternate.Enabled() {
+		originIP, originPort := addrIPPort(origin.conn.LocalAddr())
+		responseOrigin := &stun.ResponseOrigin{IP: originIP, Port: originPort}
+		if err := responseOrigin.AddTo(response); err != nil {
+			logger.WithError(err).Error("Failed to add RESPONSE-ORIGIN")
+			return nil, nil
+		}
+
+		other := s.sockets[index(!socket.altIP)][index(!socket.altPort)]
+		otherIP, otherPort := addrIPPort(other.conn.LocalAddr())
+		otherAddress := &stun.OtherAddress{IP: otherIP, Port: otherPort}
+		if err := otherAddress.AddTo(response); err != nil {
+			logger.WithError(err).Error("Failed to add OTHER-ADDRESS")
+			return nil, nil
+		}
 	}
-	
+
 	// Add SOFTWARE attribute
 	software := stun.NewSoftware("pion-stun-server/1.0")
 	if err := software.AddTo(response); err != nil {
 		logger.WithError(err).Error("Failed to add SOFTWARE attribute")
-		return
+		return nil, nil
 	}
-	
-	// Send response
+
 	response.Encode()
-	responseData := response.Raw
-	if len(responseData) == 0 {
+	if len(response.Raw) == 0 {
 		logger.Error("Failed to encode response")
-		return
-	}
-	
-	if _, err := s.conn.WriteTo(responseData, addr); err != nil {
-		logger.WithError(err).Error("Failed to send response")
-		return
+		return nil, nil
 	}
-	
+
 	logger.WithFields(logrus.Fields{
 		"mapped_ip":   xorAddr.IP.String(),
 		"mapped_port": xorAddr.Port,
 	}).Debug("Sent binding response")
+
+	return response, origin
+}
+
+// errorResponse builds a binding error response
+func (s *STUNServer) errorResponse(msg *stun.Message, code stun.ErrorCode, logger *logrus.Entry, unknown ...stun.AttrType) *stun.Message {
+	setters := []stun.Setter{
+		stun.NewTransactionIDSetter(msg.TransactionID),
+		stun.NewType(stun.MethodBinding, stun.ClassErrorResponse),
+		code,
+	}
+	if len(unknown) > 0 {
+		setters = append(setters, stun.UnknownAttributes(unknown))
+	}
+
+	response, err := stun.Build(setters...)
+	if err != nil {
+		logger.WithError(err).Error("Failed to build error response")
+		return nil
+	}
+	return response
 }
 
 // GetStats returns STUN server statistics
 func (s *STUNServer) GetStats() map[string]interface{} {
-	return map[string]interface{}{
+	stats := map[string]interface{}{
 		"status":  "running",
 		"address": fmt.Sprintf("%s:%d", s.config.Address, s.config.Port),
 	}
-}
\ No newline at end of file
+	if s.config.TCP {
+		stats["tcp_address"] = fmt.Sprintf("%s:%d", s.config.Address, s.config.Port)
+	}
+	if s.config.TLS.Enabled() {
+		stats["tls_address"] = fmt.Sprintf("%s:%d", s.config.Address, s.config.TLS.Port)
+	}
+	if s.config.Alternate.Enabled() {
+		stats["alternate_address"] = fmt.Sprintf("%s:%d", s.config.Alternate.Address, s.config.Alternate.Port)
+	}
+	return stats
+}
+
+// changeRequest represents the RFC 5780 CHANGE-REQUEST attribute
+type changeRequest struct {
+	ChangeIP   bool
+	ChangePort bool
+}
+
+// GetFrom decodes CHANGE-REQUEST from the message
+func (c *changeRequest) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrChangeRequest)
+	if err != nil {
+		return err
+	}
+	if err := stun.CheckSize(stun.AttrChangeRequest, len(v), 4); err != nil {
+		return err
+	}
+
+	flags := binary.BigEndian.Uint32(v)
+	c.ChangeIP = flags&changeIPFlag != 0
+	c.ChangePort = flags&changePortFlag != 0
+	return nil
+}
+
+// index converts a primary/alternate flag into a socket table index
+func index(alt bool) int {
+	if alt {
+		return 1
+	}
+	return 0
+}
+
+// addrIPPort extracts the IP and port from a UDP or TCP address
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
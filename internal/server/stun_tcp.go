@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	// stunHeaderSize is the fixed size of a STUN message header
+	stunHeaderSize = 20
+
+	// streamIdleTimeout closes TCP and TLS connections that stay silent this long
+	streamIdleTimeout = 60 * time.Second
+)
+
+// startStreamListeners opens the TCP and TLS listeners that are enabled
+func (s *STUNServer) startStreamListeners() error {
+	if s.config.TCP {
+		network, addr := listenAddress("tcp", s.config.Address, s.config.Port, true)
+
+		listener, err := net.Listen(network, addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on TCP %s: %w", addr, err)
+		}
+
+		s.listeners = append(s.listeners, listener)
+		s.logger.WithField("address", addr).Info("STUN TCP listener started")
+	}
+
+	if s.config.TLS.Enabled() {
+		network, addr := listenAddress("tcp", s.config.Address, s.config.TLS.Port, true)
+
+		reloader, err := newCertReloader(s.config.TLS.CertFile, s.config.TLS.KeyFile, s.logger)
+		if err != nil {
+			s.closeStreams()
+			return fmt.Errorf("failed to load STUN TLS certificate: %w", err)
+		}
+		s.certReloader = reloader
+
+		tlsConfig, err := newTLSConfig(&s.config.TLS, reloader)
+		if err != nil {
+			s.closeStreams()
+			return err
+		}
+
+		listener, err := tls.Listen(network, addr, tlsConfig)
+		if err != nil {
+			s.closeStreams()
+			return fmt.Errorf("failed to listen on TLS %s: %w", addr, err)
+		}
+
+		s.listeners = append(s.listeners, listener)
+		s.logger.WithField("address", addr).Info("STUN TLS listener started")
+	}
+
+	for _, listener := range s.listeners {
+		go s.acceptConns(listener)
+	}
+
+	return nil
+}
+
+// closeStreams closes the stream listeners and every open connection
+func (s *STUNServer) closeStreams() {
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	if s.certReloader != nil {
+		s.certReloader.Close()
+	}
+
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+
+	for conn := range s.streamConns {
+		conn.Close()
+	}
+}
+
+// acceptConns accepts connections until the listener is closed
+func (s *STUNServer) acceptConns(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.WithError(err).Error("Failed to accept connection")
+			continue
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn answers STUN requests on a TCP or TLS connection until it is
+// closed or idles out. Responses go back on the same connection, so
+// XOR-MAPPED-ADDRESS reflects the connection's source address.
+func (s *STUNServer) handleConn(conn net.Conn) {
+	s.connsMutex.Lock()
+	s.streamConns[conn] = struct{}{}
+	s.connsMutex.Unlock()
+
+	defer func() {
+		s.connsMutex.Lock()
+		delete(s.streamConns, conn)
+		s.connsMutex.Unlock()
+		conn.Close()
+	}()
+
+	logger := s.logger.WithField("client", conn.RemoteAddr().String())
+	reader := bufio.NewReader(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+
+		data, err := readStreamMessage(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.WithError(err).Debug("Closing STUN stream connection")
+			}
+			return
+		}
+
+		response, _ := s.handleMessage(data, conn.RemoteAddr(), nil)
+		if response == nil {
+			continue
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(streamIdleTimeout))
+		if _, err := conn.Write(response.Raw); err != nil {
+			logger.WithError(err).Error("Failed to send response")
+			return
+		}
+	}
+}
+
+// readStreamMessage reads one STUN message from a stream. STUN over TCP has
+// no extra framing: the length field of the header delimits messages
+// (RFC 8489 section 6.2.2), so anything that is not a STUN header means the
+// stream can't be resynchronized.
+func readStreamMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, stunHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if header[0]&0xc0 != 0 || !stun.IsMessage(header) {
+		return nil, fmt.Errorf("stream does not carry STUN messages")
+	}
+
+	length := int(binary.BigEndian.Uint16(header[2:4]))
+	data := make([]byte, stunHeaderSize+length)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[stunHeaderSize:]); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
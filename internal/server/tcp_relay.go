@@ -0,0 +1,585 @@
+package server
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/sirupsen/logrus"
+)
+
+// protoTCP is the REQUESTED-TRANSPORT of TCP allocations
+const protoTCP = 6
+
+const (
+	// peerConnectTimeout bounds how long a Connect request waits for the
+	// peer to accept the connection
+	peerConnectTimeout = 10 * time.Second
+	// connectionBindTimeout is how long a peer connection waits for the
+	// client to bind a data connection to it (RFC 6062 section 5.3)
+	connectionBindTimeout = 30 * time.Second
+	// tcpPermissionLifetime is how long a permission lets a peer connect
+	// to a TCP allocation, as pion/turn keeps them for UDP ones
+	tcpPermissionLifetime = 5 * time.Minute
+	// tcpRelayBufferSize is the most relayed in one write. It stays under
+	// ratelimit.MinBurst so that a throttled stream always makes progress.
+	tcpRelayBufferSize = 16 * 1024
+)
+
+// tcpRelay is the TCP side of an RFC 6062 allocation: the listener on its
+// relayed transport address, the permissions that let peers connect to it
+// and its connections to peers. pion/turn only knows the allocation's UDP
+// relay socket, which holds no traffic; the TCP side is closed with it.
+type tcpRelay struct {
+	server      *TURNServer
+	relay       *relayConn
+	listener    net.Listener
+	port        int
+	client      string             // client address of the control connection
+	key         []byte             // the allocation's credentials, data connections must use them too
+	control     func([]byte) error // sends on the control connection
+	mutex       sync.Mutex
+	permissions map[string]time.Time // by peer IP, when they expire
+	connecting  map[string]bool      // peer addresses of Connect requests with a live connection
+	conns       map[*peerConnection]struct{}
+	closed      bool
+}
+
+// peerConnection is a TCP connection to or from a peer. It waits for the
+// client to bind a data connection to it, then the two are relayed to each
+// other.
+type peerConnection struct {
+	id        uint32
+	relay     *tcpRelay
+	conn      net.Conn
+	peer      *net.TCPAddr
+	connected bool // opened for a Connect request, rather than by the peer
+	timer     *time.Timer
+	client    net.Conn // bound data connection, guarded by relay.mutex
+	dataAddr  string   // client address of the data connection once bound
+	closeOnce sync.Once
+}
+
+// requestsTCP reports whether an Allocate request asks for a TCP relay
+func requestsTCP(msg *stun.Message) bool {
+	value, err := msg.Get(stun.AttrRequestedTransport)
+	return err == nil && len(value) == 4 && value[0] == protoTCP
+}
+
+// isStream reports whether a client is connected over TCP or TLS
+func isStream(client net.Addr) bool {
+	_, ok := client.(*net.TCPAddr)
+	return ok
+}
+
+// tcpAllocationError checks an Allocate request for a TCP relay (RFC 6062
+// section 5.1). It returns the error code to refuse it with, 0 when it
+// may go ahead.
+func (t *TURNServer) tcpAllocationError(msg *stun.Message, client net.Addr) stun.ErrorCode {
+	switch {
+	case !t.config.TCPRelays:
+		return stun.CodeUnsupportedTransProto
+	case !isStream(client):
+		return stun.CodeBadRequest
+	case msg.Contains(stun.AttrDontFragment), msg.Contains(stun.AttrEvenPort), msg.Contains(stun.AttrReservationToken):
+		return stun.CodeBadRequest
+	}
+	return 0
+}
+
+// openTCPRelay opens the TCP side of a TCP allocation pion/turn just
+// answered, on the port of its UDP relay socket. When the port is taken
+// for TCP, the allocation is deleted again and the response to send
+// instead is returned; nil means the response goes out as it is.
+func (t *TURNServer) openTCPRelay(msg *stun.Message, client net.Addr) []byte {
+	inflight := t.inflightMessageFrom(client)
+	if inflight == nil || !inflight.tcp || inflight.key == nil {
+		return nil
+	}
+
+	var relayed stun.XORMappedAddress
+	if err := relayed.GetFromAs(msg, stun.AttrXORRelayedAddress); err != nil {
+		return nil
+	}
+	t.relaysMutex.Lock()
+	relay, ok := t.relays[relayed.Port]
+	t.relaysMutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	listener, err := t.relayGenerator.listenStream(relayed.Port)
+	if err != nil {
+		t.logger.WithFields(logrus.Fields{
+			"client": client.String(),
+			"port":   relayed.Port,
+		}).WithError(err).Warn("Failed to open TCP relay, deleting allocation")
+
+		// pion/turn deletes the allocation once its relay socket is closed
+		relay.Close()
+		response, err := stun.Build(
+			stun.NewTransactionIDSetter(msg.TransactionID),
+			stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse),
+			stun.CodeInsufficientCapacity,
+			stun.MessageIntegrity(inflight.key),
+			stun.Fingerprint,
+		)
+		if err != nil {
+			t.logger.WithError(err).Error("Failed to build error response")
+			return nil
+		}
+		return response.Raw
+	}
+
+	r := &tcpRelay{
+		server:      t,
+		relay:       relay,
+		listener:    listener,
+		port:        relayed.Port,
+		client:      client.String(),
+		key:         inflight.key,
+		control:     inflight.control,
+		permissions: make(map[string]time.Time),
+		connecting:  make(map[string]bool),
+		conns:       make(map[*peerConnection]struct{}),
+	}
+	relay.tcp.Store(r)
+	t.relaysMutex.Lock()
+	t.tcpRelays[r.client] = r
+	t.relaysMutex.Unlock()
+
+	go r.accept()
+	return nil
+}
+
+// tcpRelayOf returns the TCP allocation of a client, nil if it has none
+func (t *TURNServer) tcpRelayOf(client net.Addr) *tcpRelay {
+	t.relaysMutex.Lock()
+	defer t.relaysMutex.Unlock()
+	return t.tcpRelays[client.String()]
+}
+
+// recordTCPPermissions lets the peers of a CreatePermission request that
+// pion/turn granted connect to the client's TCP allocation
+func (t *TURNServer) recordTCPPermissions(client net.Addr) {
+	r := t.tcpRelayOf(client)
+	inflight := t.inflightMessageFrom(client)
+	if r == nil || inflight == nil || inflight.msg.Type.Method != stun.MethodCreatePermission {
+		return
+	}
+
+	expires := time.Now().Add(tcpPermissionLifetime)
+	inflight.msg.ForEach(stun.AttrXORPeerAddress, func(m *stun.Message) error {
+		var peer stun.XORMappedAddress
+		if err := peer.GetFromAs(m, stun.AttrXORPeerAddress); err != nil {
+			return err
+		}
+		r.permit(peer.IP, expires)
+		return nil
+	})
+}
+
+// connectPeer handles a Connect request (RFC 6062 section 5.2). It opens a
+// connection to the peer from the relayed transport address and answers
+// with the CONNECTION-ID the client binds a data connection to. The peer
+// is dialed in the background so the control connection keeps flowing.
+func (t *TURNServer) connectPeer(inflight *inflightMessage, srcAddr net.Addr, reply func([]byte) error) {
+	r := t.tcpRelayOf(srcAddr)
+	if r == nil {
+		t.respond(inflight, reply, stun.ClassErrorResponse, stun.CodeAllocMismatch)
+		return
+	}
+
+	var peer stun.XORMappedAddress
+	if err := peer.GetFromAs(inflight.msg, stun.AttrXORPeerAddress); err != nil {
+		t.respond(inflight, reply, stun.ClassErrorResponse, stun.CodeBadRequest)
+		return
+	}
+	if t.overTransferCap(inflight.user) {
+		t.respond(inflight, reply, stun.ClassErrorResponse, stun.CodeAllocQuotaReached)
+		return
+	}
+
+	peerAddr := &net.TCPAddr{IP: peer.IP, Port: peer.Port}
+	if !r.startConnect(peerAddr) {
+		t.respond(inflight, reply, stun.ClassErrorResponse, stun.CodeConnAlreadyExists)
+		return
+	}
+
+	go func() {
+		conn, err := t.relayGenerator.dialStream(r.port, peerAddr, peerConnectTimeout)
+		if err != nil {
+			r.endConnect(peerAddr)
+			t.logger.WithFields(logrus.Fields{
+				"client": srcAddr.String(),
+				"peer":   peerAddr.String(),
+			}).WithError(err).Debug("Failed to connect to peer")
+			t.respond(inflight, reply, stun.ClassErrorResponse, stun.CodeConnTimeoutOrFailure)
+			return
+		}
+
+		pc := t.addPeerConnection(r, conn, peerAddr, true)
+		if pc == nil {
+			t.respond(inflight, reply, stun.ClassErrorResponse, stun.CodeConnTimeoutOrFailure)
+			return
+		}
+		t.respond(inflight, reply, stun.ClassSuccessResponse, connectionID(pc.id))
+	}()
+}
+
+// bindConnection handles a ConnectionBind request (RFC 6062 section 5.4)
+// sent on a new data connection with the allocation's credentials. Once it
+// is answered, claimConnection takes the data connection off pion/turn.
+func (t *TURNServer) bindConnection(inflight *inflightMessage, srcAddr net.Addr, reply func([]byte) error) {
+	id, ok := getConnectionID(inflight.msg)
+	if !ok || !isStream(srcAddr) || t.hasSession(srcAddr) {
+		t.respond(inflight, reply, stun.ClassErrorResponse, stun.CodeBadRequest)
+		return
+	}
+
+	t.peerConnsMutex.Lock()
+	pc, ok := t.peerConns[id]
+	switch {
+	case !ok:
+		t.peerConnsMutex.Unlock()
+		t.respond(inflight, reply, stun.ClassErrorResponse, stun.CodeBadRequest)
+		return
+	case !bytes.Equal(pc.relay.key, inflight.key):
+		t.peerConnsMutex.Unlock()
+		t.respond(inflight, reply, stun.ClassErrorResponse, stun.CodeWrongCredentials)
+		return
+	}
+	delete(t.peerConns, id)
+	pc.dataAddr = srcAddr.String()
+	t.boundConns[pc.dataAddr] = pc
+	t.peerConnsMutex.Unlock()
+
+	pc.timer.Stop()
+	t.respond(inflight, reply, stun.ClassSuccessResponse)
+}
+
+// claimConnection takes a data connection bindConnection just bound off
+// pion/turn and relays it to its peer connection. It returns false for
+// every other connection.
+func (t *TURNServer) claimConnection(conn *inspectingConn) bool {
+	key := conn.RemoteAddr().String()
+
+	t.peerConnsMutex.Lock()
+	pc, ok := t.boundConns[key]
+	delete(t.boundConns, key)
+	t.peerConnsMutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	conn.handedOff.Store(true)
+	go pc.relayTo(conn.Conn, conn.reader)
+	return true
+}
+
+// addPeerConnection registers a new peer connection under a fresh
+// CONNECTION-ID and closes it if no data connection is bound to it in
+// time. It returns nil, having closed the connection, when the allocation
+// is gone.
+func (t *TURNServer) addPeerConnection(r *tcpRelay, conn net.Conn, peer *net.TCPAddr, connected bool) *peerConnection {
+	pc := &peerConnection{relay: r, conn: conn, peer: peer, connected: connected}
+	if !r.track(pc) {
+		pc.close()
+		return nil
+	}
+
+	t.peerConnsMutex.Lock()
+	for pc.id == 0 || t.peerConns[pc.id] != nil {
+		pc.id = rand.Uint32()
+	}
+	t.peerConns[pc.id] = pc
+	pc.timer = time.AfterFunc(connectionBindTimeout, func() {
+		if t.forgetPeerConnection(pc) {
+			pc.close()
+		}
+	})
+	t.peerConnsMutex.Unlock()
+
+	return pc
+}
+
+// forgetPeerConnection drops a peer connection waiting to be bound or
+// claimed. It reports whether the connection was still waiting.
+func (t *TURNServer) forgetPeerConnection(pc *peerConnection) bool {
+	t.peerConnsMutex.Lock()
+	defer t.peerConnsMutex.Unlock()
+
+	if t.peerConns[pc.id] == pc {
+		delete(t.peerConns, pc.id)
+		return true
+	}
+	if pc.dataAddr != "" && t.boundConns[pc.dataAddr] == pc {
+		delete(t.boundConns, pc.dataAddr)
+		return true
+	}
+	return false
+}
+
+// challengeRequest answers a Connect or ConnectionBind request that does
+// not authenticate with a 401 challenge, as pion/turn answers the requests
+// it knows. The inspector checks these requests' integrity, not their
+// nonce, so the nonce is only there for the client to echo.
+func (t *TURNServer) challengeRequest(msg *stun.Message, reply func([]byte) error) {
+	nonce := make([]byte, 16)
+	if _, err := crand.Read(nonce); err != nil {
+		t.logger.WithError(err).Error("Failed to generate nonce")
+		return
+	}
+
+	response, err := stun.Build(
+		stun.NewTransactionIDSetter(msg.TransactionID),
+		stun.NewType(msg.Type.Method, stun.ClassErrorResponse),
+		stun.CodeUnauthorized,
+		stun.NewRealm(t.config.Realm),
+		stun.NewNonce(hex.EncodeToString(nonce)),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		t.logger.WithError(err).Error("Failed to build error response")
+		return
+	}
+	if err := reply(response.Raw); err != nil {
+		t.logger.WithError(err).Debug("Failed to send error response")
+	}
+}
+
+// respond answers a request the inspector verified and handles itself,
+// signing the response with the key the request was verified with
+func (t *TURNServer) respond(inflight *inflightMessage, reply func([]byte) error, class stun.MessageClass, setters ...stun.Setter) {
+	msg := inflight.msg
+	setters = append([]stun.Setter{
+		stun.NewTransactionIDSetter(msg.TransactionID),
+		stun.NewType(msg.Type.Method, class),
+	}, setters...)
+	setters = append(setters, stun.MessageIntegrity(inflight.key), stun.Fingerprint)
+
+	response, err := stun.Build(setters...)
+	if err != nil {
+		t.logger.WithError(err).Error("Failed to build response")
+		return
+	}
+	if err := reply(response.Raw); err != nil {
+		t.logger.WithError(err).Debug("Failed to send response")
+	}
+}
+
+// accept takes the connections of peers. Those with a permission are
+// announced to the client in a ConnectionAttempt indication on the
+// control connection (RFC 6062 section 5.3); the others are closed.
+func (r *tcpRelay) accept() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		peer, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !r.permitted(peer.IP) {
+			conn.Close()
+			continue
+		}
+
+		pc := r.server.addPeerConnection(r, conn, peer, false)
+		if pc == nil {
+			continue
+		}
+		indication, err := stun.Build(
+			stun.TransactionID,
+			stun.NewType(stun.MethodConnectionAttempt, stun.ClassIndication),
+			peerAddress{IP: peer.IP, Port: peer.Port},
+			connectionID(pc.id),
+			stun.Fingerprint,
+		)
+		if err == nil {
+			err = r.control(indication.Raw)
+		}
+		if err != nil {
+			r.server.logger.WithField("client", r.client).WithError(err).Debug("Failed to send connection attempt")
+			if r.server.forgetPeerConnection(pc) {
+				pc.close()
+			}
+		}
+	}
+}
+
+// permit lets a peer IP connect until a permission expires, forgetting
+// permissions that already have
+func (r *tcpRelay) permit(ip net.IP, expires time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	for peer, expiry := range r.permissions {
+		if now.After(expiry) {
+			delete(r.permissions, peer)
+		}
+	}
+	r.permissions[ip.String()] = expires
+}
+
+// permitted reports whether a peer IP holds a permission
+func (r *tcpRelay) permitted(ip net.IP) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	expiry, ok := r.permissions[ip.String()]
+	return ok && time.Now().Before(expiry)
+}
+
+// startConnect claims a peer address for a Connect request. It returns
+// false when a Connect to it is in progress or its connection is live.
+func (r *tcpRelay) startConnect(peer *net.TCPAddr) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed || r.connecting[peer.String()] {
+		return false
+	}
+	r.connecting[peer.String()] = true
+	return true
+}
+
+// endConnect gives a peer address back once its connection is gone
+func (r *tcpRelay) endConnect(peer *net.TCPAddr) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.connecting, peer.String())
+}
+
+// track registers a peer connection so it is closed with the allocation.
+// It returns false when the allocation is already closed.
+func (r *tcpRelay) track(pc *peerConnection) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return false
+	}
+	r.conns[pc] = struct{}{}
+	return true
+}
+
+// close closes the listener and every peer and data connection of the
+// allocation
+func (r *tcpRelay) close() {
+	r.mutex.Lock()
+	r.closed = true
+	conns := make([]*peerConnection, 0, len(r.conns))
+	for pc := range r.conns {
+		conns = append(conns, pc)
+	}
+	r.mutex.Unlock()
+
+	r.server.relaysMutex.Lock()
+	if r.server.tcpRelays[r.client] == r {
+		delete(r.server.tcpRelays, r.client)
+	}
+	r.server.relaysMutex.Unlock()
+
+	r.listener.Close()
+	for _, pc := range conns {
+		r.server.forgetPeerConnection(pc)
+		pc.close()
+	}
+}
+
+// relayTo relays a bound data connection and the peer connection to each
+// other until either side closes. Traffic counts towards the allocation
+// like relayed datagrams do and is held to the user's bandwidth limit.
+func (pc *peerConnection) relayTo(client net.Conn, clientReader io.Reader) {
+	r := pc.relay
+	r.mutex.Lock()
+	closed := r.closed
+	pc.client = client
+	r.mutex.Unlock()
+	if closed {
+		pc.close()
+		return
+	}
+
+	go func() {
+		r.pipe(pc.conn, clientReader, r.relay.countSent)
+		pc.close()
+	}()
+	r.pipe(client, pc.conn, r.relay.countRecv)
+	pc.close()
+}
+
+// pipe copies one direction of a bound connection
+func (r *tcpRelay) pipe(dst io.Writer, src io.Reader, count func(int)) {
+	buf := make([]byte, tcpRelayBufferSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if limiter := r.relay.limiter.Load(); limiter != nil {
+				time.Sleep(limiter.Reserve(n))
+			}
+			written, err := dst.Write(buf[:n])
+			count(written)
+			if err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close closes the peer connection and its data connection, if bound
+func (pc *peerConnection) close() {
+	pc.closeOnce.Do(func() {
+		r := pc.relay
+		r.mutex.Lock()
+		client := pc.client
+		delete(r.conns, pc)
+		if pc.connected {
+			delete(r.connecting, pc.peer.String())
+		}
+		r.mutex.Unlock()
+
+		pc.conn.Close()
+		if client != nil {
+			client.Close()
+		}
+	})
+}
+
+// peerAddress is an XOR-PEER-ADDRESS attribute
+type peerAddress stun.XORMappedAddress
+
+// AddTo adds the attribute to a message
+func (a peerAddress) AddTo(m *stun.Message) error {
+	addr := stun.XORMappedAddress(a)
+	return addr.AddToAs(m, stun.AttrXORPeerAddress)
+}
+
+// connectionID is a CONNECTION-ID attribute
+type connectionID uint32
+
+// AddTo adds the attribute to a message
+func (c connectionID) AddTo(m *stun.Message) error {
+	m.Add(stun.AttrConnectionID, binary.BigEndian.AppendUint32(nil, uint32(c)))
+	return nil
+}
+
+// getConnectionID reads the CONNECTION-ID of a message
+func getConnectionID(msg *stun.Message) (uint32, bool) {
+	value, err := msg.Get(stun.AttrConnectionID)
+	if err != nil || len(value) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value), true
+}
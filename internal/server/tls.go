@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pion/dtls/v2"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+)
+
+// certReloadDelay lets writers such as certbot finish replacing both files
+// before the pair is loaded again
+const certReloadDelay = 2 * time.Second
+
+// certReloader serves a certificate/key pair and reloads it when either file
+// changes, so renewed certificates are picked up without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *logrus.Logger
+	watcher  *fsnotify.Watcher
+
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+
+	timerMutex sync.Mutex
+	timer      *time.Timer // pending reload, if any
+	closed     bool
+}
+
+// newCertReloader loads the pair and starts watching the files for changes
+func newCertReloader(certFile, keyFile string, logger *logrus.Logger) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate watcher: %w", err)
+	}
+
+	// Watch the directories rather than the files: renewals usually replace
+	// the files (or the symlinks pointing at them) instead of writing in place
+	dirs := map[string]struct{}{
+		filepath.Dir(certFile): {},
+		filepath.Dir(keyFile):  {},
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+
+	r.watcher = watcher
+	go r.watch()
+
+	return r, nil
+}
+
+// reload loads the certificate pair from disk
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s: %w", r.certFile, err)
+	}
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.mutex.Unlock()
+
+	return nil
+}
+
+// watch reloads the pair after file system events in the watched
+// directories, keeping the previous certificate if the new one can't be
+// loaded. Any event triggers a reload: renewals swap symlinks or rename
+// temporary files, so matching on the configured names alone misses them.
+func (r *certReloader) watch() {
+	for {
+		select {
+		case _, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			r.scheduleReload()
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			r.logger.WithError(err).Warn("TLS certificate watcher error")
+		}
+	}
+}
+
+// scheduleReload reloads the pair once the files have been quiet for
+// certReloadDelay, unless the reloader is closed first
+func (r *certReloader) scheduleReload() {
+	r.timerMutex.Lock()
+	defer r.timerMutex.Unlock()
+
+	if r.closed {
+		return
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = time.AfterFunc(certReloadDelay, func() {
+		if err := r.reload(); err != nil {
+			r.logger.WithError(err).Error("Failed to reload TLS certificate, keeping the previous one")
+			return
+		}
+		r.logger.WithField("cert_file", r.certFile).Info("Reloaded TLS certificate")
+	})
+}
+
+// GetCertificate returns the current certificate for TLS handshakes
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// GetDTLSCertificate returns the current certificate for DTLS handshakes
+func (r *certReloader) GetDTLSCertificate(*dtls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// Close stops watching the certificate files and cancels a pending reload
+func (r *certReloader) Close() error {
+	r.timerMutex.Lock()
+	r.closed = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timerMutex.Unlock()
+
+	return r.watcher.Close()
+}
+
+// loadClientCAs loads the CA bundle used to verify client certificates
+func loadClientCAs(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", caFile)
+	}
+	return pool, nil
+}
+
+// newTLSConfig builds a server TLS configuration backed by a reloading certificate
+func newTLSConfig(cfg *config.TLSConfig, reloader *certReloader) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadClientCAs(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// newDTLSConfig builds a server DTLS configuration backed by a reloading certificate
+func newDTLSConfig(cfg *config.TLSConfig, reloader *certReloader) (*dtls.Config, error) {
+	dtlsConfig := &dtls.Config{
+		GetCertificate:       reloader.GetDTLSCertificate,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadClientCAs(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		dtlsConfig.ClientCAs = pool
+		dtlsConfig.ClientAuth = dtls.RequireAndVerifyClientCert
+	}
+
+	return dtlsConfig, nil
+}
@@ -2,12 +2,15 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/pion/dtls/v2"
 	pionlogger "github.com/pion/logging"
 	"github.com/pion/stun"
 	"github.com/pion/turn/v2"
@@ -15,6 +18,7 @@ import (
 
 	"github.com/ga666666-new/pion-stun-server/internal/auth"
 	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/internal/ratelimit"
 	"github.com/ga666666-new/pion-stun-server/pkg/models"
 )
 
@@ -67,23 +71,102 @@ func (f *turnLoggerFactory) NewLogger(scope string) pionlogger.LeveledLogger {
 
 // TURNServer represents a TURN server
 type TURNServer struct {
-	config        *config.TURNConfig
-	auth          *auth.MongoAuthenticator
-	server        *turn.Server
-	logger        *logrus.Logger
-	sessions      map[string]*models.SessionInfo
-	sessionsMutex sync.RWMutex
-	stopChan      chan struct{}
+	config             *config.TURNConfig
+	auth               auth.Authenticator
+	quotas             auth.QuotaStore
+	instanceID         string // counts this server's sessions in quotas
+	sessionStore       auth.SessionStore
+	rest               *auth.RESTCredentials
+	tokens             *auth.AccessTokens // nil unless OAuth access tokens are accepted
+	tokenGrants        map[string]*auth.AccessToken
+	tokenGrantsMutex   sync.Mutex
+	peerACL            *peerACL
+	lockouts           *lockoutTracker
+	passwordAlgorithms []byte // PASSWORD-ALGORITHMS offered, nil when only MD5 is
+	relayGenerator     *relayAddressGenerator
+	server             *turn.Server
+	publicIP           net.IP
+	publicIPv6         net.IP // nil unless IPv6 relays are available
+	logger             *logrus.Logger
+	sessions           map[string]*models.SessionInfo
+	sessionsMutex      sync.RWMutex
+	families           map[string]addressFamilies // by client address, of its allocation
+	inflight           map[string]*inflightMessage
+	inflightMutex      sync.Mutex
+	grants             map[string]*allocationGrant
+	grantsMutex        sync.Mutex
+	relays             map[int]*relayConn
+	tcpRelays          map[string]*tcpRelay       // by client address of the control connection
+	peerConns          map[uint32]*peerConnection // by CONNECTION-ID, waiting to be bound
+	boundConns         map[string]*peerConnection // by client address of the data connection, waiting to be claimed
+	peerConnsMutex     sync.Mutex
+	userSessions       map[string]*userSessions
+	reservations       map[string]*sessionReservation
+	acquireRetryAt     time.Time // session slots are not acquired in the user store before then
+	limiters           map[string]*ratelimit.TokenBucket
+	usage              map[string]*userUsage
+	usageClock         func() time.Time
+	quotaMutex         sync.Mutex
+	sessionDeltas      chan sessionDelta
+	endedSessions      chan *models.SessionInfo
+	relaysMutex        sync.Mutex
+	traffic            trafficStats
+	certReloader       *certReloader
+	realms             []*TURNServer     // other realms served by this process
+	router             *realmRouter      // shares the listeners with realms, nil without any
+	routedPackets      *routedPacketConn // datagrams of this realm on the default realm's socket
+	routedStreams      *routedListener   // connections of this realm on the default realm's listeners
+	stopChan           chan struct{}
 }
 
-// NewTURNServer creates a new TURN server
-func NewTURNServer(cfg *config.TURNConfig, authenticator *auth.MongoAuthenticator, logger *logrus.Logger) *TURNServer {
+// inflightMessage is the last STUN message received from a client address,
+// kept so the auth handler can look at more than the username and realm.
+// Once the inspector has verified the message, the key and user it
+// resolved are kept too so the auth handler doesn't look them up again.
+type inflightMessage struct {
+	msg         *stun.Message
+	receivedAt  time.Time
+	username    string
+	key         []byte
+	user        *models.User
+	families    addressFamilies    // granted to an Allocate request
+	unavailable addressFamilies    // requested by an Allocate request but not granted
+	tcp         bool               // an Allocate request for a TCP relay
+	control     func([]byte) error // sends on the connection an Allocate request came on
+}
+
+// NewTURNServer creates a new TURN server. authenticator may be nil when
+// only TURN REST API credentials are accepted, rest may be nil when they are
+// disabled. Quota counters are persisted if authenticator implements
+// auth.QuotaStore, ended sessions if it implements auth.SessionStore.
+func NewTURNServer(cfg *config.TURNConfig, authenticator auth.Authenticator, rest *auth.RESTCredentials, logger *logrus.Logger) *TURNServer {
+	quotas, _ := auth.Unwrap(authenticator).(auth.QuotaStore)
+	sessionStore, _ := auth.Unwrap(authenticator).(auth.SessionStore)
 	return &TURNServer{
-		config:   cfg,
-		auth:     authenticator,
-		logger:   logger,
-		sessions: make(map[string]*models.SessionInfo),
-		stopChan: make(chan struct{}),
+		config:        cfg,
+		auth:          authenticator,
+		quotas:        quotas,
+		instanceID:    instanceID(cfg),
+		sessionStore:  sessionStore,
+		rest:          rest,
+		logger:        logger,
+		sessions:      make(map[string]*models.SessionInfo),
+		families:      make(map[string]addressFamilies),
+		inflight:      make(map[string]*inflightMessage),
+		grants:        make(map[string]*allocationGrant),
+		tokenGrants:   make(map[string]*auth.AccessToken),
+		relays:        make(map[int]*relayConn),
+		tcpRelays:     make(map[string]*tcpRelay),
+		peerConns:     make(map[uint32]*peerConnection),
+		boundConns:    make(map[string]*peerConnection),
+		userSessions:  make(map[string]*userSessions),
+		reservations:  make(map[string]*sessionReservation),
+		limiters:      make(map[string]*ratelimit.TokenBucket),
+		usage:         make(map[string]*userUsage),
+		usageClock:    time.Now,
+		sessionDeltas: make(chan sessionDelta, 1024),
+		endedSessions: make(chan *models.SessionInfo, 1024),
+		stopChan:      make(chan struct{}),
 	}
 }
 
@@ -98,9 +181,12 @@ func (t *TURNServer) Start() error {
 			return fmt.Errorf("invalid public_ip address: %s", t.config.PublicIP)
 		}
 		t.logger.WithField("ip", relayAddress.String()).Info("Using configured public IP")
+	} else if t.publicIP != nil {
+		// A realm without a public IP of its own uses the default realm's
+		relayAddress = t.publicIP
 	} else {
 		t.logger.Info("Public IP not configured, attempting to discover using STUN")
-		discoveredIP, err := discoverPublicIP(t.logger)
+		discoveredIP, err := discoverPublicIP("udp4", t.logger)
 		if err != nil {
 			t.logger.WithError(err).Warn("Failed to discover public IP, falling back to 127.0.0.1. TURN will likely not work externally.")
 			relayAddress = net.ParseIP("127.0.0.1")
@@ -110,62 +196,172 @@ func (t *TURNServer) Start() error {
 		}
 	}
 
-	// Create relay address generator
-	relayAddressGenerator := &turn.RelayAddressGeneratorStatic{
-		RelayAddress: relayAddress,
-		Address:      "0.0.0.0",
+	t.publicIP = relayAddress
+	t.publicIPv6 = t.resolvePublicIPv6()
+
+	acl, err := newPeerACL(t.config.RelayRanges, t.config.DenyRanges)
+	if err != nil {
+		return err
+	}
+	t.peerACL = acl
+
+	t.passwordAlgorithms = encodePasswordAlgorithms(t.config.PasswordAlgorithms)
+
+	if t.config.OAuth.Enabled {
+		tokens, err := newAccessTokens(&t.config.OAuth, t.config.Realm)
+		if err != nil {
+			return err
+		}
+		t.tokens = tokens
+	}
+
+	if t.config.Lockout.Enabled {
+		lockouts, err := newLockoutTracker(&t.config.Lockout)
+		if err != nil {
+			return err
+		}
+		t.lockouts = lockouts
+	}
+
+	if time.Duration(t.config.MaxLifetime)*time.Second > pionMaxLifetime {
+		t.logger.WithField("max_lifetime", t.config.MaxLifetime).Warnf("max_lifetime is capped at %d seconds", int(pionMaxLifetime/time.Second))
 	}
 
+	// Create relay address generator
+	relayAddressGenerator := newRelayAddressGenerator(relayAddress, t.config.RelayAddress, t.config.RelayMinPort, t.config.RelayMaxPort)
+	relayAddressGenerator.dualStack = t.publicIPv6 != nil
+	relayAddressGenerator.wrap = t.trackRelay
+	t.relayGenerator = relayAddressGenerator
+
 	// Create logger factory for pion
 	loggerFactory := &turnLoggerFactory{logger: t.logger}
 
-	// Listen on UDP
-	udpListener, err := net.ListenPacket("udp4", addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on UDP %s: %w", addr, err)
+	var packetConnConfigs []turn.PacketConnConfig
+	var listenerConfigs []turn.ListenerConfig
+	closeListeners := func() {
+		for _, cfg := range packetConnConfigs {
+			cfg.PacketConn.Close()
+		}
+		for _, cfg := range listenerConfigs {
+			cfg.Listener.Close()
+		}
+	}
+	addListener := func(listener net.Listener) {
+		inspecting := &inspectingListener{Listener: listener, inspect: t.inspectMessage, observe: t.observeMessage, claim: t.claimConnection}
+		if len(t.realms) > 0 {
+			inspecting.route = t.routeStream
+		}
+		listenerConfigs = append(listenerConfigs, turn.ListenerConfig{
+			Listener:              inspecting,
+			RelayAddressGenerator: relayAddressGenerator,
+			PermissionHandler:     acl.PermissionHandler,
+		})
+	}
+
+	// A realm without a port of its own is only served on the default
+	// realm's listeners
+	var udpListener net.PacketConn
+	var tcpListener net.Listener
+	if t.config.Port != 0 {
+		// Listen on UDP
+		network, addr := listenAddress("udp", t.config.Address, t.config.Port, t.config.IPv6)
+		udpListener, err = net.ListenPacket(network, addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on UDP %s: %w", addr, err)
+		}
+		packetConn := &inspectingPacketConn{PacketConn: udpListener, inspect: t.inspectMessage, observe: t.observeMessage}
+		if len(t.realms) > 0 {
+			packetConn.route = t.routePacket
+		}
+		packetConnConfigs = append(packetConnConfigs, turn.PacketConnConfig{
+			PacketConn:            packetConn,
+			RelayAddressGenerator: relayAddressGenerator,
+			PermissionHandler:     acl.PermissionHandler,
+		})
+
+		// Listen on TCP
+		network, addr = listenAddress("tcp", t.config.Address, t.config.Port, t.config.IPv6)
+		tcpListener, err = net.Listen(network, addr)
+		if err != nil {
+			closeListeners()
+			return fmt.Errorf("failed to listen on TCP %s: %w", addr, err)
+		}
+		addListener(tcpListener)
 	}
 
-	// Listen on TCP
-	tcpListener, err := net.Listen("tcp4", addr)
+	// Listen on TLS and DTLS (turns:)
+	secureListeners, err := t.listenSecure()
 	if err != nil {
-		udpListener.Close()
-		return fmt.Errorf("failed to listen on TCP %s: %w", addr, err)
+		closeListeners()
+		return err
+	}
+	for _, listener := range secureListeners {
+		addListener(listener)
+	}
+
+	// The clients of this realm on the default realm's listeners. Their
+	// connections come already wrapped.
+	if t.routedPackets != nil {
+		packetConnConfigs = append(packetConnConfigs, turn.PacketConnConfig{
+			PacketConn:            &inspectingPacketConn{PacketConn: t.routedPackets, inspect: t.inspectMessage, observe: t.observeMessage},
+			RelayAddressGenerator: relayAddressGenerator,
+			PermissionHandler:     acl.PermissionHandler,
+		})
+		listenerConfigs = append(listenerConfigs, turn.ListenerConfig{
+			Listener:              t.routedStreams,
+			RelayAddressGenerator: relayAddressGenerator,
+			PermissionHandler:     acl.PermissionHandler,
+		})
+	}
+
+	if len(t.realms) > 0 {
+		if err := t.startRealms(udpListener, tcpListener); err != nil {
+			closeListeners()
+			return err
+		}
 	}
 
 	// Create TURN server configuration
 	serverConfig := turn.ServerConfig{
-		Realm:         t.config.Realm,
-		AuthHandler:   t.handleAuth,
-		LoggerFactory: loggerFactory,
-		InboundMTU:    1500, // This is a workaround to enable automatic permissions.
-		PacketConnConfigs: []turn.PacketConnConfig{
-			{
-				PacketConn:            udpListener,
-				RelayAddressGenerator: relayAddressGenerator,
-			},
-		},
-		ListenerConfigs: []turn.ListenerConfig{
-			{
-				Listener:              tcpListener,
-				RelayAddressGenerator: relayAddressGenerator,
-			},
-		},
+		Realm:             t.config.Realm,
+		AuthHandler:       t.handleAuth,
+		LoggerFactory:     loggerFactory,
+		InboundMTU:        1500, // This is a workaround to enable automatic permissions.
+		PacketConnConfigs: packetConnConfigs,
+		ListenerConfigs:   listenerConfigs,
 	}
 
 	// Create TURN server
 	server, err := turn.NewServer(serverConfig)
 	if err != nil {
-		udpListener.Close()
-		tcpListener.Close()
+		t.stopRealms()
+		closeListeners()
 		return fmt.Errorf("failed to create TURN server: %w", err)
 	}
 
 	t.server = server
 
-	t.logger.WithField("address", addr).Info("TURN server started")
+	fields := logrus.Fields{
+		"address":     addr,
+		"realm":       t.config.Realm,
+		"relay_ports": relayAddressGenerator.portRange(),
+	}
+	if t.publicIPv6 != nil {
+		fields["public_ipv6"] = t.publicIPv6.String()
+	}
+	t.logger.WithFields(fields).Info("TURN server started")
 
-	// Start session cleanup routine
-	go t.sessionCleanup()
+	// Start cleanup routine
+	go t.cleanupLoop()
+
+	if t.quotas != nil {
+		t.reconcileSessionCounts()
+		go t.persistSessionCounts()
+		go t.usageLoop()
+	}
+	if t.sessionStore != nil {
+		go t.recordSessions()
+	}
 
 	return nil
 }
@@ -173,17 +369,90 @@ func (t *TURNServer) Start() error {
 // Stop stops the TURN server
 func (t *TURNServer) Stop() error {
 	close(t.stopChan)
-	
+	t.stopRealms()
+
+	if t.certReloader != nil {
+		t.certReloader.Close()
+	}
+
 	if t.server != nil {
 		if err := t.server.Close(); err != nil {
 			return fmt.Errorf("failed to close TURN server: %w", err)
 		}
 	}
-	
+
+	// Write back the usage of the allocations that were just closed
+	if t.quotas != nil {
+		t.flushUsage()
+		t.reconcileSessionCounts()
+	}
+	if t.sessionStore != nil {
+		t.recordEndedSessions()
+	}
+
 	t.logger.Info("TURN server stopped")
 	return nil
 }
 
+// listenSecure opens the TLS listener and, if enabled, the DTLS listener
+// used for turns: URLs. Both share a certificate that is reloaded when the
+// files change on disk.
+func (t *TURNServer) listenSecure() ([]net.Listener, error) {
+	if !t.config.TLS.Enabled() {
+		return nil, nil
+	}
+
+	network, addr := listenAddress("tcp", t.config.Address, t.config.TLS.Port, t.config.IPv6)
+
+	reloader, err := newCertReloader(t.config.TLS.CertFile, t.config.TLS.KeyFile, t.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TURN TLS certificate: %w", err)
+	}
+
+	tlsConfig, err := newTLSConfig(&t.config.TLS, reloader)
+	if err != nil {
+		reloader.Close()
+		return nil, err
+	}
+
+	tlsListener, err := tls.Listen(network, addr, tlsConfig)
+	if err != nil {
+		reloader.Close()
+		return nil, fmt.Errorf("failed to listen on TLS %s: %w", addr, err)
+	}
+	listeners := []net.Listener{tlsListener}
+	t.logger.WithField("address", addr).Info("TURN TLS listener started")
+
+	if t.config.DTLS {
+		dtlsConfig, err := newDTLSConfig(&t.config.TLS, reloader)
+		if err != nil {
+			reloader.Close()
+			tlsListener.Close()
+			return nil, err
+		}
+
+		network, addr := listenAddress("udp", t.config.Address, t.config.TLS.Port, t.config.IPv6)
+		udpAddr, err := net.ResolveUDPAddr(network, addr)
+		if err != nil {
+			reloader.Close()
+			tlsListener.Close()
+			return nil, fmt.Errorf("invalid DTLS address %s: %w", addr, err)
+		}
+
+		dtlsListener, err := dtls.Listen(network, udpAddr, dtlsConfig)
+		if err != nil {
+			reloader.Close()
+			tlsListener.Close()
+			return nil, fmt.Errorf("failed to listen on DTLS %s: %w", addr, err)
+		}
+		listeners = append(listeners, dtlsListener)
+		t.logger.WithField("address", addr).Info("TURN DTLS listener started")
+	}
+
+	t.certReloader = reloader
+	return listeners, nil
+}
+
 // handleAuth handles TURN authentication
 func (t *TURNServer) handleAuth(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
 	logger := t.logger.WithFields(logrus.Fields{
@@ -191,87 +460,143 @@ func (t *TURNServer) handleAuth(username, realm string, srcAddr net.Addr) (key [
 		"realm":    realm,
 		"client":   srcAddr.String(),
 	})
-	
+
+	key, _, err := t.lookupKey(username, realm, srcAddr)
+	if err != nil {
+		logger.WithError(err).Debug("Authentication failed")
+		return nil, false
+	}
+
+	logger.Debug("Authentication successful")
+
+	return key, true
+}
+
+// lookupKey resolves the long-term credential key for a username without
+// any side effects. It also returns the user sessions are recorded under;
+// REST API users only carry a username and have no quota.
+func (t *TURNServer) lookupKey(username, realm string, srcAddr net.Addr) ([]byte, *models.User, error) {
+	if err := t.servesRealm(realm); err != nil {
+		return nil, nil, err
+	}
+
+	if msg := t.inflightMessageFrom(srcAddr); msg != nil && msg.username == username && msg.key != nil {
+		return msg.key, msg.user, nil
+	}
+
+	if key, user, isToken, err := t.tokenKey(username, srcAddr); isToken {
+		return key, user, err
+	}
+
+	if t.rest != nil {
+		if _, userID, isREST := auth.ParseRESTUsername(username); isREST {
+			key, err := t.restKey(username, realm, srcAddr)
+			if err != nil {
+				return nil, nil, err
+			}
+			return key, &models.User{Username: userID, Enabled: true}, nil
+		}
+	}
+
+	if t.auth == nil {
+		return nil, nil, fmt.Errorf("no user store configured")
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	
+
 	storedKey, user, err := t.auth.GetTURNAuthKey(ctx, username)
 	if err != nil {
-		logger.WithError(err).Debug("Authentication failed")
-		return nil, false
+		if !errors.Is(err, auth.ErrUserNotFound) && !errors.Is(err, auth.ErrUserDisabled) {
+			err = fmt.Errorf("%w: %v", errUserStore, err)
+		}
+		return nil, nil, err
 	}
-	
+
 	// The stored key is hex-encoded, decode it for pion/turn
 	decodedKey, err := hex.DecodeString(storedKey)
 	if err != nil {
-		logger.WithError(err).Error("Failed to decode stored TURN key")
-		return nil, false
+		t.logger.WithField("username", username).WithError(err).Error("Failed to decode stored TURN key")
+		return nil, nil, fmt.Errorf("%w: invalid stored TURN key", errUserStore)
 	}
-	
-	// Check user quota
-	if user.Quota != nil && user.Quota.CurrentSessions >= user.Quota.MaxSessions {
-		logger.Debug("User quota exceeded")
-		return nil, false
+
+	return decodedKey, user, nil
+}
+
+// restKey validates a TURN REST API credential without touching the user
+// store. With several secrets configured, the one whose key verifies the
+// request's MESSAGE-INTEGRITY is used.
+func (t *TURNServer) restKey(username, realm string, srcAddr net.Addr) ([]byte, error) {
+	keys, err := t.rest.Keys(username, realm)
+	if err != nil {
+		return nil, err
 	}
-	
-	logger.Debug("Authentication successful")
-	
-	// Create session info
-	sessionID := fmt.Sprintf("%s-%d", srcAddr.String(), time.Now().Unix())
-	session := &models.SessionInfo{
-		ID:         sessionID,
-		Username:   user.Username,
-		ClientAddr: srcAddr.String(),
-		StartTime:  time.Now(),
-		LastActive: time.Now(),
-	}
-	
-	t.sessionsMutex.Lock()
-	t.sessions[sessionID] = session
-	t.sessionsMutex.Unlock()
-	
-	return decodedKey, true
+
+	if msg := t.inflightMessageFrom(srcAddr); msg != nil && len(keys) > 1 {
+		for _, candidate := range keys {
+			if err := stun.MessageIntegrity(candidate).Check(msg.msg); err == nil {
+				return candidate, nil
+			}
+		}
+	}
+
+	return keys[0], nil
 }
 
-// sessionCleanup periodically cleans up inactive sessions
-func (t *TURNServer) sessionCleanup() {
+// cleanupLoop periodically forgets per-client state that has gone stale.
+// Sessions end with their allocation and need no sweeping.
+func (t *TURNServer) cleanupLoop() {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
-	
+
 	for {
 		select {
 		case <-t.stopChan:
 			return
 		case <-ticker.C:
-			t.cleanupInactiveSessions()
+			t.cleanupInflightMessages()
+			t.cleanupGrants()
+			t.cleanupReservations()
+			t.cleanupLimiters()
+			t.cleanupLockouts()
+			t.cleanupRoutedClients()
+			t.cleanupTokenGrants()
 		}
 	}
 }
 
-// cleanupInactiveSessions removes inactive sessions
-func (t *TURNServer) cleanupInactiveSessions() {
-	t.sessionsMutex.Lock()
-	defer t.sessionsMutex.Unlock()
-	
-	now := time.Now()
-	for sessionID, session := range t.sessions {
-		if now.Sub(session.LastActive) > 5*time.Minute {
-			delete(t.sessions, sessionID)
-			t.logger.WithField("session_id", sessionID).Debug("Cleaned up inactive session")
-		}
-	}
+// PublicIP returns the relay address advertised to clients. It is only
+// known once the server has started.
+func (t *TURNServer) PublicIP() net.IP {
+	return t.publicIP
+}
+
+// PublicIPv6 returns the IPv6 relay address advertised to clients that ask
+// for one, nil when IPv6 relays are unavailable
+func (t *TURNServer) PublicIPv6() net.IP {
+	return t.publicIPv6
 }
 
-// GetSessions returns current active sessions
+// GetSessions returns snapshots of the current sessions, including the
+// traffic of their live relays
 func (t *TURNServer) GetSessions() []*models.SessionInfo {
+	relays := t.sessionRelays()
+
 	t.sessionsMutex.RLock()
 	defer t.sessionsMutex.RUnlock()
-	
+
 	sessions := make([]*models.SessionInfo, 0, len(t.sessions))
 	for _, session := range t.sessions {
-		sessions = append(sessions, session)
+		snapshot := *session
+		for _, relay := range relays[session] {
+			relay.stats.addTo(&snapshot)
+		}
+		sessions = append(sessions, &snapshot)
 	}
-	
+	for _, realm := range t.realms {
+		sessions = append(sessions, realm.GetSessions()...)
+	}
+
 	return sessions
 }
 
@@ -280,19 +605,45 @@ func (t *TURNServer) GetStats() map[string]interface{} {
 	t.sessionsMutex.RLock()
 	sessionCount := len(t.sessions)
 	t.sessionsMutex.RUnlock()
-	
-	return map[string]interface{}{
-		"status":          "running",
-		"address":         fmt.Sprintf("%s:%d", t.config.Address, t.config.Port),
-		"realm":           t.config.Realm,
-		"active_sessions": sessionCount,
+
+	stats := map[string]interface{}{
+		"status":            "running",
+		"address":           fmt.Sprintf("%s:%d", t.config.Address, t.config.Port),
+		"realm":             t.config.Realm,
+		"active_sessions":   sessionCount,
+		"bytes_sent":        t.traffic.bytesSent.Load(),
+		"bytes_received":    t.traffic.bytesRecv.Load(),
+		"packets_sent":      t.traffic.packetsSent.Load(),
+		"packets_received":  t.traffic.packetsRecv.Load(),
+		"packets_throttled": t.traffic.packetsThrottled.Load(),
+		"throttled_by_user": t.throttledByUser(),
+	}
+	if t.relayGenerator != nil {
+		stats["relay_address"] = t.relayGenerator.address
+		stats["relay_ports"] = t.relayGenerator.portRange()
+	}
+	if t.publicIPv6 != nil {
+		stats["public_ipv6"] = t.publicIPv6.String()
+	}
+	stats["tcp_relays"] = t.config.TCPRelays
+	if t.config.TLS.Enabled() {
+		stats["tls_address"] = fmt.Sprintf("%s:%d", t.config.Address, t.config.TLS.Port)
+		stats["dtls"] = t.config.DTLS
 	}
+	if len(t.realms) > 0 {
+		realms := make(map[string]interface{}, len(t.realms))
+		for _, realm := range t.realms {
+			realms[realm.config.Realm] = realm.GetStats()
+		}
+		stats["realms"] = realms
+	}
+	return stats
 }
 
-func discoverPublicIP(logger *logrus.Logger) (net.IP, error) {
+func discoverPublicIP(network string, logger *logrus.Logger) (net.IP, error) {
 	// We use a public STUN server to discover our public IP address.
-	// Google's STUN server is a good choice.
-	c, err := net.Dial("udp4", "stun.l.google.com:19302")
+	// Google's STUN server is a good choice, and answers over IPv6 too.
+	c, err := net.Dial(network, "stun.l.google.com:19302")
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial STUN server: %w", err)
 	}
@@ -342,4 +693,4 @@ func discoverPublicIP(logger *logrus.Logger) (net.IP, error) {
 	}
 
 	return xorMappedAddr.IP, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,498 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/stun"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	channelDataHeaderSize = 4
+	maxTURNFrameSize      = 65535 + stunHeaderSize
+)
+
+// errPeerDenied stops iterating peer addresses once one is denied
+var errPeerDenied = errors.New("peer address denied")
+
+// inspectFunc sees a TURN message before pion/turn handles it. reply sends a
+// raw response back to the client on the transport the message came from.
+// It returns the message pion/turn should handle, which may be rewritten,
+// or nil to drop it.
+type inspectFunc func(data []byte, srcAddr net.Addr, reply func([]byte) error) []byte
+
+// observeFunc sees each message pion/turn sends to a client. It returns the
+// message to send, which may be rewritten.
+type observeFunc func(data []byte, tuple fiveTuple) []byte
+
+// fiveTuple identifies an allocation by transport, client address and
+// server address, as in RFC 8656 section 2
+type fiveTuple struct {
+	transport string
+	client    net.Addr
+	server    net.Addr
+}
+
+// String formats the 5-tuple as "transport:client->server"
+func (f fiveTuple) String() string {
+	return fmt.Sprintf("%s:%s->%s", f.transport, f.client, f.server)
+}
+
+// inspectingPacketConn wraps a UDP listener socket so each datagram passes
+// through an inspectFunc before pion/turn reads it. pion/turn only gives the
+// auth handler a username, realm and source address; the inspector is how
+// the server gets at the rest of the request. On a socket shared by
+// several realms, route first hands datagrams of other realms over.
+type inspectingPacketConn struct {
+	net.PacketConn
+	inspect inspectFunc
+	observe observeFunc
+	route   func(data []byte, srcAddr net.Addr) bool // may be nil
+}
+
+// ReadFrom returns the next datagram the inspector lets through
+func (c *inspectingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		if c.route != nil && c.route(p[:n], addr) {
+			continue
+		}
+
+		reply := func(b []byte) error {
+			_, err := c.PacketConn.WriteTo(b, addr)
+			return err
+		}
+		if out := c.inspect(p[:n], addr, reply); out != nil && len(out) <= len(p) {
+			return copy(p, out), addr, nil
+		}
+	}
+}
+
+// WriteTo shows the outgoing datagram to the observer before sending it
+func (c *inspectingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	out := c.observe(p, fiveTuple{transport: "udp", client: addr, server: c.PacketConn.LocalAddr()})
+	if _, err := c.PacketConn.WriteTo(out, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// inspectingListener wraps a TCP, TLS or DTLS listener so every accepted
+// connection passes its TURN frames through an inspectFunc
+type inspectingListener struct {
+	net.Listener
+	inspect inspectFunc
+	observe observeFunc
+	route   func(frame []byte, conn *inspectingConn) bool // may be nil
+	claim   func(conn *inspectingConn) bool               // may be nil
+}
+
+// Accept wraps the next connection
+func (l *inspectingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &inspectingConn{
+		Conn:      conn,
+		reader:    bufio.NewReaderSize(conn, maxTURNFrameSize),
+		inspect:   l.inspect,
+		observe:   l.observe,
+		route:     l.route,
+		claim:     l.claim,
+		transport: streamTransport(conn),
+	}, nil
+}
+
+// inspectingConn splits a stream into TURN frames, inspects each one and
+// hands the accepted frames on to pion/turn unchanged. Once route hands the
+// connection to another realm, or claim takes it as the data connection of
+// a TCP allocation, it reads as closed and Close leaves the connection to
+// its new owner.
+type inspectingConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	inspect   inspectFunc
+	observe   observeFunc
+	route     func(frame []byte, conn *inspectingConn) bool // may be nil
+	claim     func(conn *inspectingConn) bool               // may be nil
+	transport string
+	pending   []byte
+	replay    []byte // frame read before the connection was handed over
+	handedOff atomic.Bool
+}
+
+// Read returns bytes of the frames the inspector lets through
+func (c *inspectingConn) Read(p []byte) (int, error) {
+	if c.handedOff.Load() {
+		return 0, io.EOF
+	}
+	for len(c.pending) == 0 {
+		frame := c.replay
+		c.replay = nil
+		if frame == nil {
+			var err error
+			if frame, err = readTURNFrame(c.reader); err != nil {
+				return 0, err
+			}
+			if c.route != nil && c.route(frame, c) {
+				return 0, io.EOF
+			}
+		}
+
+		reply := func(b []byte) error {
+			_, err := c.Conn.Write(b)
+			return err
+		}
+		c.pending = c.inspect(frame, c.Conn.RemoteAddr(), reply)
+		if c.pending == nil && c.claim != nil && c.claim(c) {
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write shows the outgoing message to the observer before sending it.
+// pion/turn writes each message with a single call.
+func (c *inspectingConn) Write(p []byte) (int, error) {
+	out := c.observe(p, fiveTuple{transport: c.transport, client: c.Conn.RemoteAddr(), server: c.Conn.LocalAddr()})
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the connection unless another realm took it over
+func (c *inspectingConn) Close() error {
+	if c.handedOff.Load() {
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+// streamTransport names the transport of an accepted connection
+func streamTransport(conn net.Conn) string {
+	switch conn.(type) {
+	case *tls.Conn:
+		return "tls"
+	case *dtls.Conn:
+		return "dtls"
+	default:
+		return "tcp"
+	}
+}
+
+// readTURNFrame reads one STUN message or ChannelData message from a stream.
+// ChannelData over TCP is padded to a multiple of four bytes (RFC 8656
+// section 12.5).
+func readTURNFrame(r *bufio.Reader) ([]byte, error) {
+	header, err := r.Peek(channelDataHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int
+	switch {
+	case header[0]&0xc0 == 0x40:
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		size = channelDataHeaderSize + (length+3)&^3
+	case header[0]&0xc0 == 0:
+		header, err = r.Peek(stunHeaderSize)
+		if err != nil {
+			return nil, err
+		}
+		if !stun.IsMessage(header) {
+			return nil, fmt.Errorf("stream does not carry TURN frames")
+		}
+		size = stunHeaderSize + int(binary.BigEndian.Uint16(header[2:4]))
+	default:
+		return nil, fmt.Errorf("stream does not carry TURN frames")
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// inspectMessage looks at each STUN message before pion/turn handles it. It
+// records the message so the auth handler can check it against more than
+// one key, negotiates the password algorithm with RFC 8489 clients,
+// refuses requests from locked out clients, applies the peer ACL
+// with a 403 response that pion/turn itself can't send, checks the address
+// families of allocations and their peers, and rewrites the LIFETIME of
+// allocations to the configured limits. The RFC 6062 Connect and
+// ConnectionBind requests of TCP allocations, which pion/turn doesn't
+// know, are answered here.
+func (t *TURNServer) inspectMessage(data []byte, srcAddr net.Addr, reply func([]byte) error) []byte {
+	if !stun.IsMessage(data) {
+		return data
+	}
+
+	msg := &stun.Message{Raw: append([]byte{}, data...)}
+	if err := msg.Decode(); err != nil {
+		return data
+	}
+
+	inflight := &inflightMessage{msg: msg, receivedAt: time.Now()}
+	t.inflightMutex.Lock()
+	t.inflight[srcAddr.String()] = inflight
+	t.inflightMutex.Unlock()
+
+	if t.passwordAlgorithms != nil {
+		var ok bool
+		if data, ok = t.negotiatePasswordAlgorithm(inflight, srcAddr, reply, data); !ok {
+			return nil
+		}
+		msg = inflight.msg
+	}
+
+	if t.lockouts != nil && msg.Type.Class == stun.ClassRequest {
+		if t.lockedOut(msg, srcAddr) {
+			t.refuseRequest(msg, reply, stun.CodeForbidden)
+			return nil
+		}
+		if msg.Contains(stun.AttrMessageIntegrity) {
+			t.recordAuthentication(inflight, srcAddr)
+		}
+	}
+
+	switch msg.Type {
+	case stun.NewType(stun.MethodCreatePermission, stun.ClassRequest),
+		stun.NewType(stun.MethodChannelBind, stun.ClassRequest):
+		if peer := t.deniedPeer(msg); peer != nil {
+			t.logger.WithFields(logrus.Fields{
+				"client": srcAddr.String(),
+				"peer":   peer.String(),
+			}).Info("Rejected relay to denied peer address")
+			if t.rejectRequest(inflight, srcAddr, reply, stun.CodeForbidden) {
+				return nil
+			}
+		}
+		if peer := t.mismatchedPeer(msg, srcAddr); peer != nil {
+			t.logger.WithFields(logrus.Fields{
+				"client": srcAddr.String(),
+				"peer":   peer.String(),
+			}).Debug("Rejected peer of an address family the allocation has no relayed address for")
+			if t.rejectRequest(inflight, srcAddr, reply, stun.CodePeerAddrFamilyMismatch) {
+				return nil
+			}
+		}
+		if msg.Type.Method == stun.MethodChannelBind && t.tcpRelayOf(srcAddr) != nil {
+			if t.rejectRequest(inflight, srcAddr, reply, stun.CodeBadRequest) {
+				return nil
+			}
+		}
+	case stun.NewType(stun.MethodSend, stun.ClassIndication):
+		if peer := t.deniedPeer(msg); peer != nil {
+			return nil
+		}
+		if peer := t.mismatchedPeer(msg, srcAddr); peer != nil {
+			return nil
+		}
+		if t.tcpRelayOf(srcAddr) != nil {
+			return nil
+		}
+	case stun.NewType(stun.MethodConnect, stun.ClassRequest):
+		if !t.verifyMessage(inflight, srcAddr) {
+			t.challengeRequest(msg, reply)
+			return nil
+		}
+		if peer := t.deniedPeer(msg); peer != nil {
+			t.logger.WithFields(logrus.Fields{
+				"client": srcAddr.String(),
+				"peer":   peer.String(),
+			}).Info("Rejected connection to denied peer address")
+			t.respond(inflight, reply, stun.ClassErrorResponse, stun.CodeForbidden)
+			return nil
+		}
+		if peer := t.mismatchedPeer(msg, srcAddr); peer != nil {
+			t.respond(inflight, reply, stun.ClassErrorResponse, stun.CodePeerAddrFamilyMismatch)
+			return nil
+		}
+		t.connectPeer(inflight, srcAddr, reply)
+		return nil
+	case stun.NewType(stun.MethodConnectionBind, stun.ClassRequest):
+		if !t.verifyMessage(inflight, srcAddr) {
+			t.challengeRequest(msg, reply)
+			return nil
+		}
+		t.bindConnection(inflight, srcAddr, reply)
+		return nil
+	case stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		stun.NewType(stun.MethodRefresh, stun.ClassRequest):
+		if !t.verifyMessage(inflight, srcAddr) {
+			return data
+		}
+		if msg.Type.Method == stun.MethodAllocate {
+			families, unavailable, code := t.requestedFamilies(msg)
+			if code != 0 {
+				if t.rejectRequest(inflight, srcAddr, reply, code) {
+					return nil
+				}
+				return data
+			}
+			if requestsTCP(msg) {
+				if code := t.tcpAllocationError(msg, srcAddr); code != 0 {
+					if t.rejectRequest(inflight, srcAddr, reply, code) {
+						return nil
+					}
+					return data
+				}
+			}
+			t.inflightMutex.Lock()
+			inflight.families = families
+			inflight.unavailable = unavailable
+			inflight.tcp = requestsTCP(msg)
+			inflight.control = reply
+			t.inflightMutex.Unlock()
+
+			if reason := t.allocationQuotaExceeded(srcAddr, inflight.user); reason != "" {
+				t.logger.WithFields(logrus.Fields{
+					"client":   srcAddr.String(),
+					"username": inflight.user.Username,
+				}).Infof("Rejected allocation over %s", reason)
+				if t.rejectRequest(inflight, srcAddr, reply, stun.CodeAllocQuotaReached) {
+					return nil
+				}
+				return data
+			}
+		}
+		lifetime := t.grantLifetime(msg, srcAddr, inflight.user)
+		rewritten, err := rewriteLifetime(msg, inflight.key, lifetime)
+		if err != nil {
+			t.logger.WithError(err).Error("Failed to rewrite allocation lifetime")
+			return data
+		}
+		return rewritten
+	}
+
+	return data
+}
+
+// deniedPeer returns the first XOR-PEER-ADDRESS the ACL rejects, or nil
+func (t *TURNServer) deniedPeer(msg *stun.Message) net.IP {
+	var denied net.IP
+	msg.ForEach(stun.AttrXORPeerAddress, func(m *stun.Message) error {
+		var peer stun.XORMappedAddress
+		if err := peer.GetFromAs(m, stun.AttrXORPeerAddress); err != nil {
+			return err
+		}
+		if !t.peerACL.Allowed(peer.IP) {
+			denied = peer.IP
+			return errPeerDenied
+		}
+		return nil
+	})
+	return denied
+}
+
+// verifyMessage checks an inflight message's MESSAGE-INTEGRITY against the
+// sender's key and, on success, keeps the key and user with the message.
+// Messages that don't verify are left for pion/turn to challenge.
+func (t *TURNServer) verifyMessage(inflight *inflightMessage, srcAddr net.Addr) bool {
+	_, err := t.authenticate(inflight, srcAddr)
+	return err == nil
+}
+
+// authenticate does the work of verifyMessage and returns the username the
+// message claims together with why it did not verify
+func (t *TURNServer) authenticate(inflight *inflightMessage, srcAddr net.Addr) (string, error) {
+	var username stun.Username
+	var realm stun.Realm
+	if err := username.GetFrom(inflight.msg); err != nil {
+		return "", errNoCredentials
+	}
+	if err := realm.GetFrom(inflight.msg); err != nil {
+		return "", errNoCredentials
+	}
+
+	key, user, err := t.lookupKey(username.String(), realm.String(), srcAddr)
+	if err != nil {
+		return username.String(), err
+	}
+	if err := stun.MessageIntegrity(key).Check(inflight.msg); err != nil {
+		return username.String(), err
+	}
+
+	t.inflightMutex.Lock()
+	inflight.username = username.String()
+	inflight.key = key
+	inflight.user = user
+	t.inflightMutex.Unlock()
+
+	if inflight.msg.Contains(attrAccessToken) {
+		t.grantAccessToken(username.String(), srcAddr)
+	}
+	return username.String(), nil
+}
+
+// rejectRequest answers an authenticated request with an error response
+// signed with the user's key. It returns false, leaving the request to
+// pion/turn, when the request does not authenticate.
+func (t *TURNServer) rejectRequest(inflight *inflightMessage, srcAddr net.Addr, reply func([]byte) error, code stun.ErrorCode) bool {
+	if !t.verifyMessage(inflight, srcAddr) {
+		return false
+	}
+
+	msg := inflight.msg
+	response, err := stun.Build(
+		stun.NewTransactionIDSetter(msg.TransactionID),
+		stun.NewType(msg.Type.Method, stun.ClassErrorResponse),
+		code,
+		stun.MessageIntegrity(inflight.key),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		t.logger.WithError(err).Error("Failed to build error response")
+		return false
+	}
+
+	if err := reply(response.Raw); err != nil {
+		t.logger.WithError(err).Debug("Failed to send error response")
+	}
+	return true
+}
+
+// inflightMessageFrom returns a copy of the message currently being handled
+// for a client
+func (t *TURNServer) inflightMessageFrom(srcAddr net.Addr) *inflightMessage {
+	t.inflightMutex.Lock()
+	defer t.inflightMutex.Unlock()
+
+	if inflight, ok := t.inflight[srcAddr.String()]; ok {
+		copied := *inflight
+		return &copied
+	}
+	return nil
+}
+
+// cleanupInflightMessages forgets messages from clients that have gone quiet
+func (t *TURNServer) cleanupInflightMessages() {
+	t.inflightMutex.Lock()
+	defer t.inflightMutex.Unlock()
+
+	now := time.Now()
+	for addr, inflight := range t.inflight {
+		if now.Sub(inflight.receivedAt) > time.Minute {
+			delete(t.inflight, addr)
+		}
+	}
+}
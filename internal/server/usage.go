@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// userUsage holds relayed bytes of a user not yet written to the user store
+type userUsage struct {
+	pending atomic.Int64
+}
+
+// usageFor returns the usage accumulator of a user whose quota document
+// tracks usage, nil otherwise. Callers hold quotaMutex.
+func (t *TURNServer) usageFor(user *models.User) *userUsage {
+	if user.Quota == nil || t.quotas == nil {
+		return nil
+	}
+
+	usage, ok := t.usage[user.Username]
+	if !ok {
+		usage = &userUsage{}
+		t.usage[user.Username] = usage
+	}
+	return usage
+}
+
+// overTransferCap reports whether a user has used up the configured
+// transfer cap for the current period, counting bytes not yet written back
+func (t *TURNServer) overTransferCap(user *models.User) bool {
+	transferCap := t.config.Quota.TransferCap
+	if transferCap <= 0 || user == nil || user.Quota == nil {
+		return false
+	}
+
+	used := user.Quota.UsedBandwidth
+	if !user.Quota.ResetAt.IsZero() && t.usageClock().After(user.Quota.ResetAt) {
+		used = 0 // the reset job hasn't caught up yet
+	}
+
+	t.quotaMutex.Lock()
+	if usage, ok := t.usage[user.Username]; ok {
+		used += usage.pending.Load()
+	}
+	t.quotaMutex.Unlock()
+
+	return used >= transferCap
+}
+
+// usageLoop periodically writes usage back to the user store and starts new
+// usage periods
+func (t *TURNServer) usageLoop() {
+	interval := time.Duration(t.config.Quota.SyncInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	t.resetUsage()
+	for {
+		select {
+		case <-t.stopChan:
+			return
+		case <-ticker.C:
+			t.SyncUsage()
+		}
+	}
+}
+
+// SyncUsage writes the usage relayed since the last sync back to the user
+// store and starts a new usage period for users whose period has ended. The
+// server does so every quota.sync_interval; it is a no-op without a
+// QuotaStore.
+func (t *TURNServer) SyncUsage() {
+	if t.quotas == nil {
+		return
+	}
+	t.flushUsage()
+	t.resetUsage()
+}
+
+// SetUsageClock replaces the clock usage periods are measured by, so tests
+// can move across period boundaries. It must be called before Start.
+func (t *TURNServer) SetUsageClock(now func() time.Time) {
+	t.usageClock = now
+}
+
+// flushUsage adds the bytes relayed since the last flush to each user's
+// quota.used_bandwidth
+func (t *TURNServer) flushUsage() {
+	t.quotaMutex.Lock()
+	pending := make(map[string]*userUsage, len(t.usage))
+	for username, usage := range t.usage {
+		pending[username] = usage
+		if _, live := t.userSessions[username]; !live {
+			delete(t.usage, username)
+		}
+	}
+	t.quotaMutex.Unlock()
+
+	for username, usage := range pending {
+		bytes := usage.pending.Swap(0)
+		if bytes == 0 {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := t.quotas.AddUsedBandwidth(ctx, username, bytes)
+		cancel()
+		if err != nil {
+			t.quotaMutex.Lock()
+			current, ok := t.usage[username]
+			if !ok {
+				current = usage
+				t.usage[username] = usage
+			}
+			current.pending.Add(bytes)
+			t.quotaMutex.Unlock()
+			t.logger.WithField("username", username).WithError(err).Warn("Failed to write back usage")
+		}
+	}
+}
+
+// resetUsage zeroes the usage of users whose period has rolled over
+func (t *TURNServer) resetUsage() {
+	now := t.usageClock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reset, err := t.quotas.ResetUsage(ctx, now, NextUsagePeriod(now, t.config.Quota.ResetPeriod))
+	if err != nil {
+		t.logger.WithError(err).Warn("Failed to reset usage")
+		return
+	}
+	if reset > 0 {
+		t.logger.WithFields(logrus.Fields{
+			"users":  reset,
+			"period": t.config.Quota.ResetPeriod,
+		}).Info("Started new usage period")
+	}
+}
+
+// NextUsagePeriod returns when the usage period after now starts: the next
+// UTC midnight for "daily", the first of the next month otherwise
+func NextUsagePeriod(now time.Time, period string) time.Time {
+	now = now.UTC()
+	if period == "daily" {
+		return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
@@ -12,6 +12,7 @@ type User struct {
 	Username  string             `bson:"username" json:"username"`
 	Password  string             `bson:"password" json:"-"` // Never expose password in JSON
 	Salt      string             `bson:"salt,omitempty" json:"-"`
+	KeySHA256 string             `bson:"key_sha256,omitempty" json:"-"` // hex SHA-256(username:realm:password), if stored
 	Enabled   bool               `bson:"enabled" json:"enabled"`
 	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
@@ -20,13 +21,26 @@ type User struct {
 	// Additional fields for TURN server
 	Quota     *UserQuota         `bson:"quota,omitempty" json:"quota,omitempty"`
 	Metadata  map[string]interface{} `bson:"metadata,omitempty" json:"metadata,omitempty"`
+
+	// ExternalID is the ID of a user in a store whose IDs aren't
+	// ObjectIDs, such as an SQL table keyed by integers or UUIDs
+	ExternalID string `bson:"-" json:"external_id,omitempty"`
+}
+
+// IDString returns the ID the auth package takes for the user: its
+// ExternalID if it has one, else the hex of its ObjectID
+func (u *User) IDString() string {
+	if u.ExternalID != "" {
+		return u.ExternalID
+	}
+	return u.ID.Hex()
 }
 
 // UserQuota represents usage quotas for a user
 type UserQuota struct {
-	MaxSessions     int   `bson:"max_sessions" json:"max_sessions"`
-	MaxBandwidth    int64 `bson:"max_bandwidth" json:"max_bandwidth"` // bytes per second
-	MaxDuration     int   `bson:"max_duration" json:"max_duration"`   // seconds
+	MaxSessions     int   `bson:"max_sessions" json:"max_sessions"`   // live allocations, 0 for no limit
+	MaxBandwidth    int64 `bson:"max_bandwidth" json:"max_bandwidth"` // bytes per second, 0 for no limit
+	MaxDuration     int   `bson:"max_duration" json:"max_duration"`   // seconds, 0 for no limit
 	CurrentSessions int   `bson:"current_sessions" json:"current_sessions"`
 	UsedBandwidth   int64 `bson:"used_bandwidth" json:"used_bandwidth"`
 	ResetAt         time.Time `bson:"reset_at" json:"reset_at"`
@@ -52,16 +66,30 @@ type AuthResponse struct {
 type SessionInfo struct {
 	ID          string    `bson:"_id" json:"id"`
 	Username    string    `bson:"username" json:"username"`
+	Realm       string    `bson:"realm,omitempty" json:"realm,omitempty"`
 	ClientAddr  string    `bson:"client_addr" json:"client_addr"`
 	RelayAddr   string    `bson:"relay_addr" json:"relay_addr"`
+	RelayAddr6  string    `bson:"relay_addr6,omitempty" json:"relay_addr6,omitempty"` // IPv6 relayed address of a dual-stack allocation
 	StartTime   time.Time `bson:"start_time" json:"start_time"`
 	LastActive  time.Time `bson:"last_active" json:"last_active"`
+	ExpiresAt   time.Time `bson:"expires_at" json:"expires_at"`
 	BytesSent   int64     `bson:"bytes_sent" json:"bytes_sent"`
 	BytesRecv   int64     `bson:"bytes_recv" json:"bytes_recv"`
 	PacketsSent int64     `bson:"packets_sent" json:"packets_sent"`
 	PacketsRecv int64     `bson:"packets_recv" json:"packets_recv"`
 }
 
+// Lockout is the failed authentication record of a username or client IP
+type Lockout struct {
+	Realm       string    `json:"realm,omitempty"`
+	Kind        string    `json:"kind"` // "username" or "ip"
+	Key         string    `json:"key"`
+	IP          string    `json:"ip,omitempty"` // client IP a username's failures come from
+	Failures    int       `json:"failures"`
+	Lockouts    int       `json:"lockouts"` // lockouts so far, each one doubles the next
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
 // HealthStatus represents the health status of the server
 type HealthStatus struct {
 	Status      string            `json:"status"`
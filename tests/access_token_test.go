@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
+)
+
+func TestAccessTokens(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	tokens, err := auth.NewAccessTokens("turn.example.com", []auth.AccessTokenKey{
+		{KID: "key-1", Algorithm: auth.TokenAlgorithmA256GCM, Key: key},
+	})
+	require.NoError(t, err)
+
+	macKey := make([]byte, 20)
+	_, err = rand.Read(macKey)
+	require.NoError(t, err)
+
+	token, err := tokens.Issue("key-1", macKey, time.Hour)
+	require.NoError(t, err)
+
+	parsed, err := tokens.Validate("key-1", token)
+	require.NoError(t, err)
+	assert.Equal(t, macKey, parsed.MACKey)
+	assert.Equal(t, time.Hour, parsed.Lifetime)
+	assert.WithinDuration(t, time.Now(), parsed.Timestamp, time.Second)
+
+	_, err = tokens.Validate("key-2", token)
+	assert.ErrorIs(t, err, auth.ErrUnknownKeyID)
+
+	tampered := append([]byte{}, token...)
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = tokens.Validate("key-1", tampered)
+	assert.Error(t, err)
+
+	// Tokens are bound to the server name
+	other, err := auth.NewAccessTokens("other.example.com", []auth.AccessTokenKey{
+		{KID: "key-1", Algorithm: auth.TokenAlgorithmA256GCM, Key: key},
+	})
+	require.NoError(t, err)
+	_, err = other.Validate("key-1", token)
+	assert.Error(t, err)
+
+	expired, err := tokens.Issue("key-1", macKey, 0)
+	require.NoError(t, err)
+	_, err = tokens.Validate("key-1", expired)
+	assert.Error(t, err)
+
+	_, err = auth.NewAccessTokens("turn.example.com", []auth.AccessTokenKey{
+		{KID: "key-1", Algorithm: auth.TokenAlgorithmA128GCM, Key: key},
+	})
+	assert.Error(t, err)
+}
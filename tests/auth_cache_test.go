@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// watchedAuthenticator is a fake store that reports changes made behind the
+// cache's back, like a MongoDB change stream
+type watchedAuthenticator struct {
+	*fakeAuthenticator
+	changes chan *auth.UserChange
+}
+
+func (w *watchedAuthenticator) WatchUsers(ctx context.Context, onChange func(change *auth.UserChange)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case change := <-w.changes:
+			onChange(change)
+		}
+	}
+}
+
+func newCachedFake(t *testing.T, backend auth.Authenticator, cfg *config.AuthCacheConfig) *auth.CachedAuthenticator {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	cache := auth.NewCachedAuthenticator(backend, cfg, logger)
+	t.Cleanup(func() { cache.Close(context.Background()) })
+	return cache
+}
+
+func TestAuthCache(t *testing.T) {
+	store := newFakeAuthenticator(fileRealm)
+	cache := newCachedFake(t, store, &config.AuthCacheConfig{Enabled: true, TTL: 60, NegativeTTL: 60, MaxEntries: 2})
+	ctx := context.Background()
+
+	alice := &models.User{Username: "alice", Enabled: true}
+	require.NoError(t, cache.CreateUser(ctx, alice, "alice-password"))
+	require.NoError(t, cache.CreateUser(ctx, &models.User{Username: "bob", Enabled: true}, "bob-password"))
+
+	// Repeated lookups are answered from the cache
+	for i := 0; i < 3; i++ {
+		key, _, err := cache.GetTURNAuthKey(ctx, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, turnKey("alice", "alice-password"), key)
+	}
+	assert.Equal(t, int32(1), store.lookups.Load())
+
+	// So are unknown users, until they are created
+	for i := 0; i < 3; i++ {
+		_, _, err := cache.GetTURNAuthKey(ctx, "carol")
+		assert.ErrorIs(t, err, auth.ErrUserNotFound)
+	}
+	assert.Equal(t, int32(2), store.lookups.Load())
+	require.NoError(t, cache.CreateUser(ctx, &models.User{Username: "carol", Enabled: true}, "carol-password"))
+	_, _, err := cache.GetTURNAuthKey(ctx, "carol")
+	assert.NoError(t, err)
+
+	// The least recently used entry is evicted beyond max_entries
+	_, _, err = cache.GetTURNAuthKey(ctx, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, 2, cache.Len())
+	lookups := store.lookups.Load()
+	_, _, err = cache.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, lookups+1, store.lookups.Load())
+
+	// Writes through the cache take effect at once
+	require.NoError(t, cache.UpdatePassword(ctx, alice.ID.Hex(), "new-password"))
+	key, _, err := cache.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, turnKey("alice", "new-password"), key)
+
+	// The backend's optional interfaces stay reachable
+	_, ok := auth.Unwrap(cache).(auth.QuotaStore)
+	assert.True(t, ok)
+}
+
+func TestAuthCacheExpiry(t *testing.T) {
+	store := newFakeAuthenticator(fileRealm)
+	cache := newCachedFake(t, store, &config.AuthCacheConfig{Enabled: true, TTL: 1, MaxEntries: 10})
+	ctx := context.Background()
+
+	require.NoError(t, store.CreateUser(ctx, &models.User{Username: "alice", Enabled: true}, "alice-password"))
+
+	_, _, err := cache.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+
+	// Changes made behind the cache show once the entry expires
+	user := store.user("alice")
+	user.Enabled = false
+	require.NoError(t, store.UpdateUser(ctx, user))
+	_, _, err = cache.GetTURNAuthKey(ctx, "alice")
+	assert.NoError(t, err)
+
+	time.Sleep(1100 * time.Millisecond)
+	_, _, err = cache.GetTURNAuthKey(ctx, "alice")
+	assert.ErrorIs(t, err, auth.ErrUserDisabled)
+
+	// Without negative_ttl unknown users are always looked up
+	lookups := store.lookups.Load()
+	cache.GetTURNAuthKey(ctx, "carol")
+	cache.GetTURNAuthKey(ctx, "carol")
+	assert.Equal(t, lookups+2, store.lookups.Load())
+}
+
+func TestAuthCacheChangeStream(t *testing.T) {
+	store := &watchedAuthenticator{
+		fakeAuthenticator: newFakeAuthenticator(fileRealm),
+		changes:           make(chan *auth.UserChange),
+	}
+	cache := newCachedFake(t, store, &config.AuthCacheConfig{Enabled: true, TTL: 60, NegativeTTL: 60, MaxEntries: 10})
+	ctx := context.Background()
+
+	alice := &models.User{Username: "alice", Enabled: true}
+	require.NoError(t, store.CreateUser(ctx, alice, "alice-password"))
+	_, _, err := cache.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	_, _, err = cache.GetTURNAuthKey(ctx, "bob")
+	require.ErrorIs(t, err, auth.ErrUserNotFound)
+
+	// A delete only carries the document ID
+	require.NoError(t, store.DeleteUser(ctx, alice.ID.Hex()))
+	store.changes <- &auth.UserChange{ID: alice.ID}
+	assert.Eventually(t, func() bool {
+		_, _, err := cache.GetTURNAuthKey(ctx, "alice")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+
+	// An insert clears the negative entry
+	require.NoError(t, store.CreateUser(ctx, &models.User{Username: "bob", Enabled: true}, "bob-password"))
+	store.changes <- &auth.UserChange{Username: "bob"}
+	assert.Eventually(t, func() bool {
+		_, _, err := cache.GetTURNAuthKey(ctx, "bob")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
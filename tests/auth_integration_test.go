@@ -7,8 +7,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 
 	"github.com/ga666666-new/pion-stun-server/internal/auth"
 	"github.com/ga666666-new/pion-stun-server/internal/config"
@@ -18,6 +20,14 @@ import (
 // Note: These tests require a running MongoDB instance
 // Use build tag 'integration' to run these tests: go test -tags=integration
 
+const mongoTestRealm = "test.example.com"
+
+var mongoTestOptions = config.MongoDBOptions{
+	MaxPoolSize:     10,
+	ConnectTimeout:  10,
+	ServerSelection: 5,
+}
+
 func TestMongoAuthenticator(t *testing.T) {
 	// Setup test configuration
 	cfg := &config.MongoDBConfig{
@@ -25,23 +35,24 @@ func TestMongoAuthenticator(t *testing.T) {
 		Database:   "test_stun_server",
 		Collection: "test_users",
 		Fields: config.MongoDBFields{
-			Username: "username",
-			Password: "password",
-			Enabled:  "enabled",
+			Username:    "username",
+			Password:    "password",
+			Credentials: "credentials",
+			Enabled:     "enabled",
 		},
+		Options: mongoTestOptions,
 	}
 
 	// Create authenticator
-	authenticator, err := auth.NewMongoAuthenticator(cfg)
+	authenticator, err := auth.NewMongoAuthenticator(cfg, mongoTestRealm, bcrypt.MinCost)
 	require.NoError(t, err)
-	defer authenticator.Close()
 
 	ctx := context.Background()
+	defer authenticator.Close(ctx)
 
 	// Test user creation
 	testUser := &models.User{
 		Username: "testuser",
-		Password: "testpass",
 		Enabled:  true,
 		Quota: &models.UserQuota{
 			MaxSessions:     10,
@@ -49,7 +60,7 @@ func TestMongoAuthenticator(t *testing.T) {
 		},
 	}
 
-	err = authenticator.CreateUser(ctx, testUser)
+	err = authenticator.CreateUser(ctx, testUser, "testpass")
 	require.NoError(t, err)
 
 	// Test authentication with correct credentials
@@ -76,11 +87,11 @@ func TestMongoAuthenticator(t *testing.T) {
 	assert.Error(t, err)
 
 	// Test user deletion
-	err = authenticator.DeleteUser(ctx, "testuser")
+	err = authenticator.DeleteUser(ctx, testUser.ID.Hex())
 	require.NoError(t, err)
 
 	// Verify user is deleted
-	_, err = authenticator.GetUser(ctx, "testuser")
+	_, err = authenticator.GetUser(ctx, testUser.ID.Hex())
 	assert.Error(t, err)
 }
 
@@ -91,27 +102,28 @@ func TestMongoAuthenticatorCustomFields(t *testing.T) {
 		Database:   "test_stun_server",
 		Collection: "custom_users",
 		Fields: config.MongoDBFields{
-			Username: "user_name",
-			Password: "user_pass",
-			Enabled:  "is_active",
+			Username:    "user_name",
+			Password:    "user_pass",
+			Credentials: "user_creds",
+			Enabled:     "is_active",
 		},
+		Options: mongoTestOptions,
 	}
 
 	// Create authenticator
-	authenticator, err := auth.NewMongoAuthenticator(cfg)
+	authenticator, err := auth.NewMongoAuthenticator(cfg, mongoTestRealm, bcrypt.MinCost)
 	require.NoError(t, err)
-	defer authenticator.Close()
 
 	ctx := context.Background()
+	defer authenticator.Close(ctx)
 
 	// Test user creation with custom fields
 	testUser := &models.User{
 		Username: "customuser",
-		Password: "custompass",
 		Enabled:  true,
 	}
 
-	err = authenticator.CreateUser(ctx, testUser)
+	err = authenticator.CreateUser(ctx, testUser, "custompass")
 	require.NoError(t, err)
 
 	// Test authentication
@@ -120,6 +132,76 @@ func TestMongoAuthenticatorCustomFields(t *testing.T) {
 	assert.Equal(t, "customuser", user.Username)
 
 	// Cleanup
-	err = authenticator.DeleteUser(ctx, "customuser")
+	err = authenticator.DeleteUser(ctx, testUser.ID.Hex())
+	require.NoError(t, err)
+}
+
+// TestMongoCacheChangeStream needs MongoDB running as a replica set, change
+// streams aren't available on a standalone server
+func TestMongoCacheChangeStream(t *testing.T) {
+	cfg := &config.MongoDBConfig{
+		URI:        "mongodb://localhost:27017",
+		Database:   "test_stun_server",
+		Collection: "cache_users",
+		Fields: config.MongoDBFields{
+			Username:    "username",
+			Password:    "password",
+			Credentials: "credentials",
+			Enabled:     "enabled",
+		},
+		Options: mongoTestOptions,
+	}
+
+	backend, err := auth.NewMongoAuthenticator(cfg, mongoTestRealm, bcrypt.MinCost)
 	require.NoError(t, err)
-}
\ No newline at end of file
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	cache := auth.NewCachedAuthenticator(backend, &config.AuthCacheConfig{Enabled: true, TTL: 300, MaxEntries: 100}, logger)
+	ctx := context.Background()
+	defer cache.Close(ctx)
+
+	alice := &models.User{Username: "alice", Enabled: true, Quota: &models.UserQuota{MaxSessions: 5}}
+	bob := &models.User{Username: "bob", Enabled: true}
+	require.NoError(t, backend.CreateUser(ctx, alice, "alice-password"))
+	require.NoError(t, backend.CreateUser(ctx, bob, "bob-password"))
+	defer backend.DeleteUser(ctx, alice.ID.Hex())
+	defer backend.DeleteUser(ctx, bob.ID.Hex())
+
+	// bobDropped caches bob, changes his password behind the cache's back
+	// and reports whether the stream dropped the entry
+	bobDropped := func() bool {
+		_, _, err := cache.GetTURNAuthKey(ctx, "bob")
+		require.NoError(t, err)
+		require.NoError(t, backend.UpdatePassword(ctx, bob.ID.Hex(), "bob-password"))
+		time.Sleep(100 * time.Millisecond)
+		return cache.Len() == 0
+	}
+
+	// Credential changes made outside the cache drop the entry, once the
+	// stream is open
+	require.Eventually(t, bobDropped, 10*time.Second, 10*time.Millisecond)
+
+	// Quota counter updates don't. The password change of bob that follows
+	// them in the stream shows they have been seen.
+	_, _, err = cache.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	acquired, err := backend.AcquireSession(ctx, "alice", "turn-a", 5)
+	require.NoError(t, err)
+	require.True(t, acquired)
+	require.NoError(t, backend.AddUsedBandwidth(ctx, "alice", 1500))
+	require.NoError(t, backend.ReleaseSession(ctx, "alice", "turn-a"))
+
+	_, _, err = cache.GetTURNAuthKey(ctx, "bob")
+	require.NoError(t, err)
+	require.NoError(t, backend.UpdatePassword(ctx, bob.ID.Hex(), "bob-password"))
+	assert.Eventually(t, func() bool { return cache.Len() == 1 }, 5*time.Second, 50*time.Millisecond)
+	_, user, err := cache.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	assert.Zero(t, user.Quota.UsedBandwidth, "alice's entry is still the cached one")
+
+	// Disabling a user drops the entry too
+	alice.Enabled = false
+	require.NoError(t, backend.UpdateUser(ctx, alice))
+	assert.Eventually(t, func() bool { return cache.Len() == 0 }, 5*time.Second, 50*time.Millisecond)
+}
@@ -108,4 +108,23 @@ func TestConfigValidation(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestConfigDefaultDenyRanges(t *testing.T) {
+	cfg, err := config.Load("test-config.yaml")
+	require.NoError(t, err)
+
+	// Private networks are refused unless deny_ranges is configured
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7", "127.0.0.0/8"} {
+		assert.Contains(t, cfg.Server.TURN.DenyRanges, cidr)
+	}
+	assert.Empty(t, cfg.Server.TURN.RelayRanges)
+}
+
+func TestConfigDefaultMaxLifetime(t *testing.T) {
+	cfg, err := config.Load("test-config.yaml")
+	require.NoError(t, err)
+
+	// The longest lifetime pion/turn accepts, so the default isn't capped
+	assert.Equal(t, 3599, cfg.Server.TURN.MaxLifetime)
+}
@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
+)
+
+func TestNewCredentials(t *testing.T) {
+	creds, err := auth.NewCredentials("alice", "alice-password", []string{"a.example.com", "b.example.com"}, bcrypt.MinCost)
+	require.NoError(t, err)
+
+	assert.Equal(t, auth.CredentialsVersion, creds.Version)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(creds.PasswordHash), []byte("alice-password")))
+	require.Len(t, creds.TURNKeys, 2)
+
+	keys, err := creds.Keys("b.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, auth.TURNKey("alice", "b.example.com", "alice-password"), keys.MD5)
+	assert.Equal(t, auth.TURNKeySHA256("alice", "b.example.com", "alice-password"), keys.SHA256)
+
+	_, err = creds.Keys("c.example.com")
+	assert.ErrorIs(t, err, auth.ErrNoTURNKey)
+
+	assert.True(t, creds.Verify("alice", "a.example.com", "alice-password"))
+	assert.False(t, creds.Verify("alice", "a.example.com", "wrong-password"))
+}
+
+func TestConvertLegacyCredentials(t *testing.T) {
+	const realm = "test.example.com"
+
+	// A TURN key written by the old usermgr, with its SHA-256 companion
+	md5Key := strings.ToUpper(auth.TURNKey("alice", realm, "alice-password"))
+	creds, err := auth.ConvertLegacyCredentials(md5Key, auth.TURNKeySHA256("alice", realm, "alice-password"), realm)
+	require.NoError(t, err)
+	assert.Empty(t, creds.PasswordHash)
+
+	keys, err := creds.Keys(realm)
+	require.NoError(t, err)
+	assert.Equal(t, strings.ToLower(md5Key), keys.MD5)
+	assert.Equal(t, auth.TURNKeySHA256("alice", realm, "alice-password"), keys.SHA256)
+
+	// Without a login hash the password is checked against the TURN key,
+	// and a login fills in the hash
+	assert.True(t, creds.Verify("alice", realm, "alice-password"))
+	assert.False(t, creds.Verify("alice", realm, "wrong-password"))
+	changed, err := creds.Complete("alice", "alice-password", []string{realm}, bcrypt.MinCost)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(creds.PasswordHash), []byte("alice-password")))
+
+	changed, err = creds.Complete("alice", "alice-password", []string{realm}, bcrypt.MinCost)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// A bcrypt hash written by the library API has no TURN key until the
+	// next login derives it
+	hash, err := bcrypt.GenerateFromPassword([]byte("bob-password"), bcrypt.MinCost)
+	require.NoError(t, err)
+	creds, err = auth.ConvertLegacyCredentials(string(hash), "", realm)
+	require.NoError(t, err)
+	assert.Equal(t, string(hash), creds.PasswordHash)
+	_, err = creds.Keys(realm)
+	assert.ErrorIs(t, err, auth.ErrNoTURNKey)
+
+	require.True(t, creds.Verify("bob", realm, "bob-password"))
+	changed, err = creds.Complete("bob", "bob-password", []string{realm}, bcrypt.MinCost)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	keys, err = creds.Keys(realm)
+	require.NoError(t, err)
+	assert.Equal(t, auth.TURNKey("bob", realm, "bob-password"), keys.MD5)
+
+	// Anything else is not recognized
+	for _, password := range []string{"", "plain-text-password", auth.TURNKeySHA256("carol", realm, "x")} {
+		_, err = auth.ConvertLegacyCredentials(password, "", realm)
+		assert.Error(t, err, password)
+	}
+}
@@ -0,0 +1,285 @@
+package tests
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// fakeAuthenticator is an in-memory user store for driving the servers
+// without MongoDB
+type fakeAuthenticator struct {
+	mu      sync.Mutex
+	realm   string
+	users   map[string]*models.User
+	keys    map[string]string
+	lookups atomic.Int32
+
+	// instanceSessions counts sessions by "instance/username"
+	instanceSessions map[string]int
+
+	// failUsage makes AddUsedBandwidth fail like an unreachable store
+	failUsage atomic.Bool
+
+	// acquireDelay makes AcquireSession take that long, like a slow store
+	acquireDelay atomic.Int64
+}
+
+var (
+	_ auth.Authenticator = (*fakeAuthenticator)(nil)
+	_ auth.QuotaStore    = (*fakeAuthenticator)(nil)
+)
+
+func newFakeAuthenticator(realm string) *fakeAuthenticator {
+	return &fakeAuthenticator{
+		realm: realm,
+		users: make(map[string]*models.User),
+		keys:  make(map[string]string),
+
+		instanceSessions: make(map[string]int),
+	}
+}
+
+// user returns a copy of a stored user
+func (f *fakeAuthenticator) user(username string) *models.User {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, ok := f.users[username]
+	if !ok {
+		return nil
+	}
+	copied := *user
+	if user.Quota != nil {
+		quota := *user.Quota
+		copied.Quota = &quota
+	}
+	return &copied
+}
+
+func (f *fakeAuthenticator) GetTURNAuthKey(ctx context.Context, username string) (string, *models.User, error) {
+	f.lookups.Add(1)
+
+	user := f.user(username)
+	if user == nil {
+		return "", nil, auth.ErrUserNotFound
+	}
+	if !user.Enabled {
+		return "", nil, auth.ErrUserDisabled
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.keys[username], user, nil
+}
+
+func (f *fakeAuthenticator) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	key, user, err := f.GetTURNAuthKey(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if key != hex.EncodeToString(turn.GenerateAuthKey(username, f.realm, password)) {
+		return nil, fmt.Errorf("invalid password")
+	}
+	return user, nil
+}
+
+func (f *fakeAuthenticator) CreateUser(ctx context.Context, user *models.User, plainPassword string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.users[user.Username]; ok {
+		return fmt.Errorf("user already exists")
+	}
+	user.ID = primitive.NewObjectID()
+	stored := *user
+	stored.KeySHA256 = auth.TURNKeySHA256(user.Username, f.realm, plainPassword)
+	f.users[user.Username] = &stored
+	f.keys[user.Username] = hex.EncodeToString(turn.GenerateAuthKey(user.Username, f.realm, plainPassword))
+	return nil
+}
+
+func (f *fakeAuthenticator) UpdateUser(ctx context.Context, user *models.User) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.users[user.Username]; !ok {
+		return auth.ErrUserNotFound
+	}
+	stored := *user
+	f.users[user.Username] = &stored
+	return nil
+}
+
+func (f *fakeAuthenticator) UpdatePassword(ctx context.Context, userID string, newPassword string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for username, user := range f.users {
+		if user.ID.Hex() == userID {
+			f.keys[username] = hex.EncodeToString(turn.GenerateAuthKey(username, f.realm, newPassword))
+			user.KeySHA256 = auth.TURNKeySHA256(username, f.realm, newPassword)
+			return nil
+		}
+	}
+	return auth.ErrUserNotFound
+}
+
+func (f *fakeAuthenticator) DeleteUser(ctx context.Context, userID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for username, user := range f.users {
+		if user.ID.Hex() == userID {
+			delete(f.users, username)
+			delete(f.keys, username)
+			return nil
+		}
+	}
+	return auth.ErrUserNotFound
+}
+
+func (f *fakeAuthenticator) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, user := range f.users {
+		if user.ID.Hex() == userID {
+			copied := *user
+			return &copied, nil
+		}
+	}
+	return nil, auth.ErrUserNotFound
+}
+
+func (f *fakeAuthenticator) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	if user := f.user(username); user != nil {
+		return user, nil
+	}
+	return nil, auth.ErrUserNotFound
+}
+
+func (f *fakeAuthenticator) ListUsers(ctx context.Context, offset, limit int) ([]*models.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var users []*models.User
+	for _, user := range f.users {
+		copied := *user
+		users = append(users, &copied)
+	}
+	if offset >= len(users) {
+		return nil, nil
+	}
+	users = users[offset:]
+	if limit > 0 && limit < len(users) {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (f *fakeAuthenticator) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeAuthenticator) Close(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeAuthenticator) AcquireSession(ctx context.Context, username, instance string, max int) (bool, error) {
+	if delay := time.Duration(f.acquireDelay.Load()); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, ok := f.users[username]
+	if !ok || user.Quota == nil {
+		return max <= 0, nil
+	}
+	if max > 0 && user.Quota.CurrentSessions >= max {
+		return false, nil
+	}
+	user.Quota.CurrentSessions++
+	f.instanceSessions[instance+"/"+username]++
+	return true, nil
+}
+
+func (f *fakeAuthenticator) ReleaseSession(ctx context.Context, username, instance string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := instance + "/" + username
+	if f.instanceSessions[key] <= 0 {
+		return nil
+	}
+	f.instanceSessions[key]--
+	if user, ok := f.users[username]; ok && user.Quota != nil && user.Quota.CurrentSessions > 0 {
+		user.Quota.CurrentSessions--
+	}
+	return nil
+}
+
+func (f *fakeAuthenticator) ReleaseInstanceSessions(ctx context.Context, instance string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var released int64
+	for key, sessions := range f.instanceSessions {
+		username, ok := strings.CutPrefix(key, instance+"/")
+		if !ok {
+			continue
+		}
+		delete(f.instanceSessions, key)
+		if user, ok := f.users[username]; ok && user.Quota != nil && sessions > 0 {
+			user.Quota.CurrentSessions = max(user.Quota.CurrentSessions-sessions, 0)
+			released++
+		}
+	}
+	return released, nil
+}
+
+func (f *fakeAuthenticator) AddUsedBandwidth(ctx context.Context, username string, bytes int64) error {
+	if f.failUsage.Load() {
+		return errors.New("store unavailable")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if user, ok := f.users[username]; ok && user.Quota != nil {
+		user.Quota.UsedBandwidth += bytes
+	}
+	return nil
+}
+
+func (f *fakeAuthenticator) ResetUsage(ctx context.Context, now, next time.Time) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var reset int64
+	for _, user := range f.users {
+		if user.Quota != nil && now.After(user.Quota.ResetAt) {
+			user.Quota.UsedBandwidth = 0
+			user.Quota.ResetAt = next
+			reset++
+		}
+	}
+	return reset, nil
+}
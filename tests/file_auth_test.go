@@ -0,0 +1,204 @@
+package tests
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+const fileRealm = "test.example.com"
+
+func turnKey(username, password string) string {
+	return hex.EncodeToString(turn.GenerateAuthKey(username, fileRealm, password))
+}
+
+func newFileAuthenticator(t *testing.T, name, contents string) (*auth.FileAuthenticator, string) {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	store, err := auth.NewFileAuthenticator(&config.FileAuthConfig{Path: path}, fileRealm, logger)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close(context.Background()) })
+
+	return store, path
+}
+
+func TestFileAuthenticatorYAML(t *testing.T) {
+	store, _ := newFileAuthenticator(t, "users.yaml", `
+users:
+  - username: alice
+    key: "`+turnKey("alice", "alice-password")+`"
+    quota:
+      max_sessions: 2
+      max_bandwidth: 1000000
+  - username: bob
+    key: "`+turnKey("bob", "bob-password")+`"
+    enabled: false
+`)
+	ctx := context.Background()
+
+	key, user, err := store.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, turnKey("alice", "alice-password"), key)
+	assert.True(t, user.Enabled)
+	require.NotNil(t, user.Quota)
+	assert.Equal(t, 2, user.Quota.MaxSessions)
+	assert.Equal(t, int64(1000000), user.Quota.MaxBandwidth)
+
+	_, err = store.Authenticate(ctx, "alice", "alice-password")
+	assert.NoError(t, err)
+	_, err = store.Authenticate(ctx, "alice", "wrong-password")
+	assert.Error(t, err)
+
+	_, _, err = store.GetTURNAuthKey(ctx, "bob")
+	assert.Error(t, err, "disabled users have no key")
+	_, _, err = store.GetTURNAuthKey(ctx, "carol")
+	assert.Error(t, err)
+
+	users, err := store.ListUsers(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, "alice", users[0].Username)
+}
+
+func TestFileAuthenticatorJSON(t *testing.T) {
+	store, _ := newFileAuthenticator(t, "users.json", `{"users": [
+		{"username": "alice", "key": "`+turnKey("alice", "alice-password")+`", "quota": {"max_sessions": 1}}
+	]}`)
+
+	_, user, err := store.GetTURNAuthKey(context.Background(), "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 1, user.Quota.MaxSessions)
+}
+
+func TestFileAuthenticatorHTDigest(t *testing.T) {
+	store, _ := newFileAuthenticator(t, "users", "# edge site users\n"+
+		"alice:"+fileRealm+":"+turnKey("alice", "alice-password")+"\n\n")
+
+	_, err := store.Authenticate(context.Background(), "alice", "alice-password")
+	assert.NoError(t, err)
+
+	// Entries for another realm and malformed keys are rejected
+	path := filepath.Join(t.TempDir(), "users")
+	require.NoError(t, os.WriteFile(path, []byte("alice:other.realm:"+turnKey("alice", "x")+"\n"), 0o600))
+	_, err = auth.NewFileAuthenticator(&config.FileAuthConfig{Path: path}, fileRealm, logrus.New())
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("alice:"+fileRealm+":not-a-key\n"), 0o600))
+	_, err = auth.NewFileAuthenticator(&config.FileAuthConfig{Path: path}, fileRealm, logrus.New())
+	assert.Error(t, err)
+}
+
+func TestFileAuthenticatorReload(t *testing.T) {
+	store, path := newFileAuthenticator(t, "users.yaml", `
+users:
+  - username: alice
+    key: "`+turnKey("alice", "old-password")+`"
+`)
+	ctx := context.Background()
+
+	users, err := store.ListUsers(ctx, 0, 1)
+	require.NoError(t, err)
+	id := users[0].ID.Hex()
+
+	// Replace the file the way editors do
+	tmp := path + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte(`
+users:
+  - username: alice
+    key: "`+turnKey("alice", "new-password")+`"
+  - username: bob
+    key: "`+turnKey("bob", "bob-password")+`"
+`), 0o600))
+	require.NoError(t, os.Rename(tmp, path))
+
+	assert.Eventually(t, func() bool {
+		_, err := store.Authenticate(ctx, "alice", "new-password")
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	_, err = store.Authenticate(ctx, "bob", "bob-password")
+	assert.NoError(t, err)
+
+	user, err := store.GetUser(ctx, id)
+	require.NoError(t, err, "IDs survive reloads")
+	assert.Equal(t, "alice", user.Username)
+
+	// A broken file keeps the previous users
+	require.NoError(t, os.WriteFile(path, []byte("users: [\n"), 0o600))
+	time.Sleep(2 * time.Second)
+	_, err = store.Authenticate(ctx, "alice", "new-password")
+	assert.NoError(t, err)
+}
+
+func TestFileAuthenticatorCloseCancelsReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("users: []\n"), 0o600))
+
+	logger, hook := logtest.NewNullLogger()
+	store, err := auth.NewFileAuthenticator(&config.FileAuthConfig{Path: path}, fileRealm, logger)
+	require.NoError(t, err)
+
+	// A change right before Close would be reloaded after it, once the
+	// file is gone
+	require.NoError(t, os.WriteFile(path, []byte("users: [\n"), 0o600))
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, store.Close(context.Background()))
+	require.NoError(t, os.Remove(path))
+
+	time.Sleep(1500 * time.Millisecond)
+	for _, entry := range hook.AllEntries() {
+		assert.Greater(t, entry.Level, logrus.WarnLevel, entry.Message)
+	}
+}
+
+func TestFileAuthenticatorWriteBack(t *testing.T) {
+	store, path := newFileAuthenticator(t, "users.yaml", "users: []\n")
+	ctx := context.Background()
+
+	user := &models.User{Username: "alice", Enabled: true, Quota: &models.UserQuota{MaxSessions: 3}}
+	require.NoError(t, store.CreateUser(ctx, user, "alice-password"))
+	require.NoError(t, store.UpdatePassword(ctx, user.ID.Hex(), "changed-password"))
+
+	user.Enabled = false
+	require.NoError(t, store.UpdateUser(ctx, user))
+
+	// The file on disk holds the same users
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	reopened, err := auth.NewFileAuthenticator(&config.FileAuthConfig{Path: path}, fileRealm, logger)
+	require.NoError(t, err)
+	defer reopened.Close(ctx)
+
+	users, err := reopened.ListUsers(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.False(t, users[0].Enabled)
+	assert.Equal(t, 3, users[0].Quota.MaxSessions)
+	assert.Equal(t, auth.TURNKeySHA256("alice", fileRealm, "changed-password"), users[0].KeySHA256)
+
+	users[0].Enabled = true
+	require.NoError(t, reopened.UpdateUser(ctx, users[0]))
+	_, err = reopened.Authenticate(ctx, "alice", "changed-password")
+	assert.NoError(t, err)
+
+	require.NoError(t, reopened.DeleteUser(ctx, users[0].ID.Hex()))
+	users, err = reopened.ListUsers(ctx, 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, users)
+}
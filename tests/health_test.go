@@ -0,0 +1,208 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/internal/health"
+	"github.com/ga666666-new/pion-stun-server/internal/server"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// healthRequest sends a request to a health handler with an optional
+// bearer token and returns the recorded response
+func healthRequest(t *testing.T, handler http.Handler, method, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestICEServersEndpoint(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.STUN.Port = 3478
+	cfg.Server.TURN.Port = 3479
+	cfg.Server.TURN.Realm = "test.example.com"
+	cfg.Server.TURN.TLS = config.TLSConfig{Port: 5349, CertFile: "cert.pem", KeyFile: "key.pem"}
+	cfg.Server.TURN.DTLS = true
+	cfg.Server.Health.ICEServers = config.ICEServersConfig{
+		Enabled: true,
+		Token:   "ice-token",
+		TTL:     600,
+		Host:    "turn.example.com",
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	rest := auth.NewRESTCredentials("ice-secret", nil)
+	handler := health.NewHealthHandler(cfg, nil, rest, nil, nil, logger).Handler()
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		for _, token := range []string{"", "wrong-token"} {
+			rec := healthRequest(t, handler, http.MethodGet, "/ice-servers", token)
+			assert.Equal(t, http.StatusUnauthorized, rec.Code, "token %q", token)
+			assert.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"))
+		}
+	})
+
+	t.Run("Credentials", func(t *testing.T) {
+		issued := time.Now()
+		rec := healthRequest(t, handler, http.MethodGet, "/ice-servers?user=alice", "ice-token")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var response health.ICEServersResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		assert.Equal(t, 600, response.TTL)
+		assert.WithinDuration(t, issued.Add(600*time.Second), response.ExpiresAt, 2*time.Second)
+
+		require.Len(t, response.ICEServers, 2)
+		assert.Equal(t, []string{"stun:turn.example.com:3478"}, response.ICEServers[0].URLs)
+		assert.Empty(t, response.ICEServers[0].Username)
+
+		turnServer := response.ICEServers[1]
+		assert.Equal(t, []string{
+			"turn:turn.example.com:3479?transport=udp",
+			"turn:turn.example.com:3479?transport=tcp",
+			"turns:turn.example.com:5349?transport=tcp",
+			"turns:turn.example.com:5349?transport=udp",
+		}, turnServer.URLs)
+		assert.True(t, strings.HasSuffix(turnServer.Username, ":alice"), turnServer.Username)
+
+		// The credentials are the TURN server's REST API credentials
+		keys, err := rest.Keys(turnServer.Username, cfg.Server.TURN.Realm)
+		require.NoError(t, err)
+		expected := stun.NewLongTermIntegrity(turnServer.Username, cfg.Server.TURN.Realm, turnServer.Credential)
+		assert.Contains(t, keys, []byte(expected))
+	})
+
+	t.Run("AnonymousUser", func(t *testing.T) {
+		rec := healthRequest(t, handler, http.MethodGet, "/ice-servers", "ice-token")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var response health.ICEServersResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		_, err := rest.Keys(response.ICEServers[1].Username, cfg.Server.TURN.Realm)
+		assert.NoError(t, err)
+	})
+
+	t.Run("InvalidUser", func(t *testing.T) {
+		rec := healthRequest(t, handler, http.MethodGet, "/ice-servers?user=a:b", "ice-token")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestLockoutsEndpoint(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.TURN = config.TURNConfig{
+		Port:     19343,
+		Address:  "127.0.0.1",
+		Realm:    "test.example.com",
+		PublicIP: "127.0.0.1",
+		Lockout: config.LockoutConfig{
+			Enabled:       true,
+			UserThreshold: 2,
+			IPThreshold:   10,
+			Window:        60,
+			Duration:      60,
+			MaxDuration:   600,
+		},
+	}
+	cfg.Server.Health.AdminToken = "admin-token"
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	store := newFakeAuthenticator(cfg.Server.TURN.Realm)
+	require.NoError(t, store.CreateUser(context.Background(), &models.User{Username: "alice", Enabled: true}, "alice-password"))
+
+	turnServer := server.NewTURNServer(&cfg.Server.TURN, store, nil, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	for i := 0; i < 2; i++ {
+		_, err := allocate(t, "127.0.0.1:19343", "alice", "wrong-password", cfg.Server.TURN.Realm)
+		require.Error(t, err)
+	}
+
+	handler := health.NewHealthHandler(cfg, store, nil, nil, turnServer, logger).Handler()
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		for _, method := range []string{http.MethodGet, http.MethodDelete} {
+			for _, token := range []string{"", "wrong-token"} {
+				rec := healthRequest(t, handler, method, "/lockouts", token)
+				assert.Equal(t, http.StatusUnauthorized, rec.Code, "%s with token %q", method, token)
+			}
+		}
+		assert.NotEmpty(t, turnServer.Lockouts())
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		noAdmin := *cfg
+		noAdmin.Server.Health.AdminToken = ""
+		handler := health.NewHealthHandler(&noAdmin, store, nil, nil, turnServer, logger).Handler()
+		rec := healthRequest(t, handler, http.MethodGet, "/lockouts", "")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		rec := healthRequest(t, handler, http.MethodGet, "/lockouts", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var response struct {
+			Lockouts []*models.Lockout `json:"lockouts"`
+			Count    int               `json:"count"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		require.NotEmpty(t, response.Lockouts)
+		assert.Equal(t, len(response.Lockouts), response.Count)
+
+		lockout := response.Lockouts[0]
+		assert.Equal(t, cfg.Server.TURN.Realm, lockout.Realm)
+		assert.Equal(t, server.LockoutUsername, lockout.Kind)
+		assert.Equal(t, "alice", lockout.Key)
+		assert.Equal(t, "127.0.0.1", lockout.IP)
+		assert.False(t, lockout.LockedUntil.IsZero())
+	})
+
+	t.Run("InvalidKind", func(t *testing.T) {
+		rec := healthRequest(t, handler, http.MethodDelete, "/lockouts?kind=realm", "admin-token")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		rec := healthRequest(t, handler, http.MethodDelete, "/lockouts?kind=username&key=alice", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var response map[string]int
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		assert.Equal(t, 1, response["cleared"])
+
+		for _, lockout := range turnServer.Lockouts() {
+			assert.NotEqual(t, server.LockoutUsername, lockout.Kind)
+		}
+		_, err := allocate(t, "127.0.0.1:19343", "alice", "alice-password", cfg.Server.TURN.Realm)
+		require.NoError(t, err)
+	})
+
+	t.Run("ClearAll", func(t *testing.T) {
+		rec := healthRequest(t, handler, http.MethodDelete, "/lockouts", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.Empty(t, turnServer.Lockouts())
+	})
+}
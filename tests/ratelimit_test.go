@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ga666666-new/pion-stun-server/internal/ratelimit"
+)
+
+// fakeClock is a clock tests move forward by hand
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	clock := newFakeClock()
+	bucket := ratelimit.NewTokenBucketWithClock(100000, clock.Now)
+
+	// A new bucket is full, holding one second's worth of traffic
+	assert.True(t, bucket.Allow(100000))
+	assert.False(t, bucket.Allow(1))
+	assert.Equal(t, int64(1), bucket.Throttled())
+
+	// Slow rates still pass a maximum-size datagram
+	slow := ratelimit.NewTokenBucketWithClock(1000, clock.Now)
+	assert.True(t, slow.Allow(ratelimit.MinBurst))
+	assert.False(t, slow.Allow(1))
+}
+
+func TestTokenBucketRate(t *testing.T) {
+	clock := newFakeClock()
+	bucket := ratelimit.NewTokenBucketWithClock(100000, clock.Now)
+	assert.True(t, bucket.Allow(100000))
+
+	clock.Advance(500 * time.Millisecond)
+	assert.True(t, bucket.Allow(50000))
+	assert.False(t, bucket.Allow(1))
+
+	// Tokens don't pile up beyond the burst
+	clock.Advance(10 * time.Second)
+	assert.False(t, bucket.Allow(100001))
+
+	// Lowering the rate caps the burst and refills slower
+	bucket.SetRate(1000)
+	assert.False(t, bucket.Allow(ratelimit.MinBurst+1))
+	assert.True(t, bucket.Allow(ratelimit.MinBurst))
+	clock.Advance(time.Second)
+	assert.False(t, bucket.Allow(1001))
+	assert.True(t, bucket.Allow(1000))
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	clock := newFakeClock()
+	bucket := ratelimit.NewTokenBucketWithClock(100000, clock.Now)
+
+	assert.Equal(t, time.Duration(0), bucket.Reserve(100000))
+
+	// Reservations go into debt and wait for it to be paid off
+	assert.Equal(t, 500*time.Millisecond, bucket.Reserve(50000))
+	assert.Equal(t, time.Second, bucket.Reserve(50000))
+	assert.False(t, bucket.Allow(1), "the debt is paid before packets pass again")
+	assert.Equal(t, int64(1), bucket.Throttled())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, time.Duration(0), bucket.Reserve(0))
+	assert.True(t, bucket.Allow(0))
+}
+
+func TestTokenBucketIdle(t *testing.T) {
+	clock := newFakeClock()
+	bucket := ratelimit.NewTokenBucketWithClock(100000, clock.Now)
+	assert.False(t, bucket.Idle(time.Minute))
+
+	clock.Advance(time.Minute)
+	assert.True(t, bucket.Idle(time.Minute))
+
+	// A bucket in debt isn't idle until the debt is paid off
+	bucket.Reserve(100000 * 120)
+	clock.Advance(time.Minute)
+	assert.False(t, bucket.Idle(time.Minute))
+	clock.Advance(2 * time.Minute)
+	assert.True(t, bucket.Idle(time.Minute))
+}
@@ -0,0 +1,439 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/internal/server"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+func sqliteConfig(t *testing.T) *config.SQLConfig {
+	return &config.SQLConfig{
+		Driver:        "sqlite",
+		DSN:           filepath.Join(t.TempDir(), "users.db"),
+		Table:         "users",
+		SessionsTable: "sessions",
+		Columns: config.SQLColumns{
+			Username:  "username",
+			Password:  "password",
+			Enabled:   "enabled",
+			KeySHA256: "key_sha256",
+			Metadata:  "metadata",
+			CreatedAt: "created_at",
+			UpdatedAt: "updated_at",
+			LastLogin: "last_login",
+		},
+		Migrate: true,
+		Options: config.SQLOptions{MaxOpenConns: 1},
+	}
+}
+
+func newSQLAuthenticator(t *testing.T, cfg *config.SQLConfig) *auth.SQLAuthenticator {
+	store, err := auth.NewSQLAuthenticator(cfg, fileRealm)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close(context.Background()) })
+	return store
+}
+
+func TestSQLAuthenticatorUsers(t *testing.T) {
+	cfg := sqliteConfig(t)
+	store := newSQLAuthenticator(t, cfg)
+	ctx := context.Background()
+
+	alice := &models.User{
+		Username: "alice",
+		Enabled:  true,
+		Quota:    &models.UserQuota{MaxSessions: 2, MaxBandwidth: 1000000},
+		Metadata: map[string]interface{}{"team": "edge"},
+	}
+	require.NoError(t, store.CreateUser(ctx, alice, "alice-password"))
+	require.NoError(t, store.CreateUser(ctx, &models.User{Username: "bob", Enabled: false}, "bob-password"))
+	assert.Error(t, store.CreateUser(ctx, &models.User{Username: "alice", Enabled: true}, "x"), "usernames are unique")
+
+	key, user, err := store.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, turnKey("alice", "alice-password"), key)
+	assert.Equal(t, auth.TURNKeySHA256("alice", fileRealm, "alice-password"), user.KeySHA256)
+	assert.Equal(t, alice.ID, user.ID)
+	require.NotNil(t, user.Quota)
+	assert.Equal(t, 2, user.Quota.MaxSessions)
+	assert.Equal(t, int64(1000000), user.Quota.MaxBandwidth)
+	assert.Equal(t, "edge", user.Metadata["team"])
+
+	_, _, err = store.GetTURNAuthKey(ctx, "bob")
+	assert.Error(t, err, "disabled users have no key")
+	_, _, err = store.GetTURNAuthKey(ctx, "carol")
+	assert.Error(t, err)
+
+	_, err = store.Authenticate(ctx, "alice", "alice-password")
+	assert.NoError(t, err)
+	_, err = store.Authenticate(ctx, "alice", "wrong-password")
+	assert.Error(t, err)
+
+	require.NoError(t, store.UpdatePassword(ctx, alice.ID.Hex(), "new-password"))
+	_, err = store.Authenticate(ctx, "alice", "new-password")
+	assert.NoError(t, err)
+	_, user, err = store.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, auth.TURNKeySHA256("alice", fileRealm, "new-password"), user.KeySHA256)
+
+	alice.Enabled = false
+	alice.Quota.MaxSessions = 5
+	require.NoError(t, store.UpdateUser(ctx, alice))
+	user, err = store.GetUser(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.False(t, user.Enabled)
+	assert.Equal(t, 5, user.Quota.MaxSessions)
+
+	// Disabled users are still found by the management API
+	user, err = store.GetUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID, user.ID)
+	_, err = store.GetUserByUsername(ctx, "nobody")
+	assert.ErrorIs(t, err, auth.ErrUserNotFound)
+
+	users, err := store.ListUsers(ctx, 0, 10)
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+
+	require.NoError(t, store.DeleteUser(ctx, alice.ID.Hex()))
+	_, err = store.GetUser(ctx, alice.ID.Hex())
+	assert.Error(t, err)
+
+	// Migrations are only applied once
+	reopened := newSQLAuthenticator(t, cfg)
+	_, err = reopened.GetUser(ctx, users[0].ID.Hex())
+	assert.NoError(t, err)
+}
+
+func TestSQLAuthenticatorColumnMapping(t *testing.T) {
+	cfg := sqliteConfig(t)
+	cfg.Table = "accounts"
+	cfg.Columns = config.SQLColumns{Username: "login", Password: "turn_key"}
+
+	store := newSQLAuthenticator(t, cfg)
+	ctx := context.Background()
+	require.NoError(t, store.CreateUser(ctx, &models.User{Username: "alice"}, "alice-password"))
+
+	// Rows written by other tools under the mapped names are picked up, and
+	// without an enabled column every user is enabled
+	db, err := sql.Open("sqlite", cfg.DSN)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(`INSERT INTO accounts (id, login, turn_key) VALUES ('0123456789abcdef01234567', 'bob', ?)`,
+		turnKey("bob", "bob-password"))
+	require.NoError(t, err)
+
+	_, err = store.Authenticate(ctx, "alice", "alice-password")
+	assert.NoError(t, err)
+	user, err := store.Authenticate(ctx, "bob", "bob-password")
+	require.NoError(t, err)
+	assert.True(t, user.Enabled)
+	assert.Nil(t, user.Quota)
+}
+
+func TestSQLAuthenticatorExistingSchema(t *testing.T) {
+	cfg := sqliteConfig(t)
+	cfg.Migrate = false
+	cfg.Table = "accounts"
+	cfg.Columns = config.SQLColumns{
+		ID:              "account_id",
+		Username:        "login",
+		Password:        "turn_key",
+		Enabled:         "active",
+		MaxSessions:     "max_sessions",
+		MaxBandwidth:    "max_bandwidth",
+		MaxDuration:     "max_duration",
+		CurrentSessions: "current_sessions",
+		UsedBandwidth:   "used_bandwidth",
+		ResetAt:         "reset_at",
+	}
+
+	// A platform's own table, keyed by integers, without metadata or
+	// timestamps
+	db, err := sql.Open("sqlite", cfg.DSN)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE accounts (
+		account_id INTEGER PRIMARY KEY,
+		login TEXT NOT NULL UNIQUE,
+		turn_key TEXT NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		max_sessions INTEGER, max_bandwidth BIGINT, max_duration INTEGER,
+		current_sessions INTEGER NOT NULL DEFAULT 0,
+		used_bandwidth BIGINT NOT NULL DEFAULT 0,
+		reset_at TIMESTAMP
+	)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO accounts (account_id, login, turn_key) VALUES (42, 'alice', ?)`,
+		turnKey("alice", "alice-password"))
+	require.NoError(t, err)
+
+	store := newSQLAuthenticator(t, cfg)
+	ctx := context.Background()
+
+	user, err := store.Authenticate(ctx, "alice", "alice-password")
+	require.NoError(t, err)
+	assert.Equal(t, "42", user.ExternalID)
+	assert.Equal(t, "42", user.IDString())
+	assert.True(t, user.ID.IsZero())
+
+	users, err := store.ListUsers(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "42", users[0].IDString())
+
+	// Updates reach the row by its own ID
+	user.Enabled = false
+	require.NoError(t, store.UpdateUser(ctx, user))
+	var active bool
+	require.NoError(t, db.QueryRow(`SELECT active FROM accounts WHERE account_id = 42`).Scan(&active))
+	assert.False(t, active)
+
+	require.NoError(t, store.UpdatePassword(ctx, user.IDString(), "new-password"))
+	user, err = store.GetUser(ctx, "42")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user.Username)
+	assert.False(t, user.Enabled)
+	assert.Nil(t, user.LastLogin)
+
+	require.NoError(t, store.DeleteUser(ctx, "42"))
+	_, err = store.GetUser(ctx, "42")
+	assert.ErrorIs(t, err, auth.ErrUserNotFound)
+}
+
+func TestSQLAuthenticatorMigrateExistingColumn(t *testing.T) {
+	cfg := sqliteConfig(t)
+
+	// A table created by hand that already has the key_sha256 column, in a
+	// database that has never been migrated
+	db, err := sql.Open("sqlite", cfg.DSN)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE users (
+		id VARCHAR(24) PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE,
+		password TEXT NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		key_sha256 TEXT,
+		max_sessions INTEGER, max_bandwidth BIGINT, max_duration INTEGER,
+		current_sessions INTEGER NOT NULL DEFAULT 0,
+		used_bandwidth BIGINT NOT NULL DEFAULT 0,
+		reset_at TIMESTAMP,
+		metadata TEXT,
+		created_at TIMESTAMP, updated_at TIMESTAMP, last_login TIMESTAMP
+	)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO users (id, username, password) VALUES ('0123456789abcdef01234567', 'alice', ?)`,
+		turnKey("alice", "alice-password"))
+	require.NoError(t, err)
+
+	store := newSQLAuthenticator(t, cfg)
+	_, err = store.Authenticate(context.Background(), "alice", "alice-password")
+	assert.NoError(t, err)
+
+	var version int
+	require.NoError(t, db.QueryRow(`SELECT MAX(version) FROM turn_schema_migrations`).Scan(&version))
+	assert.Equal(t, 3, version)
+}
+
+func TestSQLAuthenticatorRealmsShareDatabase(t *testing.T) {
+	cfg := sqliteConfig(t)
+	first := newSQLAuthenticator(t, cfg)
+
+	// A second realm keeps its users in other tables of the same database,
+	// which need migrating although the first realm's are up to date
+	other := *cfg
+	other.Table = "partner_users"
+	other.SessionsTable = "partner_sessions"
+	store, err := auth.NewSQLAuthenticator(&other, "partner.example.com")
+	require.NoError(t, err)
+	defer store.Close(context.Background())
+
+	ctx := context.Background()
+	require.NoError(t, first.CreateUser(ctx, &models.User{Username: "alice", Enabled: true}, "alice-password"))
+	require.NoError(t, store.CreateUser(ctx, &models.User{Username: "bob", Enabled: true}, "bob-password"))
+
+	_, err = first.Authenticate(ctx, "alice", "alice-password")
+	assert.NoError(t, err)
+	_, err = store.Authenticate(ctx, "bob", "bob-password")
+	assert.NoError(t, err)
+	_, err = store.Authenticate(ctx, "alice", "alice-password")
+	assert.ErrorIs(t, err, auth.ErrUserNotFound)
+
+	require.NoError(t, store.RecordSession(ctx, &models.SessionInfo{
+		ID:         "session-1",
+		Username:   "bob",
+		ClientAddr: "192.0.2.1:5000",
+		RelayAddr:  "198.51.100.1:50000",
+		StartTime:  time.Now().Add(-time.Minute),
+	}))
+}
+
+func TestSQLAuthenticatorQuotaColumnMapping(t *testing.T) {
+	cfg := sqliteConfig(t)
+	cfg.Columns.ID = "user_id"
+	cfg.Columns.MaxSessions = "session_limit"
+	cfg.Columns.MaxBandwidth = "rate_limit"
+	cfg.Columns.MaxDuration = "time_limit"
+	cfg.Columns.CurrentSessions = "sessions_open"
+	cfg.Columns.UsedBandwidth = "bytes_used"
+	cfg.Columns.ResetAt = "usage_reset_at"
+
+	store := newSQLAuthenticator(t, cfg)
+	ctx := context.Background()
+	alice := &models.User{Username: "alice", Enabled: true, Quota: &models.UserQuota{MaxSessions: 1, MaxBandwidth: 1000}}
+	require.NoError(t, store.CreateUser(ctx, alice, "alice-password"))
+
+	acquired, err := store.AcquireSession(ctx, "alice", "turn-a", 1)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, err = store.AcquireSession(ctx, "alice", "turn-a", 1)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+	require.NoError(t, store.AddUsedBandwidth(ctx, "alice", 1500))
+
+	user, err := store.GetUser(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	require.NotNil(t, user.Quota)
+	assert.Equal(t, 1, user.Quota.MaxSessions)
+	assert.Equal(t, int64(1000), user.Quota.MaxBandwidth)
+	assert.Equal(t, 1, user.Quota.CurrentSessions)
+	assert.Equal(t, int64(1500), user.Quota.UsedBandwidth)
+
+	// The values live in the mapped columns
+	db, err := sql.Open("sqlite", cfg.DSN)
+	require.NoError(t, err)
+	defer db.Close()
+	var limit, open, used int64
+	require.NoError(t, db.QueryRow(`SELECT session_limit, sessions_open, bytes_used FROM users WHERE user_id = ?`,
+		alice.ID.Hex()).Scan(&limit, &open, &used))
+	assert.Equal(t, []int64{1, 1, 1500}, []int64{limit, open, used})
+
+	now := time.Now()
+	_, err = store.ResetUsage(ctx, now, now.Add(time.Hour))
+	require.NoError(t, err)
+	var resetAt sql.NullTime
+	require.NoError(t, db.QueryRow(`SELECT usage_reset_at FROM users WHERE user_id = ?`, alice.ID.Hex()).Scan(&resetAt))
+	assert.True(t, resetAt.Valid)
+}
+
+func TestSQLAuthenticatorQuota(t *testing.T) {
+	store := newSQLAuthenticator(t, sqliteConfig(t))
+	ctx := context.Background()
+
+	require.NoError(t, store.CreateUser(ctx, &models.User{Username: "alice", Enabled: true, Quota: &models.UserQuota{}}, "x"))
+	require.NoError(t, store.CreateUser(ctx, &models.User{Username: "bob", Enabled: true}, "x"))
+
+	// Acquiring checks the limit and counts in one step
+	for i := 0; i < 2; i++ {
+		acquired, err := store.AcquireSession(ctx, "alice", "turn-a", 3)
+		require.NoError(t, err)
+		assert.True(t, acquired)
+	}
+	acquired, err := store.AcquireSession(ctx, "alice", "turn-b", 3)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, err = store.AcquireSession(ctx, "alice", "turn-b", 3)
+	require.NoError(t, err)
+	assert.False(t, acquired, "alice has 3 sessions already")
+	acquired, err = store.AcquireSession(ctx, "bob", "turn-a", 0)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	// Releases only take back sessions the instance counted
+	require.NoError(t, store.ReleaseSession(ctx, "alice", "turn-b"))
+	require.NoError(t, store.ReleaseSession(ctx, "alice", "turn-b"))
+	require.NoError(t, store.AddUsedBandwidth(ctx, "alice", 1500))
+
+	_, user, err := store.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 2, user.Quota.CurrentSessions)
+	assert.Equal(t, int64(1500), user.Quota.UsedBandwidth)
+
+	_, user, err = store.GetTURNAuthKey(ctx, "bob")
+	require.NoError(t, err)
+	assert.Nil(t, user.Quota, "users without a quota are left alone")
+
+	// Reconciling an instance leaves the counts of the others alone
+	acquired, err = store.AcquireSession(ctx, "alice", "turn-b", 3)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	reset, err := store.ReleaseInstanceSessions(ctx, "turn-a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), reset)
+	reset, err = store.ReleaseInstanceSessions(ctx, "turn-a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), reset)
+
+	_, user, err = store.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 1, user.Quota.CurrentSessions)
+
+	// The first run schedules a reset, the next period's run performs it
+	now := time.Now()
+	reset, err = store.ResetUsage(ctx, now, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), reset)
+	reset, err = store.ResetUsage(ctx, now.Add(2*time.Hour), now.Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), reset)
+
+	_, user, err = store.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), user.Quota.UsedBandwidth)
+	assert.WithinDuration(t, now.Add(24*time.Hour), user.Quota.ResetAt, time.Second)
+}
+
+func TestTURNServerSQLBackend(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:     19327,
+		Address:  "127.0.0.1",
+		Realm:    fileRealm,
+		PublicIP: "127.0.0.1",
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	sqlConfig := sqliteConfig(t)
+	store := newSQLAuthenticator(t, sqlConfig)
+	require.NoError(t, store.CreateUser(context.Background(), &models.User{
+		Username: "alice",
+		Enabled:  true,
+		Quota:    &models.UserQuota{MaxSessions: 1},
+	}, "alice-password"))
+
+	turnServer := server.NewTURNServer(cfg, store, nil, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	relayConn, _, err := allocateClient(t, "127.0.0.1:19327", "alice", "alice-password", cfg.Realm)
+	require.NoError(t, err)
+
+	_, err = allocate(t, "127.0.0.1:19327", "alice", "alice-password", cfg.Realm)
+	assert.Error(t, err, "MaxSessions is read from the users table")
+
+	// Ended sessions are written to the sessions table
+	require.NoError(t, relayConn.Close())
+
+	db, err := sql.Open("sqlite", sqlConfig.DSN)
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Eventually(t, func() bool {
+		var count int
+		err := db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE username = 'alice'`).Scan(&count)
+		return err == nil && count == 1
+	}, 5*time.Second, 50*time.Millisecond)
+}
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -209,4 +210,126 @@ func TestSTUNServerMultipleClients(t *testing.T) {
 			t.Fatal("Timeout waiting for clients to complete")
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestSTUNServerNATBehaviorDiscovery(t *testing.T) {
+	cfg := &config.STUNConfig{
+		Port:    19304,
+		Address: "127.0.0.1",
+		Alternate: config.STUNAlternateConfig{
+			Address: "127.0.0.2",
+			Port:    19305,
+		},
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	stunServer := server.NewSTUNServer(cfg, logger)
+	err := stunServer.Start()
+	require.NoError(t, err)
+	defer stunServer.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Use an unconnected socket so responses from the alternate address are received
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	serverAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: cfg.Port}
+
+	tests := []struct {
+		name         string
+		changeFlags  uint32
+		expectOrigin string
+	}{
+		{name: "NoChange", changeFlags: 0, expectOrigin: "127.0.0.1:19304"},
+		{name: "ChangePort", changeFlags: 0x02, expectOrigin: "127.0.0.1:19305"},
+		{name: "ChangeIP", changeFlags: 0x04, expectOrigin: "127.0.0.2:19304"},
+		{name: "ChangeIPAndPort", changeFlags: 0x06, expectOrigin: "127.0.0.2:19305"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &stun.Message{
+				Type:          stun.NewType(stun.MethodBinding, stun.ClassRequest),
+				TransactionID: stun.NewTransactionID(),
+			}
+			msg.WriteHeader()
+			msg.Add(stun.AttrChangeRequest, []byte{0, 0, 0, byte(tt.changeFlags)})
+			msg.Encode()
+
+			_, err := conn.WriteTo(msg.Raw, serverAddr)
+			require.NoError(t, err)
+
+			buffer := make([]byte, 1500)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, from, err := conn.ReadFrom(buffer)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectOrigin, from.String())
+
+			response := &stun.Message{Raw: buffer[:n]}
+			require.NoError(t, response.Decode())
+			assert.Equal(t, msg.TransactionID, response.TransactionID)
+
+			var origin stun.ResponseOrigin
+			require.NoError(t, origin.GetFrom(response))
+			assert.Equal(t, tt.expectOrigin, fmt.Sprintf("%s:%d", origin.IP, origin.Port))
+
+			var other stun.OtherAddress
+			require.NoError(t, other.GetFrom(response))
+			assert.Equal(t, "127.0.0.2:19305", fmt.Sprintf("%s:%d", other.IP, other.Port))
+		})
+	}
+}
+
+func TestSTUNServerTCP(t *testing.T) {
+	cfg := &config.STUNConfig{
+		Port:    19306,
+		Address: "127.0.0.1",
+		TCP:     true,
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	stunServer := server.NewSTUNServer(cfg, logger)
+	err := stunServer.Start()
+	require.NoError(t, err)
+	defer stunServer.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", cfg.Port))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Send two requests back to back to exercise message framing
+	requests := make([]*stun.Message, 2)
+	for i := range requests {
+		requests[i] = stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		_, err = conn.Write(requests[i].Raw)
+		require.NoError(t, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, request := range requests {
+		header := make([]byte, 20)
+		_, err = io.ReadFull(conn, header)
+		require.NoError(t, err)
+
+		body := make([]byte, int(header[2])<<8|int(header[3]))
+		_, err = io.ReadFull(conn, body)
+		require.NoError(t, err)
+
+		response := &stun.Message{Raw: append(header, body...)}
+		require.NoError(t, response.Decode())
+		assert.Equal(t, request.TransactionID, response.TransactionID)
+
+		// XOR-MAPPED-ADDRESS reflects the TCP source address
+		var xorAddr stun.XORMappedAddress
+		require.NoError(t, xorAddr.GetFrom(response))
+		assert.Equal(t, conn.LocalAddr().String(), fmt.Sprintf("%s:%d", xorAddr.IP, xorAddr.Port))
+	}
+}
@@ -0,0 +1,1433 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/internal/server"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+// allocate performs a TURN allocation against addr and returns the relayed address
+func allocate(t *testing.T, addr, username, password, realm string) (net.Addr, error) {
+	relayConn, _, err := allocateClient(t, addr, username, password, realm)
+	if err != nil {
+		return nil, err
+	}
+	return relayConn.LocalAddr(), nil
+}
+
+// allocateClient performs a TURN allocation and returns the relayed
+// connection together with the client that owns it
+func allocateClient(t *testing.T, addr, username, password, realm string) (net.PacketConn, *turn.Client, error) {
+	return allocateClientFrom(t, "127.0.0.1:0", addr, username, password, realm)
+}
+
+// allocateClientFrom performs a TURN allocation from a given local address
+func allocateClientFrom(t *testing.T, local, addr, username, password, realm string) (net.PacketConn, *turn.Client, error) {
+	conn, err := net.ListenPacket("udp4", local)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: addr,
+		TURNServerAddr: addr,
+		Conn:           conn,
+		Username:       username,
+		Password:       password,
+		Realm:          realm,
+		RTO:            100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	require.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	if err != nil {
+		return nil, nil, err
+	}
+	t.Cleanup(func() { relayConn.Close() })
+
+	return relayConn, client, nil
+}
+
+func TestTURNServerRESTCredentials(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:     19320,
+		Address:  "127.0.0.1",
+		Realm:    "test.example.com",
+		PublicIP: "127.0.0.1",
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	// The server accepts the current and the previous secret
+	rest := auth.NewRESTCredentials("current-secret", []string{"previous-secret"})
+	turnServer := server.NewTURNServer(cfg, nil, rest, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	serverAddr := "127.0.0.1:19320"
+
+	t.Run("ValidCredential", func(t *testing.T) {
+		username, password, _ := rest.Generate("alice", time.Hour)
+		relayAddr, err := allocate(t, serverAddr, username, password, cfg.Realm)
+		require.NoError(t, err)
+		assert.NotNil(t, relayAddr)
+	})
+
+	t.Run("RotatedSecret", func(t *testing.T) {
+		previous := auth.NewRESTCredentials("previous-secret", nil)
+		username, password, _ := previous.Generate("bob", time.Hour)
+		_, err := allocate(t, serverAddr, username, password, cfg.Realm)
+		assert.NoError(t, err)
+	})
+
+	t.Run("ExpiredCredential", func(t *testing.T) {
+		username, password, _ := rest.Generate("carol", -time.Minute)
+		_, err := allocate(t, serverAddr, username, password, cfg.Realm)
+		assert.Error(t, err)
+	})
+
+	t.Run("UnknownSecret", func(t *testing.T) {
+		other := auth.NewRESTCredentials("unknown-secret", nil)
+		username, password, _ := other.Generate("dave", time.Hour)
+		_, err := allocate(t, serverAddr, username, password, cfg.Realm)
+		assert.Error(t, err)
+	})
+}
+
+func TestTURNServerPeerACL(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:        19321,
+		Address:     "127.0.0.1",
+		Realm:       "test.example.com",
+		PublicIP:    "127.0.0.1",
+		RelayRanges: []string{"10.0.0.0/8", "127.0.0.0/8"},
+		DenyRanges:  []string{"127.0.0.0/8"},
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	rest := auth.NewRESTCredentials("acl-secret", nil)
+	turnServer := server.NewTURNServer(cfg, nil, rest, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	username, password, _ := rest.Generate("alice", time.Hour)
+	_, client, err := allocateClient(t, "127.0.0.1:19321", username, password, cfg.Realm)
+	require.NoError(t, err)
+
+	t.Run("AllowedPeer", func(t *testing.T) {
+		err := client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5000})
+		assert.NoError(t, err)
+	})
+
+	t.Run("DeniedPeer", func(t *testing.T) {
+		err := client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "403")
+	})
+
+	t.Run("PeerOutsideRelayRanges", func(t *testing.T) {
+		err := client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "403")
+	})
+}
+
+func TestTURNServerDefaultDenyRanges(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:       19340,
+		Address:    "127.0.0.1",
+		Realm:      "test.example.com",
+		PublicIP:   "127.0.0.1",
+		DenyRanges: config.DefaultDenyRanges,
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	rest := auth.NewRESTCredentials("deny-secret", nil)
+	turnServer := server.NewTURNServer(cfg, nil, rest, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	username, password, _ := rest.Generate("alice", time.Hour)
+	_, client, err := allocateClient(t, "127.0.0.1:19340", username, password, cfg.Realm)
+	require.NoError(t, err)
+
+	for _, peer := range []string{"10.1.2.3", "172.16.0.1", "192.168.1.1", "100.64.0.1", "127.0.0.1", "169.254.169.254"} {
+		err := client.CreatePermission(&net.UDPAddr{IP: net.ParseIP(peer), Port: 5000})
+		require.Error(t, err, peer)
+		assert.Contains(t, err.Error(), "403", peer)
+	}
+	assert.NoError(t, client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5000}))
+}
+
+func TestTURNServerRelayPortRange(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:         19322,
+		Address:      "127.0.0.1",
+		Realm:        "test.example.com",
+		PublicIP:     "127.0.0.1",
+		RelayAddress: "127.0.0.1",
+		RelayMinPort: 19330,
+		RelayMaxPort: 19331,
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	rest := auth.NewRESTCredentials("range-secret", nil)
+	turnServer := server.NewTURNServer(cfg, nil, rest, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	serverAddr := "127.0.0.1:19322"
+
+	// Both ports of the range can be allocated
+	for _, user := range []string{"alice", "bob"} {
+		username, password, _ := rest.Generate(user, time.Hour)
+		relayAddr, err := allocate(t, serverAddr, username, password, cfg.Realm)
+		require.NoError(t, err)
+
+		port := relayAddr.(*net.UDPAddr).Port
+		assert.GreaterOrEqual(t, port, cfg.RelayMinPort)
+		assert.LessOrEqual(t, port, cfg.RelayMaxPort)
+	}
+
+	// The range is now exhausted
+	username, password, _ := rest.Generate("carol", time.Hour)
+	_, err := allocate(t, serverAddr, username, password, cfg.Realm)
+	assert.Error(t, err)
+}
+
+// turnRequest sends a long-term-credential request over UDP, answering the
+// 401 nonce challenge first, and returns the response
+func turnRequest(t *testing.T, conn net.Conn, method stun.Method, username, password, realm string, setters ...stun.Setter) *stun.Message {
+	roundTrip := func(setters ...stun.Setter) *stun.Message {
+		request, err := stun.Build(setters...)
+		require.NoError(t, err)
+		_, err = conn.Write(request.Raw)
+		require.NoError(t, err)
+
+		buf := make([]byte, 1500)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+
+		response := &stun.Message{Raw: buf[:n]}
+		require.NoError(t, response.Decode())
+		return response
+	}
+
+	requestType := stun.NewType(method, stun.ClassRequest)
+	challenge := roundTrip(append([]stun.Setter{stun.TransactionID, requestType}, setters...)...)
+
+	var nonce stun.Nonce
+	require.NoError(t, nonce.GetFrom(challenge))
+
+	authSetters := append([]stun.Setter{stun.TransactionID, requestType}, setters...)
+	authSetters = append(authSetters,
+		stun.NewUsername(username),
+		stun.NewRealm(realm),
+		nonce,
+		stun.NewLongTermIntegrity(username, realm, password),
+		stun.Fingerprint,
+	)
+	return roundTrip(authSetters...)
+}
+
+// lifetimeAttr is a LIFETIME attribute in seconds
+type lifetimeAttr uint32
+
+func (l lifetimeAttr) AddTo(m *stun.Message) error {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(l))
+	m.Add(stun.AttrLifetime, v)
+	return nil
+}
+
+// responseLifetime reads the granted LIFETIME of a success response
+func responseLifetime(t *testing.T, m *stun.Message) uint32 {
+	require.Equal(t, stun.ClassSuccessResponse, m.Type.Class, "unexpected response %s", m)
+	v, err := m.Get(stun.AttrLifetime)
+	require.NoError(t, err)
+	return binary.BigEndian.Uint32(v)
+}
+
+func TestTURNServerAllocationLifetime(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:        19323,
+		Address:     "127.0.0.1",
+		Realm:       "test.example.com",
+		PublicIP:    "127.0.0.1",
+		MaxLifetime: 120,
+		DefaultTTL:  60,
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	rest := auth.NewRESTCredentials("lifetime-secret", nil)
+	turnServer := server.NewTURNServer(cfg, nil, rest, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	udpTransport := stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}
+
+	allocateWithLifetime := func(t *testing.T, user string, setters ...stun.Setter) (net.Conn, *stun.Message) {
+		conn, err := net.Dial("udp4", "127.0.0.1:19323")
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		username, password, _ := rest.Generate(user, time.Hour)
+		setters = append([]stun.Setter{udpTransport}, setters...)
+		return conn, turnRequest(t, conn, stun.MethodAllocate, username, password, cfg.Realm, setters...)
+	}
+
+	t.Run("DefaultApplied", func(t *testing.T) {
+		_, response := allocateWithLifetime(t, "alice")
+		assert.Equal(t, uint32(60), responseLifetime(t, response))
+	})
+
+	t.Run("ClampedToMax", func(t *testing.T) {
+		_, response := allocateWithLifetime(t, "bob", lifetimeAttr(3600))
+		assert.Equal(t, uint32(120), responseLifetime(t, response))
+	})
+
+	t.Run("RaisedToDefault", func(t *testing.T) {
+		_, response := allocateWithLifetime(t, "carol", lifetimeAttr(10))
+		assert.Equal(t, uint32(60), responseLifetime(t, response))
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		conn, _ := allocateWithLifetime(t, "dave")
+		username, password, _ := rest.Generate("dave", time.Hour)
+
+		response := turnRequest(t, conn, stun.MethodRefresh, username, password, cfg.Realm, lifetimeAttr(600))
+		assert.Equal(t, uint32(120), responseLifetime(t, response))
+
+		response = turnRequest(t, conn, stun.MethodRefresh, username, password, cfg.Realm, lifetimeAttr(0))
+		assert.Equal(t, uint32(0), responseLifetime(t, response))
+	})
+}
+
+func TestTURNServerTrafficAccounting(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:     19324,
+		Address:  "127.0.0.1",
+		Realm:    "test.example.com",
+		PublicIP: "127.0.0.1",
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	rest := auth.NewRESTCredentials("accounting-secret", nil)
+	turnServer := server.NewTURNServer(cfg, nil, rest, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer peer.Close()
+
+	username, password, _ := rest.Generate("alice", time.Hour)
+	relayConn, _, err := allocateClient(t, "127.0.0.1:19324", username, password, cfg.Realm)
+	require.NoError(t, err)
+
+	// Client -> peer
+	_, err = relayConn.WriteTo([]byte("hello peer"), peer.LocalAddr())
+	require.NoError(t, err)
+
+	buf := make([]byte, 1500)
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, relayAddr, err := peer.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello peer", string(buf[:n]))
+
+	// Peer -> client
+	_, err = peer.WriteTo([]byte("hi"), relayAddr)
+	require.NoError(t, err)
+	require.NoError(t, relayConn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, _, err = relayConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(buf[:n]))
+
+	var found bool
+	for _, session := range turnServer.GetSessions() {
+		if session.RelayAddr != relayAddr.String() {
+			continue
+		}
+		found = true
+		assert.Equal(t, "alice", session.Username)
+		assert.Equal(t, int64(len("hello peer")), session.BytesSent)
+		assert.Equal(t, int64(1), session.PacketsSent)
+		assert.Equal(t, int64(len("hi")), session.BytesRecv)
+		assert.Equal(t, int64(1), session.PacketsRecv)
+	}
+	assert.True(t, found, "no session for relay %s", relayAddr)
+
+	stats := turnServer.GetStats()
+	assert.Equal(t, int64(len("hello peer")), stats["bytes_sent"])
+	assert.Equal(t, int64(len("hi")), stats["bytes_received"])
+}
+
+func TestTURNServerSessionLifecycle(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:        19325,
+		Address:     "127.0.0.1",
+		Realm:       "test.example.com",
+		PublicIP:    "127.0.0.1",
+		MaxLifetime: 600,
+		DefaultTTL:  300,
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	rest := auth.NewRESTCredentials("session-secret", nil)
+	turnServer := server.NewTURNServer(cfg, nil, rest, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	conn, err := net.Dial("udp4", "127.0.0.1:19325")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	username, password, _ := rest.Generate("alice", time.Hour)
+	udpTransport := stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}
+
+	// Allocation success opens exactly one session for the 5-tuple
+	response := turnRequest(t, conn, stun.MethodAllocate, username, password, cfg.Realm, udpTransport)
+	require.Equal(t, stun.ClassSuccessResponse, response.Type.Class)
+
+	sessions := turnServer.GetSessions()
+	require.Len(t, sessions, 1)
+	session := sessions[0]
+	assert.Equal(t, "udp:"+conn.LocalAddr().String()+"->127.0.0.1:19325", session.ID)
+	assert.Equal(t, "alice", session.Username)
+	assert.WithinDuration(t, time.Now().Add(300*time.Second), session.ExpiresAt, 5*time.Second)
+
+	// Authenticated requests that aren't allocations don't add sessions,
+	// and a refresh extends the existing one
+	response = turnRequest(t, conn, stun.MethodRefresh, username, password, cfg.Realm, lifetimeAttr(600))
+	require.Equal(t, stun.ClassSuccessResponse, response.Type.Class)
+
+	sessions = turnServer.GetSessions()
+	require.Len(t, sessions, 1)
+	assert.WithinDuration(t, time.Now().Add(600*time.Second), sessions[0].ExpiresAt, 5*time.Second)
+
+	// Deleting the allocation ends the session
+	response = turnRequest(t, conn, stun.MethodRefresh, username, password, cfg.Realm, lifetimeAttr(0))
+	require.Equal(t, stun.ClassSuccessResponse, response.Type.Class)
+	assert.Eventually(t, func() bool {
+		return len(turnServer.GetSessions()) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestTURNServerUserStore(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:     19326,
+		Address:  "127.0.0.1",
+		Realm:    "test.example.com",
+		PublicIP: "127.0.0.1",
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	store := newFakeAuthenticator(cfg.Realm)
+	ctx := context.Background()
+	require.NoError(t, store.CreateUser(ctx, &models.User{
+		Username: "alice",
+		Enabled:  true,
+		Quota:    &models.UserQuota{MaxSessions: 1},
+	}, "alice-password"))
+	require.NoError(t, store.CreateUser(ctx, &models.User{Username: "bob", Enabled: false}, "bob-password"))
+	require.NoError(t, store.CreateUser(ctx, &models.User{
+		Username: "dave",
+		Enabled:  true,
+		Quota:    &models.UserQuota{MaxSessions: 0},
+	}, "dave-password"))
+
+	turnServer := server.NewTURNServer(cfg, store, nil, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	// Stored users authenticate with their long-term credentials
+	_, err := allocate(t, "127.0.0.1:19326", "alice", "alice-password", cfg.Realm)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return store.user("alice").Quota.CurrentSessions == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// MaxSessions is enforced from the stored quota
+	_, err = allocate(t, "127.0.0.1:19326", "alice", "alice-password", cfg.Realm)
+	assert.Error(t, err)
+
+	// A MaxSessions of 0 means no limit
+	for i := 0; i < 3; i++ {
+		_, err = allocate(t, "127.0.0.1:19326", "dave", "dave-password", cfg.Realm)
+		require.NoError(t, err)
+	}
+
+	// Wrong passwords, disabled and unknown users are rejected
+	_, err = allocate(t, "127.0.0.1:19326", "alice", "wrong-password", cfg.Realm)
+	assert.Error(t, err)
+	_, err = allocate(t, "127.0.0.1:19326", "bob", "bob-password", cfg.Realm)
+	assert.Error(t, err)
+	_, err = allocate(t, "127.0.0.1:19326", "carol", "carol-password", cfg.Realm)
+	assert.Error(t, err)
+}
+
+func TestTURNServerSharedSessionCounts(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:       19341,
+		Address:    "127.0.0.1",
+		Realm:      "test.example.com",
+		PublicIP:   "127.0.0.1",
+		InstanceID: "turn-a",
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	store := newFakeAuthenticator(cfg.Realm)
+	ctx := context.Background()
+	require.NoError(t, store.CreateUser(ctx, &models.User{
+		Username: "alice",
+		Enabled:  true,
+		Quota:    &models.UserQuota{MaxSessions: 2},
+	}, "alice-password"))
+
+	// Another server holds a session of alice, and a previous run of this
+	// one left a stale count behind
+	acquired, err := store.AcquireSession(ctx, "alice", "turn-b", 2)
+	require.NoError(t, err)
+	require.True(t, acquired)
+	acquired, err = store.AcquireSession(ctx, "alice", "turn-a", 2)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	turnServer := server.NewTURNServer(cfg, store, nil, logger)
+	require.NoError(t, turnServer.Start())
+	assert.Equal(t, 1, store.user("alice").Quota.CurrentSessions, "only this instance's count is reconciled")
+
+	// The session held by the other server counts against MaxSessions
+	_, err = allocate(t, "127.0.0.1:19341", "alice", "alice-password", cfg.Realm)
+	require.NoError(t, err)
+	assert.Equal(t, 2, store.user("alice").Quota.CurrentSessions)
+	_, err = allocate(t, "127.0.0.1:19341", "alice", "alice-password", cfg.Realm)
+	assert.Error(t, err)
+
+	require.NoError(t, turnServer.Stop())
+	assert.Equal(t, 1, store.user("alice").Quota.CurrentSessions, "the other server's session stays counted")
+}
+
+func TestTURNServerSlowSessionStore(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:     19346,
+		Address:  "127.0.0.1",
+		Realm:    "test.example.com",
+		PublicIP: "127.0.0.1",
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	store := newFakeAuthenticator(cfg.Realm)
+	require.NoError(t, store.CreateUser(context.Background(), &models.User{
+		Username: "alice",
+		Enabled:  true,
+		Quota:    &models.UserQuota{MaxSessions: 2},
+	}, "alice-password"))
+	store.acquireDelay.Store(int64(5 * time.Second))
+
+	turnServer := server.NewTURNServer(cfg, store, nil, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	// A slow store doesn't hold up the listener, the server counts the
+	// sessions itself instead
+	start := time.Now()
+	_, err := allocate(t, "127.0.0.1:19346", "alice", "alice-password", cfg.Realm)
+	require.NoError(t, err)
+	_, err = allocate(t, "127.0.0.1:19346", "alice", "alice-password", cfg.Realm)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	_, err = allocate(t, "127.0.0.1:19346", "alice", "alice-password", cfg.Realm)
+	assert.Error(t, err)
+}
+
+func TestTURNServerLockout(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:     19329,
+		Address:  "127.0.0.1",
+		Realm:    "test.example.com",
+		PublicIP: "127.0.0.1",
+		Lockout: config.LockoutConfig{
+			Enabled:       true,
+			UserThreshold: 3,
+			IPThreshold:   6,
+			Window:        60,
+			Duration:      60,
+			MaxDuration:   600,
+		},
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	store := newFakeAuthenticator(cfg.Realm)
+	ctx := context.Background()
+	require.NoError(t, store.CreateUser(ctx, &models.User{Username: "alice", Enabled: true}, "alice-password"))
+	require.NoError(t, store.CreateUser(ctx, &models.User{Username: "bob", Enabled: true}, "bob-password"))
+
+	turnServer := server.NewTURNServer(cfg, store, nil, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	serverAddr := "127.0.0.1:19329"
+
+	// Repeated wrong passwords lock the username out, even for the right one
+	for i := 0; i < 3; i++ {
+		_, err := allocate(t, serverAddr, "alice", "wrong-password", cfg.Realm)
+		require.Error(t, err)
+	}
+	_, err := allocate(t, serverAddr, "alice", "alice-password", cfg.Realm)
+	assert.Error(t, err)
+
+	lockouts := turnServer.Lockouts()
+	require.NotEmpty(t, lockouts)
+	assert.Equal(t, server.LockoutUsername, lockouts[0].Kind)
+	assert.Equal(t, "alice", lockouts[0].Key)
+	assert.Equal(t, "127.0.0.1", lockouts[0].IP)
+	assert.Equal(t, 1, lockouts[0].Lockouts)
+	assert.WithinDuration(t, time.Now().Add(60*time.Second), lockouts[0].LockedUntil, 5*time.Second)
+
+	// Other users are unaffected until the client IP reaches its threshold
+	_, err = allocate(t, serverAddr, "bob", "bob-password", cfg.Realm)
+	require.NoError(t, err)
+
+	// The username is only locked out for the client IP that failed
+	_, _, err = allocateClientFrom(t, "127.0.0.2:0", serverAddr, "alice", "alice-password", cfg.Realm)
+	require.NoError(t, err)
+
+	// Clearing the lockout lets the user back in
+	assert.Equal(t, 1, turnServer.ClearLockout(server.LockoutUsername, "alice"))
+	_, err = allocate(t, serverAddr, "alice", "alice-password", cfg.Realm)
+	require.NoError(t, err)
+
+	// Failures for unknown users count against the client IP
+	for _, username := range []string{"carol", "dave", "erin"} {
+		_, err := allocate(t, serverAddr, username, "password", cfg.Realm)
+		require.Error(t, err)
+	}
+	_, err = allocate(t, serverAddr, "bob", "bob-password", cfg.Realm)
+	assert.Error(t, err)
+
+	var ipLocked bool
+	for _, lockout := range turnServer.Lockouts() {
+		if lockout.Kind == server.LockoutIP && lockout.Key == "127.0.0.1" {
+			ipLocked = !lockout.LockedUntil.IsZero()
+		}
+	}
+	assert.True(t, ipLocked)
+
+	assert.Positive(t, turnServer.ClearLockout("", ""))
+	assert.Empty(t, turnServer.Lockouts())
+	_, err = allocate(t, serverAddr, "bob", "bob-password", cfg.Realm)
+	require.NoError(t, err)
+}
+
+func TestTURNServerPasswordAlgorithms(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:               19332,
+		Address:            "127.0.0.1",
+		Realm:              "test.example.com",
+		PublicIP:           "127.0.0.1",
+		PasswordAlgorithms: []string{auth.PasswordAlgorithmSHA256, auth.PasswordAlgorithmMD5},
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	store := newFakeAuthenticator(cfg.Realm)
+	ctx := context.Background()
+	require.NoError(t, store.CreateUser(ctx, &models.User{Username: "alice", Enabled: true}, "alice-password"))
+
+	turnServer := server.NewTURNServer(cfg, store, nil, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	serverAddr := "127.0.0.1:19332"
+	udpTransport := stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}
+	offered := []byte{0, 2, 0, 0, 0, 1, 0, 0} // SHA-256, MD5
+	sha256Key, err := auth.DecodeKey(auth.PasswordAlgorithmSHA256, auth.TURNKeySHA256("alice", cfg.Realm, "alice-password"))
+	require.NoError(t, err)
+
+	roundTrip := func(conn net.Conn, setters ...stun.Setter) *stun.Message {
+		request, err := stun.Build(append([]stun.Setter{stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest)}, setters...)...)
+		require.NoError(t, err)
+		_, err = conn.Write(request.Raw)
+		require.NoError(t, err)
+
+		buf := make([]byte, 1500)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+
+		response := &stun.Message{Raw: buf[:n]}
+		require.NoError(t, response.Decode())
+		return response
+	}
+
+	// The challenge offers the password algorithms behind a nonce cookie
+	challenge := func(conn net.Conn) stun.Nonce {
+		response := roundTrip(conn, udpTransport)
+		var code stun.ErrorCodeAttribute
+		require.NoError(t, code.GetFrom(response))
+		require.Equal(t, stun.CodeUnauthorized, code.Code)
+
+		var nonce stun.Nonce
+		require.NoError(t, nonce.GetFrom(response))
+		assert.True(t, strings.HasPrefix(nonce.String(), "obMatJos2gAAA"))
+		algorithms, err := response.Get(stun.AttrPasswordAlgorithms)
+		require.NoError(t, err)
+		assert.Equal(t, offered, algorithms)
+		return nonce
+	}
+
+	// An RFC 8489 client picking SHA-256 is answered with the SHA-256 key
+	conn, err := net.Dial("udp4", serverAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	nonce := challenge(conn)
+	response := roundTrip(conn, udpTransport,
+		stun.NewUsername("alice"),
+		stun.NewRealm(cfg.Realm),
+		nonce,
+		stun.RawAttribute{Type: stun.AttrPasswordAlgorithms, Value: offered},
+		stun.RawAttribute{Type: stun.AttrPasswordAlgorithm, Value: []byte{0, 2, 0, 0}},
+		stun.MessageIntegrity(sha256Key),
+		stun.Fingerprint,
+	)
+	require.Equal(t, stun.ClassSuccessResponse, response.Type.Class)
+	assert.NoError(t, stun.MessageIntegrity(sha256Key).Check(response))
+
+	// PASSWORD-ALGORITHMS must be echoed unchanged
+	conn2, err := net.Dial("udp4", serverAddr)
+	require.NoError(t, err)
+	defer conn2.Close()
+
+	nonce = challenge(conn2)
+	response = roundTrip(conn2, udpTransport,
+		stun.NewUsername("alice"),
+		stun.NewRealm(cfg.Realm),
+		nonce,
+		stun.RawAttribute{Type: stun.AttrPasswordAlgorithms, Value: []byte{0, 2, 0, 0}},
+		stun.RawAttribute{Type: stun.AttrPasswordAlgorithm, Value: []byte{0, 2, 0, 0}},
+		stun.MessageIntegrity(sha256Key),
+		stun.Fingerprint,
+	)
+	var code stun.ErrorCodeAttribute
+	require.NoError(t, code.GetFrom(response))
+	assert.Equal(t, stun.CodeBadRequest, code.Code)
+
+	// Older clients echo the nonce and keep using MD5
+	_, err = allocate(t, serverAddr, "alice", "alice-password", cfg.Realm)
+	assert.NoError(t, err)
+}
+
+func TestTURNServerPasswordAlgorithmsMD5Only(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:               19344,
+		Address:            "127.0.0.1",
+		Realm:              "test.example.com",
+		PublicIP:           "127.0.0.1",
+		PasswordAlgorithms: []string{auth.PasswordAlgorithmMD5},
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	store := newFakeAuthenticator(cfg.Realm)
+	require.NoError(t, store.CreateUser(context.Background(), &models.User{Username: "alice", Enabled: true}, "alice-password"))
+
+	turnServer := server.NewTURNServer(cfg, store, nil, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	conn, err := net.Dial("udp4", "127.0.0.1:19344")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	request, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}})
+	require.NoError(t, err)
+	_, err = conn.Write(request.Raw)
+	require.NoError(t, err)
+
+	buf := make([]byte, 1500)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	response := &stun.Message{Raw: buf[:n]}
+	require.NoError(t, response.Decode())
+
+	// Nothing is negotiated, so the challenge is pion/turn's own
+	var nonce stun.Nonce
+	require.NoError(t, nonce.GetFrom(response))
+	assert.False(t, strings.HasPrefix(nonce.String(), "obMatJos2"), nonce.String())
+	assert.False(t, response.Contains(stun.AttrPasswordAlgorithms))
+
+	_, err = allocate(t, "127.0.0.1:19344", "alice", "alice-password", cfg.Realm)
+	assert.NoError(t, err)
+}
+
+func TestTURNServerRealms(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:     19333,
+		Address:  "127.0.0.1",
+		Realm:    "test.example.com",
+		PublicIP: "127.0.0.1",
+	}
+	tenantCfg := &config.TURNConfig{
+		Port:     19334,
+		Address:  "127.0.0.1",
+		Realm:    "tenant.example.com",
+		PublicIP: "127.0.0.1",
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	// The same username lives in both realms with different passwords
+	ctx := context.Background()
+	store := newFakeAuthenticator(cfg.Realm)
+	require.NoError(t, store.CreateUser(ctx, &models.User{Username: "alice", Enabled: true}, "default-password"))
+	tenantStore := newFakeAuthenticator(tenantCfg.Realm)
+	require.NoError(t, tenantStore.CreateUser(ctx, &models.User{Username: "alice", Enabled: true}, "tenant-password"))
+
+	turnServer := server.NewTURNServer(cfg, store, nil, logger)
+	turnServer.AddRealm(tenantCfg, tenantStore)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	serverAddr := "127.0.0.1:19333"
+	tenantAddr := "127.0.0.1:19334"
+
+	t.Run("OwnListeners", func(t *testing.T) {
+		_, err := allocate(t, serverAddr, "alice", "default-password", cfg.Realm)
+		assert.NoError(t, err)
+		_, err = allocate(t, tenantAddr, "alice", "tenant-password", tenantCfg.Realm)
+		assert.NoError(t, err)
+
+		// Each listener checks its own realm's user store
+		_, err = allocate(t, serverAddr, "alice", "tenant-password", tenantCfg.Realm)
+		assert.Error(t, err)
+		_, err = allocate(t, tenantAddr, "alice", "default-password", cfg.Realm)
+		assert.Error(t, err)
+	})
+
+	// Naming the realm on the default realm's listeners hands the client to it
+	for _, network := range []string{"udp4", "tcp4"} {
+		t.Run("SharedListener/"+network, func(t *testing.T) {
+			conn, err := net.Dial(network, serverAddr)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			udpTransport := stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}
+			roundTrip := func(setters ...stun.Setter) *stun.Message {
+				request, err := stun.Build(append([]stun.Setter{stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest), udpTransport}, setters...)...)
+				require.NoError(t, err)
+				_, err = conn.Write(request.Raw)
+				require.NoError(t, err)
+
+				buf := make([]byte, 1500)
+				require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+				n, err := io.ReadAtLeast(conn, buf, 20)
+				require.NoError(t, err)
+				length := 20 + int(binary.BigEndian.Uint16(buf[2:4]))
+				_, err = io.ReadFull(conn, buf[n:length])
+				require.NoError(t, err)
+
+				response := &stun.Message{Raw: buf[:length]}
+				require.NoError(t, response.Decode())
+				return response
+			}
+
+			challenge := roundTrip(stun.NewRealm(tenantCfg.Realm))
+			var realm stun.Realm
+			require.NoError(t, realm.GetFrom(challenge))
+			assert.Equal(t, tenantCfg.Realm, realm.String())
+			var nonce stun.Nonce
+			require.NoError(t, nonce.GetFrom(challenge))
+
+			response := roundTrip(
+				stun.NewUsername("alice"),
+				stun.NewRealm(tenantCfg.Realm),
+				nonce,
+				stun.NewLongTermIntegrity("alice", tenantCfg.Realm, "tenant-password"),
+				stun.Fingerprint,
+			)
+			require.Equal(t, stun.ClassSuccessResponse, response.Type.Class, "unexpected response %s", response)
+
+			var tenantSessions int
+			for _, session := range turnServer.GetSessions() {
+				if session.ClientAddr == conn.LocalAddr().String() {
+					assert.Equal(t, tenantCfg.Realm, session.Realm)
+					tenantSessions++
+				}
+			}
+			assert.Equal(t, 1, tenantSessions)
+		})
+	}
+
+	stats := turnServer.GetStats()
+	assert.Contains(t, stats["realms"], tenantCfg.Realm)
+}
+
+// peerAddressAttr is an XOR-PEER-ADDRESS attribute
+type peerAddressAttr stun.XORMappedAddress
+
+func (p peerAddressAttr) AddTo(m *stun.Message) error {
+	addr := stun.XORMappedAddress(p)
+	return addr.AddToAs(m, stun.AttrXORPeerAddress)
+}
+
+func TestTURNServerAccessTokens(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	cfg := &config.TURNConfig{
+		Port:     19335,
+		Address:  "127.0.0.1",
+		Realm:    "test.example.com",
+		PublicIP: "127.0.0.1",
+		Lockout:  config.LockoutConfig{Enabled: true, UserThreshold: 1, IPThreshold: 10, Window: 60, Duration: 60, MaxDuration: 60},
+		OAuth: config.OAuthConfig{
+			Enabled:             true,
+			AuthorizationServer: "https://auth.example.com",
+			Keys:                []config.OAuthKeyConfig{{KID: "key-1", Key: base64.StdEncoding.EncodeToString(key), Algorithm: auth.TokenAlgorithmA256GCM}},
+		},
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	turnServer := server.NewTURNServer(cfg, newFakeAuthenticator(cfg.Realm), nil, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	// The authorization server shares the key and binds tokens to the realm
+	issuer, err := auth.NewAccessTokens(cfg.Realm, []auth.AccessTokenKey{{KID: "key-1", Algorithm: auth.TokenAlgorithmA256GCM, Key: key}})
+	require.NoError(t, err)
+	macKey := bytes.Repeat([]byte{0x17}, 20)
+
+	conn, err := net.Dial("udp4", "127.0.0.1:19335")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	roundTrip := func(method stun.Method, setters ...stun.Setter) *stun.Message {
+		request, err := stun.Build(append([]stun.Setter{stun.TransactionID, stun.NewType(method, stun.ClassRequest)}, setters...)...)
+		require.NoError(t, err)
+		_, err = conn.Write(request.Raw)
+		require.NoError(t, err)
+
+		buf := make([]byte, 1500)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+
+		response := &stun.Message{Raw: buf[:n]}
+		require.NoError(t, response.Decode())
+		return response
+	}
+	udpTransport := stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}
+	allocate := func(nonce stun.Nonce, token []byte) *stun.Message {
+		return roundTrip(stun.MethodAllocate, udpTransport,
+			stun.NewUsername("key-1"),
+			stun.NewRealm(cfg.Realm),
+			nonce,
+			stun.RawAttribute{Type: 0x001B, Value: token},
+			stun.MessageIntegrity(macKey),
+			stun.Fingerprint,
+		)
+	}
+
+	// The challenge names the authorization server
+	challenge := roundTrip(stun.MethodAllocate, udpTransport)
+	authorization, err := challenge.Get(0x802E)
+	require.NoError(t, err)
+	assert.Equal(t, "https://auth.example.com", string(authorization))
+	var nonce stun.Nonce
+	require.NoError(t, nonce.GetFrom(challenge))
+
+	// Tokens that don't validate are refused, without locking out the key ID
+	for i := 0; i < 2; i++ {
+		expired, err := issuer.Issue("key-1", macKey, 0)
+		require.NoError(t, err)
+		response := allocate(nonce, expired)
+		assert.Equal(t, stun.ClassErrorResponse, response.Type.Class)
+	}
+	for _, lockout := range turnServer.Lockouts() {
+		assert.NotEqual(t, server.LockoutUsername, lockout.Kind)
+	}
+
+	// A valid token allocates, and its MAC key signs the response
+	token, err := issuer.Issue("key-1", macKey, time.Hour)
+	require.NoError(t, err)
+	response := allocate(nonce, token)
+	require.Equal(t, stun.ClassSuccessResponse, response.Type.Class, "unexpected response %s", response)
+	assert.NoError(t, stun.MessageIntegrity(macKey).Check(response))
+
+	// Later requests are signed with the MAC key without sending the token
+	response = roundTrip(stun.MethodCreatePermission,
+		peerAddressAttr{IP: net.ParseIP("127.0.0.1"), Port: 5000},
+		stun.NewUsername("key-1"),
+		stun.NewRealm(cfg.Realm),
+		nonce,
+		stun.MessageIntegrity(macKey),
+		stun.Fingerprint,
+	)
+	assert.Equal(t, stun.ClassSuccessResponse, response.Type.Class, "unexpected response %s", response)
+
+	sessions := turnServer.GetSessions()
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "key-1", sessions[0].Username)
+}
+
+// addressFamilyAttr is a REQUESTED-ADDRESS-FAMILY or
+// ADDITIONAL-ADDRESS-FAMILY attribute
+type addressFamilyAttr struct {
+	attr   stun.AttrType
+	family byte
+}
+
+func (a addressFamilyAttr) AddTo(m *stun.Message) error {
+	m.Add(a.attr, []byte{a.family, 0, 0, 0})
+	return nil
+}
+
+// relayedAddresses reads every XOR-RELAYED-ADDRESS of a response
+func relayedAddresses(t *testing.T, m *stun.Message) []stun.XORMappedAddress {
+	var addrs []stun.XORMappedAddress
+	require.NoError(t, m.ForEach(stun.AttrXORRelayedAddress, func(m *stun.Message) error {
+		var addr stun.XORMappedAddress
+		if err := addr.GetFromAs(m, stun.AttrXORRelayedAddress); err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+		return nil
+	}))
+	return addrs
+}
+
+func TestTURNServerIPv6(t *testing.T) {
+	probe, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	probe.Close()
+
+	cfg := &config.TURNConfig{
+		Port:        19336,
+		Address:     "::",
+		Realm:       "test.example.com",
+		PublicIP:    "127.0.0.1",
+		IPv6:        true,
+		PublicIPv6:  "::1",
+		MaxLifetime: 600,
+		DefaultTTL:  600,
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	rest := auth.NewRESTCredentials("ipv6-secret", nil)
+	turnServer := server.NewTURNServer(cfg, nil, rest, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	udpTransport := stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}
+	requested := func(family byte) addressFamilyAttr {
+		return addressFamilyAttr{attr: stun.AttrRequestedAddressFamily, family: family}
+	}
+	additional := func(family byte) addressFamilyAttr {
+		return addressFamilyAttr{attr: 0x8000, family: family}
+	}
+	dial := func(t *testing.T, network, addr string) net.Conn {
+		conn, err := net.Dial(network, addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	t.Run("IPv6Only", func(t *testing.T) {
+		username, password, _ := rest.Generate("alice", time.Hour)
+		conn := dial(t, "udp6", "[::1]:19336")
+
+		response := turnRequest(t, conn, stun.MethodAllocate, username, password, cfg.Realm, udpTransport, requested(0x02))
+		require.Equal(t, stun.ClassSuccessResponse, response.Type.Class, "unexpected response %s", response)
+		assert.NoError(t, stun.NewLongTermIntegrity(username, cfg.Realm, password).Check(response))
+		relayed := relayedAddresses(t, response)
+		require.Len(t, relayed, 1)
+		assert.Equal(t, "::1", relayed[0].IP.String())
+
+		// IPv4 peers are refused, IPv6 ones are relayed to
+		response = turnRequest(t, conn, stun.MethodCreatePermission, username, password, cfg.Realm,
+			peerAddressAttr{IP: net.ParseIP("127.0.0.1"), Port: 5000})
+		var code stun.ErrorCodeAttribute
+		require.NoError(t, code.GetFrom(response))
+		assert.Equal(t, stun.CodePeerAddrFamilyMismatch, code.Code)
+
+		peer, err := net.ListenPacket("udp6", "[::1]:0")
+		require.NoError(t, err)
+		defer peer.Close()
+		peerAddr := peer.LocalAddr().(*net.UDPAddr)
+
+		response = turnRequest(t, conn, stun.MethodCreatePermission, username, password, cfg.Realm,
+			peerAddressAttr{IP: peerAddr.IP, Port: peerAddr.Port})
+		require.Equal(t, stun.ClassSuccessResponse, response.Type.Class, "unexpected response %s", response)
+
+		send, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodSend, stun.ClassIndication),
+			peerAddressAttr{IP: peerAddr.IP, Port: peerAddr.Port},
+			stun.RawAttribute{Type: stun.AttrData, Value: []byte("over ipv6")},
+			stun.Fingerprint,
+		)
+		require.NoError(t, err)
+		_, err = conn.Write(send.Raw)
+		require.NoError(t, err)
+
+		buf := make([]byte, 1500)
+		require.NoError(t, peer.SetReadDeadline(time.Now().Add(2*time.Second)))
+		n, from, err := peer.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "over ipv6", string(buf[:n]))
+		assert.Equal(t, relayed[0].Port, from.(*net.UDPAddr).Port)
+	})
+
+	t.Run("DualStack", func(t *testing.T) {
+		username, password, _ := rest.Generate("bob", time.Hour)
+		conn := dial(t, "udp4", "127.0.0.1:19336")
+
+		response := turnRequest(t, conn, stun.MethodAllocate, username, password, cfg.Realm, udpTransport, additional(0x02))
+		require.Equal(t, stun.ClassSuccessResponse, response.Type.Class, "unexpected response %s", response)
+		assert.NoError(t, stun.NewLongTermIntegrity(username, cfg.Realm, password).Check(response))
+		relayed := relayedAddresses(t, response)
+		require.Len(t, relayed, 2)
+		assert.Equal(t, "127.0.0.1", relayed[0].IP.String())
+		assert.Equal(t, "::1", relayed[1].IP.String())
+		assert.Equal(t, relayed[0].Port, relayed[1].Port)
+
+		var found bool
+		for _, session := range turnServer.GetSessions() {
+			if session.ClientAddr == conn.LocalAddr().String() {
+				found = true
+				assert.Equal(t, relayed[1].String(), session.RelayAddr6)
+			}
+		}
+		assert.True(t, found)
+	})
+
+	t.Run("InvalidFamilies", func(t *testing.T) {
+		username, password, _ := rest.Generate("carol", time.Hour)
+		conn := dial(t, "udp4", "127.0.0.1:19336")
+
+		for _, setters := range [][]stun.Setter{
+			{requested(0x02), additional(0x02)},
+			{additional(0x01)},
+			{requested(0x03)},
+		} {
+			response := turnRequest(t, conn, stun.MethodAllocate, username, password, cfg.Realm, append([]stun.Setter{udpTransport}, setters...)...)
+			var code stun.ErrorCodeAttribute
+			require.NoError(t, code.GetFrom(response))
+			assert.Equal(t, stun.CodeBadRequest, code.Code)
+		}
+	})
+}
+
+func TestTURNServerHostnameAddress(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:     19345,
+		Address:  "localhost",
+		Realm:    "test.example.com",
+		PublicIP: "127.0.0.1",
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	store := newFakeAuthenticator(cfg.Realm)
+	require.NoError(t, store.CreateUser(context.Background(), &models.User{Username: "alice", Enabled: true}, "alice-password"))
+
+	turnServer := server.NewTURNServer(cfg, store, nil, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	_, err := allocate(t, "127.0.0.1:19345", "alice", "alice-password", cfg.Realm)
+	require.NoError(t, err)
+
+	// A hostname is listened on as it resolves, not as a wildcard
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	request, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	require.NoError(t, err)
+	_, err = conn.WriteTo(request.Raw, &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 19345})
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(300*time.Millisecond)))
+	_, _, err = conn.ReadFrom(make([]byte, 1500))
+	assert.Error(t, err)
+}
+
+func TestTURNServerTCPRelay(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:        19337,
+		Address:     "127.0.0.1",
+		Realm:       "test.example.com",
+		PublicIP:    "127.0.0.1",
+		TCPRelays:   true,
+		DenyRanges:  []string{"192.0.2.0/24"},
+		MaxLifetime: 600,
+		DefaultTTL:  600,
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	rest := auth.NewRESTCredentials("tcp-secret", nil)
+	turnServer := server.NewTURNServer(cfg, nil, rest, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	dialServer := func(t *testing.T) net.Conn {
+		conn, err := net.Dial("tcp4", "127.0.0.1:19337")
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	tcpClient := func(t *testing.T, username, password string) *turn.Client {
+		turnClient, err := turn.NewClient(&turn.ClientConfig{
+			STUNServerAddr: "127.0.0.1:19337",
+			TURNServerAddr: "127.0.0.1:19337",
+			Conn:           turn.NewSTUNConn(dialServer(t)),
+			Username:       username,
+			Password:       password,
+			Realm:          cfg.Realm,
+		})
+		require.NoError(t, err)
+		t.Cleanup(turnClient.Close)
+		require.NoError(t, turnClient.Listen())
+		return turnClient
+	}
+	exchange := func(t *testing.T, a, b net.Conn) {
+		_, err := a.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		require.NoError(t, b.SetReadDeadline(time.Now().Add(2*time.Second)))
+		_, err = io.ReadFull(b, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buf))
+
+		_, err = b.Write([]byte("pong"))
+		require.NoError(t, err)
+		require.NoError(t, a.SetReadDeadline(time.Now().Add(2*time.Second)))
+		_, err = io.ReadFull(a, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "pong", string(buf))
+	}
+
+	peer, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer peer.Close()
+	peerAddr := peer.Addr().(*net.TCPAddr)
+
+	t.Run("Connect", func(t *testing.T) {
+		username, password, _ := rest.Generate("alice", time.Hour)
+		turnClient := tcpClient(t, username, password)
+		allocation, err := turnClient.AllocateTCP()
+		require.NoError(t, err)
+		defer allocation.Close()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := peer.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+
+		dataConn, err := allocation.DialTCPWithConn(dialServer(t), "tcp", peerAddr)
+		require.NoError(t, err)
+
+		var peerConn net.Conn
+		select {
+		case peerConn = <-accepted:
+		case <-time.After(2 * time.Second):
+			t.Fatal("peer connection not accepted")
+		}
+		defer peerConn.Close()
+
+		// The peer sees the connection come from the relayed address
+		assert.Equal(t, allocation.Addr().String(), peerConn.RemoteAddr().String())
+		exchange(t, dataConn, peerConn)
+
+		// Only one connection per peer address
+		_, err = allocation.Connect(peerAddr)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "446")
+	})
+
+	t.Run("ConnectionAttempt", func(t *testing.T) {
+		username, password, _ := rest.Generate("bob", time.Hour)
+		turnClient := tcpClient(t, username, password)
+		allocation, err := turnClient.AllocateTCP()
+		require.NoError(t, err)
+		defer allocation.Close()
+		require.NoError(t, turnClient.CreatePermission(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}))
+
+		peerConn, err := net.Dial("tcp4", allocation.Addr().String())
+		require.NoError(t, err)
+		defer peerConn.Close()
+
+		require.NoError(t, allocation.SetDeadline(time.Now().Add(2*time.Second)))
+		dataConn, err := allocation.AcceptTCPWithConn(dialServer(t))
+		require.NoError(t, err)
+		assert.Equal(t, peerConn.LocalAddr().String(), dataConn.RemoteAddr().String())
+		exchange(t, peerConn, dataConn)
+	})
+
+	t.Run("DeniedPeer", func(t *testing.T) {
+		username, password, _ := rest.Generate("carol", time.Hour)
+		turnClient := tcpClient(t, username, password)
+		allocation, err := turnClient.AllocateTCP()
+		require.NoError(t, err)
+		defer allocation.Close()
+
+		_, err = allocation.Connect(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "403")
+	})
+
+	t.Run("OverUDP", func(t *testing.T) {
+		username, password, _ := rest.Generate("dave", time.Hour)
+		conn, err := net.Dial("udp4", "127.0.0.1:19337")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		response := turnRequest(t, conn, stun.MethodAllocate, username, password, cfg.Realm,
+			stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{6, 0, 0, 0}})
+		var code stun.ErrorCodeAttribute
+		require.NoError(t, code.GetFrom(response))
+		assert.Equal(t, stun.CodeBadRequest, code.Code)
+	})
+
+	assert.Equal(t, true, turnServer.GetStats()["tcp_relays"])
+}
+
+func TestTURNServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	served, _ := writeCert(t, dir, "server", ca, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	cfg := &config.TURNConfig{
+		Port:     19338,
+		Address:  "127.0.0.1",
+		Realm:    "test.example.com",
+		PublicIP: "127.0.0.1",
+		DTLS:     true,
+		TLS: config.TLSConfig{
+			Port:     19339,
+			CertFile: filepath.Join(dir, "server.pem"),
+			KeyFile:  filepath.Join(dir, "server-key.pem"),
+		},
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	turnServer := server.NewTURNServer(cfg, nil, auth.NewRESTCredentials("tls-secret", nil), logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	// binding answers a Binding request over a secure connection
+	binding := func(t *testing.T, conn net.Conn) {
+		request, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+		require.NoError(t, err)
+		_, err = conn.Write(request.Raw)
+		require.NoError(t, err)
+
+		buf := make([]byte, 1500)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		response := &stun.Message{Raw: buf[:n]}
+		require.NoError(t, response.Decode())
+		assert.Equal(t, stun.BindingSuccess, response.Type)
+	}
+	tlsCertificate := func(t *testing.T) *x509.Certificate {
+		conn, err := tls.Dial("tcp", "127.0.0.1:19339", &tls.Config{RootCAs: pool})
+		require.NoError(t, err)
+		defer conn.Close()
+		binding(t, conn)
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+
+	t.Run("TLS", func(t *testing.T) {
+		assert.Equal(t, served.Raw, tlsCertificate(t).Raw)
+	})
+
+	t.Run("DTLS", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := dtls.DialWithContext(ctx, "udp",
+			&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 19339},
+			&dtls.Config{RootCAs: pool, ServerName: "127.0.0.1"})
+		require.NoError(t, err)
+		defer conn.Close()
+		binding(t, conn)
+
+		certificates := conn.ConnectionState().PeerCertificates
+		require.NotEmpty(t, certificates)
+		assert.Equal(t, served.Raw, certificates[0])
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		renewed, _ := writeCert(t, dir, "server", ca, caKey)
+		require.NotEqual(t, served.Raw, renewed.Raw)
+
+		assert.Eventually(t, func() bool {
+			return bytes.Equal(renewed.Raw, tlsCertificate(t).Raw)
+		}, 10*time.Second, 250*time.Millisecond)
+	})
+}
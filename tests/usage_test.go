@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/internal/server"
+	"github.com/ga666666-new/pion-stun-server/pkg/models"
+)
+
+func TestNextUsagePeriod(t *testing.T) {
+	tests := []struct {
+		name   string
+		now    time.Time
+		period string
+		next   time.Time
+	}{
+		{"Daily", time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC), "daily", time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"DailyAtMidnight", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), "daily", time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"DailyEndOfMonth", time.Date(2024, 2, 29, 23, 59, 0, 0, time.UTC), "daily", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"DailyInUTC", time.Date(2024, 1, 15, 20, 0, 0, 0, time.FixedZone("UTC-5", -5*3600)), "daily", time.Date(2024, 1, 17, 0, 0, 0, 0, time.UTC)},
+		{"Monthly", time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC), "monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"MonthlyEndOfYear", time.Date(2024, 12, 31, 23, 0, 0, 0, time.UTC), "monthly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"DefaultsToMonthly", time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC), "", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.next, server.NextUsagePeriod(tt.now, tt.period))
+		})
+	}
+}
+
+func TestTURNServerUsage(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:      19342,
+		Address:   "127.0.0.1",
+		Realm:     "test.example.com",
+		PublicIP:  "127.0.0.1",
+		TCPRelays: true,
+		Quota: config.TURNQuotaConfig{
+			TransferCap: 1000,
+			ResetPeriod: "daily",
+		},
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	clock := newFakeClock()
+	endOfDay := server.NextUsagePeriod(clock.Now(), "daily")
+
+	store := newFakeAuthenticator(cfg.Realm)
+	ctx := context.Background()
+	for _, user := range []*models.User{
+		{Username: "alice", Enabled: true, Quota: &models.UserQuota{ResetAt: endOfDay}},
+		{Username: "bob", Enabled: true, Quota: &models.UserQuota{UsedBandwidth: 1000, ResetAt: endOfDay}},
+		{Username: "carol", Enabled: true, Quota: &models.UserQuota{ResetAt: endOfDay}},
+	} {
+		require.NoError(t, store.CreateUser(ctx, user, user.Username+"-password"))
+	}
+
+	turnServer := server.NewTURNServer(cfg, store, nil, logger)
+	turnServer.SetUsageClock(clock.Now)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer peer.Close()
+
+	relayConn, _, err := allocateClient(t, "127.0.0.1:19342", "alice", "alice-password", cfg.Realm)
+	require.NoError(t, err)
+
+	// exchange relays len(out)+len(in) bytes between alice and the peer
+	exchange := func(out, in string) {
+		_, err := relayConn.WriteTo([]byte(out), peer.LocalAddr())
+		require.NoError(t, err)
+		buf := make([]byte, 1500)
+		require.NoError(t, peer.SetReadDeadline(time.Now().Add(2*time.Second)))
+		_, relayAddr, err := peer.ReadFrom(buf)
+		require.NoError(t, err)
+
+		_, err = peer.WriteTo([]byte(in), relayAddr)
+		require.NoError(t, err)
+		require.NoError(t, relayConn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		_, _, err = relayConn.ReadFrom(buf)
+		require.NoError(t, err)
+	}
+
+	t.Run("Flush", func(t *testing.T) {
+		exchange("hello peer", "hi")
+		turnServer.SyncUsage()
+		assert.Equal(t, int64(12), store.user("alice").Quota.UsedBandwidth)
+
+		// Flushed bytes aren't written again
+		turnServer.SyncUsage()
+		assert.Equal(t, int64(12), store.user("alice").Quota.UsedBandwidth)
+	})
+
+	t.Run("FlushFailure", func(t *testing.T) {
+		store.failUsage.Store(true)
+		exchange("hello again", "hi")
+		turnServer.SyncUsage()
+		assert.Equal(t, int64(12), store.user("alice").Quota.UsedBandwidth)
+
+		// Bytes that failed to write back are kept for the next sync
+		store.failUsage.Store(false)
+		turnServer.SyncUsage()
+		assert.Equal(t, int64(25), store.user("alice").Quota.UsedBandwidth)
+	})
+
+	t.Run("TransferCapAllocate", func(t *testing.T) {
+		_, err := allocate(t, "127.0.0.1:19342", "bob", "bob-password", cfg.Realm)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "486")
+	})
+
+	t.Run("TransferCapConnect", func(t *testing.T) {
+		conn, err := net.Dial("tcp4", "127.0.0.1:19342")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		turnClient, err := turn.NewClient(&turn.ClientConfig{
+			STUNServerAddr: "127.0.0.1:19342",
+			TURNServerAddr: "127.0.0.1:19342",
+			Conn:           turn.NewSTUNConn(conn),
+			Username:       "carol",
+			Password:       "carol-password",
+			Realm:          cfg.Realm,
+		})
+		require.NoError(t, err)
+		defer turnClient.Close()
+		require.NoError(t, turnClient.Listen())
+
+		allocation, err := turnClient.AllocateTCP()
+		require.NoError(t, err)
+		defer allocation.Close()
+
+		// carol uses up the cap on another server meanwhile
+		carol := store.user("carol")
+		carol.Quota.UsedBandwidth = 1000
+		require.NoError(t, store.UpdateUser(ctx, carol))
+
+		_, err = allocation.Connect(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "486")
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		clock.Advance(13 * time.Hour)
+
+		// The period has ended, so the cap no longer applies even before the
+		// store has caught up
+		_, err := allocate(t, "127.0.0.1:19342", "bob", "bob-password", cfg.Realm)
+		require.NoError(t, err)
+
+		turnServer.SyncUsage()
+		for _, username := range []string{"alice", "bob", "carol"} {
+			quota := store.user(username).Quota
+			assert.Zero(t, quota.UsedBandwidth, username)
+			assert.Equal(t, endOfDay.Add(24*time.Hour), quota.ResetAt, username)
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package tests
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ga666666-new/pion-stun-server/internal/auth"
+	"github.com/ga666666-new/pion-stun-server/internal/config"
+	"github.com/ga666666-new/pion-stun-server/internal/server"
+)
+
+// accountService is a webhook endpoint backed by a fixed set of answers
+func accountService(t *testing.T, calls *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+
+		var req struct {
+			Username string `json:"username"`
+			Realm    string `json:"realm"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, fileRealm, req.Realm)
+		assert.Equal(t, "Bearer webhook-token", r.Header.Get("Authorization"))
+
+		switch req.Username {
+		case "alice":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"key":   turnKey("alice", "alice-password"),
+				"quota": map[string]interface{}{"max_sessions": 1},
+			})
+		case "bob":
+			json.NewEncoder(w).Encode(map[string]interface{}{"password": "bob-password"})
+		case "carol":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func webhookConfig(url string) *config.WebhookAuthConfig {
+	return &config.WebhookAuthConfig{
+		URL:         url,
+		Headers:     map[string]string{"Authorization": "Bearer webhook-token"},
+		Timeout:     2,
+		Retries:     2,
+		CacheTTL:    60,
+		NegativeTTL: 10,
+	}
+}
+
+func TestWebhookAuthenticator(t *testing.T) {
+	var calls atomic.Int32
+	endpoint := httptest.NewServer(accountService(t, &calls))
+	defer endpoint.Close()
+
+	store, err := auth.NewWebhookAuthenticator(webhookConfig(endpoint.URL), fileRealm)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	key, user, err := store.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, turnKey("alice", "alice-password"), key)
+	require.NotNil(t, user.Quota)
+	assert.Equal(t, 1, user.Quota.MaxSessions)
+
+	// Passwords are turned into keys
+	_, err = store.Authenticate(ctx, "bob", "bob-password")
+	assert.NoError(t, err)
+	_, err = store.Authenticate(ctx, "bob", "wrong-password")
+	assert.Error(t, err)
+
+	_, _, err = store.GetTURNAuthKey(ctx, "carol")
+	assert.EqualError(t, err, "user is disabled")
+	_, _, err = store.GetTURNAuthKey(ctx, "dave")
+	assert.EqualError(t, err, "user not found")
+
+	// Known users are answered from the cache
+	before := calls.Load()
+	_, _, err = store.GetTURNAuthKey(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, before, calls.Load())
+
+	// So are unknown and disabled ones, for the negative TTL
+	_, _, err = store.GetTURNAuthKey(ctx, "carol")
+	assert.ErrorIs(t, err, auth.ErrUserDisabled)
+	_, _, err = store.GetTURNAuthKey(ctx, "dave")
+	assert.ErrorIs(t, err, auth.ErrUserNotFound)
+	assert.Equal(t, before, calls.Load())
+
+	cfg := webhookConfig(endpoint.URL)
+	cfg.NegativeTTL = 0
+	store, err = auth.NewWebhookAuthenticator(cfg, fileRealm)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, _, err = store.GetTURNAuthKey(ctx, "dave")
+		assert.ErrorIs(t, err, auth.ErrUserNotFound)
+	}
+	assert.Equal(t, before+2, calls.Load())
+
+	// User management belongs to the account service
+	_, err = store.ListUsers(ctx, 0, 10)
+	assert.ErrorIs(t, err, auth.ErrUnsupported)
+}
+
+func TestWebhookAuthenticatorRetries(t *testing.T) {
+	var calls, failures atomic.Int32
+	answer := accountService(t, &calls)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		answer(w, r)
+	}))
+	defer endpoint.Close()
+
+	// Two failures are covered by two retries
+	failures.Store(2)
+	store, err := auth.NewWebhookAuthenticator(webhookConfig(endpoint.URL), fileRealm)
+	require.NoError(t, err)
+	_, err = store.Authenticate(context.Background(), "alice", "alice-password")
+	assert.NoError(t, err)
+
+	// Give up once the retries are used up
+	failures.Store(2)
+	cfg := webhookConfig(endpoint.URL)
+	cfg.Retries = 1
+	store, err = auth.NewWebhookAuthenticator(cfg, fileRealm)
+	require.NoError(t, err)
+	_, _, err = store.GetTURNAuthKey(context.Background(), "alice")
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), failures.Load())
+}
+
+func TestWebhookAuthenticatorDeadline(t *testing.T) {
+	var calls, hangs atomic.Int32
+	answer := accountService(t, &calls)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hangs.Add(-1) >= 0 {
+			// The server only notices the client giving up once the
+			// body is read
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+			return
+		}
+		answer(w, r)
+	}))
+	defer endpoint.Close()
+
+	// A hanging first attempt is cut short so the retry still fits in the
+	// auth deadline, although the deadline is shorter than timeout
+	hangs.Store(1)
+	cfg := webhookConfig(endpoint.URL)
+	cfg.Retries = 1
+	store, err := auth.NewWebhookAuthenticator(cfg, fileRealm)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = store.Authenticate(ctx, "alice", "alice-password")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// All attempts end within the deadline when the endpoint keeps hanging
+	hangs.Store(10)
+	store, err = auth.NewWebhookAuthenticator(cfg, fileRealm)
+	require.NoError(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = store.GetTURNAuthKey(ctx, "alice")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 600*time.Millisecond)
+}
+
+// writeCert issues a certificate signed by parent, or a self-signed CA when
+// parent is nil, and writes it and its key as PEM files
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return cert, key
+}
+
+func TestWebhookAuthenticatorMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	var calls atomic.Int32
+	endpoint := httptest.NewUnstartedServer(accountService(t, &calls))
+	endpoint.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	endpoint.StartTLS()
+	defer endpoint.Close()
+
+	cfg := webhookConfig(endpoint.URL)
+	cfg.Retries = 0
+	cfg.TLS.CAFile = filepath.Join(dir, "ca.pem")
+
+	// Without a client certificate the handshake fails
+	store, err := auth.NewWebhookAuthenticator(cfg, fileRealm)
+	require.NoError(t, err)
+	_, _, err = store.GetTURNAuthKey(context.Background(), "alice")
+	assert.Error(t, err)
+
+	cfg.TLS.CertFile = filepath.Join(dir, "client.pem")
+	cfg.TLS.KeyFile = filepath.Join(dir, "client-key.pem")
+	store, err = auth.NewWebhookAuthenticator(cfg, fileRealm)
+	require.NoError(t, err)
+	_, err = store.Authenticate(context.Background(), "alice", "alice-password")
+	assert.NoError(t, err)
+}
+
+func TestTURNServerWebhookBackend(t *testing.T) {
+	cfg := &config.TURNConfig{
+		Port:     19328,
+		Address:  "127.0.0.1",
+		Realm:    fileRealm,
+		PublicIP: "127.0.0.1",
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	var calls atomic.Int32
+	endpoint := httptest.NewServer(accountService(t, &calls))
+	defer endpoint.Close()
+
+	store, err := auth.NewWebhookAuthenticator(webhookConfig(endpoint.URL), fileRealm)
+	require.NoError(t, err)
+
+	turnServer := server.NewTURNServer(cfg, store, nil, logger)
+	require.NoError(t, turnServer.Start())
+	defer turnServer.Stop()
+
+	_, err = allocate(t, "127.0.0.1:19328", "bob", "bob-password", cfg.Realm)
+	assert.NoError(t, err)
+	_, err = allocate(t, "127.0.0.1:19328", "carol", "carol-password", cfg.Realm)
+	assert.Error(t, err)
+}